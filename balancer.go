@@ -0,0 +1,507 @@
+package simplehttp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// UpstreamMaxFails is the default number of consecutive failures
+	// after which an upstream of an UpstreamPool is ejected.
+	UpstreamMaxFails = 3
+	// UpstreamEjectTime is the default time an upstream is ejected for.
+	UpstreamEjectTime = 30 * time.Second
+
+	// hashRingReplicas is the number of points of an upstream (of weight 1)
+	// on the consistent hash ring.
+	hashRingReplicas = 160
+)
+
+// errNoUpstream is the error when no upstream is available.
+var errNoUpstream = errors.New("no upstream available")
+
+// region Handler: LoadBalancer
+
+// LoadBalancer is a ReverseProxy (see there for the options) forwarding
+// requests across the upstreams of the pool:
+//
+//	pool := NewUpstreamPool([]string{"http://10.0.0.2:8080", "http://10.0.0.3:8080"},
+//		WithLeastConn())
+//	stop := pool.HealthCheck("/healthz", 5*time.Second)
+//	defer stop()
+//
+//	r.GET("/api/", LoadBalancer(pool))
+//	r.GET("/debug/upstreams", pool.ServeStatus)
+//
+// A retried request goes to another upstream, if any.
+func LoadBalancer(pool *UpstreamPool, options ...ProxyOption) HandlerFunc {
+	p := &reverseProxy{
+		pool:    pool,
+		timeout: ProxyTimeout,
+		retries: ProxyRetries,
+	}
+	for _, option := range options {
+		option(p)
+	}
+	return p.serve
+}
+
+// UpstreamPool is a set of upstream servers of a LoadBalancer, picked by a
+// strategy (round-robin by default) among the available ones: the
+// upstreams failing the active health checks (see HealthCheck), or
+// ejected passively after consecutive failures, are skipped.
+type UpstreamPool struct {
+	upstreams []*upstream
+	balancer  balancer
+
+	newBalancer func(upstreams []*upstream) balancer
+	weights     []int
+	tlsConfig   *tls.Config
+	maxFails    int // 0 for no passive ejection
+	ejectTime   time.Duration
+}
+
+// UpstreamOption configures an UpstreamPool.
+type UpstreamOption func(p *UpstreamPool)
+
+// NewUpstreamPool creates an UpstreamPool of the targets, "http" or
+// "https" URLs as of ReverseProxy. It panics if a target is invalid.
+func NewUpstreamPool(targets []string, options ...UpstreamOption) *UpstreamPool {
+	p := &UpstreamPool{
+		newBalancer: func([]*upstream) balancer { return &roundRobin{} },
+		maxFails:    UpstreamMaxFails,
+		ejectTime:   UpstreamEjectTime,
+	}
+	for _, option := range options {
+		option(p)
+	}
+	if len(targets) == 0 {
+		panic("NewUpstreamPool: no targets")
+	}
+	if p.weights != nil && len(p.weights) != len(targets) {
+		panic(fmt.Sprintf("NewUpstreamPool: %d weights for %d targets", len(p.weights), len(targets)))
+	}
+
+	for i, target := range targets {
+		up, err := newUpstream(target, p.tlsConfig)
+		if err != nil {
+			panic(fmt.Sprintf("NewUpstreamPool: %v", err))
+		}
+		if p.weights != nil {
+			up.weight = max1(p.weights[i])
+		}
+		p.upstreams = append(p.upstreams, up)
+	}
+	p.balancer = p.newBalancer(p.upstreams)
+	return p
+}
+
+// WithRoundRobin makes the pool pick the upstreams in turn (the default).
+func WithRoundRobin() UpstreamOption {
+	return func(p *UpstreamPool) {
+		p.newBalancer = func([]*upstream) balancer { return &roundRobin{} }
+	}
+}
+
+// WithLeastConn makes the pool pick the upstream with the least requests
+// in flight, relative to its weight if WithWeights.
+func WithLeastConn() UpstreamOption {
+	return func(p *UpstreamPool) {
+		p.newBalancer = func([]*upstream) balancer { return &leastConn{} }
+	}
+}
+
+// WithWeightedRoundRobin makes the pool pick the upstreams in turn in
+// proportion to their weights (of the targets in order), smoothly: with
+// weights 5, 1, 1 the picks are a a b a c a a, not a a a a a b c.
+func WithWeightedRoundRobin(weights ...int) UpstreamOption {
+	return func(p *UpstreamPool) {
+		p.weights = weights
+		p.newBalancer = func([]*upstream) balancer {
+			return &weightedRoundRobin{current: make(map[*upstream]int)}
+		}
+	}
+}
+
+// WithWeights sets the weights of the targets in order, for WithLeastConn
+// and WithConsistentHash.
+func WithWeights(weights ...int) UpstreamOption {
+	return func(p *UpstreamPool) {
+		p.weights = weights
+	}
+}
+
+// WithConsistentHash makes the pool pick the upstream by the hash of the
+// key of the request, e.g. HashByCookie("session"), so that the requests
+// of a key stick to an upstream, and only about 1/n of the keys move when
+// an upstream of n comes or goes. Requests of an empty key are picked
+// round-robin.
+func WithConsistentHash(key func(c *Context) string) UpstreamOption {
+	return func(p *UpstreamPool) {
+		p.newBalancer = func(upstreams []*upstream) balancer {
+			return newConsistentHash(upstreams, key)
+		}
+	}
+}
+
+// HashByHeader is a key of WithConsistentHash: the request header.
+func HashByHeader(name string) func(c *Context) string {
+	return func(c *Context) string {
+		return c.Request.Headers[name]
+	}
+}
+
+// HashByCookie is a key of WithConsistentHash: the request cookie.
+func HashByCookie(name string) func(c *Context) string {
+	return func(c *Context) string {
+		for _, cookie := range strings.Split(c.Request.Headers["Cookie"], ";") {
+			if k, v, ok := strings.Cut(strings.TrimSpace(cookie), "="); ok && k == name {
+				return v
+			}
+		}
+		return ""
+	}
+}
+
+// HashByClientIP is a key of WithConsistentHash: the client IP address.
+func HashByClientIP() func(c *Context) string {
+	return func(c *Context) string {
+		ip, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+		if err != nil {
+			return c.Request.RemoteAddr
+		}
+		return ip
+	}
+}
+
+// WithPassiveEjection sets the number of consecutive failures (conn
+// errors and timeouts) after which an upstream is ejected, and for how
+// long (UpstreamMaxFails and UpstreamEjectTime by default). After that,
+// a request is let through to try it, which ejects it again if it fails.
+// A maxFails of zero disables passive ejection.
+func WithPassiveEjection(maxFails int, ejectTime time.Duration) UpstreamOption {
+	return func(p *UpstreamPool) {
+		p.maxFails = maxFails
+		p.ejectTime = ejectTime
+	}
+}
+
+// WithUpstreamTLSConfig sets the TLS config to connect to https
+// upstreams, as WithProxyTLSConfig of ReverseProxy.
+func WithUpstreamTLSConfig(config *tls.Config) UpstreamOption {
+	return func(p *UpstreamPool) {
+		p.tlsConfig = config
+	}
+}
+
+// pick picks an available upstream not tried for the request to the c,
+// and counts it in flight (see upstream.done). It returns nil if none.
+func (p *UpstreamPool) pick(c *Context, tried []*upstream) *upstream {
+	now := time.Now()
+	candidates := make([]*upstream, 0, len(p.upstreams))
+	for _, up := range p.upstreams {
+		if up.available(now) && !containsUpstream(tried, up) {
+			candidates = append(candidates, up)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	up := p.balancer.pick(c, candidates)
+	up.mu.Lock()
+	up.active++
+	up.requests++
+	up.mu.Unlock()
+	return up
+}
+
+// containsUpstream reports whether up is in upstreams.
+func containsUpstream(upstreams []*upstream, up *upstream) bool {
+	for _, u := range upstreams {
+		if u == up {
+			return true
+		}
+	}
+	return false
+}
+
+// report records the result of a request to the up, ejecting it after
+// too many consecutive failures. Requests cancelled by the client are
+// not failures of the upstream.
+func (p *UpstreamPool) report(up *upstream, ctx context.Context, err error) {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return
+	}
+
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if err == nil {
+		up.fails = 0
+		return
+	}
+	up.failures++
+	up.fails++
+	up.lastError = err.Error()
+	if p.maxFails > 0 && up.fails >= p.maxFails {
+		up.ejectedUntil = time.Now().Add(p.ejectTime)
+	}
+}
+
+// HealthCheck starts checking the health of the upstreams in the
+// background, by a GET request of the path (joined to the upstream URL)
+// every interval, and returns a function to stop it. An upstream is
+// healthy if it responds 2xx or 3xx in the interval, and the unhealthy
+// ones are not picked for requests.
+func (p *UpstreamPool) HealthCheck(path string, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			p.checkHealth(path, interval)
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// checkHealth checks the health of the upstreams concurrently.
+func (p *UpstreamPool) checkHealth(path string, timeout time.Duration) {
+	wg := sync.WaitGroup{}
+	for _, up := range p.upstreams {
+		wg.Add(1)
+		go func(up *upstream) {
+			defer wg.Done()
+			err := up.checkHealth(path, timeout)
+
+			up.mu.Lock()
+			defer up.mu.Unlock()
+			up.unhealthy = err != nil
+			if err != nil {
+				up.lastError = "health check: " + err.Error()
+			}
+		}(up)
+	}
+	wg.Wait()
+}
+
+// checkHealth checks the health of the upstream by a GET request of the
+// path, returning an error if it's not healthy.
+func (up *upstream) checkHealth(path string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req := NewRequest()
+	req.Method = "GET"
+	req.Url = path
+	req.Version = "HTTP/1.1"
+	req.Headers["User-Agent"] = "simplehttp-health-check"
+
+	resp, err := up.roundTrip(ctx, req, nil)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.body) // to reuse the conn
+	_ = resp.body.Close()
+	if resp.status < 200 || resp.status >= 400 {
+		return fmt.Errorf("status %d", resp.status)
+	}
+	return nil
+}
+
+// available reports whether the upstream can take requests at now:
+// healthy and not ejected.
+func (up *upstream) available(now time.Time) bool {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return !up.unhealthy && !now.Before(up.ejectedUntil)
+}
+
+// done ends a request in flight to the upstream.
+func (up *upstream) done() {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	up.active--
+}
+
+// UpstreamStatus is the state of an upstream in an UpstreamPool.
+type UpstreamStatus struct {
+	URL       string `json:"url"`
+	Weight    int    `json:"weight"`
+	Healthy   bool   `json:"healthy"` // by the health checks
+	Ejected   bool   `json:"ejected"` // by the consecutive failures
+	Active    int    `json:"active"`  // requests in flight
+	Requests  int64  `json:"requests"`
+	Failures  int64  `json:"failures"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Status returns the current state of the upstreams.
+func (p *UpstreamPool) Status() []UpstreamStatus {
+	now := time.Now()
+	status := make([]UpstreamStatus, 0, len(p.upstreams))
+	for _, up := range p.upstreams {
+		up.mu.Lock()
+		status = append(status, UpstreamStatus{
+			URL:       up.url.String(),
+			Weight:    up.weight,
+			Healthy:   !up.unhealthy,
+			Ejected:   now.Before(up.ejectedUntil),
+			Active:    up.active,
+			Requests:  up.requests,
+			Failures:  up.failures,
+			LastError: up.lastError,
+		})
+		up.mu.Unlock()
+	}
+	return status
+}
+
+// ServeStatus is a HandlerFunc responding the Status of the pool as JSON,
+// with 503 Service Unavailable if no upstream is available.
+func (p *UpstreamPool) ServeStatus(c *Context) {
+	status := p.Status()
+	code := 503
+	for _, s := range status {
+		if s.Healthy && !s.Ejected {
+			code = 200
+		}
+	}
+	c.ResponseJSON(code, status)
+}
+
+// balancer is a strategy to pick an upstream among the candidates
+// (not empty) for the request to the c.
+type balancer interface {
+	pick(c *Context, candidates []*upstream) *upstream
+}
+
+// roundRobin picks the candidates in turn.
+type roundRobin struct {
+	next uint32
+}
+
+func (b *roundRobin) pick(c *Context, candidates []*upstream) *upstream {
+	n := atomic.AddUint32(&b.next, 1) - 1
+	return candidates[int(n%uint32(len(candidates)))]
+}
+
+// leastConn picks the candidate with the least active requests per
+// weight, in turn among the ties.
+type leastConn struct {
+	roundRobin
+}
+
+func (b *leastConn) pick(c *Context, candidates []*upstream) *upstream {
+	start := int(atomic.AddUint32(&b.next, 1) % uint32(len(candidates)))
+	var best *upstream
+	var bestLoad float64
+	for i := range candidates {
+		up := candidates[(start+i)%len(candidates)]
+		up.mu.Lock()
+		load := float64(up.active) / float64(up.weight)
+		up.mu.Unlock()
+		if best == nil || load < bestLoad {
+			best, bestLoad = up, load
+		}
+	}
+	return best
+}
+
+// weightedRoundRobin is the smooth weighted round-robin of nginx: every
+// pick, each candidate gains its weight, and the one of the most loses
+// the total.
+type weightedRoundRobin struct {
+	mu      sync.Mutex
+	current map[*upstream]int
+}
+
+func (b *weightedRoundRobin) pick(c *Context, candidates []*upstream) *upstream {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var best *upstream
+	total := 0
+	for _, up := range candidates {
+		b.current[up] += up.weight
+		total += up.weight
+		if best == nil || b.current[up] > b.current[best] {
+			best = up
+		}
+	}
+	b.current[best] -= total
+	return best
+}
+
+// consistentHash picks the candidate by the hash of the key of the
+// request on a ring of the upstreams (with hashRingReplicas points per
+// weight), the next one clockwise if not a candidate.
+type consistentHash struct {
+	key      func(c *Context) string
+	ring     []hashRingPoint // sorted by hash
+	fallback roundRobin
+}
+
+// hashRingPoint is a point of an upstream on the consistent hash ring.
+type hashRingPoint struct {
+	hash     uint32
+	upstream *upstream
+}
+
+// newConsistentHash makes the consistentHash of the upstreams.
+func newConsistentHash(upstreams []*upstream, key func(c *Context) string) *consistentHash {
+	b := &consistentHash{key: key}
+	for _, up := range upstreams {
+		for i := 0; i < hashRingReplicas*up.weight; i++ {
+			b.ring = append(b.ring, hashRingPoint{hashKey(up.url.String() + "#" + strconv.Itoa(i)), up})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+	return b
+}
+
+// hashKey returns the FNV-1a hash of the key.
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func (b *consistentHash) pick(c *Context, candidates []*upstream) *upstream {
+	key := b.key(c)
+	if key == "" {
+		return b.fallback.pick(c, candidates)
+	}
+
+	hash := hashKey(key)
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= hash })
+	for i := 0; i < len(b.ring); i++ {
+		up := b.ring[(start+i)%len(b.ring)].upstream
+		if containsUpstream(candidates, up) {
+			return up
+		}
+	}
+	return b.fallback.pick(c, candidates)
+}
+
+// endregion Handler: LoadBalancer
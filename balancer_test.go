@@ -0,0 +1,245 @@
+package simplehttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testBalancerPortBase = 23730
+
+// testUpstreams returns upstreams of the names, as the URL hosts.
+func testUpstreams(t *testing.T, names ...string) []*upstream {
+	var upstreams []*upstream
+	for _, name := range names {
+		up, err := newUpstream("http://"+name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upstreams = append(upstreams, up)
+	}
+	return upstreams
+}
+
+// pickNames returns the hosts of the upstreams picked n times.
+func pickNames(b balancer, c *Context, candidates []*upstream, n int) string {
+	var names []string
+	for i := 0; i < n; i++ {
+		names = append(names, b.pick(c, candidates).url.Host)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestBalancers(t *testing.T) {
+	c := NewContext(NewRequest(), NewResponse())
+
+	t.Run("roundRobin", func(t *testing.T) {
+		upstreams := testUpstreams(t, "a", "b", "c")
+		if got := pickNames(&roundRobin{}, c, upstreams, 6); got != "a b c a b c" {
+			t.Errorf("expected a b c a b c, got %s", got)
+		}
+	})
+
+	t.Run("weightedRoundRobin", func(t *testing.T) {
+		upstreams := testUpstreams(t, "a", "b", "c")
+		upstreams[0].weight = 5
+		b := &weightedRoundRobin{current: make(map[*upstream]int)}
+		if got := pickNames(b, c, upstreams, 14); got != "a a b a c a a a a b a c a a" {
+			t.Errorf("expected smooth 5:1:1, got %s", got)
+		}
+	})
+
+	t.Run("leastConn", func(t *testing.T) {
+		upstreams := testUpstreams(t, "a", "b", "c")
+		upstreams[0].active, upstreams[1].active, upstreams[2].active = 3, 1, 2
+		if got := pickNames(&leastConn{}, c, upstreams, 3); got != "b b b" {
+			t.Errorf("expected b b b, got %s", got)
+		}
+		upstreams[2].weight = 4 // 2/4 < 1/1
+		if got := pickNames(&leastConn{}, c, upstreams, 1); got != "c" {
+			t.Errorf("expected c by weight, got %s", got)
+		}
+	})
+
+	t.Run("consistentHash", func(t *testing.T) {
+		upstreams := testUpstreams(t, "a", "b", "c", "d")
+		b := newConsistentHash(upstreams, HashByHeader("X-User"))
+
+		const users = 1000
+		picked := make(map[string]string)
+		counts := make(map[string]int)
+		for i := 0; i < users; i++ {
+			c := NewContext(NewRequest(), NewResponse())
+			c.Request.Headers["X-User"] = fmt.Sprintf("user-%d", i)
+			name := b.pick(c, upstreams).url.Host
+			if again := b.pick(c, upstreams).url.Host; again != name {
+				t.Fatalf("expected user-%d to stick to %s, got %s", i, name, again)
+			}
+			picked[c.Request.Headers["X-User"]] = name
+			counts[name]++
+		}
+		for name, n := range counts {
+			if n < users/4/2 || n > users/4*2 {
+				t.Errorf("expected about %d users on %s, got %d", users/4, name, n)
+			}
+		}
+
+		// without d, only the users of d move
+		moved := 0
+		for user, name := range picked {
+			c := NewContext(NewRequest(), NewResponse())
+			c.Request.Headers["X-User"] = user
+			if got := b.pick(c, upstreams[:3]).url.Host; got != name {
+				moved++
+				if name != "d" {
+					t.Errorf("expected %s to stay on %s, moved to %s", user, name, got)
+				}
+			}
+		}
+		if moved != counts["d"] {
+			t.Errorf("expected %d users moved, got %d", counts["d"], moved)
+		}
+
+		// no key: round-robin
+		if got := pickNames(b, c, upstreams, 4); got != "a b c d" {
+			t.Errorf("expected round-robin without key, got %s", got)
+		}
+	})
+
+	t.Run("hashKeys", func(t *testing.T) {
+		c := NewContext(NewRequest(), NewResponse())
+		c.Request.Headers["Cookie"] = "theme=dark; session=abc123; x=1"
+		c.Request.RemoteAddr = "10.1.2.3:4567"
+		if got := HashByCookie("session")(c); got != "abc123" {
+			t.Errorf("expected cookie abc123, got %q", got)
+		}
+		if got := HashByCookie("missing")(c); got != "" {
+			t.Errorf("expected no cookie, got %q", got)
+		}
+		if got := HashByClientIP()(c); got != "10.1.2.3" {
+			t.Errorf("expected 10.1.2.3, got %q", got)
+		}
+	})
+}
+
+func TestLoadBalancer(t *testing.T) {
+	port := testBalancerPortBase
+
+	var bHealthy int32 = 1
+	a, _ := testUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "a")
+	})
+	b, _ := testUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" && atomic.LoadInt32(&bHealthy) == 0 {
+			w.WriteHeader(500)
+			return
+		}
+		_, _ = io.WriteString(w, "b")
+	})
+	down := "http://127.0.0.1:1"
+
+	pool := NewUpstreamPool([]string{a.URL, b.URL, down}, WithPassiveEjection(1, time.Minute))
+	healthPool := NewUpstreamPool([]string{a.URL, b.URL})
+	hashPool := NewUpstreamPool([]string{a.URL, b.URL}, WithConsistentHash(HashByCookie("session")))
+
+	// server
+	go func() {
+		r := NewPrefixRouter("/")
+		r.GET("/lb", LoadBalancer(pool))
+		r.GET("/health", LoadBalancer(healthPool))
+		r.GET("/hash", LoadBalancer(hashPool))
+		r.GET("/status", healthPool.ServeStatus)
+
+		s := HttpServer{Handler: r}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	get := func(t *testing.T, path string, headers map[string]string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d%s", port, path), nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		got, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(got.Body)
+		_ = got.Body.Close()
+		return got, string(body)
+	}
+
+	t.Run("passiveEjection", func(t *testing.T) {
+		counts := map[string]int{}
+		for i := 0; i < 6; i++ {
+			got, body := get(t, "/lb", nil)
+			if got.StatusCode != 200 {
+				t.Errorf("expected status code 200 by retrying, got %d", got.StatusCode)
+			}
+			counts[body]++
+		}
+		if counts["a"] != 3 || counts["b"] != 3 {
+			t.Errorf("expected 3 requests on a and b each, got %v", counts)
+		}
+
+		status := pool.Status()
+		if !status[2].Ejected || status[2].Failures != 1 || status[2].LastError == "" {
+			t.Errorf("expected the down upstream ejected after a failure, got %+v", status[2])
+		}
+		if status[0].Ejected || status[0].Requests != 3 || status[0].Active != 0 {
+			t.Errorf("expected a with 3 requests done, got %+v", status[0])
+		}
+	})
+
+	t.Run("healthCheck", func(t *testing.T) {
+		stop := healthPool.HealthCheck("/healthz", 100*time.Millisecond)
+		defer stop()
+
+		atomic.StoreInt32(&bHealthy, 0)
+		time.Sleep(300 * time.Millisecond)
+		for i := 0; i < 4; i++ {
+			if _, body := get(t, "/health", nil); body != "a" {
+				t.Errorf("expected a only while b is unhealthy, got %s", body)
+			}
+		}
+
+		got, body := get(t, "/status", nil)
+		var status []UpstreamStatus
+		if err := json.Unmarshal([]byte(body), &status); err != nil {
+			t.Fatal(err)
+		}
+		if got.StatusCode != 200 || len(status) != 2 || !status[0].Healthy || status[1].Healthy {
+			t.Errorf("expected a healthy and b not, got %d %s", got.StatusCode, body)
+		}
+
+		atomic.StoreInt32(&bHealthy, 1)
+		time.Sleep(300 * time.Millisecond)
+		bodies := map[string]bool{}
+		for i := 0; i < 4; i++ {
+			_, body := get(t, "/health", nil)
+			bodies[body] = true
+		}
+		if !bodies["a"] || !bodies["b"] {
+			t.Errorf("expected b back, got %v", bodies)
+		}
+	})
+
+	t.Run("consistentHash", func(t *testing.T) {
+		for _, session := range []string{"alice", "bob", "carol"} {
+			_, first := get(t, "/hash", map[string]string{"Cookie": "session=" + session})
+			for i := 0; i < 3; i++ {
+				if _, body := get(t, "/hash", map[string]string{"Cookie": "session=" + session}); body != first {
+					t.Errorf("expected session %s to stick to %s, got %s", session, first, body)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,399 @@
+package simplehttp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// CGITimeout is the default time limit of a CGI script,
+	// after which the process is killed.
+	CGITimeout = 30 * time.Second
+
+	// cgiMaxLocalRedirects limits the local redirects of a request, e.g.
+	// of a script redirecting to itself.
+	cgiMaxLocalRedirects = 10
+)
+
+// region Handler: CGIServer
+
+// CGIHandler is a Handler that runs the CGI script (executable) at path
+// for requests, as [RFC 3875] describes. root is the URL path the script
+// mounted at, i.e. SCRIPT_NAME, and the rest of the request path is
+// PATH_INFO:
+//
+//	r.GET("/cgi-bin/hello/", CGIHandler("/var/www/cgi-bin/hello.pl", "/cgi-bin/hello"))
+//
+//	GET /cgi-bin/hello/a/b?c=d
+//	=>  SCRIPT_NAME=/cgi-bin/hello PATH_INFO=/a/b QUERY_STRING=c=d
+//
+// The request body is piped to the stdin of the script, and the CGI
+// response (headers, Status and Location, then the body) is read from
+// its stdout, the body streamed to the client. The stderr goes to the
+// stderr of the server. The script is run in its directory, and killed
+// after the timeout (CGITimeout by default) or the client disconnects.
+//
+// [RFC 3875]: https://www.rfc-editor.org/rfc/rfc3875
+func CGIHandler(path string, root string, options ...CGIOption) HandlerFunc {
+	if abs, err := filepath.Abs(path); err == nil { // as it's run in its dir
+		path = abs
+	}
+	h := &cgiHandler{
+		path:    path,
+		root:    strings.TrimSuffix(root, "/"),
+		timeout: CGITimeout,
+	}
+	for _, option := range options {
+		option(h)
+	}
+	return h.serve
+}
+
+// cgiHandler is the CGIHandler.
+type cgiHandler struct {
+	path string // the script
+	root string // SCRIPT_NAME
+
+	timeout       time.Duration
+	env           []string // extra env vars
+	localRedirect Handler  // handles local redirects, nil to redirect the client
+}
+
+// CGIOption configures a CGIHandler.
+type CGIOption func(h *cgiHandler)
+
+// WithCGITimeout sets the time limit of the script, zero for no limit.
+func WithCGITimeout(timeout time.Duration) CGIOption {
+	return func(h *cgiHandler) {
+		h.timeout = timeout
+	}
+}
+
+// WithCGIEnv adds env vars ("KEY=value") to the script, e.g. PERL5LIB.
+// Only PATH is inherited from the server by default.
+func WithCGIEnv(env ...string) CGIOption {
+	return func(h *cgiHandler) {
+		h.env = append(h.env, env...)
+	}
+}
+
+// WithCGILocalRedirect makes the local redirect responses of the script
+// (a Location of a path without Status, RFC 3875 Section 6.2.2) be served
+// by the handler as a GET of the path, e.g. the router, instead of being
+// sent to the client as a 302 redirect.
+func WithCGILocalRedirect(handler Handler) CGIOption {
+	return func(h *cgiHandler) {
+		h.localRedirect = handler
+	}
+}
+
+// serve is the HandlerFunc of the CGIHandler.
+func (h *cgiHandler) serve(c *Context) {
+	rawPath, rawQuery, _ := strings.Cut(c.Request.Url, "?")
+	rawPath, _, _ = strings.Cut(rawPath, "#")
+	urlPath, err := url.PathUnescape(rawPath)
+	if err != nil {
+		c.ResponseText(400, "Bad Request")
+		return
+	}
+	if urlPath != h.root && !strings.HasPrefix(urlPath, h.root+"/") {
+		c.ResponseText(404, "Not Found")
+		return
+	}
+	pathInfo := strings.TrimPrefix(urlPath, h.root)
+
+	env := cgiEnv(c, h.root, pathInfo, rawQuery)
+	env = append(env,
+		"SCRIPT_FILENAME="+h.path,
+		"PATH="+cgiPath(),
+	)
+	env = append(env, h.env...)
+
+	ctx := c.Ctx() // cancelled when the client disconnects
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+
+	script, err := startCGI(h.path, env, c.Request.Body)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "CGI %s: %v\n", h.path, err)
+		c.ResponseText(502, "Bad Gateway")
+		return
+	}
+
+	// kill the script when ctx is done, waiting for the response headers,
+	// but not when ctx is cancelled on return, with the body to stream
+	headersRead := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			select {
+			case <-headersRead:
+			default:
+				script.kill()
+			}
+		case <-headersRead:
+		}
+	}()
+	stdout := bufio.NewReader(script)
+	localRedirect, contentLength, err := readCGIHeaders(c, stdout)
+	close(headersRead)
+	if ctx.Err() != nil || err != nil || localRedirect != "" {
+		_ = script.Close()
+		c.Response.Headers = make(map[string]string)
+	}
+
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		c.ResponseText(504, "Gateway Timeout")
+	case ctx.Err() != nil: // client disconnected, nobody cares
+		c.ResponseText(503, "Service Unavailable")
+	case err != nil:
+		_, _ = fmt.Fprintf(os.Stderr, "CGI %s: %v\n", h.path, err)
+		c.ResponseText(502, "Bad Gateway")
+	case localRedirect != "" && h.localRedirect == nil:
+		c.redirect(302, localRedirect)
+	case localRedirect != "":
+		h.serveLocalRedirect(c, localRedirect)
+	default: // stream the body, in the rest of the time limit
+		if deadline, ok := ctx.Deadline(); ok && h.timeout > 0 {
+			script.timer = time.AfterFunc(time.Until(deadline), script.kill)
+		}
+		c.Response.SetBodyReader(readCloser{stdout, script}, contentLength)
+	}
+}
+
+// cgiLocalRedirectsKey is the context.Context key of the number of the
+// local redirects of a request.
+type cgiLocalRedirectsKey struct{}
+
+// serveLocalRedirect serves a GET of the location by the localRedirect
+// handler, as the response of the c, unless redirected too many times.
+func (h *cgiHandler) serveLocalRedirect(c *Context, location string) {
+	redirects, _ := c.ctx.Value(cgiLocalRedirectsKey{}).(int)
+	if redirects >= cgiMaxLocalRedirects {
+		_, _ = fmt.Fprintf(os.Stderr, "CGI %s: too many local redirects\n", h.path)
+		c.ResponseText(500, "Internal Server Error")
+		return
+	}
+
+	req := NewRequest()
+	req.Method = "GET"
+	req.Url = location
+	req.Version = c.Request.Version
+	req.Body = strings.NewReader("")
+	req.RemoteAddr = c.Request.RemoteAddr
+	req.TLS = c.Request.TLS
+	for k, v := range c.Request.Headers {
+		if k != "Content-Length" && k != "Content-Type" {
+			req.Headers[k] = v
+		}
+	}
+
+	c.Response.resetBody()
+	c.Response.Headers = make(map[string]string)
+	redirected := NewContext(req, c.Response)
+	redirected.WithContext(context.WithValue(c.ctx, cgiLocalRedirectsKey{}, redirects+1))
+	h.localRedirect.ServeHTTP(redirected)
+}
+
+// cgiEnv returns the RFC 3875 meta-variables of the request to the c,
+// except the SCRIPT_FILENAME and PATH, for CGI and FastCGI.
+func cgiEnv(c *Context, scriptName string, pathInfo string, rawQuery string) []string {
+	req := c.Request
+
+	host, port, err := net.SplitHostPort(req.Headers["Host"])
+	if err != nil { // no port
+		host, port = req.Headers["Host"], "80"
+		if req.TLS != nil {
+			port = "443"
+		}
+	}
+	remoteHost, remotePort, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remoteHost = req.RemoteAddr
+	}
+
+	env := []string{
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"SERVER_SOFTWARE=simplehttp",
+		"SERVER_NAME=" + host,
+		"SERVER_PORT=" + port,
+		"SERVER_PROTOCOL=" + req.Version,
+		"REQUEST_METHOD=" + req.Method,
+		"REQUEST_URI=" + req.Url,
+		"SCRIPT_NAME=" + scriptName,
+		"PATH_INFO=" + pathInfo,
+		"QUERY_STRING=" + rawQuery,
+		"REMOTE_ADDR=" + remoteHost,
+		"REMOTE_HOST=" + remoteHost,
+		"REMOTE_PORT=" + remotePort,
+	}
+	if req.TLS != nil {
+		env = append(env, "HTTPS=on")
+	}
+
+	for k, v := range req.Headers {
+		switch k = strings.ToUpper(strings.ReplaceAll(k, "-", "_")); k {
+		case "CONTENT_LENGTH", "CONTENT_TYPE":
+			env = append(env, k+"="+v)
+		case "PROXY": // httpoxy: not to be taken as HTTP_PROXY
+		default:
+			env = append(env, "HTTP_"+k+"="+v)
+		}
+	}
+	return env
+}
+
+// cgiPath returns the PATH for scripts: the one of the server,
+// or a sane default.
+func cgiPath() string {
+	if path := os.Getenv("PATH"); path != "" {
+		return path
+	}
+	return "/bin:/usr/bin:/usr/local/bin"
+}
+
+// cgiScript is a running CGI script, whose stdout is read as the
+// response, from an os.Pipe: closed to stop reading, not waiting for
+// the children of the script which may hold it.
+type cgiScript struct {
+	cmd    *exec.Cmd
+	stdout *os.File
+	timer  *time.Timer // kills the script after the time limit, or nil
+
+	mu     sync.Mutex
+	killed bool
+}
+
+// startCGI starts the script at path with the env, piping stdin to it.
+func startCGI(path string, env []string, stdin io.Reader) (*cgiScript, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(path)
+	cmd.Dir = filepath.Dir(path)
+	cmd.Env = env
+	cmd.Stdin = stdin
+	cmd.Stdout = pw
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	_ = pw.Close() // the script has it
+	if err != nil {
+		_ = pr.Close()
+		return nil, err
+	}
+	return &cgiScript{cmd: cmd, stdout: pr}, nil
+}
+
+func (s *cgiScript) Read(p []byte) (int, error) {
+	return s.stdout.Read(p)
+}
+
+// kill kills the script, if not yet, and stops reading its stdout.
+func (s *cgiScript) kill() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.killed {
+		s.killed = true
+		_ = s.cmd.Process.Kill()
+		_ = s.stdout.Close()
+	}
+}
+
+// Close kills the script, if still running, and waits for it. A failure
+// of the script, e.g. exit status 1, is logged, while its output is
+// served anyway.
+func (s *cgiScript) Close() error {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.mu.Lock()
+	killed := s.killed
+	s.mu.Unlock()
+	if !killed {
+		s.kill()
+	}
+	if err := s.cmd.Wait(); err != nil && !killed {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.Exited() { // not by the kill
+			_, _ = fmt.Fprintf(os.Stderr, "CGI %s: %v\n", s.cmd.Path, err)
+		}
+	}
+	return nil
+}
+
+// readCGIHeaders reads the headers of the CGI response from r into the
+// c, leaving r at the beginning of the body. It returns the location of
+// a local redirect response, and the Content-Length (-1 if unknown).
+func readCGIHeaders(c *Context, r *bufio.Reader) (localRedirect string, contentLength int64, err error) {
+	tp := textproto.NewReader(r)
+	headers, err := tp.ReadMIMEHeader() // tolerates "\n" line endings
+	if err != nil && !(errors.Is(err, io.EOF) && len(headers) > 0) {
+		return "", -1, fmt.Errorf("invalid CGI response headers: %w", err)
+	}
+	if len(headers) == 0 {
+		return "", -1, errors.New("no CGI response headers")
+	}
+
+	status, reason := 0, ""
+	if s := headers.Get("Status"); s != "" {
+		code, text, _ := strings.Cut(s, " ")
+		if status, err = strconv.Atoi(code); err != nil || status < 100 || status > 999 {
+			return "", -1, fmt.Errorf("invalid CGI Status %q", s)
+		}
+		reason = strings.TrimSpace(text)
+	}
+	location := headers.Get("Location")
+
+	switch {
+	case strings.HasPrefix(location, "/") && status == 0:
+		// local-redir-response: the server handles the new location
+		return location, -1, nil
+	case location != "" && status == 0:
+		status = 302 // client-redir-response
+	case status == 0 && headers.Get("Content-Type") == "":
+		return "", -1, errors.New("missing Content-Type in CGI response headers")
+	case status == 0:
+		status = 200
+	}
+
+	c.Response.SetStateLine(c.Request.Version, status)
+	if reason != "" {
+		c.Response.Reason = reason
+	}
+	for k, values := range headers {
+		switch k {
+		case "Status", "Content-Length", "Connection", "Transfer-Encoding":
+		default:
+			for _, v := range values {
+				c.Response.AddHeader(k, v)
+			}
+		}
+	}
+
+	contentLength, err = strconv.ParseInt(headers.Get("Content-Length"), 10, 64)
+	if err != nil || contentLength < 0 {
+		contentLength = -1
+	}
+	return "", contentLength, nil
+}
+
+// endregion Handler: CGIServer
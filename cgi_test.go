@@ -0,0 +1,262 @@
+package simplehttp
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testCGIPortBase = 23430
+
+// writeTestScript writes an executable shell script to dir/name.
+func writeTestScript(t *testing.T, dir string, name string, script string) string {
+	path := filepath.Join(dir, name)
+	writeTestFile(t, path, "#!/bin/sh\n"+script)
+	if err := os.Chmod(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCGIHandler(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell scripts required")
+	}
+	port := testCGIPortBase
+
+	dir := t.TempDir()
+	envScript := writeTestScript(t, dir, "env.cgi", `
+printf 'Content-Type: text/plain\r\n'
+printf 'X-Script: env\r\n\r\n'
+for name in GATEWAY_INTERFACE SERVER_PROTOCOL SERVER_NAME SERVER_PORT REQUEST_METHOD \
+	SCRIPT_NAME PATH_INFO QUERY_STRING CONTENT_LENGTH CONTENT_TYPE HTTP_X_CUSTOM HTTP_PROXY CUSTOM_ENV; do
+	eval "echo $name=\$$name"
+done
+echo "REMOTE_ADDR=$REMOTE_ADDR"
+echo "PWD=$(pwd)"
+echo "STDIN=$(cat)"
+`)
+	statusScript := writeTestScript(t, dir, "status.cgi", `
+echo "Status: 404 No Such Thing"
+echo "Content-Type: text/plain"
+echo
+echo "not here"
+`)
+	localScript := writeTestScript(t, dir, "local.cgi", `
+echo "Location: /target?from=cgi"
+echo
+`)
+	clientScript := writeTestScript(t, dir, "client.cgi", `
+echo "Location: http://example.com/elsewhere"
+echo
+`)
+	slowScript := writeTestScript(t, dir, "slow.cgi", `
+sleep 1
+echo "Content-Type: text/plain"
+echo
+echo "done" > "`+filepath.Join(dir, "slow.done")+`"
+`)
+	badScript := writeTestScript(t, dir, "bad.cgi", `
+echo "no headers here"
+`)
+	cookieScript := writeTestScript(t, dir, "cookie.cgi", `
+echo "Content-Type: text/plain"
+echo "Set-Cookie: a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT"
+echo "Set-Cookie: b=2; Expires=Thu, 22 Oct 2015 07:28:00 GMT"
+echo
+`)
+	loopScript := writeTestScript(t, dir, "loop.cgi", `
+echo "Location: /loop"
+echo
+`)
+	streamScript := writeTestScript(t, dir, "stream.cgi", `
+echo "Content-Type: text/plain"
+echo
+echo "first"
+sleep 1
+echo "second"
+`)
+	failScript := writeTestScript(t, dir, "fail.cgi", `
+echo "Content-Type: text/plain"
+echo
+echo "partial"
+exit 1
+`)
+
+	// server
+	go func() {
+		r := NewPrefixRouter("/")
+		r.GET("/target", func(c *Context) {
+			c.ResponseText(200, "target "+c.Request.Url)
+		})
+		r.GET("/env/", CGIHandler(envScript, "/env", WithCGIEnv("CUSTOM_ENV=custom")))
+		r.POST("/env/", CGIHandler(envScript, "/env"))
+		r.GET("/status", CGIHandler(statusScript, "/status"))
+		r.GET("/local", CGIHandler(localScript, "/local", WithCGILocalRedirect(r)))
+		r.GET("/local302", CGIHandler(localScript, "/local302"))
+		r.GET("/client", CGIHandler(clientScript, "/client"))
+		r.GET("/slow", CGIHandler(slowScript, "/slow", WithCGITimeout(300*time.Millisecond)))
+		r.GET("/disconnect", CGIHandler(slowScript, "/disconnect"))
+		r.GET("/bad", CGIHandler(badScript, "/bad"))
+		r.GET("/fail", CGIHandler(failScript, "/fail"))
+		r.GET("/cookie", CGIHandler(cookieScript, "/cookie"))
+		r.GET("/loop", CGIHandler(loopScript, "/loop", WithCGILocalRedirect(r)))
+		r.GET("/stream", CGIHandler(streamScript, "/stream"))
+		r.GET("/mounted/", CGIHandler(statusScript, "/elsewhere"))
+
+		s := HttpServer{Handler: r}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	do := func(t *testing.T, method string, path string, body string, headers map[string]string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, fmt.Sprintf("http://localhost:%d%s", port, path), strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		got, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(got.Body)
+		_ = got.Body.Close()
+		return got, string(b)
+	}
+
+	t.Run("env", func(t *testing.T) {
+		got, body := do(t, "GET", "/env/a/b%20c?x=1&y=2", "", map[string]string{
+			"X-Custom": "custom header",
+			"Proxy":    "http://evil.example.com",
+		})
+		if got.StatusCode != 200 {
+			t.Errorf("expected status code 200, got %d", got.StatusCode)
+		}
+		if got.Header.Get("X-Script") != "env" || got.Header.Get("Content-Type") != "text/plain" {
+			t.Errorf("expected the script headers, got %v", got.Header)
+		}
+		for _, expected := range []string{
+			"GATEWAY_INTERFACE=CGI/1.1\n",
+			"SERVER_PROTOCOL=HTTP/1.1\n",
+			"SERVER_NAME=localhost\n",
+			fmt.Sprintf("SERVER_PORT=%d\n", port),
+			"REQUEST_METHOD=GET\n",
+			"SCRIPT_NAME=/env\n",
+			"PATH_INFO=/a/b c\n",
+			"QUERY_STRING=x=1&y=2\n",
+			"HTTP_X_CUSTOM=custom header\n",
+			"HTTP_PROXY=\n",
+			"CUSTOM_ENV=custom\n",
+			"REMOTE_ADDR=127.0.0.1\n",
+			"PWD=" + dir + "\n",
+		} {
+			if !strings.Contains(body, expected) {
+				t.Errorf("expected %q in\n%s", expected, body)
+			}
+		}
+	})
+
+	t.Run("stdin", func(t *testing.T) {
+		_, body := do(t, "POST", "/env/", "a=1&b=2", map[string]string{
+			"Content-Type": "application/x-www-form-urlencoded",
+		})
+		for _, expected := range []string{
+			"REQUEST_METHOD=POST\n",
+			"PATH_INFO=/\n",
+			"CONTENT_LENGTH=7\n",
+			"CONTENT_TYPE=application/x-www-form-urlencoded\n",
+			"STDIN=a=1&b=2\n",
+		} {
+			if !strings.Contains(body, expected) {
+				t.Errorf("expected %q in\n%s", expected, body)
+			}
+		}
+	})
+
+	cases := []struct {
+		name             string
+		path             string
+		expectedStatus   int
+		expectedLocation string
+		expectedBody     string
+	}{
+		{"status", "/status", 404, "", "not here\n"},
+		{"localRedirect", "/local", 200, "", "target /target?from=cgi"},
+		{"localRedirect302", "/local302", 302, "/target?from=cgi", `<a href="/target?from=cgi">Found</a>.` + "\n"},
+		{"clientRedirect", "/client", 302, "http://example.com/elsewhere", ""},
+		{"timeout", "/slow", 504, "", "Gateway Timeout"},
+		{"badResponse", "/bad", 502, "", "Bad Gateway"},
+		{"exitStatus", "/fail", 200, "", "partial\n"},
+		{"notMounted", "/mounted/x", 404, "", "Not Found"},
+		{"localRedirectLoop", "/loop", 500, "", "Internal Server Error"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, body := do(t, "GET", tt.path, "", nil)
+			if got.StatusCode != tt.expectedStatus {
+				t.Errorf("expected status code %d, got %d", tt.expectedStatus, got.StatusCode)
+			}
+			if loc := got.Header.Get("Location"); loc != tt.expectedLocation {
+				t.Errorf("expected Location %q, got %q", tt.expectedLocation, loc)
+			}
+			if body != tt.expectedBody {
+				t.Errorf("expected %q, got %q", tt.expectedBody, body)
+			}
+		})
+	}
+
+	t.Run("setCookie", func(t *testing.T) {
+		got, _ := do(t, "GET", "/cookie", "", nil)
+		cookies := got.Header.Values("Set-Cookie")
+		if len(cookies) != 2 || cookies[0] != "a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT" ||
+			cookies[1] != "b=2; Expires=Thu, 22 Oct 2015 07:28:00 GMT" {
+			t.Errorf("expected 2 Set-Cookie headers, got %q", cookies)
+		}
+	})
+
+	t.Run("streamed", func(t *testing.T) {
+		start := time.Now()
+		got, err := http.Get(fmt.Sprintf("http://localhost:%d/stream", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer got.Body.Close()
+		first := make([]byte, len("first\n"))
+		if _, err := io.ReadFull(got.Body, first); err != nil || string(first) != "first\n" {
+			t.Fatalf("expected the first line, got %q %v", first, err)
+		}
+		if elapsed := time.Since(start); elapsed > 700*time.Millisecond {
+			t.Errorf("expected the first line before the script ends, got it after %v", elapsed)
+		}
+		if rest, err := io.ReadAll(got.Body); string(rest) != "second\n" {
+			t.Errorf("expected the rest streamed, got %q %v", rest, err)
+		}
+	})
+
+	t.Run("killOnDisconnect", func(t *testing.T) {
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = conn.Write([]byte("GET /disconnect HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		time.Sleep(200 * time.Millisecond)
+		_ = conn.Close()
+
+		time.Sleep(1500 * time.Millisecond) // the script would have finished
+		if _, err := os.Stat(filepath.Join(dir, "slow.done")); err == nil {
+			t.Error("expected the script killed on disconnect, but it finished")
+		}
+	})
+}
@@ -0,0 +1,276 @@
+package simplehttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"io/fs"
+	pathLib "path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// minCompressSize is the minimum size of files to compress on the fly:
+	// smaller ones hardly get smaller.
+	minCompressSize = 256
+	// maxCompressSize is the maximum size of files to compress on the fly,
+	// as the compressed contents are cached in memory.
+	maxCompressSize = 8 << 20
+	// maxGzipCacheBytes is the maximum total size of the compressed
+	// contents cached per FileServer, the least recently used evicted.
+	maxGzipCacheBytes = 32 << 20
+)
+
+// region FileServer: compression
+
+// WithCompression makes the FileServer gzip compressible files (text,
+// JavaScript, JSON, XML, SVG) on the fly for clients Accept-Encoding gzip,
+// if there is no precompressed .gz sibling. The compressed contents are
+// cached per file, up to 32 MB in total, recompressed on changes of size
+// or mod time.
+func WithCompression() FileServerOption {
+	return func(srv *fileServer) {
+		srv.compress = true
+	}
+}
+
+// gzipCacheEntry is the gzip compressed contents of a file with its size
+// and mod time when compressed, to tell whether it's still valid.
+type gzipCacheEntry struct {
+	name    string
+	size    int64
+	modTime time.Time
+	data    []byte
+}
+
+// gzipCache is the cache of the compressed contents of the files of a
+// FileServer, bounded by maxBytes in total with LRU eviction. The zero
+// value is an empty cache of maxGzipCacheBytes.
+type gzipCache struct {
+	maxBytes int64 // 0 for maxGzipCacheBytes
+
+	mu      sync.Mutex
+	lru     *list.List // of *gzipCacheEntry, the most recently used first
+	entries map[string]*list.Element
+	bytes   int64
+}
+
+// load returns the cached entry of the file named name, if any.
+func (gc *gzipCache) load(name string) *gzipCacheEntry {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	elem, ok := gc.entries[name]
+	if !ok {
+		return nil
+	}
+	gc.lru.MoveToFront(elem)
+	return elem.Value.(*gzipCacheEntry)
+}
+
+// store caches the entry, replacing the one of the same name, and evicts
+// the least recently used ones over maxBytes.
+func (gc *gzipCache) store(entry *gzipCacheEntry) {
+	maxBytes := gc.maxBytes
+	if maxBytes <= 0 {
+		maxBytes = maxGzipCacheBytes
+	}
+	if int64(len(entry.data)) > maxBytes {
+		return
+	}
+
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if gc.entries == nil {
+		gc.lru = list.New()
+		gc.entries = make(map[string]*list.Element)
+	}
+	if elem, ok := gc.entries[entry.name]; ok {
+		gc.remove(elem)
+	}
+	gc.entries[entry.name] = gc.lru.PushFront(entry)
+	gc.bytes += int64(len(entry.data))
+	for gc.bytes > maxBytes {
+		gc.remove(gc.lru.Back())
+	}
+}
+
+// remove removes the elem from the cache. gc.mu must be held.
+func (gc *gzipCache) remove(elem *list.Element) {
+	entry := gc.lru.Remove(elem).(*gzipCacheEntry)
+	delete(gc.entries, entry.name)
+	gc.bytes -= int64(len(entry.data))
+}
+
+// gzipVariant returns the gzip encoded representation of the file named
+// name, if the client accepts it, with the stat and ETag of it:
+//
+//   - the precompressed sibling name+".gz", if exists;
+//   - or the contents compressed on the fly, if WithCompression and the
+//     contentType is compressible.
+//
+// It sets Vary: Accept-Encoding if there is a gzip representation,
+// whether the client accepts it or not, for caches. f is nil if there
+// is no (acceptable) gzip representation.
+func (srv *fileServer) gzipVariant(c *Context, name string, stat fs.FileInfo, contentType string) (f fs.File, gzStat fs.FileInfo, etag string) {
+	accepted := acceptsEncoding(c.Request.Headers["Accept-Encoding"], "gzip")
+
+	if srv.precompressed && srv.allowed(name+".gz") {
+		if gz, err := srv.fsys.Open(name + ".gz"); err == nil {
+			if gzStat, err := gz.Stat(); err == nil && gzStat.Mode().IsRegular() {
+				c.Response.Headers["Vary"] = "Accept-Encoding"
+				if accepted {
+					return gz, gzStat, encodedETag(srv.etag(name+".gz", gzStat), "gzip")
+				}
+			}
+			_ = gz.Close()
+		}
+	}
+
+	if srv.compress && compressible(contentType) &&
+		stat.Size() >= minCompressSize && stat.Size() <= maxCompressSize {
+		c.Response.Headers["Vary"] = "Accept-Encoding"
+		if !accepted {
+			return nil, nil, ""
+		}
+		data, err := srv.gzipped(name, stat)
+		if err != nil {
+			return nil, nil, ""
+		}
+		mf := newMemFile(name, data, stat.ModTime())
+		return mf, mf, encodedETag(srv.etag(name, stat), "gzip")
+	}
+
+	return nil, nil, ""
+}
+
+// gzipped returns the gzip compressed contents of the file named name,
+// cached per file in srv.gzips.
+func (srv *fileServer) gzipped(name string, stat fs.FileInfo) ([]byte, error) {
+	if entry := srv.gzips.load(name); entry != nil {
+		if entry.size == stat.Size() && entry.modTime.Equal(stat.ModTime()) {
+			return entry.data, nil
+		}
+	}
+
+	content, err := fs.ReadFile(srv.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := gzipBytes(content)
+	if err != nil {
+		return nil, err
+	}
+
+	srv.gzips.store(&gzipCacheEntry{
+		name:    name,
+		size:    stat.Size(),
+		modTime: stat.ModTime(),
+		data:    data,
+	})
+	return data, nil
+}
+
+// gzipBytes returns the gzip compressed content.
+func gzipBytes(content []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(content); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header accepts the
+// content coding (RFC 9110 Section 12.5.3), by name or "*", with a
+// non-zero qvalue.
+func acceptsEncoding(header string, coding string) bool {
+	accepted := false
+	for _, item := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != coding && name != "*" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(k, "q") {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+
+		if name == coding { // explicit one wins over "*"
+			return q > 0
+		}
+		accepted = q > 0
+	}
+	return accepted
+}
+
+// compressible reports whether the contents of the contentType are worth
+// compressing: text, not already compressed images/videos/archives.
+func compressible(contentType string) bool {
+	contentType, _, _ = strings.Cut(contentType, ";")
+	switch {
+	case strings.HasPrefix(contentType, "text/"):
+		return true
+	case strings.HasSuffix(contentType, "+json"), strings.HasSuffix(contentType, "+xml"):
+		return true
+	}
+	switch contentType {
+	case "application/javascript", "application/json", "application/xml",
+		"application/wasm", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// encodedETag makes the ETag of a content-coded representation from the
+// etag of the file, so that they are never the same:
+//
+//	W/"1a-2b" => W/"1a-2b-gzip"
+func encodedETag(etag string, coding string) string {
+	if !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return etag[:len(etag)-1] + "-" + coding + `"`
+}
+
+// memFile is an in-memory fs.File, with its fs.FileInfo,
+// e.g. the compressed contents of a file.
+type memFile struct {
+	*bytes.Reader
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// newMemFile returns a memFile of the data, as the file named name.
+func newMemFile(name string, data []byte, modTime time.Time) *memFile {
+	return &memFile{
+		Reader:  bytes.NewReader(data),
+		name:    pathLib.Base(name),
+		size:    int64(len(data)),
+		modTime: modTime,
+	}
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f, nil }
+func (f *memFile) Close() error               { return nil }
+func (f *memFile) Name() string               { return f.name }
+func (f *memFile) Size() int64                { return f.size }
+func (f *memFile) Mode() fs.FileMode          { return 0444 }
+func (f *memFile) ModTime() time.Time         { return f.modTime }
+func (f *memFile) IsDir() bool                { return false }
+func (f *memFile) Sys() any                   { return nil }
+
+// endregion FileServer: compression
@@ -0,0 +1,205 @@
+package simplehttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testCompressPortBase = 23030
+
+func TestAcceptsEncoding(t *testing.T) {
+	cases := []struct {
+		header   string
+		expected bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"GZIP", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.000", false},
+		{"br", false},
+		{"*", true},
+		{"*;q=0", false},
+		{"*, gzip;q=0", false},
+		{"gzip;q=0, *", false},
+		{"identity", false},
+	}
+	for _, tt := range cases {
+		if got := acceptsEncoding(tt.header, "gzip"); got != tt.expected {
+			t.Errorf("acceptsEncoding(%q): expected %v, got %v", tt.header, tt.expected, got)
+		}
+	}
+}
+
+func gzipString(t *testing.T, s string) string {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestFileServerCompression(t *testing.T) {
+	port := testCompressPortBase
+
+	root := t.TempDir()
+	appJS := ""
+	for i := 0; i < 500; i++ { // not too compressible for multiple ranges
+		appJS += fmt.Sprintf("console.log(%d);\n", i*7919%100003)
+	}
+	appJSGz := gzipString(t, appJS)
+	styleCSS := strings.Repeat("body { color: red; }\n", 100)
+	writeTestFile(t, filepath.Join(root, "app.js"), appJS)
+	writeTestFile(t, filepath.Join(root, "app.js.gz"), appJSGz)
+	writeTestFile(t, filepath.Join(root, "style.css"), styleCSS)
+	writeTestFile(t, filepath.Join(root, "small.css"), "a{}")
+	writeTestFile(t, filepath.Join(root, "image.png"), strings.Repeat("\x89PNG", 100))
+
+	// server
+	go func() {
+		r := NewPrefixRouter("/")
+		r.GET("/static/", FileServer(root, "/static"))
+		r.GET("/gzip/", FileServer(root, "/gzip", WithCompression()))
+
+		s := HttpServer{Handler: r}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	// a client sees the raw encoded body
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	get := func(t *testing.T, path string, headers map[string]string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d%s", port, path), nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		got, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(got.Body)
+		_ = got.Body.Close()
+		return got, string(b)
+	}
+
+	gzipHeader := map[string]string{"Accept-Encoding": "gzip, deflate"}
+
+	cases := []struct {
+		name             string
+		path             string
+		headers          map[string]string
+		expectedStatus   int
+		expectedEncoding string
+		expectedVary     string
+		expectedBody     string
+	}{
+		{"precompressed", "/static/app.js", gzipHeader, 200, "gzip", "Accept-Encoding", appJSGz},
+		{"precompressedNotAccepted", "/static/app.js", nil, 200, "", "Accept-Encoding", appJS},
+		{"precompressedRefused", "/static/app.js", map[string]string{"Accept-Encoding": "gzip;q=0"}, 200, "", "Accept-Encoding", appJS},
+		{"precompressedRange", "/static/app.js", map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-9"}, 206, "gzip", "Accept-Encoding", appJSGz[:10]},
+		{"precompressedMultiRange", "/static/app.js", map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-9,-10"}, 200, "gzip", "Accept-Encoding", appJSGz},
+		{"rangeNotAccepted", "/static/app.js", map[string]string{"Range": "bytes=0-9"}, 206, "", "Accept-Encoding", appJS[:10]},
+		{"gzFile", "/static/app.js.gz", gzipHeader, 200, "", "", appJSGz},
+		{"noCompression", "/static/style.css", gzipHeader, 200, "", "", styleCSS},
+
+		{"onTheFlyPrecompressed", "/gzip/app.js", gzipHeader, 200, "gzip", "Accept-Encoding", appJSGz},
+		{"onTheFlyNotAccepted", "/gzip/style.css", nil, 200, "", "Accept-Encoding", styleCSS},
+		{"onTheFlyTooSmall", "/gzip/small.css", gzipHeader, 200, "", "", "a{}"},
+		{"onTheFlyIncompressible", "/gzip/image.png", gzipHeader, 200, "", "", strings.Repeat("\x89PNG", 100)},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, body := get(t, tt.path, tt.headers)
+			if got.StatusCode != tt.expectedStatus {
+				t.Errorf("expected status code %d, got %d", tt.expectedStatus, got.StatusCode)
+			}
+			if ce := got.Header.Get("Content-Encoding"); ce != tt.expectedEncoding {
+				t.Errorf("expected Content-Encoding %q, got %q", tt.expectedEncoding, ce)
+			}
+			if vary := got.Header.Get("Vary"); vary != tt.expectedVary {
+				t.Errorf("expected Vary %q, got %q", tt.expectedVary, vary)
+			}
+			if body != tt.expectedBody {
+				t.Errorf("expected body of %d bytes, got %d bytes", len(tt.expectedBody), len(body))
+			}
+		})
+	}
+
+	t.Run("onTheFly", func(t *testing.T) {
+		var etags []string
+		for i := 0; i < 2; i++ { // compressed, then cached
+			got, body := get(t, "/gzip/style.css", gzipHeader)
+			if got.StatusCode != 200 || got.Header.Get("Content-Encoding") != "gzip" {
+				t.Fatalf("expected 200 gzip, got %d %q", got.StatusCode, got.Header.Get("Content-Encoding"))
+			}
+			zr, err := gzip.NewReader(strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if plain, _ := io.ReadAll(zr); string(plain) != styleCSS {
+				t.Errorf("expected decompressed %q, got %q", styleCSS, plain)
+			}
+			etags = append(etags, got.Header.Get("ETag"))
+		}
+		if etags[0] != etags[1] {
+			t.Errorf("expected the same ETag, got %s and %s", etags[0], etags[1])
+		}
+
+		plain, _ := get(t, "/gzip/style.css", nil)
+		if plain.Header.Get("ETag") == etags[0] {
+			t.Errorf("expected different ETags for the representations, got %s", etags[0])
+		}
+
+		got, _ := get(t, "/gzip/style.css", map[string]string{"Accept-Encoding": "gzip", "If-None-Match": etags[0]})
+		if got.StatusCode != 304 {
+			t.Errorf("expected status code 304, got %d", got.StatusCode)
+		}
+	})
+}
+
+func TestGzipCache(t *testing.T) {
+	gc := &gzipCache{maxBytes: 100}
+	store := func(name string, size int) {
+		gc.store(&gzipCacheEntry{name: name, data: make([]byte, size)})
+	}
+
+	store("a", 40)
+	store("b", 40)
+	if gc.load("a") == nil { // a is now the most recently used
+		t.Fatal("expected a cached")
+	}
+	store("c", 40) // evicts b
+	if gc.load("b") != nil {
+		t.Error("expected b evicted")
+	}
+	if gc.load("a") == nil || gc.load("c") == nil {
+		t.Error("expected a and c cached")
+	}
+	if gc.bytes != 80 {
+		t.Errorf("expected 80 bytes cached, got %d", gc.bytes)
+	}
+
+	store("a", 10) // replaces a
+	if gc.bytes != 50 {
+		t.Errorf("expected 50 bytes cached, got %d", gc.bytes)
+	}
+	store("big", 101) // not cached
+	if gc.load("big") != nil || gc.bytes != 50 {
+		t.Errorf("expected big not cached, got %d bytes cached", gc.bytes)
+	}
+}
@@ -0,0 +1,237 @@
+package simplehttp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// TimeFormat is the time format of HTTP dates (IMF-fixdate),
+// e.g. for Last-Modified. The time must be in UTC.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// region Conditional requests
+
+// CheckPreconditions evaluates the conditional request headers
+// (If-Match, If-Unmodified-Since, If-None-Match and If-Modified-Since)
+// against the current etag and lastModified of the resource,
+// in the order of [RFC 9110 Section 13.2.2].
+//
+// It sets the ETag and Last-Modified response headers (unless empty/zero),
+// and makes a 304 Not Modified or 412 Precondition Failed response and
+// returns true if the request should not be processed any further:
+//
+//	if c.CheckPreconditions(etag, updatedAt) {
+//		return
+//	}
+//	c.ResponseJSON(200, resource)
+//
+// [RFC 9110 Section 13.2.2]: https://www.rfc-editor.org/rfc/rfc9110#name-precedence-of-preconditions
+func (c *Context) CheckPreconditions(etag string, lastModified time.Time) bool {
+	lastModified = lastModified.Truncate(time.Second) // HTTP dates in seconds
+	if etag != "" {
+		c.Response.Headers["ETag"] = etag
+	}
+	if !isZeroTime(lastModified) {
+		c.Response.Headers["Last-Modified"] = lastModified.UTC().Format(TimeFormat)
+	}
+
+	headers := c.Request.Headers
+	method := c.Request.Method
+
+	// step 1 & 2: the request method would change the state
+	if ifMatch, ok := headers["If-Match"]; ok {
+		if !etagListMatch(ifMatch, etag, true) {
+			c.preconditionFailed()
+			return true
+		}
+	} else if ius, ok := headers["If-Unmodified-Since"]; ok && !isZeroTime(lastModified) {
+		if t, err := parseHTTPTime(ius); err == nil && lastModified.After(t) {
+			c.preconditionFailed()
+			return true
+		}
+	}
+
+	// step 3 & 4: the client has a cached copy
+	if ifNoneMatch, ok := headers["If-None-Match"]; ok {
+		if etagListMatch(ifNoneMatch, etag, false) {
+			if method == "GET" || method == "HEAD" {
+				c.notModified()
+			} else {
+				c.preconditionFailed()
+			}
+			return true
+		}
+	} else if ims, ok := headers["If-Modified-Since"]; ok && !isZeroTime(lastModified) &&
+		(method == "GET" || method == "HEAD") {
+		if t, err := parseHTTPTime(ims); err == nil && !lastModified.After(t) {
+			c.notModified()
+			return true
+		}
+	}
+
+	return false
+}
+
+// ifRangeSatisfied evaluates the If-Range header (step 5 of
+// RFC 9110 Section 13.2.2): the Range header should be ignored
+// if it returns false.
+func (c *Context) ifRangeSatisfied(etag string, lastModified time.Time) bool {
+	ifRange, ok := c.Request.Headers["If-Range"]
+	if !ok {
+		return true
+	}
+
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, `W/"`) {
+		// a weak validator never matches
+		return etagMatch(ifRange, etag, true)
+	}
+
+	t, err := parseHTTPTime(ifRange)
+	if err != nil || isZeroTime(lastModified) {
+		return false
+	}
+	return lastModified.Truncate(time.Second).Equal(t)
+}
+
+// notModified makes a 304 response, keeping only the headers
+// allowed by RFC 9110 Section 15.4.5.
+func (c *Context) notModified() {
+	for k := range c.Response.Headers {
+		switch k {
+		case "ETag", "Last-Modified", "Cache-Control", "Content-Location",
+			"Date", "Expires", "Vary":
+		default:
+			delete(c.Response.Headers, k)
+		}
+	}
+	c.Response.resetBody()
+	c.Response.SetStateLine(c.Request.Version, 304)
+}
+
+// preconditionFailed makes a 412 response.
+func (c *Context) preconditionFailed() {
+	c.Response.resetBody()
+	c.ResponseText(412, "Precondition Failed")
+}
+
+// etagListMatch reports whether etag matches any entity-tag in the
+// list (the value of If-Match or If-None-Match), or the list is "*"
+// and the resource exists (etag is not empty).
+func etagListMatch(list string, etag string, strong bool) bool {
+	if etag == "" {
+		return false
+	}
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		if etagMatch(strings.TrimSpace(candidate), etag, strong) {
+			return true
+		}
+	}
+	return false
+}
+
+// etagMatch compares the entity-tags a and b with the strong
+// or weak comparison function (RFC 9110 Section 8.8.3.2).
+func etagMatch(a, b string, strong bool) bool {
+	if strong {
+		return a == b && !strings.HasPrefix(a, "W/")
+	}
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// parseHTTPTime parses an HTTP date in IMF-fixdate, or the obsolete
+// RFC 850 and asctime formats.
+func parseHTTPTime(s string) (time.Time, error) {
+	var err error
+	for _, layout := range []string{TimeFormat, time.RFC850, time.ANSIC} {
+		var t time.Time
+		if t, err = time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// isZeroTime reports whether t is unknown: the zero time or the Unix epoch
+// (e.g. the ModTime of files in an embed.FS or a zip).
+func isZeroTime(t time.Time) bool {
+	return t.IsZero() || t.Equal(time.Unix(0, 0))
+}
+
+// endregion Conditional requests
+
+// region FileServer: ETag
+
+// weakETag makes a weak ETag from the size and mod time of a file.
+func weakETag(stat fs.FileInfo) string {
+	return fmt.Sprintf(`W/"%x-%x"`, stat.Size(), stat.ModTime().UnixNano())
+}
+
+// contentETag makes a strong ETag from the SHA-256 of the content of f,
+// which is read to the end.
+func contentETag(f io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`, nil
+}
+
+// etagCacheEntry is a strong ETag of a file with its size and mod time
+// when the ETag is computed, to tell whether it's still valid.
+type etagCacheEntry struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+// etag returns the ETag of the file named name: a weak one derived from
+// the size and mod time, or a strong one (content hash) cached per file
+// if WithStrongETag or the mod time is unknown.
+func (srv *fileServer) etag(name string, stat fs.FileInfo) string {
+	if !srv.strongETag && !isZeroTime(stat.ModTime()) {
+		return weakETag(stat)
+	}
+
+	if v, ok := srv.etags.Load(name); ok {
+		entry := v.(etagCacheEntry)
+		if entry.size == stat.Size() && entry.modTime.Equal(stat.ModTime()) {
+			return entry.etag
+		}
+	}
+
+	f, err := srv.fsys.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	etag, err := contentETag(f)
+	if err != nil {
+		return ""
+	}
+	srv.etags.Store(name, etagCacheEntry{
+		size:    stat.Size(),
+		modTime: stat.ModTime(),
+		etag:    etag,
+	})
+	return etag
+}
+
+// WithStrongETag makes the FileServer use strong ETags of content
+// hashes (cached per file, recomputed on changes of size or mod time),
+// instead of the weak ones derived from the size and mod time.
+func WithStrongETag() FileServerOption {
+	return func(srv *fileServer) {
+		srv.strongETag = true
+	}
+}
+
+// endregion FileServer: ETag
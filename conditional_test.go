@@ -0,0 +1,156 @@
+package simplehttp
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testConditionalPortBase = 22830
+
+func TestCheckPreconditions(t *testing.T) {
+	etag := `"v2"`
+	modTime := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	before := modTime.Add(-time.Hour).Format(TimeFormat)
+	after := modTime.Add(time.Hour).Format(TimeFormat)
+
+	cases := []struct {
+		name           string
+		method         string
+		headers        map[string]string
+		expectedDone   bool
+		expectedStatus int
+	}{
+		{"none", "GET", nil, false, 0},
+
+		{"ifMatch", "PUT", map[string]string{"If-Match": `"v1", "v2"`}, false, 0},
+		{"ifMatchStar", "PUT", map[string]string{"If-Match": `*`}, false, 0},
+		{"ifMatchFailed", "PUT", map[string]string{"If-Match": `"v1"`}, true, 412},
+		{"ifMatchWeak", "PUT", map[string]string{"If-Match": `W/"v2"`}, true, 412},
+		{"ifUnmodifiedSince", "PUT", map[string]string{"If-Unmodified-Since": after}, false, 0},
+		{"ifUnmodifiedSinceFailed", "PUT", map[string]string{"If-Unmodified-Since": before}, true, 412},
+		{"ifMatchOverIUS", "PUT", map[string]string{"If-Match": `"v2"`, "If-Unmodified-Since": before}, false, 0},
+
+		{"ifNoneMatch", "GET", map[string]string{"If-None-Match": `"v1"`}, false, 0},
+		{"ifNoneMatchHit", "GET", map[string]string{"If-None-Match": `"v1", W/"v2"`}, true, 304},
+		{"ifNoneMatchStar", "GET", map[string]string{"If-None-Match": `*`}, true, 304},
+		{"ifNoneMatchPut", "PUT", map[string]string{"If-None-Match": `*`}, true, 412},
+		{"ifModifiedSince", "GET", map[string]string{"If-Modified-Since": before}, false, 0},
+		{"ifModifiedSinceHit", "GET", map[string]string{"If-Modified-Since": after}, true, 304},
+		{"ifModifiedSinceExact", "GET", map[string]string{"If-Modified-Since": modTime.Format(TimeFormat)}, true, 304},
+		{"ifModifiedSincePost", "POST", map[string]string{"If-Modified-Since": after}, false, 0},
+		{"ifModifiedSinceBad", "GET", map[string]string{"If-Modified-Since": "yesterday"}, false, 0},
+		{"ifNoneMatchOverIMS", "GET", map[string]string{"If-None-Match": `"v1"`, "If-Modified-Since": after}, false, 0},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req := NewRequest()
+			req.Method = tt.method
+			req.Version = "HTTP/1.1"
+			for k, v := range tt.headers {
+				req.Headers[k] = v
+			}
+			c := NewContext(req, NewResponse())
+
+			done := c.CheckPreconditions(etag, modTime)
+			if done != tt.expectedDone {
+				t.Errorf("expected done %v, got %v", tt.expectedDone, done)
+			}
+			if c.Response.Status != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, c.Response.Status)
+			}
+			if c.Response.Headers["ETag"] != etag {
+				t.Errorf("expected ETag %s, got %s", etag, c.Response.Headers["ETag"])
+			}
+		})
+	}
+}
+
+func TestFileServerConditional(t *testing.T) {
+	port := testConditionalPortBase
+
+	root := t.TempDir()
+	path := filepath.Join(root, "a.txt")
+	writeTestFile(t, path, "0123456789")
+	modTime := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	// server
+	go func() {
+		r := NewPrefixRouter("/")
+		r.GET("/weak/", FileServer(root, "/weak"))
+		r.GET("/strong/", FileServer(root, "/strong", WithStrongETag()))
+
+		s := HttpServer{Handler: r}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	get := func(t *testing.T, path string, headers map[string]string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d%s", port, path), nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		got, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(got.Body)
+		return got, string(b)
+	}
+
+	for _, prefix := range []string{"/weak", "/strong"} {
+		t.Run(prefix, func(t *testing.T) {
+			first, _ := get(t, prefix+"/a.txt", nil)
+			etag := first.Header.Get("ETag")
+			if etag == "" {
+				t.Fatal("expected ETag, got none")
+			}
+			if lm := first.Header.Get("Last-Modified"); lm != modTime.Format(TimeFormat) {
+				t.Errorf("expected Last-Modified %s, got %s", modTime.Format(TimeFormat), lm)
+			}
+
+			cases := []struct {
+				name           string
+				headers        map[string]string
+				expectedStatus int
+				expectedBody   string
+			}{
+				{"ifNoneMatch", map[string]string{"If-None-Match": etag}, 304, ""},
+				{"ifModifiedSince", map[string]string{"If-Modified-Since": modTime.Format(TimeFormat)}, 304, ""},
+				{"ifMatchFailed", map[string]string{"If-Match": `"other"`}, 412, "Precondition Failed"},
+				{"ifRangeDate", map[string]string{"Range": "bytes=0-1", "If-Range": modTime.Format(TimeFormat)}, 206, "01"},
+				{"ifRangeOld", map[string]string{"Range": "bytes=0-1", "If-Range": modTime.Add(-time.Hour).Format(TimeFormat)}, 200, "0123456789"},
+				{"ifRangeOtherETag", map[string]string{"Range": "bytes=0-1", "If-Range": `"other"`}, 200, "0123456789"},
+			}
+			for _, tt := range cases {
+				t.Run(tt.name, func(t *testing.T) {
+					got, body := get(t, prefix+"/a.txt", tt.headers)
+					if got.StatusCode != tt.expectedStatus {
+						t.Errorf("expected status code %d, got %d", tt.expectedStatus, got.StatusCode)
+					}
+					if body != tt.expectedBody {
+						t.Errorf("expected %q, got %q", tt.expectedBody, body)
+					}
+				})
+			}
+
+			if prefix == "/strong" {
+				got, body := get(t, prefix+"/a.txt", map[string]string{"Range": "bytes=0-1", "If-Range": etag})
+				if got.StatusCode != 206 || body != "01" {
+					t.Errorf("expected 206 01 for If-Range with strong ETag, got %d %q", got.StatusCode, body)
+				}
+			}
+		})
+	}
+}
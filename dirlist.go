@@ -0,0 +1,163 @@
+package simplehttp
+
+import (
+	"bytes"
+	"html/template"
+	"io/fs"
+	"net/url"
+	pathLib "path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// region FileServer: directory listing
+
+// dirEntry is an entry in a directory listing.
+type dirEntry struct {
+	Name    string    `json:"name"`
+	IsDir   bool      `json:"is_dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// Href returns the relative link to the entry.
+func (e dirEntry) Href() string {
+	href := "./" + url.PathEscape(e.Name) // "./" in case of "a:b" taken as scheme
+	if e.IsDir {
+		href += "/"
+	}
+	return href
+}
+
+// dirListing is the data of dirListingTemplate.
+type dirListing struct {
+	Path    string
+	Entries []dirEntry
+	Sort    string
+	Order   string
+}
+
+// NextOrder returns the order for the link of the column:
+// reversed if the column is the current sorting one.
+func (d dirListing) NextOrder(column string) string {
+	if d.Sort == column && d.Order == "asc" {
+		return "desc"
+	}
+	return "asc"
+}
+
+var dirListingTemplate = template.Must(template.New("dir").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index of {{.Path}}</title></head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr>
+<th><a href="?sort=name&amp;order={{.NextOrder "name"}}">Name</a></th>
+<th><a href="?sort=size&amp;order={{.NextOrder "size"}}">Size</a></th>
+<th><a href="?sort=mtime&amp;order={{.NextOrder "mtime"}}">Last Modified</a></th>
+</tr>
+<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}{{if .IsDir}}/{{end}}</a></td><td>{{if not .IsDir}}{{.Size}}{{end}}</td><td>{{.ModTime.UTC.Format "2006-01-02 15:04:05"}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// listDir responses the listing of the directory named dir in the fsys:
+// a JSON array if the client Accept application/json, an HTML table
+// otherwise. The entries are sorted by the query:
+//
+//	?sort=name|size|mtime&order=asc|desc
+//
+// Directories come first when sorted by name. Hidden files are filtered
+// out unless WithHiddenFiles; symlinks are filtered out unless
+// SymlinkFollow.
+func (srv *fileServer) listDir(c *Context, dir string, rawQuery string) {
+	files, err := fs.ReadDir(srv.fsys, dir)
+	if err != nil {
+		c.ResponseText(403, "Forbidden")
+		return
+	}
+
+	entries := make([]dirEntry, 0, len(files))
+	for _, f := range files {
+		if !srv.showHidden && strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		if srv.symlinks != SymlinkFollow && f.Type()&fs.ModeSymlink != 0 {
+			continue
+		}
+
+		info, err := fs.Stat(srv.fsys, pathLib.Join(dir, f.Name())) // follow symlinks
+		if err != nil {                                             // e.g. broken symlink
+			continue
+		}
+		entries = append(entries, dirEntry{
+			Name:    f.Name(),
+			IsDir:   info.IsDir(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+
+	query, _ := url.ParseQuery(rawQuery)
+	listing := dirListing{
+		Path:    strings.TrimSuffix(c.Request.Url, "?"+rawQuery),
+		Entries: entries,
+		Sort:    query.Get("sort"),
+		Order:   query.Get("order"),
+	}
+	if listing.Order != "desc" {
+		listing.Order = "asc"
+	}
+	sortDirEntries(entries, listing.Sort, listing.Order == "desc")
+
+	if strings.Contains(c.Request.Headers["Accept"], "application/json") {
+		c.ResponseJSON(200, entries)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	if err := dirListingTemplate.Execute(buf, listing); err != nil {
+		c.ResponseText(500, "Internal Server Error")
+		return
+	}
+	c.ResponseHTML(200, buf.String())
+}
+
+// sortDirEntries sorts the entries by name (default), size or mtime.
+func sortDirEntries(entries []dirEntry, by string, desc bool) {
+	less := func(a, b dirEntry) bool {
+		if a.IsDir != b.IsDir { // directories first
+			return a.IsDir
+		}
+		return a.Name < b.Name
+	}
+	switch by {
+	case "size":
+		less = func(a, b dirEntry) bool {
+			if a.Size == b.Size {
+				return a.Name < b.Name
+			}
+			return a.Size < b.Size
+		}
+	case "mtime":
+		less = func(a, b dirEntry) bool {
+			if a.ModTime.Equal(b.ModTime) {
+				return a.Name < b.Name
+			}
+			return a.ModTime.Before(b.ModTime)
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if desc {
+			return less(entries[j], entries[i])
+		}
+		return less(entries[i], entries[j])
+	})
+}
+
+// endregion FileServer: directory listing
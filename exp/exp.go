@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"net/url"
 	"os"
 	"simplehttp"
 )
@@ -81,10 +80,7 @@ func expMininet(config expMininetConfig) {
 		Handler: simplehttp.HandlerFunc(func(c *simplehttp.Context) {
 			fmt.Println("301 to https: ",
 				c.Request.Url, c.Request.Headers["Host"])
-			c.Response.SetStateLine(c.Request.Version, 301)
-			c.Response.Headers["Location"], _ = url.JoinPath(
-				"https://", c.Request.Headers["Host"], c.Request.Url,
-			)
+			c.Redirect(301, "https://"+c.Request.Headers["Host"]+c.Request.Url)
 		}),
 	}
 	srvHttps := simplehttp.HttpServer{ // static file server
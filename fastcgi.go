@@ -0,0 +1,660 @@
+package simplehttp
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FastCGI record types, roles and flags (FastCGI Specification 8).
+const (
+	fcgiVersion1 = 1
+
+	fcgiBeginRequest = 1
+	fcgiAbortRequest = 2
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+
+	fcgiResponder = 1
+	fcgiKeepConn  = 1
+
+	fcgiMaxContent = 65535
+)
+
+// fcgiMaxBuffered is the max of the FCGI_STDOUT of a request buffered,
+// not yet read by the handler, see fcgiStream.
+const fcgiMaxBuffered = 1 << 20
+
+// region Handler: FastCGI
+
+// FastCGIHandler is a Handler that forwards requests to a FastCGI
+// application server (e.g. PHP-FPM) listening on the network address,
+// "tcp" or "unix", as a FastCGI client:
+//
+//	r.GET("/", FastCGIHandler("unix", "/run/php/php-fpm.sock",
+//		WithFastCGIRoot("/var/www/html"), WithFastCGISplitPath(".php")))
+//
+// The request data are sent as the CGI meta-variables (see CGIHandler)
+// in FCGI_PARAMS, the body in FCGI_STDIN; the FCGI_STDOUT of the
+// application is streamed back as the CGI response, and FCGI_STDERR goes
+// to the stderr of the server.
+//
+// The connections to the application are kept alive and pooled, and
+// multiplexed if WithFastCGIPool allows (PHP-FPM does not multiplex).
+func FastCGIHandler(network string, address string, options ...FastCGIOption) HandlerFunc {
+	h := &fastCGIHandler{
+		network:     network,
+		address:     address,
+		timeout:     CGITimeout,
+		maxConns:    16,
+		maxRequests: 1,
+		dialed:      make(chan struct{}),
+	}
+	for _, option := range options {
+		option(h)
+	}
+	h.slots = make(chan struct{}, h.maxConns*h.maxRequests)
+	return h.serve
+}
+
+// fastCGIHandler is the FastCGIHandler.
+type fastCGIHandler struct {
+	network string
+	address string
+
+	root      string   // DOCUMENT_ROOT
+	splitPath string   // the extension splitting SCRIPT_NAME and PATH_INFO
+	env       []string // extra params
+	timeout   time.Duration
+
+	maxConns    int // max conns to the application
+	maxRequests int // max concurrent requests per conn
+
+	mu      sync.Mutex
+	conns   []*fcgiConn
+	dialing int           // conns being dialed
+	dialed  chan struct{} // closed (and renewed) when a dial is done
+	slots   chan struct{} // a slot per request in flight, or aborted but not ended
+}
+
+// FastCGIOption configures a FastCGIHandler.
+type FastCGIOption func(h *fastCGIHandler)
+
+// WithFastCGIRoot sets the document root of the application: the
+// DOCUMENT_ROOT param, and the SCRIPT_FILENAME param as the root joined
+// with the SCRIPT_NAME.
+func WithFastCGIRoot(root string) FastCGIOption {
+	return func(h *fastCGIHandler) {
+		h.root = root
+	}
+}
+
+// WithFastCGISplitPath splits the request path after the first extension
+// ext, e.g. ".php", into the SCRIPT_NAME and PATH_INFO params:
+//
+//	/index.php/a/b => SCRIPT_NAME=/index.php PATH_INFO=/a/b
+//
+// By default the whole path is the SCRIPT_NAME.
+func WithFastCGISplitPath(ext string) FastCGIOption {
+	return func(h *fastCGIHandler) {
+		h.splitPath = ext
+	}
+}
+
+// WithFastCGIEnv adds params ("KEY=value") to the requests, replacing
+// the default ones, e.g. "SCRIPT_FILENAME=/var/www/index.php" for a
+// front controller.
+func WithFastCGIEnv(env ...string) FastCGIOption {
+	return func(h *fastCGIHandler) {
+		h.env = append(h.env, env...)
+	}
+}
+
+// WithFastCGITimeout sets the time limit to wait for the response
+// headers from the application, zero for no limit.
+func WithFastCGITimeout(timeout time.Duration) FastCGIOption {
+	return func(h *fastCGIHandler) {
+		h.timeout = timeout
+	}
+}
+
+// WithFastCGIPool sets the max number of conns to the application
+// (16 by default), and the max number of concurrent requests multiplexed
+// on a conn (1 by default, i.e. no multiplexing), if the application
+// supports (FCGI_MPXS_CONNS). A multiplexed request fails if its output
+// outruns the client by fcgiMaxBuffered, not to block the others.
+func WithFastCGIPool(maxConns int, maxRequestsPerConn int) FastCGIOption {
+	return func(h *fastCGIHandler) {
+		h.maxConns = max1(maxConns)
+		h.maxRequests = max1(maxRequestsPerConn)
+	}
+}
+
+// max1 returns n, or 1 if n < 1.
+func max1(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// serve is the HandlerFunc of the FastCGIHandler.
+func (h *fastCGIHandler) serve(c *Context) {
+	ctx := c.Ctx() // cancelled when the client disconnects
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+
+	params, err := h.params(c)
+	if err != nil {
+		c.ResponseText(400, "Bad Request")
+		return
+	}
+
+	req, err := h.roundTrip(ctx, params, c.Request.Body)
+	if err != nil {
+		h.fail(c, ctx, err)
+		return
+	}
+
+	// abort waiting for the response headers when ctx is done
+	headersRead := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			req.stdout.finish(ctx.Err())
+		case <-headersRead:
+		}
+	}()
+	stdout := bufio.NewReader(&req.stdout)
+	localRedirect, contentLength, err := readCGIHeaders(c, stdout)
+	close(headersRead)
+	if err != nil {
+		_ = req.Close()
+		c.Response.Headers = make(map[string]string)
+		h.fail(c, ctx, err)
+		return
+	}
+	if localRedirect != "" {
+		_ = req.Close()
+		c.Response.Headers = make(map[string]string)
+		c.redirect(302, localRedirect)
+		return
+	}
+
+	// stream the body, the request is released after read (or aborted)
+	c.Response.SetBodyReader(readCloser{stdout, req}, contentLength)
+}
+
+// fail makes the error response of the err of a request.
+func (h *fastCGIHandler) fail(c *Context, ctx context.Context, err error) {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		c.ResponseText(504, "Gateway Timeout")
+	case ctx.Err() != nil: // client disconnected, nobody cares
+		c.ResponseText(503, "Service Unavailable")
+	default:
+		_, _ = fmt.Fprintf(os.Stderr, "FastCGI %s %s: %v\n", h.network, h.address, err)
+		c.ResponseText(502, "Bad Gateway")
+	}
+}
+
+// params returns the FCGI_PARAMS of the request to the c.
+func (h *fastCGIHandler) params(c *Context) (map[string]string, error) {
+	rawPath, rawQuery, _ := strings.Cut(c.Request.Url, "?")
+	rawPath, _, _ = strings.Cut(rawPath, "#")
+	urlPath, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return nil, err
+	}
+	// cleaned as rooted, not to climb out of the root, nor by a "..\"
+	// of the escaped backslash either on Windows
+	cleaned := path.Clean("/" + urlPath)
+	if strings.HasSuffix(urlPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	for _, segment := range strings.FieldsFunc(cleaned, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == ".." {
+			return nil, errors.New("fastcgi: bad path " + rawPath)
+		}
+	}
+	urlPath = cleaned
+
+	scriptName, pathInfo := urlPath, ""
+	if h.splitPath != "" {
+		if i := strings.Index(urlPath, h.splitPath+"/"); i >= 0 {
+			scriptName, pathInfo = urlPath[:i+len(h.splitPath)], urlPath[i+len(h.splitPath):]
+		}
+	}
+
+	env := cgiEnv(c, scriptName, pathInfo, rawQuery)
+	if h.root != "" {
+		env = append(env,
+			"DOCUMENT_ROOT="+h.root,
+			"SCRIPT_FILENAME="+filepath.Join(h.root, filepath.FromSlash(scriptName)),
+		)
+	}
+	env = append(env, h.env...)
+
+	params := make(map[string]string, len(env))
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		params[k] = v
+	}
+	return params, nil
+}
+
+// roundTrip sends a request of the params and stdin to the application,
+// on a pooled conn, and returns the request to read the stdout from.
+func (h *fastCGIHandler) roundTrip(ctx context.Context, params map[string]string, stdin io.Reader) (*fcgiRequest, error) {
+	select {
+	case h.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	req, err := h.newRequest(ctx)
+	if err != nil {
+		<-h.slots
+		return nil, err
+	}
+
+	if err = req.send(params, stdin); err != nil {
+		req.conn.close(err)
+		_ = req.Close()
+		return nil, err
+	}
+	return req, nil
+}
+
+// newRequest starts a request on a conn with a free slot, dialing a new
+// one if none, without holding h.mu. A slot of h.slots must be taken.
+func (h *fastCGIHandler) newRequest(ctx context.Context) (*fcgiRequest, error) {
+	h.mu.Lock()
+	for {
+		conns := h.conns[:0] // drop the broken conns
+		for _, conn := range h.conns {
+			if !conn.isBroken() {
+				conns = append(conns, conn)
+			}
+		}
+		h.conns = conns
+
+		for _, conn := range h.conns {
+			if req := conn.newRequest(h.maxRequests); req != nil {
+				h.mu.Unlock()
+				return req, nil
+			}
+		}
+		// all conns are busy: there must be less than maxConns by the
+		// slots, unless some are being dialed, which may have room then
+		if len(h.conns)+h.dialing < h.maxConns {
+			break
+		}
+		dialed := h.dialed
+		h.mu.Unlock()
+		select {
+		case <-dialed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		h.mu.Lock()
+	}
+	h.dialing++
+	h.mu.Unlock()
+
+	dialer := net.Dialer{}
+	netConn, err := dialer.DialContext(ctx, h.network, h.address)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dialing--
+	close(h.dialed)
+	h.dialed = make(chan struct{})
+	if err != nil {
+		return nil, err
+	}
+	conn := newFCGIConn(netConn, h.slots)
+	h.conns = append(h.conns, conn)
+	return conn.newRequest(h.maxRequests), nil
+}
+
+// fcgiConn is a conn to the FastCGI application, multiplexing requests.
+type fcgiConn struct {
+	conn  net.Conn
+	slots chan struct{} // of the handler, released with requests removed
+
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	requests map[uint16]*fcgiRequest // in flight, or aborted but not ended
+	nextID   uint16
+	err      error // the conn is broken if not nil
+}
+
+// newFCGIConn makes a fcgiConn of conn, and starts reading it.
+func newFCGIConn(conn net.Conn, slots chan struct{}) *fcgiConn {
+	fc := &fcgiConn{
+		conn:     conn,
+		slots:    slots,
+		requests: make(map[uint16]*fcgiRequest),
+	}
+	go fc.readLoop()
+	return fc
+}
+
+// newRequest allocates a request on the conn, or returns nil if the conn
+// has maxRequests already, including the aborted ones not yet ended by
+// the application, or is broken.
+func (fc *fcgiConn) newRequest(maxRequests int) *fcgiRequest {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if fc.err != nil || len(fc.requests) >= maxRequests || len(fc.requests) >= math.MaxUint16 {
+		return nil
+	}
+	for {
+		fc.nextID++
+		if _, used := fc.requests[fc.nextID]; fc.nextID != 0 && !used {
+			break
+		}
+	}
+	req := &fcgiRequest{id: fc.nextID, conn: fc}
+	req.stdout.cond = sync.NewCond(&req.stdout.mu)
+	req.stdout.wait = maxRequests == 1
+	fc.requests[req.id] = req
+	return req
+}
+
+// removeLocked removes the request released, and ended or failed by the
+// broken conn, releasing its slot. fc.mu is held.
+func (fc *fcgiConn) removeLocked(req *fcgiRequest) {
+	delete(fc.requests, req.id)
+	<-fc.slots
+}
+
+// isBroken reports whether the conn can not be used any more.
+func (fc *fcgiConn) isBroken() bool {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.err != nil
+}
+
+// close breaks the conn with the err, failing the requests in flight.
+func (fc *fcgiConn) close(err error) {
+	fc.mu.Lock()
+	if fc.err == nil {
+		fc.err = err
+	}
+	requests := make([]*fcgiRequest, 0, len(fc.requests))
+	for _, req := range fc.requests {
+		if req.released { // aborted, won't be ended
+			fc.removeLocked(req)
+		} else {
+			requests = append(requests, req)
+		}
+	}
+	fc.mu.Unlock()
+
+	_ = fc.conn.Close()
+	for _, req := range requests {
+		req.stdout.finish(err)
+	}
+}
+
+// readLoop reads the records from the application, dispatching them to
+// the requests, until the conn breaks.
+func (fc *fcgiConn) readLoop() {
+	r := bufio.NewReader(fc.conn)
+	for {
+		typ, id, content, err := readFCGIRecord(r)
+		if err != nil {
+			fc.close(fmt.Errorf("read FastCGI record: %w", err))
+			return
+		}
+
+		fc.mu.Lock()
+		req := fc.requests[id]
+		if typ == fcgiEndRequest && req != nil {
+			req.ended = true
+			if req.released {
+				fc.removeLocked(req)
+			}
+		}
+		fc.mu.Unlock()
+		if req == nil {
+			continue
+		}
+
+		switch typ {
+		case fcgiStdout:
+			req.stdout.write(content)
+		case fcgiStderr:
+			_, _ = os.Stderr.Write(content)
+		case fcgiEndRequest:
+			if len(content) >= 5 && content[4] != 0 { // protocolStatus
+				req.stdout.finish(fmt.Errorf("FastCGI request rejected: protocol status %d", content[4]))
+			} else {
+				req.stdout.finish(io.EOF)
+			}
+		}
+	}
+}
+
+// writeRecord writes a record of the content, split if too long, and
+// an empty one if the content is empty (the end of a stream).
+func (fc *fcgiConn) writeRecord(typ uint8, id uint16, content []byte) error {
+	fc.writeMu.Lock()
+	defer fc.writeMu.Unlock()
+
+	for {
+		n := len(content)
+		if n > fcgiMaxContent {
+			n = fcgiMaxContent
+		}
+		padding := -n & 7 // align to 8 bytes
+		header := []byte{fcgiVersion1, typ, byte(id >> 8), byte(id), byte(n >> 8), byte(n), byte(padding), 0}
+		record := append(append(header, content[:n]...), make([]byte, padding)...)
+		if _, err := fc.conn.Write(record); err != nil {
+			return err
+		}
+		content = content[n:]
+		if len(content) == 0 {
+			return nil
+		}
+	}
+}
+
+// readFCGIRecord reads a record from r.
+func readFCGIRecord(r io.Reader) (typ uint8, id uint16, content []byte, err error) {
+	header := make([]byte, 8)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return 0, 0, nil, err
+	}
+	if header[0] != fcgiVersion1 {
+		return 0, 0, nil, fmt.Errorf("unsupported FastCGI version %d", header[0])
+	}
+	typ, id = header[1], binary.BigEndian.Uint16(header[2:4])
+	length, padding := int(binary.BigEndian.Uint16(header[4:6])), int(header[6])
+
+	content = make([]byte, length+padding)
+	if _, err = io.ReadFull(r, content); err != nil {
+		return 0, 0, nil, err
+	}
+	return typ, id, content[:length], nil
+}
+
+// fcgiRequest is a request in flight on a fcgiConn.
+type fcgiRequest struct {
+	id     uint16
+	conn   *fcgiConn
+	stdout fcgiStream
+
+	// guarded by conn.mu
+	ended    bool // FCGI_END_REQUEST received
+	released bool // closed by the handler
+}
+
+// send sends the FCGI_BEGIN_REQUEST, FCGI_PARAMS and FCGI_STDIN of the request.
+func (req *fcgiRequest) send(params map[string]string, stdin io.Reader) error {
+	fc := req.conn
+	begin := []byte{0, fcgiResponder, fcgiKeepConn, 0, 0, 0, 0, 0}
+	if err := fc.writeRecord(fcgiBeginRequest, req.id, begin); err != nil {
+		return err
+	}
+
+	if err := fc.writeRecord(fcgiParams, req.id, encodeFCGIParams(params)); err != nil {
+		return err
+	}
+	if err := fc.writeRecord(fcgiParams, req.id, nil); err != nil {
+		return err
+	}
+
+	if stdin != nil {
+		buf := make([]byte, fcgiMaxContent)
+		for {
+			n, err := stdin.Read(buf)
+			if n > 0 {
+				if err := fc.writeRecord(fcgiStdin, req.id, buf[:n]); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return fc.writeRecord(fcgiStdin, req.id, nil)
+}
+
+// Close releases the request, aborting it (FCGI_ABORT_REQUEST) if the
+// application has not ended it.
+func (req *fcgiRequest) Close() error {
+	fc := req.conn
+	fc.mu.Lock()
+	if req.released {
+		fc.mu.Unlock()
+		return nil
+	}
+	req.released = true
+	ended := req.ended
+	if ended || fc.err != nil {
+		fc.removeLocked(req)
+	}
+	broken := fc.err != nil
+	fc.mu.Unlock()
+
+	req.stdout.finish(errors.New("FastCGI request closed"))
+	if !ended && !broken {
+		// the id is reused after the FCGI_END_REQUEST of the abort
+		if err := fc.writeRecord(fcgiAbortRequest, req.id, nil); err != nil {
+			fc.close(err)
+		}
+	}
+	return nil
+}
+
+// encodeFCGIParams encodes the params as FastCGI name-value pairs.
+func encodeFCGIParams(params map[string]string) []byte {
+	var b []byte
+	appendLength := func(n int) {
+		if n < 128 {
+			b = append(b, byte(n))
+		} else {
+			b = binary.BigEndian.AppendUint32(b, uint32(n)|1<<31)
+		}
+	}
+	for k, v := range params {
+		appendLength(len(k))
+		appendLength(len(v))
+		b = append(append(b, k...), v...)
+	}
+	return b
+}
+
+// fcgiStream is the FCGI_STDOUT of a request, buffered up to the
+// fcgiMaxBuffered unread. Beyond, the readLoop waits for the handler to
+// read it if the request is alone on the conn, or the request fails, so
+// that a slow client never blocks the other requests on the conn.
+type fcgiStream struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	chunks   [][]byte
+	buffered int
+	wait     bool  // for the handler to read, if buffered too much
+	err      error // io.EOF after ended
+}
+
+// write appends a copy of p to the stream.
+func (s *fcgiStream) write(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.wait && s.err == nil && s.buffered >= fcgiMaxBuffered {
+		s.cond.Wait()
+	}
+	if s.err != nil {
+		return
+	}
+	if !s.wait && s.buffered+len(p) > fcgiMaxBuffered {
+		s.err = fmt.Errorf("FastCGI stdout buffered over %d bytes", fcgiMaxBuffered)
+		s.cond.Broadcast()
+		return
+	}
+	s.chunks = append(s.chunks, append([]byte(nil), p...))
+	s.buffered += len(p)
+	s.cond.Broadcast()
+}
+
+// finish ends the stream with err, after the chunks are read.
+func (s *fcgiStream) finish(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+		s.cond.Broadcast()
+	}
+}
+
+// Read reads the stream, blocking until data arrive or it finishes.
+func (s *fcgiStream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.chunks) == 0 && s.err == nil {
+		s.cond.Wait()
+	}
+	if len(s.chunks) == 0 {
+		return 0, s.err
+	}
+	n := copy(p, s.chunks[0])
+	if s.chunks[0] = s.chunks[0][n:]; len(s.chunks[0]) == 0 {
+		s.chunks = s.chunks[1:]
+	}
+	s.buffered -= n
+	s.cond.Broadcast() // the readLoop may wait
+	return n, nil
+}
+
+// endregion Handler: FastCGI
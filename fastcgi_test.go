@@ -0,0 +1,365 @@
+package simplehttp
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testFastCGIPortBase = 23530
+
+// countingListener counts the conns accepted.
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+// testFastCGIResponder serves FastCGI requests on l with a net/http/fcgi
+// responder echoing the request.
+func testFastCGIResponder(t *testing.T, l net.Listener, barrier *sync.WaitGroup) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env := fcgi.ProcessEnv(r)
+		switch path.Base(r.URL.Path) {
+		case "wait": // blocks until all the barrier requests arrive
+			barrier.Done()
+			barrier.Wait()
+		case "slow":
+			time.Sleep(500 * time.Millisecond)
+		case "missing":
+			http.Error(w, "no such page", 404)
+			return
+		case "big":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			_, _ = w.Write([]byte(strings.Repeat("0123456789", 20000)))
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Backend", "fcgi")
+		_, _ = fmt.Fprintf(w, "%s %s\n", r.Method, r.URL.RequestURI())
+		for _, name := range []string{"SCRIPT_FILENAME", "DOCUMENT_ROOT", "CUSTOM"} {
+			_, _ = fmt.Fprintf(w, "%s=%s\n", name, env[name])
+		}
+		_, _ = fmt.Fprintf(w, "header=%s\n", r.Header.Get("X-Custom"))
+		_, _ = fmt.Fprintf(w, "body=%d %s\n", len(body), body[:min1(len(body), 16)])
+	})
+	go func() {
+		_ = fcgi.Serve(l, handler)
+	}()
+	t.Cleanup(func() { _ = l.Close() })
+}
+
+func min1(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func TestFastCGIHandler(t *testing.T) {
+	port := testFastCGIPortBase
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &countingListener{Listener: tcpListener}
+	barrier := &sync.WaitGroup{}
+	testFastCGIResponder(t, backend, barrier)
+
+	socket := filepath.Join(t.TempDir(), "fcgi.sock")
+	unixListener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFastCGIResponder(t, unixListener, barrier)
+
+	// multiplexed: a conn, concurrent requests on it
+	mpxListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpxBackend := &countingListener{Listener: mpxListener}
+	testFastCGIResponder(t, mpxBackend, barrier)
+
+	addr := backend.Addr().String()
+
+	// server
+	go func() {
+		r := NewPrefixRouter("/")
+		r.GET("/app/", FastCGIHandler("tcp", addr,
+			WithFastCGIRoot("/var/www"), WithFastCGISplitPath(".php"), WithFastCGIEnv("CUSTOM=custom")))
+		r.HandleFunc(MethodAny, "/tcp/", FastCGIHandler("tcp", addr))
+		r.GET("/unix/", FastCGIHandler("unix", socket))
+		r.GET("/mpx/", FastCGIHandler("tcp", mpxBackend.Addr().String(), WithFastCGIPool(1, 8)))
+		r.GET("/timeout/", FastCGIHandler("tcp", addr, WithFastCGITimeout(100*time.Millisecond)))
+		r.GET("/down/", FastCGIHandler("tcp", "127.0.0.1:1"))
+
+		s := HttpServer{Handler: r}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	do := func(t *testing.T, method string, path string, body string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, fmt.Sprintf("http://localhost:%d%s", port, path), strings.NewReader(body))
+		req.Header.Set("X-Custom", "custom header")
+		got, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(got.Body)
+		_ = got.Body.Close()
+		return got, string(b)
+	}
+
+	t.Run("params", func(t *testing.T) {
+		got, body := do(t, "GET", "/app/index.php/a/b?x=1", "")
+		if got.StatusCode != 200 || got.Header.Get("X-Backend") != "fcgi" {
+			t.Errorf("expected 200 from the backend, got %d %v", got.StatusCode, got.Header)
+		}
+		expected := "GET /app/index.php/a/b?x=1\n" +
+			"SCRIPT_FILENAME=" + filepath.Join("/var/www", "app/index.php") + "\n" +
+			"DOCUMENT_ROOT=/var/www\n" +
+			"CUSTOM=custom\n" +
+			"header=custom header\n" +
+			"body=0 \n"
+		if body != expected {
+			t.Errorf("expected\n%s\ngot\n%s", expected, body)
+		}
+	})
+
+	t.Run("stdin", func(t *testing.T) {
+		long := strings.Repeat("x", 100000) // more than a record
+		_, body := do(t, "POST", "/tcp/post", long)
+		if !strings.Contains(body, "body=100000 xxxxxxxxxxxxxxxx\n") {
+			t.Errorf("expected the body echoed, got\n%s", body)
+		}
+	})
+
+	t.Run("stdout", func(t *testing.T) {
+		got, body := do(t, "GET", "/tcp/big", "")
+		if got.StatusCode != 200 || body != strings.Repeat("0123456789", 20000) {
+			t.Errorf("expected 200 with 200000 bytes, got %d with %d bytes", got.StatusCode, len(body))
+		}
+	})
+
+	t.Run("status", func(t *testing.T) {
+		got, body := do(t, "GET", "/tcp/missing", "")
+		if got.StatusCode != 404 || body != "no such page\n" {
+			t.Errorf("expected 404 no such page, got %d %q", got.StatusCode, body)
+		}
+	})
+
+	t.Run("keepAlive", func(t *testing.T) {
+		before := atomic.LoadInt32(&backend.accepted)
+		for i := 0; i < 5; i++ {
+			do(t, "GET", "/tcp/keep", "")
+		}
+		if accepted := atomic.LoadInt32(&backend.accepted) - before; accepted != 0 {
+			t.Errorf("expected the pooled conn reused, got %d new conns", accepted)
+		}
+	})
+
+	t.Run("unix", func(t *testing.T) {
+		got, body := do(t, "GET", "/unix/path", "")
+		if got.StatusCode != 200 || !strings.HasPrefix(body, "GET /unix/path\n") {
+			t.Errorf("expected 200 from the unix backend, got %d %q", got.StatusCode, body)
+		}
+	})
+
+	t.Run("multiplex", func(t *testing.T) {
+		const n = 5
+		barrier.Add(n)
+		wg := sync.WaitGroup{}
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if got, _ := do(t, "GET", "/mpx/wait", ""); got.StatusCode != 200 {
+					t.Errorf("expected status code 200, got %d", got.StatusCode)
+				}
+			}()
+		}
+		wg.Wait()
+		if accepted := atomic.LoadInt32(&mpxBackend.accepted); accepted != 1 {
+			t.Errorf("expected the requests multiplexed on 1 conn, got %d conns", accepted)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		got, _ := do(t, "GET", "/timeout/slow", "")
+		if got.StatusCode != 504 {
+			t.Errorf("expected status code 504, got %d", got.StatusCode)
+		}
+		// the aborted request does not break the pool
+		got, _ = do(t, "GET", "/timeout/fast", "")
+		if got.StatusCode != 200 {
+			t.Errorf("expected status code 200, got %d", got.StatusCode)
+		}
+	})
+
+	t.Run("down", func(t *testing.T) {
+		got, _ := do(t, "GET", "/down/", "")
+		if got.StatusCode != 502 {
+			t.Errorf("expected status code 502, got %d", got.StatusCode)
+		}
+	})
+}
+
+func TestFastCGIParams(t *testing.T) {
+	cases := []struct {
+		name               string
+		splitPath          string
+		url                string
+		expectedScriptName string
+		expectedPathInfo   string
+		expectedQuery      string
+	}{
+		{"split", ".php", "/app/index.php/a/b?x=1", "/app/index.php", "/a/b", "x=1"},
+		{"script", ".php", "/index.php", "/index.php", "", ""},
+		{"noSplit", "", "/app/index.php/a/b", "/app/index.php/a/b", "", ""},
+		{"escaped", ".php", "/a%20b.php/c%2Fd", "/a b.php", "/c/d", ""},
+		{"traversal", ".php", "/%2e%2e/%2e%2e/tmp/evil.php/x", "/tmp/evil.php", "/x", ""},
+		{"dotSegments", ".php", "/app/./b/../index.php/a//b/", "/app/index.php", "/a/b/", ""},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &fastCGIHandler{root: "/var/www", splitPath: tt.splitPath}
+			req := NewRequest()
+			req.Method, req.Url, req.Version = "GET", tt.url, "HTTP/1.1"
+			req.Headers["Host"] = "localhost"
+			params, err := h.params(NewContext(req, NewResponse()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if params["SCRIPT_NAME"] != tt.expectedScriptName || params["PATH_INFO"] != tt.expectedPathInfo {
+				t.Errorf("expected SCRIPT_NAME=%q PATH_INFO=%q, got %q %q",
+					tt.expectedScriptName, tt.expectedPathInfo, params["SCRIPT_NAME"], params["PATH_INFO"])
+			}
+			if params["QUERY_STRING"] != tt.expectedQuery {
+				t.Errorf("expected QUERY_STRING=%q, got %q", tt.expectedQuery, params["QUERY_STRING"])
+			}
+			expected := filepath.Join("/var/www", filepath.FromSlash(tt.expectedScriptName))
+			if params["SCRIPT_FILENAME"] != expected {
+				t.Errorf("expected SCRIPT_FILENAME=%q, got %q", expected, params["SCRIPT_FILENAME"])
+			}
+		})
+	}
+}
+
+func TestFastCGIParamsTraversal(t *testing.T) {
+	h := &fastCGIHandler{root: "/var/www", splitPath: ".php"}
+	for _, url := range []string{"/..%5c..%5ctmp/evil.php", "/a/..%5C..%5C..%5Cevil.php/x"} {
+		req := NewRequest()
+		req.Method, req.Url, req.Version = "GET", url, "HTTP/1.1"
+		if params, err := h.params(NewContext(req, NewResponse())); err == nil {
+			t.Errorf("%s: expected rejected, got SCRIPT_FILENAME=%q", url, params["SCRIPT_FILENAME"])
+		}
+	}
+}
+
+func TestEncodeFCGIParams(t *testing.T) {
+	long := strings.Repeat("v", 200)
+	got := encodeFCGIParams(map[string]string{"K": long})
+	expected := append([]byte{1, 0x80, 0, 0, 200, 'K'}, long...)
+	if string(got) != string(expected) {
+		t.Errorf("expected % x, got % x", expected, got)
+	}
+}
+
+func TestFCGIConnAbortedRequest(t *testing.T) {
+	client, app := net.Pipe()
+	defer app.Close()
+	go func() { _, _ = io.Copy(io.Discard, app) }() // ignoring the abort
+
+	slots := make(chan struct{}, 2)
+	fc := newFCGIConn(client, slots)
+	slots <- struct{}{}
+	req := fc.newRequest(1)
+	_ = req.Close()
+
+	// the aborted request is still on the conn, until ended
+	if fc.newRequest(1) != nil || len(slots) != 1 {
+		t.Fatalf("expected the conn busy with the aborted request, got %d slots taken", len(slots))
+	}
+	end := []byte{fcgiVersion1, fcgiEndRequest, byte(req.id >> 8), byte(req.id), 0, 8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	if _, err := app.Write(end); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && len(slots) != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(slots) != 0 {
+		t.Fatal("expected the slot released once ended")
+	}
+	slots <- struct{}{}
+	if fc.newRequest(1) == nil {
+		t.Error("expected the conn free once ended")
+	}
+}
+
+func TestFCGIStreamBuffered(t *testing.T) {
+	chunk := make([]byte, fcgiMaxContent)
+	newStream := func(wait bool) *fcgiStream {
+		s := &fcgiStream{wait: wait}
+		s.cond = sync.NewCond(&s.mu)
+		return s
+	}
+
+	t.Run("wait", func(t *testing.T) { // alone on the conn
+		s := newStream(true)
+		written := make(chan int, 1)
+		go func() {
+			n := 0
+			for ; n < 2*fcgiMaxBuffered; n += len(chunk) {
+				s.write(chunk)
+			}
+			s.finish(io.EOF)
+			written <- n
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+		s.mu.Lock()
+		buffered := s.buffered
+		s.mu.Unlock()
+		if buffered > fcgiMaxBuffered+len(chunk) {
+			t.Errorf("expected no more than %d bytes buffered, got %d", fcgiMaxBuffered+len(chunk), buffered)
+		}
+		n, err := io.Copy(io.Discard, s)
+		if expected := <-written; err != nil || int(n) != expected {
+			t.Errorf("expected %d bytes read, got %d %v", expected, n, err)
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) { // multiplexed
+		s := newStream(false)
+		for n := 0; n < 2*fcgiMaxBuffered; n += len(chunk) {
+			s.write(chunk)
+		}
+		n, err := io.Copy(io.Discard, s)
+		if err == nil || n > fcgiMaxBuffered {
+			t.Errorf("expected an error after no more than %d bytes, got %d %v", fcgiMaxBuffered, n, err)
+		}
+	})
+}
@@ -0,0 +1,330 @@
+package simplehttp
+
+import (
+	"bytes"
+	"container/list"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// region FileServer: cache
+
+// WithFileCache makes the FileServer keep the contents of small files in
+// the cache, with their ETags, MIME types and gzip representations, so
+// that the hot files are served from memory. A cache can be shared by
+// FileServers.
+func WithFileCache(cache *FileCache) FileServerOption {
+	return func(srv *fileServer) {
+		srv.cache = cache
+	}
+}
+
+// FileCache is an LRU cache of file contents for FileServers (see
+// WithFileCache), bounded by the total bytes and the size per file.
+//
+// A cached file is revalidated by its size and mod time (and those of
+// its precompressed .gz sibling) on every hit, or by polling in the
+// background after Watch. The counters are available by Stats for
+// monitoring, e.g.:
+//
+//	cache := NewFileCache(64<<20, 1<<20)
+//	r.GET("/static/", FileServer(root, "/static", WithFileCache(cache)))
+//	r.GET("/debug/filecache", func(c *Context) {
+//		c.ResponseJSON(200, cache.Stats())
+//	})
+type FileCache struct {
+	maxBytes    int64
+	maxFileSize int64
+
+	mu       sync.Mutex
+	lru      *list.List // of *fileCacheEntry, the most recently used first
+	entries  map[fileCacheKey]*list.Element
+	bytes    int64
+	watching int // number of running Watch
+
+	hits, misses, evictions, invalidations int64
+}
+
+// FileCacheStats are the counters of a FileCache.
+type FileCacheStats struct {
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Evictions     int64 `json:"evictions"`     // to fit in the max bytes
+	Invalidations int64 `json:"invalidations"` // the files changed
+	Files         int   `json:"files"`
+	Bytes         int64 `json:"bytes"`
+}
+
+// NewFileCache creates a FileCache of at most maxBytes, caching files
+// (and their gzip representations) of at most maxFileSize bytes.
+func NewFileCache(maxBytes int64, maxFileSize int64) *FileCache {
+	if maxFileSize > maxBytes {
+		maxFileSize = maxBytes
+	}
+	return &FileCache{
+		maxBytes:    maxBytes,
+		maxFileSize: maxFileSize,
+		lru:         list.New(),
+		entries:     make(map[fileCacheKey]*list.Element),
+	}
+}
+
+// Stats returns the current counters of the cache.
+func (fc *FileCache) Stats() FileCacheStats {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return FileCacheStats{
+		Hits:          fc.hits,
+		Misses:        fc.misses,
+		Evictions:     fc.evictions,
+		Invalidations: fc.invalidations,
+		Files:         len(fc.entries),
+		Bytes:         fc.bytes,
+	}
+}
+
+// Watch makes the cache poll the cached files for changes every interval
+// in the background, dropping the changed ones, instead of checking them
+// on every hit: changes are picked up with a delay up to the interval.
+// Call the returned stop to stop polling.
+func (fc *FileCache) Watch(interval time.Duration) (stop func()) {
+	fc.mu.Lock()
+	fc.watching++
+	fc.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				fc.poll()
+			}
+		}
+	}()
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			close(done)
+			fc.mu.Lock()
+			fc.watching--
+			fc.mu.Unlock()
+		})
+	}
+}
+
+// fileCacheKey identifies a cached file: the fs.FS name in a FileServer.
+type fileCacheKey struct {
+	srv  *fileServer
+	name string
+}
+
+// fileCacheEntry is a cached file, with the representations to serve.
+type fileCacheEntry struct {
+	key fileCacheKey
+
+	// to tell whether it's still valid
+	size      int64
+	modTime   time.Time
+	gzModTime time.Time // of the .gz sibling, zero if none
+
+	contentType string
+	data        []byte
+	etag        string
+
+	gzip        []byte // the gzip representation, nil if none
+	gzipModTime time.Time
+	gzipETag    string
+}
+
+// cost is the bytes taken by the entry.
+func (e *fileCacheEntry) cost() int64 {
+	return int64(len(e.data) + len(e.gzip))
+}
+
+// valid reports whether the file is not changed since cached.
+func (e *fileCacheEntry) valid() bool {
+	srv, name := e.key.srv, e.key.name
+	stat, err := fs.Stat(srv.fsys, name)
+	if err != nil || !stat.Mode().IsRegular() {
+		return false
+	}
+	return stat.Size() == e.size && stat.ModTime().Equal(e.modTime) &&
+		gzSiblingModTime(srv, name).Equal(e.gzModTime)
+}
+
+// gzSiblingModTime returns the mod time of the precompressed sibling of
+// the file named name, or the zero time if none.
+func gzSiblingModTime(srv *fileServer, name string) time.Time {
+	if !srv.precompressed {
+		return time.Time{}
+	}
+	stat, err := fs.Stat(srv.fsys, name+".gz")
+	if err != nil {
+		return time.Time{}
+	}
+	return stat.ModTime()
+}
+
+// load returns the cached file named name in the srv, which is read into
+// the cache on a miss, or nil if it can not be cached (too large, not a
+// regular file, ...) to be served from the fsys.
+func (fc *FileCache) load(srv *fileServer, name string) *fileCacheEntry {
+	key := fileCacheKey{srv, name}
+
+	fc.mu.Lock()
+	var entry *fileCacheEntry
+	if elem, ok := fc.entries[key]; ok {
+		entry = elem.Value.(*fileCacheEntry)
+	}
+	watching := fc.watching > 0
+	fc.mu.Unlock()
+
+	if entry != nil {
+		if watching || entry.valid() {
+			fc.mu.Lock()
+			fc.hits++
+			if elem, ok := fc.entries[key]; ok && elem.Value == entry {
+				fc.lru.MoveToFront(elem)
+			}
+			fc.mu.Unlock()
+			return entry
+		}
+
+		fc.mu.Lock()
+		fc.invalidations++
+		fc.remove(entry)
+		fc.mu.Unlock()
+	}
+
+	fc.mu.Lock()
+	fc.misses++
+	fc.mu.Unlock()
+
+	entry = fc.fill(srv, name)
+	if entry == nil {
+		return nil
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if elem, ok := fc.entries[key]; ok { // filled by another request
+		fc.remove(elem.Value.(*fileCacheEntry))
+	}
+	fc.entries[key] = fc.lru.PushFront(entry)
+	fc.bytes += entry.cost()
+	for fc.bytes > fc.maxBytes {
+		fc.remove(fc.lru.Back().Value.(*fileCacheEntry))
+		fc.evictions++
+	}
+	return entry
+}
+
+// fill reads the file named name in the srv, and prepares its
+// representations as serveFile does, or returns nil if it can not be
+// cached.
+func (fc *FileCache) fill(srv *fileServer, name string) *fileCacheEntry {
+	stat, err := fs.Stat(srv.fsys, name)
+	if err != nil || !stat.Mode().IsRegular() || stat.Size() > fc.maxFileSize {
+		return nil
+	}
+	data, err := fs.ReadFile(srv.fsys, name)
+	if err != nil || int64(len(data)) != stat.Size() { // changed when reading
+		return nil
+	}
+
+	entry := &fileCacheEntry{
+		key:         fileCacheKey{srv, name},
+		size:        stat.Size(),
+		modTime:     stat.ModTime(),
+		gzModTime:   gzSiblingModTime(srv, name),
+		contentType: mimeType(name),
+		data:        data,
+		etag:        weakETag(stat),
+	}
+	if entry.contentType == "" {
+		entry.contentType = sniffMimeType(data)
+	}
+	if srv.strongETag || isZeroTime(stat.ModTime()) {
+		entry.etag, _ = contentETag(bytes.NewReader(data))
+	}
+
+	// the gzip representation, as gzipVariant
+	if srv.precompressed && srv.allowed(name+".gz") {
+		if gzStat, err := fs.Stat(srv.fsys, name+".gz"); err == nil && gzStat.Mode().IsRegular() {
+			if gzStat.Size() > fc.maxFileSize {
+				return nil
+			}
+			gz, err := fs.ReadFile(srv.fsys, name+".gz")
+			if err != nil {
+				return nil
+			}
+			gzETag := weakETag(gzStat)
+			if srv.strongETag || isZeroTime(gzStat.ModTime()) {
+				gzETag, _ = contentETag(bytes.NewReader(gz))
+			}
+			entry.gzip, entry.gzipModTime, entry.gzipETag = gz, gzStat.ModTime(), encodedETag(gzETag, "gzip")
+			return entry
+		}
+	}
+	if srv.compress && compressible(entry.contentType) &&
+		stat.Size() >= minCompressSize && stat.Size() <= maxCompressSize {
+		gz, err := gzipBytes(data)
+		if err != nil {
+			return nil
+		}
+		entry.gzip, entry.gzipModTime, entry.gzipETag = gz, stat.ModTime(), encodedETag(entry.etag, "gzip")
+	}
+	return entry
+}
+
+// remove removes the entry from the cache if it's still there.
+// fc.mu must be held.
+func (fc *FileCache) remove(entry *fileCacheEntry) {
+	elem, ok := fc.entries[entry.key]
+	if !ok || elem.Value != entry {
+		return
+	}
+	fc.lru.Remove(elem)
+	delete(fc.entries, entry.key)
+	fc.bytes -= entry.cost()
+}
+
+// poll drops the changed files from the cache.
+func (fc *FileCache) poll() {
+	fc.mu.Lock()
+	entries := make([]*fileCacheEntry, 0, len(fc.entries))
+	for _, elem := range fc.entries {
+		entries = append(entries, elem.Value.(*fileCacheEntry))
+	}
+	fc.mu.Unlock()
+
+	for _, entry := range entries {
+		if !entry.valid() {
+			fc.mu.Lock()
+			fc.invalidations++
+			fc.remove(entry)
+			fc.mu.Unlock()
+		}
+	}
+}
+
+// serveCached writes the cached file to the c, as serveFile does.
+func (srv *fileServer) serveCached(c *Context, entry *fileCacheEntry) {
+	name := entry.key.name
+	f, etag, encoding := newMemFile(name, entry.data, entry.modTime), entry.etag, ""
+	if entry.gzip != nil {
+		c.Response.Headers["Vary"] = "Accept-Encoding"
+		if acceptsEncoding(c.Request.Headers["Accept-Encoding"], "gzip") {
+			f, etag, encoding = newMemFile(name, entry.gzip, entry.gzipModTime), entry.gzipETag, "gzip"
+		}
+	}
+	srv.serveContent(c, f, f, entry.contentType, etag, encoding)
+}
+
+// endregion FileServer: cache
@@ -0,0 +1,181 @@
+package simplehttp
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testFileCachePortBase = 23330
+
+func TestFileCache(t *testing.T) {
+	port := testFileCachePortBase
+
+	root := t.TempDir()
+	writeTestFile(t, filepath.Join(root, "a.txt"), "aaaaaaaaaa")
+	writeTestFile(t, filepath.Join(root, "b.txt"), "bbbbbbbbbb")
+	writeTestFile(t, filepath.Join(root, "big.bin"), strings.Repeat("x", 100))
+	for _, name := range []string{"1.txt", "2.txt", "3.txt"} {
+		writeTestFile(t, filepath.Join(root, name), "0123456789")
+	}
+	writeTestFile(t, filepath.Join(root, "noext"), "<!DOCTYPE html><p>sniffed</p>")
+	style := strings.Repeat("body { color: red; }\n", 20)
+	writeTestFile(t, filepath.Join(root, "gz/style.css"), style)
+
+	cache := NewFileCache(1<<20, 64)
+	lru := NewFileCache(25, 64) // up to 2 files of 10 bytes
+	gzCache := NewFileCache(1<<20, 1<<10)
+
+	// server
+	go func() {
+		r := NewPrefixRouter("/")
+		r.GET("/cache/", FileServer(root, "/cache", WithFileCache(cache)))
+		r.GET("/lru/", FileServer(root, "/lru", WithFileCache(lru)))
+		r.GET("/gz/", FileServer(root, "/", WithFileCache(gzCache), WithCompression()))
+
+		s := HttpServer{Handler: r}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	get := func(t *testing.T, path string, headers map[string]string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d%s", port, path), nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		got, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(got.Body)
+		_ = got.Body.Close()
+		return got, string(b)
+	}
+	expectStats := func(t *testing.T, cache *FileCache, expected FileCacheStats) {
+		t.Helper()
+		if got := cache.Stats(); got != expected {
+			t.Errorf("expected stats %+v, got %+v", expected, got)
+		}
+	}
+
+	t.Run("hitAndMiss", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			got, body := get(t, "/cache/a.txt", nil)
+			if got.StatusCode != 200 || body != "aaaaaaaaaa" {
+				t.Errorf("expected 200 aaaaaaaaaa, got %d %q", got.StatusCode, body)
+			}
+			if got.Header.Get("ETag") == "" || got.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+				t.Errorf("expected ETag and Content-Type, got %v", got.Header)
+			}
+		}
+		expectStats(t, cache, FileCacheStats{Hits: 2, Misses: 1, Files: 1, Bytes: 10})
+
+		got, body := get(t, "/cache/a.txt", map[string]string{"Range": "bytes=2-4"})
+		if got.StatusCode != 206 || body != "aaa" {
+			t.Errorf("expected 206 aaa, got %d %q", got.StatusCode, body)
+		}
+		etag := got.Header.Get("ETag")
+		if got, _ := get(t, "/cache/a.txt", map[string]string{"If-None-Match": etag}); got.StatusCode != 304 {
+			t.Errorf("expected status code 304, got %d", got.StatusCode)
+		}
+
+		got, body = get(t, "/cache/noext", nil)
+		if ct := got.Header.Get("Content-Type"); ct != "text/html; charset=utf-8" || body != "<!DOCTYPE html><p>sniffed</p>" {
+			t.Errorf("expected sniffed text/html, got %q %q", ct, body)
+		}
+	})
+
+	t.Run("tooLarge", func(t *testing.T) {
+		before := cache.Stats()
+		got, body := get(t, "/cache/big.bin", nil)
+		if got.StatusCode != 200 || len(body) != 100 {
+			t.Errorf("expected 200 with 100 bytes, got %d %d", got.StatusCode, len(body))
+		}
+		if after := cache.Stats(); after.Files != before.Files || after.Bytes != before.Bytes {
+			t.Errorf("expected big.bin not cached, got %+v", after)
+		}
+		if got, _ := get(t, "/cache/missing.txt", nil); got.StatusCode != 404 {
+			t.Errorf("expected status code 404, got %d", got.StatusCode)
+		}
+	})
+
+	t.Run("invalidation", func(t *testing.T) {
+		path := filepath.Join(root, "b.txt")
+		if _, body := get(t, "/cache/b.txt", nil); body != "bbbbbbbbbb" {
+			t.Fatalf("expected bbbbbbbbbb, got %q", body)
+		}
+
+		writeTestFile(t, path, "BBBBB")
+		future := time.Now().Add(time.Minute) // make sure mod time changes
+		if err := os.Chtimes(path, future, future); err != nil {
+			t.Fatal(err)
+		}
+		if _, body := get(t, "/cache/b.txt", nil); body != "BBBBB" {
+			t.Errorf("expected BBBBB, got %q", body)
+		}
+		if stats := cache.Stats(); stats.Invalidations != 1 {
+			t.Errorf("expected 1 invalidation, got %+v", stats)
+		}
+	})
+
+	t.Run("lru", func(t *testing.T) {
+		get(t, "/lru/1.txt", nil) // [1]
+		get(t, "/lru/2.txt", nil) // [2 1]
+		get(t, "/lru/1.txt", nil) // [1 2]
+		get(t, "/lru/3.txt", nil) // [3 1 2] => [3 1]
+		get(t, "/lru/1.txt", nil) // [1 3]
+		get(t, "/lru/2.txt", nil) // [2 1 3] => [2 1]
+		expectStats(t, lru, FileCacheStats{Hits: 2, Misses: 4, Evictions: 2, Files: 2, Bytes: 20})
+	})
+
+	t.Run("gzip", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			got, body := get(t, "/gz/style.css", map[string]string{"Accept-Encoding": "gzip"})
+			if got.Header.Get("Content-Encoding") != "gzip" || got.Header.Get("Vary") != "Accept-Encoding" {
+				t.Errorf("expected gzip, got %v", got.Header)
+			}
+			if body != gzipString(t, style) {
+				t.Errorf("expected the gzip of style.css, got %q", body)
+			}
+		}
+		got, body := get(t, "/gz/style.css", nil)
+		if got.Header.Get("Content-Encoding") != "" || body != style {
+			t.Errorf("expected identity, got %v %q", got.Header, body)
+		}
+		stats := gzCache.Stats()
+		if stats.Hits != 2 || stats.Misses != 1 || stats.Bytes <= int64(len(style)) {
+			t.Errorf("expected the gzip representation cached, got %+v", stats)
+		}
+	})
+
+	t.Run("watch", func(t *testing.T) {
+		stop := cache.Watch(100 * time.Millisecond)
+		defer stop()
+
+		before := cache.Stats()
+		path := filepath.Join(root, "a.txt")
+		writeTestFile(t, path, "AAAAAAAAAA") // same size
+		future := time.Now().Add(2 * time.Minute)
+		if err := os.Chtimes(path, future, future); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(300 * time.Millisecond)
+
+		// dropped by polling, without requests
+		if after := cache.Stats(); after.Invalidations != before.Invalidations+1 || after.Files != before.Files-1 {
+			t.Errorf("expected a.txt dropped, got %+v (before %+v)", after, before)
+		}
+		if _, body := get(t, "/cache/a.txt", nil); body != "AAAAAAAAAA" {
+			t.Errorf("expected AAAAAAAAAA, got %q", body)
+		}
+	})
+}
@@ -0,0 +1,452 @@
+package simplehttp
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// forwardProxyMaxOrigins is the max number of origin servers
+	// a ForwardProxy keeps idle conns to.
+	forwardProxyMaxOrigins = 64
+
+	// ProxyIdleTimeout is the default time limit of a ForwardProxy tunnel
+	// without data sent either way.
+	ProxyIdleTimeout = 5 * time.Minute
+)
+
+// errProxyDenied is the error of dialing a destination denied by the
+// rules of a ForwardProxy.
+var errProxyDenied = errors.New("destination denied")
+
+// region Handler: ForwardProxy
+
+// ForwardProxy is a Handler of a forward proxy, for clients configured to
+// use the server as their HTTP proxy:
+//
+//	s := HttpServer{Handler: ForwardProxy(
+//		WithForwardProxyAllow("*:80", "*:443"),
+//		WithForwardProxyDeny("localhost", "127.0.0.0/8", "10.0.0.0/8"),
+//		WithForwardProxyAuth("proxy", func(user, password string) bool {
+//			return user == "alice" && password == "secret"
+//		}),
+//	)}
+//
+// A request in the absolute-form ("GET http://example.com/ HTTP/1.1") is
+// forwarded to the origin server, as ReverseProxy does but without the
+// X-Forwarded-* headers. A CONNECT request ("CONNECT example.com:443
+// HTTP/1.1") establishes a TCP tunnel to the destination by hijacking the
+// conn, e.g. for HTTPS, which is closed when both sides finish, when
+// no data is sent either way for ProxyIdleTimeout, or on Shutdown. The
+// RequestTimeout of the HttpServer does not apply to the tunnel.
+//
+// Other requests are passed to the next handlers if it's used as a
+// middleware (Router.Use), or answered with 400 Bad Request.
+func ForwardProxy(options ...ForwardProxyOption) HandlerFunc {
+	fp := &forwardProxy{
+		timeout:     ProxyTimeout,
+		idleTimeout: ProxyIdleTimeout,
+		origins:     make(map[string]*upstream),
+	}
+	for _, option := range options {
+		option(fp)
+	}
+	return fp.serve
+}
+
+// forwardProxy is the ForwardProxy.
+type forwardProxy struct {
+	allow     []proxyRule
+	deny      []proxyRule
+	realm     string
+	authorize func(user string, password string) bool // nil for no auth
+	timeout   time.Duration
+	// idleTimeout closes a tunnel without data either way, 0 for none
+	idleTimeout time.Duration
+
+	mu      sync.Mutex
+	origins map[string]*upstream // by scheme://host:port
+}
+
+// ForwardProxyOption configures a ForwardProxy.
+type ForwardProxyOption func(fp *forwardProxy)
+
+// WithForwardProxyAllow only allows the destinations matching any of the
+// patterns:
+//
+//	"example.com"        the host, any port
+//	"example.com:443"    the host and port
+//	"*.example.com"      the subdomains of example.com
+//	"*:443"              any host, the port
+//	"10.0.0.0/8"         the IP addresses in the CIDR, any port
+//	"10.0.0.1"           the IP address, any port
+//
+// The IP patterns are matched against the addresses the host names
+// resolve to when connecting, as well as IP hosts.
+func WithForwardProxyAllow(patterns ...string) ForwardProxyOption {
+	return func(fp *forwardProxy) {
+		for _, pattern := range patterns {
+			fp.allow = append(fp.allow, parseProxyRule(pattern))
+		}
+	}
+}
+
+// WithForwardProxyDeny denies the destinations matching any of the
+// patterns (see WithForwardProxyAllow), over the allowed ones, e.g. the
+// internal networks.
+func WithForwardProxyDeny(patterns ...string) ForwardProxyOption {
+	return func(fp *forwardProxy) {
+		for _, pattern := range patterns {
+			fp.deny = append(fp.deny, parseProxyRule(pattern))
+		}
+	}
+}
+
+// WithForwardProxyAuth requires the Basic authentication of the clients
+// (the Proxy-Authorization header), checked by authorize, answering
+// 407 Proxy Authentication Required for the realm otherwise.
+func WithForwardProxyAuth(realm string, authorize func(user string, password string) bool) ForwardProxyOption {
+	return func(fp *forwardProxy) {
+		fp.realm = realm
+		fp.authorize = authorize
+	}
+}
+
+// WithForwardProxyTimeout sets the time limit to connect to the
+// destination, and for forwarded requests, to get the response headers.
+// ProxyTimeout by default, zero for no limit.
+func WithForwardProxyTimeout(timeout time.Duration) ForwardProxyOption {
+	return func(fp *forwardProxy) {
+		fp.timeout = timeout
+	}
+}
+
+// WithForwardProxyIdleTimeout sets the time limit of a CONNECT tunnel
+// without data sent either way, ProxyIdleTimeout by default, zero for
+// no limit.
+func WithForwardProxyIdleTimeout(timeout time.Duration) ForwardProxyOption {
+	return func(fp *forwardProxy) {
+		fp.idleTimeout = timeout
+	}
+}
+
+// serve is the HandlerFunc of the ForwardProxy.
+func (fp *forwardProxy) serve(c *Context) {
+	connect := c.Request.Method == "CONNECT"
+	absolute := strings.HasPrefix(strings.ToLower(c.Request.Url), "http://") ||
+		strings.HasPrefix(strings.ToLower(c.Request.Url), "https://")
+	if !connect && !absolute {
+		if c.currentHandlerIndex+1 < len(c.handlers) { // a middleware
+			c.Next()
+			return
+		}
+		c.ResponseText(400, "Bad Request")
+		return
+	}
+	c.Abort() // not to be routed
+
+	if !fp.authorized(c) {
+		c.ResponseText(407, "Proxy Authentication Required")
+		c.Response.Headers["Proxy-Authenticate"] = fmt.Sprintf("Basic realm=%q", fp.realm)
+		return
+	}
+
+	ctx := c.Ctx() // cancelled when the client disconnects
+	if fp.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, fp.timeout)
+		defer cancel()
+	}
+	if connect {
+		fp.connect(c, ctx)
+	} else {
+		fp.forward(c, ctx)
+	}
+}
+
+// authorized reports whether the Proxy-Authorization of the request to
+// the c is authorized, or no auth is required.
+func (fp *forwardProxy) authorized(c *Context) bool {
+	if fp.authorize == nil {
+		return true
+	}
+	scheme, credentials, _ := strings.Cut(c.Request.Headers["Proxy-Authorization"], " ")
+	if !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return false
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	return ok && fp.authorize(user, password)
+}
+
+// connect establishes the tunnel of the CONNECT request to the c.
+func (fp *forwardProxy) connect(c *Context, ctx context.Context) {
+	host, port, err := net.SplitHostPort(c.Request.Url)
+	if err != nil || host == "" || port == "" {
+		c.ResponseText(400, "Bad Request")
+		return
+	}
+
+	dst, err := fp.dialer(host)(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		fp.fail(c, ctx, err)
+		return
+	}
+	src, err := c.Hijack()
+	if err != nil {
+		_ = dst.Close()
+		c.ResponseText(500, "Internal Server Error")
+		return
+	}
+
+	if _, err := io.WriteString(src, c.Request.Version+" 200 Connection Established\r\n\r\n"); err != nil {
+		_ = src.Close()
+		_ = dst.Close()
+		return
+	}
+	// the conn is the tunnel's now, not bound by the request any more
+	tunnel(c.serverContext(), fp.idleTimeout, src, dst)
+}
+
+// tunnel copies the data between a and b both ways, until both sides
+// finish, ctx is done, or no data is copied either way for idleTimeout
+// (unless zero), then closes them.
+func tunnel(ctx context.Context, idleTimeout time.Duration, a net.Conn, b net.Conn) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		_ = a.Close()
+		_ = b.Close()
+	}()
+
+	var active atomic.Int64 // the UnixNano of the last data copied either way
+	active.Store(time.Now().UnixNano())
+	idle := func() bool {
+		return time.Since(time.Unix(0, active.Load())) >= idleTimeout
+	}
+
+	wg := sync.WaitGroup{}
+	halfCopy := func(dst net.Conn, src net.Conn) {
+		defer wg.Done()
+		buf := make([]byte, 32<<10)
+		for {
+			if idleTimeout > 0 {
+				_ = src.SetReadDeadline(time.Unix(0, active.Load()).Add(idleTimeout))
+			}
+			n, err := src.Read(buf)
+			if n > 0 {
+				active.Store(time.Now().UnixNano())
+				if idleTimeout > 0 {
+					_ = dst.SetWriteDeadline(time.Now().Add(idleTimeout))
+				}
+				if _, err := dst.Write(buf[:n]); err != nil {
+					break
+				}
+			}
+			if err != nil {
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() && idleTimeout > 0 && !idle() {
+					continue // the other way copied data meanwhile
+				}
+				break
+			}
+		}
+		// pass the EOF on, or give up the other way if not supported
+		if cw, ok := dst.(interface{ CloseWrite() error }); !ok || cw.CloseWrite() != nil {
+			_ = dst.Close()
+		}
+	}
+	wg.Add(2)
+	go halfCopy(a, b)
+	go halfCopy(b, a)
+	wg.Wait()
+}
+
+// forward forwards the request in the absolute-form to the c
+// to the origin server.
+func (fp *forwardProxy) forward(c *Context, ctx context.Context) {
+	u, err := url.Parse(c.Request.Url)
+	if err != nil || u.Host == "" {
+		c.ResponseText(400, "Bad Request")
+		return
+	}
+	up, err := fp.upstream(u)
+	if err != nil {
+		c.ResponseText(400, "Bad Request")
+		return
+	}
+
+	req := NewRequest()
+	req.Method = c.Request.Method
+	req.Url = u.RequestURI()
+	req.Version = "HTTP/1.1"
+	req.Body = c.Request.Body
+	for k, v := range c.Request.Headers {
+		req.Headers[k] = v
+	}
+	removeHopHeaders(req.Headers)
+	delete(req.Headers, "Expect") // answered here, as the body is read
+	req.Headers["Host"] = u.Host  // over the Host header (RFC 9112 Section 3.2.2)
+
+	// the body parsed is in memory, so it can be resent on stale conns
+	if buf, ok := req.Body.(*bytes.Buffer); ok {
+		req.Body = bytes.NewReader(buf.Bytes())
+	}
+	resp, err := up.roundTrip(ctx, req, nil)
+	if err != nil {
+		fp.fail(c, ctx, err)
+		return
+	}
+	setUpstreamResponse(c, resp)
+}
+
+// upstream returns the upstream of the origin server of u,
+// keeping the idle conns to it.
+func (fp *forwardProxy) upstream(u *url.URL) (*upstream, error) {
+	origin := strings.ToLower(u.Scheme + "://" + u.Host)
+
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if up, ok := fp.origins[origin]; ok {
+		return up, nil
+	}
+	if len(fp.origins) >= forwardProxyMaxOrigins {
+		for _, up := range fp.origins {
+			up.close()
+		}
+		fp.origins = make(map[string]*upstream)
+	}
+
+	up, err := newUpstream(origin, nil)
+	if err != nil {
+		return nil, err
+	}
+	up.dial = fp.dialer(u.Hostname())
+	fp.origins[origin] = up
+	return up, nil
+}
+
+// dialer returns the dial function to the host, which checks the
+// destination against the rules, with the IP address resolved.
+func (fp *forwardProxy) dialer(host string) func(ctx context.Context, network string, address string) (net.Conn, error) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	d := &net.Dialer{
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			ip, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if !fp.allowed(host, port, net.ParseIP(ip)) {
+				return errProxyDenied
+			}
+			return nil
+		},
+	}
+	return d.DialContext
+}
+
+// allowed reports whether the destination host:port, at the ip, is
+// allowed by the rules.
+func (fp *forwardProxy) allowed(host string, port string, ip net.IP) bool {
+	for _, rule := range fp.deny {
+		if rule.match(host, port, ip) {
+			return false
+		}
+	}
+	if len(fp.allow) == 0 {
+		return true
+	}
+	for _, rule := range fp.allow {
+		if rule.match(host, port, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// fail makes the error response of the err of connecting or forwarding
+// a request.
+func (fp *forwardProxy) fail(c *Context, ctx context.Context, err error) {
+	switch {
+	case errors.Is(err, errProxyDenied):
+		c.ResponseText(403, "Forbidden")
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		c.ResponseText(504, "Gateway Timeout")
+	case ctx.Err() != nil: // client disconnected, nobody cares
+		c.ResponseText(503, "Service Unavailable")
+	default:
+		_, _ = fmt.Fprintf(os.Stderr, "ForwardProxy %s: %v\n", c.Request.Url, err)
+		c.ResponseText(502, "Bad Gateway")
+	}
+}
+
+// proxyRule is a destination pattern of WithForwardProxyAllow and
+// WithForwardProxyDeny.
+type proxyRule struct {
+	host    string     // "" for any, "*.example.com" for the subdomains
+	port    string     // "" for any
+	network *net.IPNet // matched instead of the host if not nil
+}
+
+// parseProxyRule parses the pattern of a proxyRule.
+func parseProxyRule(pattern string) proxyRule {
+	if _, network, err := net.ParseCIDR(pattern); err == nil {
+		return proxyRule{network: network}
+	}
+
+	host, port, err := net.SplitHostPort(pattern)
+	if err != nil { // no port
+		host, port = pattern, ""
+	}
+	rule := proxyRule{host: strings.TrimSuffix(strings.ToLower(host), "."), port: port}
+	if rule.host == "*" {
+		rule.host = ""
+	}
+	if ip := net.ParseIP(rule.host); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		rule.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	return rule
+}
+
+// match reports whether the destination host:port, at the ip (nil if
+// unknown), matches the rule.
+func (r proxyRule) match(host string, port string, ip net.IP) bool {
+	if r.port != "" && r.port != port {
+		return false
+	}
+	switch {
+	case r.network != nil:
+		return ip != nil && r.network.Contains(ip)
+	case r.host == "":
+		return true
+	case strings.HasPrefix(r.host, "*."):
+		return strings.HasSuffix(host, r.host[1:])
+	default:
+		return host == r.host
+	}
+}
+
+// endregion Handler: ForwardProxy
@@ -4,12 +4,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http" // for http.StatusText only
+	"net/url"
 	"os"
 	pathLib "path"
-	"regexp"
+	"path/filepath"
 	"runtime/debug"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -55,40 +59,329 @@ func echoHandler(c *Context) {
 //	GET prefix/dir/index.html
 //	=>  root/dir/index.html
 //
+// The Content-Type is looked up by the file extension (see RegisterMimeType),
+// or sniffed from the contents if the extension is unknown.
+//
+// If the client Accept-Encoding gzip, the precompressed sibling file+".gz"
+// is served instead if exists, with Content-Encoding: gzip.
+//
+// Options are available to enable the directory listing, show hidden files,
+// compress on the fly, serve a single-page application, or change the
+// symlink policy, e.g.:
+//
+//	FileServer(root, "/static", WithDirectoryListing(), WithSymlinkPolicy(SymlinkDeny))
+//
 // [RFC 9110 Section 14]: https://www.rfc-editor.org/rfc/rfc9110#name-range-requests
-func FileServer(root string, prefix string) HandlerFunc {
-	return func(c *Context) {
-		path := strings.TrimPrefix(c.Request.Url, prefix)
-		if strings.HasSuffix(path, "/") {
-			path = pathLib.Join(path, IndexFile)
+func FileServer(root string, prefix string, options ...FileServerOption) HandlerFunc {
+	srv := newFileServer(os.DirFS(root), prefix, options)
+	srv.root = root
+	return srv.serve
+}
+
+// FileServerFS is like FileServer, but serves the contents of the fsys,
+// e.g. an embed.FS, os.DirFS or fstest.MapFS:
+//
+//	//go:embed dist
+//	var dist embed.FS
+//
+//	sub, _ := fs.Sub(dist, "dist")
+//	r.GET("/", FileServerFS(sub, "/"))
+//
+// The SymlinkDeny policy only works for symlinks in directory listings,
+// as fs.FS can not tell whether a file is reached through a symlink.
+func FileServerFS(fsys fs.FS, prefix string, options ...FileServerOption) HandlerFunc {
+	return newFileServer(fsys, prefix, options).serve
+}
+
+// newFileServer creates a fileServer with the options applied.
+func newFileServer(fsys fs.FS, prefix string, options []FileServerOption) *fileServer {
+	srv := &fileServer{
+		fsys:          fsys,
+		prefix:        prefix,
+		precompressed: true,
+	}
+	for _, option := range options {
+		option(srv)
+	}
+	return srv
+}
+
+// fileServer is the FileServer.
+type fileServer struct {
+	fsys   fs.FS
+	root   string // the root dir on disk, empty for FileServerFS
+	prefix string
+
+	listDirectory bool
+	showHidden    bool
+	symlinks      SymlinkPolicy
+	strongETag    bool
+	precompressed bool       // serve the .gz siblings
+	compress      bool       // gzip on the fly
+	spaFallback   string     // the fallback file of WithSPAFallback
+	cache         *FileCache // cache of the file contents, or nil
+
+	etags sync.Map  // name => etagCacheEntry, for strong ETags
+	gzips gzipCache // for WithCompression
+}
+
+// FileServerOption configures a FileServer.
+type FileServerOption func(srv *fileServer)
+
+// WithDirectoryListing makes the FileServer list the contents of
+// directories without an IndexFile (instead of a 403/404), as an HTML
+// table, or a JSON array if the client Accept application/json.
+// See listDir for details.
+func WithDirectoryListing() FileServerOption {
+	return func(srv *fileServer) {
+		srv.listDirectory = true
+	}
+}
+
+// WithHiddenFiles makes the FileServer serve hidden files and directories
+// (whose names start with a dot), and the directory listing show them,
+// e.g. ".well-known". By default they are not found (404), not to leak
+// ".env" or ".git".
+func WithHiddenFiles() FileServerOption {
+	return func(srv *fileServer) {
+		srv.showHidden = true
+	}
+}
+
+// WithSymlinkPolicy sets how the FileServer treats symlinks,
+// SymlinkFollow by default.
+func WithSymlinkPolicy(policy SymlinkPolicy) FileServerOption {
+	return func(srv *fileServer) {
+		srv.symlinks = policy
+	}
+}
+
+// SymlinkPolicy tells the FileServer how to treat symlinks.
+type SymlinkPolicy int
+
+const (
+	// SymlinkFollow serves and lists symlinks as the files they point to.
+	SymlinkFollow SymlinkPolicy = iota
+	// SymlinkHide serves symlinks, but hides them from directory listings.
+	SymlinkHide
+	// SymlinkDeny refuses (404) files accessed through symlinks,
+	// and hides symlinks from directory listings.
+	SymlinkDeny
+)
+
+// serve is the HandlerFunc of the FileServer.
+func (srv *fileServer) serve(c *Context) {
+	name, isDir, rawQuery, err := resolveRequestPath(c.Request.Url, srv.prefix)
+	if err != nil {
+		c.ResponseText(400, "Bad Request")
+		return
+	}
+
+	if !srv.allowed(name) || (!srv.showHidden && isHidden(name)) {
+		c.ResponseText(404, "Not Found")
+		return
+	}
+
+	if srv.listDirectory {
+		if stat, err := fs.Stat(srv.fsys, name); err == nil && stat.IsDir() {
+			if !isDir { // make relative links work
+				location, _, _ := strings.Cut(c.Request.Url, "#")
+				location, _, _ = strings.Cut(location, "?")
+				location += "/"
+				if rawQuery != "" {
+					location += "?" + rawQuery
+				}
+				c.LocalRedirect(301, location)
+				return
+			}
+			if _, err := fs.Stat(srv.fsys, pathLib.Join(name, IndexFile)); err != nil {
+				srv.listDir(c, name, rawQuery)
+				return
+			}
+		}
+	}
+
+	if srv.spaFallback != "" {
+		if fallback := srv.spa(c, name); fallback != name {
+			name, isDir = fallback, false
 		}
-		path = pathLib.Join(root, path)
-		// fmt.Println("FileServer:", path, c.Request)
+	}
+
+	if isDir {
+		name = pathLib.Join(name, IndexFile)
+	}
+	// fmt.Println("FileServer:", name, c.Request)
+
+	srv.serveFile(c, name)
+}
+
+// resolveRequestPath resolves the request url to the fs.FS name of the
+// file to serve, which never leaves the root:
+//
+//   - the query string and fragment are stripped (returned rawQuery);
+//   - the prefix is trimmed;
+//   - the path is percent-decoded, and rejected if containing NUL bytes;
+//   - backslashes are taken as slashes;
+//   - the path is cleaned as a rooted path, so that ".." can not go
+//     above the root, and converted to a fs.FS name by fsName.
+//
+// isDir reports whether the path ends with a slash, including the one
+// of the prefix, e.g. "/static/" for the prefix "/static/".
+func resolveRequestPath(rawURL string, prefix string) (name string, isDir bool, rawQuery string, err error) {
+	path, _, _ := strings.Cut(rawURL, "#")
+	path, rawQuery, _ = strings.Cut(path, "?")
+	isDir = strings.HasSuffix(path, "/")
+	path = strings.TrimPrefix(path, prefix)
+
+	path, err = url.PathUnescape(path)
+	if err != nil {
+		return "", false, "", err
+	}
+	if strings.IndexByte(path, 0) >= 0 {
+		return "", false, "", errors.New("NUL byte in path")
+	}
+	path = strings.ReplaceAll(path, "\\", "/")
+
+	name = fsName(path)
+	if !fs.ValidPath(name) { // should not happen after fsName
+		return "", false, "", errors.New("invalid path")
+	}
+	return name, isDir || strings.HasSuffix(path, "/"), rawQuery, nil
+}
+
+// fsName converts the url path to a fs.FS name:
+//
+//	"/" => "."
+//	"/dir/index.html" => "dir/index.html"
+//	"/../../etc/passwd" => "etc/passwd"
+func fsName(path string) string {
+	name := strings.TrimPrefix(pathLib.Clean("/"+path), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// isHidden reports whether the fs.FS name is, or is in, a hidden file or
+// directory, whose name starts with a dot.
+func isHidden(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if segment != "." && strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether the file named name may be served under the
+// symlink policy: not through a symlink if SymlinkDeny, and never outside
+// the root.
+func (srv *fileServer) allowed(name string) bool {
+	if srv.symlinks == SymlinkDeny && srv.hasSymlink(name) {
+		return false
+	}
+	return srv.withinRoot(name)
+}
 
-		serveFile(c, path)
+// withinRoot reports whether the file named name, with symlinks
+// resolved, is still inside the root dir. Always true for FileServerFS,
+// and for files not exist (which will be 404 anyway).
+func (srv *fileServer) withinRoot(name string) bool {
+	if srv.root == "" {
+		return true
 	}
+
+	root, err := filepath.EvalSymlinks(srv.root)
+	if err != nil {
+		return false
+	}
+	real, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(name)))
+	if err != nil {
+		return true
+	}
+
+	rel, err := filepath.Rel(root, real)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// hasSymlink reports whether any element of the fs.FS name is a symlink.
+// Always false for FileServerFS.
+func (srv *fileServer) hasSymlink(name string) bool {
+	if srv.root == "" {
+		return false
+	}
+
+	current := srv.root
+	for _, elem := range strings.Split(name, "/") {
+		current = pathLib.Join(current, elem)
+		stat, err := os.Lstat(current)
+		if err != nil {
+			return false // not exist: let serveFile say 404
+		}
+		if stat.Mode()&os.ModeSymlink != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// osFS opens files by their OS paths, for serveFile.
+// NOTE: it's not a valid fs.FS that takes only slash-separated,
+// unrooted paths. For internal use only.
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
 }
 
-// serveFile writes the contents of the file to the c,
-// with HTTP/1.1 Range supports.
+// serveFile writes the contents of the file on disk to the c,
+// with HTTP/1.1 Range and conditional requests supports.
 func serveFile(c *Context, path string) {
+	osFileServer.serveFile(c, path)
+}
+
+// osFileServer serves files by their OS paths, for serveFile.
+var osFileServer = &fileServer{fsys: osFS{}}
+
+// serveFile writes the contents of the file named name in the fsys to the c,
+// with HTTP/1.1 Range and conditional requests supports.
+func (srv *fileServer) serveFile(c *Context, name string) {
+	if srv.cache != nil {
+		if entry := srv.cache.load(srv, name); entry != nil {
+			srv.serveCached(c, entry)
+			return
+		}
+	}
+
 	// open file
-	f, err := os.Open(path)
+	f, err := srv.fsys.Open(name)
+	if errors.Is(err, fs.ErrPermission) {
+		c.ResponseText(403, "Forbidden")
+		return
+	}
 	if err != nil {
 		c.ResponseText(404, "Not Found")
 		return
 	}
-	defer f.Close()
+	handedOver := false // f will be closed by serveContent
+	defer func() {
+		if !handedOver {
+			_ = f.Close()
+		}
+	}()
 
 	// get file info
 	stat, err := f.Stat()
-	if errors.Is(err, os.ErrNotExist) {
+	if errors.Is(err, fs.ErrNotExist) {
 		c.ResponseText(404, "Not Found")
 		return
 	}
 
 	// check file stat
-	if errors.Is(err, os.ErrPermission) {
+	if errors.Is(err, fs.ErrPermission) {
 		c.ResponseText(403, "Forbidden")
 		return
 	}
@@ -101,120 +394,214 @@ func serveFile(c *Context, path string) {
 		return
 	}
 
+	// content negotiation: the gzip representation if accepted,
+	// to which the ETag, Last-Modified and Range apply then
+	contentType := mimeType(name)
+	if contentType == "" { // unknown extension: sniff the contents
+		f, contentType, err = srv.sniffFile(f, name)
+		if err != nil {
+			c.ResponseText(500, "Internal Server Error")
+			return
+		}
+	}
+	encoding := ""
+	etag := ""
+	if gz, gzStat, gzETag := srv.gzipVariant(c, name, stat, contentType); gz != nil {
+		_ = f.Close()
+		f, stat, etag, encoding = gz, gzStat, gzETag, "gzip"
+	} else {
+		etag = srv.etag(name, stat)
+	}
+
+	handedOver = true
+	srv.serveContent(c, f, stat, contentType, etag, encoding)
+}
+
+// serveContent writes the representation of a file, f with its stat,
+// content type, ETag and content coding, to the c, with HTTP/1.1 Range
+// and conditional requests supports. f is closed after served.
+func (srv *fileServer) serveContent(c *Context, f fs.File, stat fs.FileInfo, contentType string, etag string, encoding string) {
+	streaming := false // f will be closed after streamed by the Response
+	defer func() {
+		if !streaming {
+			_ = f.Close()
+		}
+	}()
+
+	// conditional requests: 304 Not Modified, 412 Precondition Failed
+	if c.CheckPreconditions(etag, stat.ModTime()) {
+		return
+	}
+
+	c.Response.Headers["Accept-Ranges"] = "bytes"
+
 	// HTTP/1.1 Range support
-	var start, end int64 = 0, stat.Size()
+	var ranges []httpRange
+	var err error
 	rangeHeader, isRange := c.Request.Headers["Range"]
-	if isRange {
-		c.Response.Headers["Accept-Ranges"] = "bytes"
-		s, e, err := parseRange(c, rangeHeader, stat.Size())
-		if err != nil {
+	if isRange && stat.Size() > 0 && c.ifRangeSatisfied(etag, stat.ModTime()) {
+		ranges, err = parseRanges(rangeHeader, stat.Size())
+		if errors.Is(err, errNoOverlap) {
+			c.Response.Headers["Content-Range"] = fmt.Sprintf("bytes */%d", stat.Size())
+			c.ResponseText(416, "Range Not Satisfiable")
 			return
 		}
-		start, end = s, e
+		if err != nil { // an invalid or abusive Range is ignored: send the full file
+			ranges, err = nil, nil
+		}
+		if encoding != "" && len(ranges) > 1 {
+			// a multipart/byteranges body can not be content-coded as a
+			// whole: send the full representation
+			ranges = nil
+		}
+	}
+	if encoding != "" {
+		c.Response.Headers["Content-Encoding"] = encoding
 	}
-	//  else if end-start > 1024*1024 { // 1MB
-	// 	// c.Response.SetStateLine()
-	// 	c.Response.Headers["Accept-Ranges"] = "bytes"
-	// }
 
 	// stop,, 不知道为什么 Safari 要加这个才能正常工作
-	if start == end {
+	if stat.Size() == 0 {
 		c.Response.SetStateLine(c.Request.Version, 200)
-		c.Response.Headers["Content-Type"] = mimeType(path)
+		c.Response.Headers["Content-Type"] = contentType
 		c.Response.Headers["Content-Length"] = "0"
 		return
 	}
 
-	if start < 0 || end > stat.Size() {
-		c.ResponseText(416, "range not satisfiable")
+	// set response headers & response body: file content,
+	// streamed from f to the conn (by sendfile if possible), instead of
+	// being copied into the Response.Body.
+	switch len(ranges) {
+	case 0:
+		c.Response.SetStateLine(c.Request.Version, 200)
+		c.Response.Headers["Content-Type"] = contentType
+		c.Response.SetBodyReader(f, stat.Size())
+		streaming = true
+	case 1:
+		c.Response.SetStateLine(c.Request.Version, 206)
+		c.Response.Headers["Content-Type"] = contentType
+		c.Response.Headers["Content-Range"] = ranges[0].contentRange(stat.Size())
+		if err = seekTo(f, 0, ranges[0].start); err == nil {
+			c.Response.SetBodyReader(f, ranges[0].length)
+			streaming = true
+		}
+	default:
+		c.Response.SetStateLine(c.Request.Version, 206)
+		boundary := multipart.NewWriter(nil).Boundary()
+		c.Response.Headers["Content-Type"] = "multipart/byteranges; boundary=" + boundary
+		if ra, ok := f.(io.ReaderAt); ok {
+			body, length := multipartRangesReader(ra, boundary, contentType, stat.Size(), ranges)
+			c.Response.SetBodyReader(readCloser{body, f}, length)
+			streaming = true
+		} else { // can not read the ranges on demand: buffer them
+			err = writeMultipartRanges(c.Response.Body, f, boundary, contentType, stat.Size(), ranges)
+		}
+	}
+	if err != nil {
+		c.Response.resetBody()
+		c.ResponseText(500, "Internal Server Error")
 		return
 	}
+}
 
-	// set response headers
-	if isRange {
-		c.Response.SetStateLine(c.Request.Version, 206)
-		c.Response.Headers["Content-Range"] = fmt.Sprintf("bytes %d-%d/%d", start, end, stat.Size())
-		c.Response.Headers["Accept-Ranges"] = "bytes"
-	} else {
-		c.Response.SetStateLine(c.Request.Version, 200)
+// sniffFile sniffs the MIME type of the contents of f, the file named
+// name, and returns f rewound to the beginning: by Seek, or reopened if
+// f can not seek (e.g. a file in a zip).
+func (srv *fileServer) sniffFile(f fs.File, name string) (fs.File, string, error) {
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return f, "", err
 	}
+	contentType := sniffMimeType(buf[:n])
 
-	c.Response.Headers["Content-Length"] = fmt.Sprintf("%d", end-start)
-	c.Response.Headers["Content-Type"] = mimeType(path)
-
-	// write response body: file content
-	_, _ = f.Seek(start, io.SeekStart)
-	_, _ = io.CopyN(c.Response.Body, f, end-start)
+	if seeker, ok := f.(io.Seeker); ok {
+		_, err = seeker.Seek(0, io.SeekStart)
+		return f, contentType, err
+	}
+	_ = f.Close()
+	reopened, err := srv.fsys.Open(name)
+	if err != nil {
+		return f, "", err
+	}
+	return reopened, contentType, nil
 }
 
-// parseRange: bytes=0-100
-func parseRange(c *Context, rangeHeader string, fileSize int64) (start, end int64, err error) {
-	rangeRegexp := regexp.MustCompile(`bytes=(\d*)\-(\d*)`)
+// File makes a response with the contents of the file at path,
+// with HTTP/1.1 Range supports, just like FileServer does.
+func (c *Context) File(path string) {
+	serveFile(c, path)
+}
 
-	if !rangeRegexp.MatchString(rangeHeader) {
-		c.ResponseText(400, "bad request")
-		return 0, 0, errors.New("bad request")
+// Attachment is like File, but makes the browser download the file
+// as filename ([RFC 6266]). If filename is empty, the base name of the
+// path is used.
+//
+// [RFC 6266]: https://www.rfc-editor.org/rfc/rfc6266
+func (c *Context) Attachment(path string, filename string) {
+	if filename == "" {
+		filename = pathLib.Base(path)
 	}
+	c.Response.Headers["Content-Disposition"] = contentDisposition("attachment", filename)
 
-	matches := rangeRegexp.FindStringSubmatch(rangeHeader)
-	// fmt.Println(matches)
-	if len(matches) < 3 { // ["bytes=0-1", "0", "1"]
-		c.ResponseText(400, "bad request")
-		return 0, 0, errors.New("bad request")
-	}
+	serveFile(c, path)
 
-	// let's parse end first, and then start, make it easier
-	if matches[2] != "" {
-		end, _ = strconv.ParseInt(matches[2], 10, 64)
-	} else { // bytes=9500-  =>  The final 500 bytes (byte offsets 9500-9999, inclusive)
-		end = fileSize - 1
+	if c.Response.Status >= 300 { // not the file sent
+		delete(c.Response.Headers, "Content-Disposition")
 	}
-	end += 1 // end is exclusive
+}
 
-	if matches[1] != "" {
-		start, _ = strconv.ParseInt(matches[1], 10, 64)
-	} else { // bytes=-500  =>  The final 500 bytes (byte offsets 9500-9999, inclusive)
-		start = fileSize - end
+// contentDisposition makes a Content-Disposition header value (RFC 6266):
+// an ASCII-only filename for old clients, and a UTF-8 filename* (RFC 8187)
+// if the filename is not plain ASCII:
+//
+//	attachment; filename="a.txt"
+//	attachment; filename="__.txt"; filename*=UTF-8''%E6%96%87%E4%BB%B6.txt
+func contentDisposition(disposition string, filename string) string {
+	ascii := strings.Builder{}
+	plain := true
+	for _, r := range filename {
+		switch {
+		case r == '"' || r == '\\':
+			ascii.WriteByte('_')
+			plain = false
+		case r < 0x20 || r == 0x7f: // control characters, esp. CR LF
+			ascii.WriteByte('_')
+			plain = false
+		case r > 0x7f:
+			ascii.WriteByte('_')
+			plain = false
+		default:
+			ascii.WriteRune(r)
+		}
 	}
 
-	return start, end, nil
+	value := fmt.Sprintf("%s; filename=\"%s\"", disposition, ascii.String())
+	if !plain {
+		value += "; filename*=UTF-8''" + rfc8187Escape(filename)
+	}
+	return value
 }
 
-func mimeType(path string) string {
-	switch pathLib.Ext(path) {
-	case ".html", ".htm":
-		return "text/html"
-	case ".css":
-		return "text/css"
-	case ".js":
-		return "application/javascript"
-	case ".json":
-		return "application/json"
-	case ".png":
-		return "image/png"
-	case ".jpg", ".jpeg":
-		return "image/jpeg"
-	case ".gif":
-		return "image/gif"
-	case ".svg":
-		return "image/svg+xml"
-	case ".txt":
-		return "text/plain"
-	case ".mp4":
-		return "video/mp4"
-	default:
-		return "application/octet-stream"
+// rfc8187Escape percent-encodes s except the attr-char of RFC 8187.
+func rfc8187Escape(s string) string {
+	const hex = "0123456789ABCDEF"
+	b := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' ||
+			strings.IndexByte("!#$&+-.^_`|~", ch) >= 0 {
+			b.WriteByte(ch)
+		} else {
+			b.WriteByte('%')
+			b.WriteByte(hex[ch>>4])
+			b.WriteByte(hex[ch&0xf])
+		}
 	}
+	return b.String()
 }
 
 // endregion  Handler: FileServer
 
-// region Handler: CGIServer
-
-// TODO: CGIServer is a Handler
-
-// endregion  Handler: CGIServer
-
 // region Middleware: Recover
 
 // Recovery is a middleware that recovers from panic
@@ -230,6 +617,7 @@ func recovery(c *Context) {
 			c.Response.Version = c.Request.Version // "HTTP/1.0"
 			c.Response.Status = 500
 			c.Response.Reason = "Internal Server Error"
+			c.Response.closeBodyReader() // e.g. a file being served
 			_, _ = c.Response.Body.Write([]byte(
 				fmt.Sprintf("panic: %v", err)))
 		}
@@ -255,3 +643,48 @@ func logger(c *Context) {
 }
 
 // endregion Middleware: Logger
+
+// region Middleware: ErrorHandler
+
+// ErrorHandler is a middleware that turns the errors collected by
+// Context.Error into a JSON response:
+//
+//	{"errors": ["error message", ...]}
+//
+// with the status made by the handlers if it's an error status (>= 400),
+// or 500 otherwise. A non-empty error response made by the handlers is
+// kept as is.
+var ErrorHandler HandlerFunc = errorHandler
+
+func errorHandler(c *Context) {
+	c.Next()
+
+	errs := c.Errors()
+	if len(errs) == 0 {
+		return
+	}
+
+	status := c.Response.Status
+	if status >= 400 && c.Response.Body.Len() > 0 { // handled by the handler
+		return
+	}
+	if status < 400 {
+		status = 500
+	}
+
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		if DebugPanicResponse {
+			messages[i] = err.Error()
+		} else {
+			messages[i] = http.StatusText(status)
+		}
+	}
+
+	c.Response.resetBody()
+	c.ResponseJSON(status, map[string]interface{}{
+		"errors": messages,
+	})
+}
+
+// endregion Middleware: ErrorHandler
@@ -0,0 +1,485 @@
+package simplehttp
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+const testFileServerPortBase = 22730
+
+func TestFileServerDirectoryListing(t *testing.T) {
+	port := testFileServerPortBase
+
+	root := t.TempDir()
+	writeTestFile(t, filepath.Join(root, "dir", "b.txt"), "bb")
+	writeTestFile(t, filepath.Join(root, "dir", "a.txt"), "aaa")
+	writeTestFile(t, filepath.Join(root, "dir", ".secret"), "hidden")
+	writeTestFile(t, filepath.Join(root, ".git", "config"), "hidden")
+	writeTestFile(t, filepath.Join(root, "dir", "sub", "c.txt"), "c")
+	writeTestFile(t, filepath.Join(root, "indexed", "index.html"), "index")
+	writeTestFile(t, filepath.Join(root, "outside.txt"), "outside")
+	if err := os.Symlink(filepath.Join(root, "outside.txt"), filepath.Join(root, "dir", "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	// server
+	go func() {
+		r := NewPrefixRouter("/")
+		r.GET("/list/", FileServer(root, "/list", WithDirectoryListing()))
+		r.GET("/hidden/", FileServer(root, "/hidden", WithDirectoryListing(), WithHiddenFiles()))
+		r.GET("/nolink/", FileServer(root, "/nolink", WithDirectoryListing(), WithSymlinkPolicy(SymlinkDeny)))
+		r.GET("/plain/", FileServer(root, "/plain"))
+
+		s := HttpServer{Handler: r}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	listJSON := func(t *testing.T, path string) []string {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d%s", port, path), nil)
+		req.Header.Set("Accept", "application/json")
+		got, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.StatusCode != 200 {
+			t.Fatalf("expected status code 200, got %d", got.StatusCode)
+		}
+		var entries []dirEntry
+		if err := json.NewDecoder(got.Body).Decode(&entries); err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, len(entries))
+		for i, e := range entries {
+			names[i] = e.Name
+		}
+		return names
+	}
+
+	cases := []struct {
+		name     string
+		path     string
+		expected []string
+	}{
+		{"byName", "/list/dir/", []string{"sub", "a.txt", "b.txt", "link.txt"}},
+		{"byNameDesc", "/list/dir/?sort=name&order=desc", []string{"link.txt", "b.txt", "a.txt", "sub"}},
+		{"bySize", "/list/dir/?sort=size", []string{"b.txt", "a.txt", "link.txt", "sub"}},
+		{"hidden", "/hidden/dir/", []string{"sub", ".secret", "a.txt", "b.txt", "link.txt"}},
+		{"symlinkDeny", "/nolink/dir/", []string{"sub", "a.txt", "b.txt"}},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got := listJSON(t, tt.path)
+			if strings.Join(got, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+
+	t.Run("hiddenRefused", func(t *testing.T) {
+		cases := []struct {
+			path     string
+			expected int
+		}{
+			{"/list/dir/.secret", 404},
+			{"/list/.git/config", 404},
+			{"/list/.git/", 404},
+			{"/list/dir/%2esecret", 404},
+			{"/plain/dir/.secret", 404},
+			{"/hidden/dir/.secret", 200},
+			{"/hidden/.git/config", 200},
+			{"/hidden/.git/", 200},
+		}
+		for _, tt := range cases {
+			got, err := http.Get(fmt.Sprintf("http://localhost:%d%s", port, tt.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = got.Body.Close()
+			if got.StatusCode != tt.expected {
+				t.Errorf("%s: expected status code %d, got %d", tt.path, tt.expected, got.StatusCode)
+			}
+		}
+	})
+
+	t.Run("html", func(t *testing.T) {
+		got, err := http.Get(fmt.Sprintf("http://localhost:%d/list/dir/", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(got.Body)
+		for _, s := range []string{`<a href="./a.txt">a.txt</a>`, `<a href="./sub/">sub/</a>`, `?sort=size&amp;order=asc`} {
+			if !strings.Contains(string(b), s) {
+				t.Errorf("expected %q in the listing, got %s", s, b)
+			}
+		}
+	})
+
+	t.Run("redirectToSlash", func(t *testing.T) {
+		client := &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		got, err := client.Get(fmt.Sprintf("http://localhost:%d/list/dir/sub", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.StatusCode != 301 || got.Header.Get("Location") != "/list/dir/sub/" {
+			t.Errorf("expected 301 to /list/dir/sub/, got %d to %s",
+				got.StatusCode, got.Header.Get("Location"))
+		}
+	})
+	t.Run("redirectRoot", func(t *testing.T) {
+		client := &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		cases := []struct {
+			prefix   string
+			path     string
+			status   int
+			location string
+		}{
+			{"/", "/", 200, ""},
+			{"/", "/dir?sort=size", 301, "/dir/?sort=size"},
+			{"/static/", "/static/", 200, ""},
+			{"/static/", "/static/dir", 301, "/static/dir/"},
+			{"/static", "/static", 301, "/static/"},
+			{"/static", "/static/", 200, ""},
+		}
+		for i, tt := range cases {
+			port, handler := testFileServerPortBase+1+i, FileServer(root, tt.prefix, WithDirectoryListing())
+			go func() {
+				s := HttpServer{Handler: handler}
+				if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+					panic(err)
+				}
+			}()
+			time.Sleep(100 * time.Millisecond)
+
+			got, err := client.Get(fmt.Sprintf("http://localhost:%d%s", port, tt.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = got.Body.Close()
+			if got.StatusCode != tt.status || got.Header.Get("Location") != tt.location {
+				t.Errorf("%s %s: expected %d to %q, got %d to %q", tt.prefix, tt.path,
+					tt.status, tt.location, got.StatusCode, got.Header.Get("Location"))
+			}
+		}
+	})
+	t.Run("index", func(t *testing.T) {
+		testRouter(t, port, "GET", "/list/indexed/", 200, "index")
+	})
+	t.Run("symlinkDenyFile", func(t *testing.T) {
+		testRouter(t, port, "GET", "/nolink/dir/link.txt", 404, "Not Found")
+	})
+	t.Run("symlinkFollowFile", func(t *testing.T) {
+		testRouter(t, port, "GET", "/list/dir/link.txt", 200, "outside")
+	})
+	t.Run("noListing", func(t *testing.T) {
+		testRouter(t, port, "GET", "/plain/dir/", 404, "Not Found")
+	})
+}
+
+//go:embed testdata/static
+var testEmbedFS embed.FS
+
+func TestFileServerFS(t *testing.T) {
+	port := testFileServerPortBase + 10
+
+	mapFS := fstest.MapFS{
+		"index.html":     {Data: []byte("map index"), ModTime: time.Now()},
+		"css/style.css":  {Data: []byte("body{}"), ModTime: time.Now()},
+		"data/0123.bin":  {Data: []byte("0123456789"), ModTime: time.Now()},
+		"data/empty.txt": {Data: []byte{}, ModTime: time.Now()},
+	}
+
+	zipBuf := &bytes.Buffer{}
+	zw := zip.NewWriter(zipBuf)
+	w, _ := zw.Create("zipped/0123.txt")
+	_, _ = w.Write([]byte("0123456789"))
+	_ = zw.Close()
+	zipFS, err := zip.NewReader(bytes.NewReader(zipBuf.Bytes()), int64(zipBuf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	embedFS, err := fs.Sub(testEmbedFS, "testdata/static")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// server
+	go func() {
+		r := NewPrefixRouter("/")
+		r.GET("/map/", FileServerFS(mapFS, "/map", WithDirectoryListing()))
+		r.GET("/zip/", FileServerFS(zipFS, "/zip"))
+		r.GET("/embed/", FileServerFS(embedFS, "/embed"))
+		r.GET("/dir/", FileServerFS(os.DirFS("testdata/static"), "/dir"))
+
+		s := HttpServer{Handler: r}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			panic(err)
+		}
+	}()
+
+	cases := []struct {
+		path                string
+		rangeHeader         string
+		expectedStatus      int
+		expectedBody        string
+		expectedContentType string
+	}{
+		{"/map/", "", 200, "map index", "text/html; charset=utf-8"},
+		{"/map/css/style.css", "", 200, "body{}", "text/css; charset=utf-8"},
+		{"/map/data/0123.bin", "bytes=2-4", 206, "234", "application/octet-stream"},
+		{"/map/data/empty.txt", "", 200, "", "text/plain; charset=utf-8"},
+		{"/map/missing", "", 404, "Not Found", "text/plain; charset=utf-8"},
+		{"/map/../index.html", "", 200, "map index", "text/html; charset=utf-8"},
+
+		{"/zip/zipped/0123.txt", "", 200, "0123456789", "text/plain; charset=utf-8"},
+		{"/zip/zipped/0123.txt", "bytes=5-", 206, "56789", "text/plain; charset=utf-8"},
+
+		{"/embed/", "", 200, "embedded index", "text/html; charset=utf-8"},
+		{"/embed/sub/hello.txt", "bytes=0-4", 206, "hello", "text/plain; charset=utf-8"},
+		{"/embed/sub/", "", 404, "Not Found", "text/plain; charset=utf-8"},
+
+		{"/dir/sub/hello.txt", "", 200, "hello, embed", "text/plain; charset=utf-8"},
+	}
+
+	time.Sleep(1 * time.Second)
+
+	for _, tt := range cases {
+		t.Run(tt.path+" "+tt.rangeHeader, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d%s", port, tt.path), nil)
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			got, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.StatusCode != tt.expectedStatus {
+				t.Errorf("expected status code %d, got %d", tt.expectedStatus, got.StatusCode)
+			}
+			b, _ := io.ReadAll(got.Body)
+			if string(b) != tt.expectedBody {
+				t.Errorf("expected %q, got %q", tt.expectedBody, b)
+			}
+			if ct := got.Header.Get("Content-Type"); ct != tt.expectedContentType {
+				t.Errorf("expected Content-Type %q, got %q", tt.expectedContentType, ct)
+			}
+		})
+	}
+}
+
+func TestFileServerPathTraversal(t *testing.T) {
+	port := testFileServerPortBase + 20
+
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	writeTestFile(t, filepath.Join(root, "public.txt"), "public")
+	writeTestFile(t, filepath.Join(root, "a b", "c.txt"), "spaced")
+	writeTestFile(t, filepath.Join(base, "secret.txt"), "secret")
+	writeTestFile(t, filepath.Join(base, "secretdir", "s.txt"), "secret")
+	if err := os.Symlink(filepath.Join(base, "secret.txt"), filepath.Join(root, "escape.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(base, "secretdir"), filepath.Join(root, "escapedir")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "public.txt"), filepath.Join(root, "inside.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	// server
+	go func() {
+		r := NewPrefixRouter("/")
+		r.GET("/static/", FileServer(root, "/static"))
+
+		s := HttpServer{Handler: r}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			panic(err)
+		}
+	}()
+
+	cases := []struct {
+		path           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"/static/public.txt", 200, "public"},
+		{"/static/public.txt?v=1", 200, "public"},
+		{"/static/public.txt#top", 200, "public"},
+		{"/static/a%20b/c.txt", 200, "spaced"},
+		{"/static/inside.txt", 200, "public"},
+
+		{"/static/../secret.txt", 404, "Not Found"},
+		{"/static/%2e%2e/secret.txt", 404, "Not Found"},
+		{"/static/%2e%2e%2fsecret.txt", 404, "Not Found"},
+		{"/static/..%5csecret.txt", 404, "Not Found"},
+		{"/static/..\\secret.txt", 404, "Not Found"},
+		{"/static/escape.txt", 404, "Not Found"},
+		{"/static/escapedir/s.txt", 404, "Not Found"},
+		{"/static/public.txt%00.html", 400, "Bad Request"},
+		{"/static/%zz", 400, "Bad Request"},
+	}
+
+	time.Sleep(1 * time.Second)
+
+	for _, tt := range cases {
+		t.Run(tt.path, func(t *testing.T) {
+			// raw requests: http.Client would clean or refuse some of the paths
+			conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_, _ = fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: localhost\r\n\r\n", tt.path)
+
+			got, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.StatusCode != tt.expectedStatus {
+				t.Errorf("expected status code %d, got %d", tt.expectedStatus, got.StatusCode)
+			}
+			b, _ := io.ReadAll(got.Body)
+			if string(b) != tt.expectedBody {
+				t.Errorf("expected %q, got %q", tt.expectedBody, b)
+			}
+		})
+	}
+}
+
+func FuzzResolveRequestPath(f *testing.F) {
+	for _, seed := range []string{
+		"/static/a.txt", "/static/../../etc/passwd", "/static/%2e%2e/%2e%2e/etc/passwd",
+		"/static/..\\..\\windows", "/static/a%00b", "/static//a//b/", "/static/?x=../..",
+		"/static/#../..", "/static/%5c..%5c..%5c", "/static/....//....//", "static", "",
+	} {
+		f.Add(seed)
+	}
+
+	root := filepath.FromSlash("/srv/root")
+
+	f.Fuzz(func(t *testing.T, rawURL string) {
+		name, _, _, err := resolveRequestPath(rawURL, "/static")
+		if err != nil {
+			return
+		}
+
+		if !fs.ValidPath(name) {
+			t.Fatalf("%q => invalid fs.FS name %q", rawURL, name)
+		}
+		if strings.ContainsAny(name, "\\\x00") {
+			t.Fatalf("%q => %q contains backslash or NUL", rawURL, name)
+		}
+		for _, elem := range strings.Split(name, "/") {
+			if elem == ".." {
+				t.Fatalf("%q => %q contains ..", rawURL, name)
+			}
+		}
+
+		full := filepath.Join(root, filepath.FromSlash(name))
+		if full != root && !strings.HasPrefix(full, root+string(filepath.Separator)) {
+			t.Fatalf("%q => %q escapes the root", rawURL, full)
+		}
+	})
+}
+
+// BenchmarkFileServer measures the throughput of serving a 64 MB file:
+//
+//	sendfile:  FileServer on plain TCP, streaming the file with sendfile
+//	buffered:  copying the file into Response.Body first, as it used to be
+//	tls:       FileServer on TLS, streaming the file through a buffer
+//
+// e.g. (go test -run XXX -bench BenchmarkFileServer):
+//
+//	BenchmarkFileServer/sendfile    37    31952182 ns/op    2100.29 MB/s        26821 B/op
+//	BenchmarkFileServer/buffered    15    80301306 ns/op     835.71 MB/s    268460438 B/op
+//	BenchmarkFileServer/tls         18    72618712 ns/op     924.13 MB/s       255450 B/op
+func BenchmarkFileServer(b *testing.B) {
+	const size = 64 << 20
+	port := testFileServerPortBase + 90
+
+	root := b.TempDir()
+	path := filepath.Join(root, "big.bin")
+	writeTestFile(b, path, strings.Repeat("x", size))
+
+	buffered := HandlerFunc(func(c *Context) {
+		f, err := os.Open(path)
+		if err != nil {
+			c.ResponseText(404, "Not Found")
+			return
+		}
+		defer f.Close()
+		c.Response.SetStateLine(c.Request.Version, 200)
+		_, _ = io.Copy(c.Response.Body, f)
+	})
+
+	certFile, keyFile := testCertFiles(b)
+
+	servers := []struct {
+		name   string
+		scheme string
+		serve  func(addr string) error
+	}{
+		{"sendfile", "http", (&HttpServer{Handler: FileServer(root, "/")}).ListenAndServe},
+		{"buffered", "http", (&HttpServer{Handler: buffered}).ListenAndServe},
+		{"tls", "https", func(addr string) error {
+			return (&HttpServer{Handler: FileServer(root, "/")}).ListenAndServeTLS(addr, certFile, keyFile)
+		}},
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	for i, srv := range servers {
+		addr := fmt.Sprintf("localhost:%d", port+i)
+		go func(serve func(string) error) {
+			if err := serve(addr); err != nil {
+				panic(err)
+			}
+		}(srv.serve)
+		time.Sleep(500 * time.Millisecond)
+
+		b.Run(srv.name, func(b *testing.B) {
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				got, err := client.Get(fmt.Sprintf("%s://%s/big.bin", srv.scheme, addr))
+				if err != nil {
+					b.Fatal(err)
+				}
+				written, _ := io.Copy(io.Discard, got.Body)
+				_ = got.Body.Close()
+				if written != size {
+					b.Fatalf("expected %d bytes, got %d", size, written)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,492 @@
+package simplehttp
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+const (
+	// hpackTableSize is the max size of the dynamic table of the decoder
+	// (SETTINGS_HEADER_TABLE_SIZE, the default).
+	hpackTableSize = 4096
+	// hpackEntryOverhead is the overhead of an entry in the dynamic table
+	// (RFC 7541 Section 4.1).
+	hpackEntryOverhead = 32
+)
+
+var (
+	errHpackInvalid  = errors.New("hpack: invalid header block")
+	errHpackTooLarge = errors.New("hpack: header list too large")
+)
+
+// region HPACK
+
+// hpackField is a header field.
+type hpackField struct {
+	name  string
+	value string
+}
+
+// size returns the size of the field in the dynamic table.
+func (f hpackField) size() int {
+	return len(f.name) + len(f.value) + hpackEntryOverhead
+}
+
+// hpackStaticTable is the static table (RFC 7541 Appendix A),
+// indexed from 1.
+var hpackStaticTable = [...]hpackField{
+	{":authority", ""},
+	{":method", "GET"},
+	{":method", "POST"},
+	{":path", "/"},
+	{":path", "/index.html"},
+	{":scheme", "http"},
+	{":scheme", "https"},
+	{":status", "200"},
+	{":status", "204"},
+	{":status", "206"},
+	{":status", "304"},
+	{":status", "400"},
+	{":status", "404"},
+	{":status", "500"},
+	{"accept-charset", ""},
+	{"accept-encoding", "gzip, deflate"},
+	{"accept-language", ""},
+	{"accept-ranges", ""},
+	{"accept", ""},
+	{"access-control-allow-origin", ""},
+	{"age", ""},
+	{"allow", ""},
+	{"authorization", ""},
+	{"cache-control", ""},
+	{"content-disposition", ""},
+	{"content-encoding", ""},
+	{"content-language", ""},
+	{"content-length", ""},
+	{"content-location", ""},
+	{"content-range", ""},
+	{"content-type", ""},
+	{"cookie", ""},
+	{"date", ""},
+	{"etag", ""},
+	{"expect", ""},
+	{"expires", ""},
+	{"from", ""},
+	{"host", ""},
+	{"if-match", ""},
+	{"if-modified-since", ""},
+	{"if-none-match", ""},
+	{"if-range", ""},
+	{"if-unmodified-since", ""},
+	{"last-modified", ""},
+	{"link", ""},
+	{"location", ""},
+	{"max-forwards", ""},
+	{"proxy-authenticate", ""},
+	{"proxy-authorization", ""},
+	{"range", ""},
+	{"referer", ""},
+	{"refresh", ""},
+	{"retry-after", ""},
+	{"server", ""},
+	{"set-cookie", ""},
+	{"strict-transport-security", ""},
+	{"transfer-encoding", ""},
+	{"user-agent", ""},
+	{"vary", ""},
+	{"via", ""},
+	{"www-authenticate", ""},
+}
+
+// hpackStaticIndex indexes the static table by fields and by names
+// (the first index of the name).
+var hpackStaticIndex = func() (index struct {
+	fields map[hpackField]int
+	names  map[string]int
+}) {
+	index.fields = make(map[hpackField]int)
+	index.names = make(map[string]int)
+	for i, f := range hpackStaticTable {
+		if _, ok := index.names[f.name]; !ok {
+			index.names[f.name] = i + 1
+		}
+		index.fields[f] = i + 1
+	}
+	return index
+}()
+
+// hpackDecoder decodes the header blocks of a conn (RFC 7541), keeping
+// the dynamic table between them.
+type hpackDecoder struct {
+	dynamic  []hpackField // the newest first
+	size     int          // of the entries in the dynamic table
+	maxSize  int          // by dynamic table size updates
+	maxList  int          // max size of a header list decoded
+	listSize int
+}
+
+// newHpackDecoder makes an hpackDecoder, decoding header lists up to
+// maxList bytes (as counted for SETTINGS_MAX_HEADER_LIST_SIZE).
+func newHpackDecoder(maxList int) *hpackDecoder {
+	return &hpackDecoder{maxSize: hpackTableSize, maxList: maxList}
+}
+
+// decode decodes the header block into the fields. An error leaves the
+// dynamic table unusable: the conn has to be closed (COMPRESSION_ERROR).
+func (d *hpackDecoder) decode(block []byte) ([]hpackField, error) {
+	var fields []hpackField
+	d.listSize = 0
+	sizeUpdateAllowed := true // at the beginning of the block only
+	for len(block) > 0 {
+		b := block[0]
+		var (
+			f   hpackField
+			err error
+		)
+		switch {
+		case b&0x80 != 0: // indexed
+			var i uint64
+			if i, block, err = hpackReadInt(block, 7); err != nil {
+				return nil, err
+			}
+			if f, err = d.field(i); err != nil {
+				return nil, err
+			}
+		case b&0xc0 == 0x40: // literal with incremental indexing
+			if f, block, err = d.readLiteral(block, 6); err != nil {
+				return nil, err
+			}
+			d.add(f)
+		case b&0xe0 == 0x20: // dynamic table size update
+			if !sizeUpdateAllowed {
+				return nil, errHpackInvalid
+			}
+			var size uint64
+			if size, block, err = hpackReadInt(block, 5); err != nil {
+				return nil, err
+			}
+			if size > hpackTableSize {
+				return nil, errHpackInvalid
+			}
+			d.maxSize = int(size)
+			d.evict(0)
+			continue
+		default: // literal without indexing, or never indexed
+			if f, block, err = d.readLiteral(block, 4); err != nil {
+				return nil, err
+			}
+		}
+
+		sizeUpdateAllowed = false
+		if d.listSize += f.size(); d.listSize > d.maxList {
+			return nil, errHpackTooLarge
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// field returns the field of the index in the static and dynamic tables.
+func (d *hpackDecoder) field(i uint64) (hpackField, error) {
+	switch {
+	case i == 0:
+		return hpackField{}, errHpackInvalid
+	case i <= uint64(len(hpackStaticTable)):
+		return hpackStaticTable[i-1], nil
+	case i-uint64(len(hpackStaticTable)) <= uint64(len(d.dynamic)):
+		return d.dynamic[i-uint64(len(hpackStaticTable))-1], nil
+	default:
+		return hpackField{}, errHpackInvalid
+	}
+}
+
+// readLiteral reads a literal field of the name index in prefix bits
+// (0 for a new name), then the value.
+func (d *hpackDecoder) readLiteral(p []byte, prefix uint) (hpackField, []byte, error) {
+	var f hpackField
+	i, p, err := hpackReadInt(p, prefix)
+	if err != nil {
+		return f, nil, err
+	}
+	if i > 0 {
+		indexed, err := d.field(i)
+		if err != nil {
+			return f, nil, err
+		}
+		f.name = indexed.name
+	} else if f.name, p, err = hpackReadString(p); err != nil {
+		return f, nil, err
+	}
+	f.value, p, err = hpackReadString(p)
+	return f, p, err
+}
+
+// add adds the field to the dynamic table, evicting the oldest entries
+// to fit.
+func (d *hpackDecoder) add(f hpackField) {
+	d.evict(f.size())
+	if f.size() > d.maxSize { // the table emptied, and f not added
+		return
+	}
+	d.dynamic = append([]hpackField{f}, d.dynamic...)
+	d.size += f.size()
+}
+
+// evict evicts the oldest entries until room for size bytes.
+func (d *hpackDecoder) evict(room int) {
+	for len(d.dynamic) > 0 && d.size+room > d.maxSize {
+		d.size -= d.dynamic[len(d.dynamic)-1].size()
+		d.dynamic = d.dynamic[:len(d.dynamic)-1]
+	}
+}
+
+// hpackAppendField appends the field encoded to dst: indexed if in the
+// static table, otherwise a literal without indexing, as the dynamic
+// table of the encoder is never used.
+func hpackAppendField(dst []byte, name string, value string) []byte {
+	if i, ok := hpackStaticIndex.fields[hpackField{name, value}]; ok {
+		return hpackAppendInt(dst, 0x80, 7, uint64(i))
+	}
+	if i, ok := hpackStaticIndex.names[name]; ok {
+		dst = hpackAppendInt(dst, 0x00, 4, uint64(i))
+	} else {
+		dst = append(dst, 0x00)
+		dst = hpackAppendString(dst, name)
+	}
+	return hpackAppendString(dst, value)
+}
+
+// hpackAppendInt appends the integer v (RFC 7541 Section 5.1) in the
+// prefix bits of the first byte, with the other bits of first.
+func hpackAppendInt(dst []byte, first byte, prefix uint, v uint64) []byte {
+	max := uint64(1)<<prefix - 1
+	if v < max {
+		return append(dst, first|byte(v))
+	}
+	dst = append(dst, first|byte(max))
+	for v -= max; v >= 0x80; v >>= 7 {
+		dst = append(dst, byte(v)|0x80)
+	}
+	return append(dst, byte(v))
+}
+
+// hpackReadInt reads an integer in prefix bits, returning the rest.
+func hpackReadInt(p []byte, prefix uint) (uint64, []byte, error) {
+	if len(p) == 0 {
+		return 0, nil, errHpackInvalid
+	}
+	max := uint64(1)<<prefix - 1
+	v := uint64(p[0]) & max
+	p = p[1:]
+	if v < max {
+		return v, p, nil
+	}
+	for shift := uint(0); len(p) > 0 && shift < 63; shift += 7 {
+		b := p[0]
+		p = p[1:]
+		v += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v, p, nil
+		}
+	}
+	return 0, nil, errHpackInvalid
+}
+
+// hpackAppendString appends the string literal of s (RFC 7541 Section
+// 5.2), Huffman-encoded if shorter.
+func hpackAppendString(dst []byte, s string) []byte {
+	if n := huffmanEncodedLen(s); n < len(s) {
+		dst = hpackAppendInt(dst, 0x80, 7, uint64(n))
+		return huffmanEncode(dst, s)
+	}
+	dst = hpackAppendInt(dst, 0x00, 7, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// hpackReadString reads a string literal, returning the rest.
+func hpackReadString(p []byte) (string, []byte, error) {
+	if len(p) == 0 {
+		return "", nil, errHpackInvalid
+	}
+	huffman := p[0]&0x80 != 0
+	n, p, err := hpackReadInt(p, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint64(len(p)) < n {
+		return "", nil, errHpackInvalid
+	}
+	s, p := p[:n], p[n:]
+	if !huffman {
+		return string(s), p, nil
+	}
+	decoded, err := huffmanDecode(s)
+	return decoded, p, err
+}
+
+// huffmanEncodedLen returns the length of s Huffman-encoded.
+func huffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(hpackHuffmanCodes[s[i]].bits)
+	}
+	return (bits + 7) / 8
+}
+
+// huffmanEncode appends s Huffman-encoded to dst, padded with the EOS
+// prefix (ones).
+func huffmanEncode(dst []byte, s string) []byte {
+	var acc uint64 // the bits not appended yet, in the low n bits
+	n := uint(0)
+	for i := 0; i < len(s); i++ {
+		code := hpackHuffmanCodes[s[i]]
+		acc = acc<<code.bits | uint64(code.code)
+		n += uint(code.bits)
+		for ; n >= 8; n -= 8 {
+			dst = append(dst, byte(acc>>(n-8)))
+		}
+	}
+	if n > 0 {
+		dst = append(dst, byte(acc<<(8-n))|byte(0xff>>n))
+	}
+	return dst
+}
+
+// huffmanNode is a node of the Huffman decoding tree.
+type huffmanNode struct {
+	children [2]*huffmanNode
+	symbol   int // of a leaf, -1 for the inner nodes
+}
+
+// huffmanTree returns the root of the Huffman decoding tree, built once.
+var huffmanTree = func() func() *huffmanNode {
+	var once sync.Once
+	var root *huffmanNode
+	return func() *huffmanNode {
+		once.Do(func() {
+			root = &huffmanNode{symbol: -1}
+			add := func(symbol int, code uint32, bits uint8) {
+				n := root
+				for i := int(bits) - 1; i >= 0; i-- {
+					bit := (code >> uint(i)) & 1
+					if n.children[bit] == nil {
+						n.children[bit] = &huffmanNode{symbol: -1}
+					}
+					n = n.children[bit]
+				}
+				n.symbol = symbol
+			}
+			for symbol, code := range hpackHuffmanCodes {
+				add(symbol, code.code, code.bits)
+			}
+			add(256, 0x3fffffff, 30) // EOS
+		})
+		return root
+	}
+}()
+
+// huffmanDecode decodes the Huffman-encoded p. The padding must be
+// the EOS prefix, shorter than 8 bits.
+func huffmanDecode(p []byte) (string, error) {
+	root := huffmanTree()
+	var b strings.Builder
+	n := root
+	padding := 0 // bits since the last symbol
+	ones := true // all of them
+	for _, c := range p {
+		for i := 7; i >= 0; i-- {
+			bit := (c >> uint(i)) & 1
+			if n = n.children[bit]; n == nil {
+				return "", errHpackInvalid
+			}
+			padding++
+			ones = ones && bit == 1
+			switch {
+			case n.symbol == 256: // EOS in the string
+				return "", errHpackInvalid
+			case n.symbol >= 0:
+				b.WriteByte(byte(n.symbol))
+				n, padding, ones = root, 0, true
+			}
+		}
+	}
+	if padding > 7 || !ones {
+		return "", errHpackInvalid
+	}
+	return b.String(), nil
+}
+
+// hpackHuffmanCodes are the Huffman codes of the bytes (RFC 7541 Appendix B),
+// with their lengths in bits.
+var hpackHuffmanCodes = [256]struct {
+	code uint32
+	bits uint8
+}{
+	{0x1ff8, 13}, {0x7fffd8, 23}, {0xfffffe2, 28}, {0xfffffe3, 28},
+	{0xfffffe4, 28}, {0xfffffe5, 28}, {0xfffffe6, 28}, {0xfffffe7, 28},
+	{0xfffffe8, 28}, {0xffffea, 24}, {0x3ffffffc, 30}, {0xfffffe9, 28},
+	{0xfffffea, 28}, {0x3ffffffd, 30}, {0xfffffeb, 28}, {0xfffffec, 28},
+	{0xfffffed, 28}, {0xfffffee, 28}, {0xfffffef, 28}, {0xffffff0, 28},
+	{0xffffff1, 28}, {0xffffff2, 28}, {0x3ffffffe, 30}, {0xffffff3, 28},
+	{0xffffff4, 28}, {0xffffff5, 28}, {0xffffff6, 28}, {0xffffff7, 28},
+	{0xffffff8, 28}, {0xffffff9, 28}, {0xffffffa, 28}, {0xffffffb, 28},
+	{0x14, 6}, {0x3f8, 10}, {0x3f9, 10}, {0xffa, 12},
+	{0x1ff9, 13}, {0x15, 6}, {0xf8, 8}, {0x7fa, 11},
+	{0x3fa, 10}, {0x3fb, 10}, {0xf9, 8}, {0x7fb, 11},
+	{0xfa, 8}, {0x16, 6}, {0x17, 6}, {0x18, 6},
+	{0x0, 5}, {0x1, 5}, {0x2, 5}, {0x19, 6},
+	{0x1a, 6}, {0x1b, 6}, {0x1c, 6}, {0x1d, 6},
+	{0x1e, 6}, {0x1f, 6}, {0x5c, 7}, {0xfb, 8},
+	{0x7ffc, 15}, {0x20, 6}, {0xffb, 12}, {0x3fc, 10},
+	{0x1ffa, 13}, {0x21, 6}, {0x5d, 7}, {0x5e, 7},
+	{0x5f, 7}, {0x60, 7}, {0x61, 7}, {0x62, 7},
+	{0x63, 7}, {0x64, 7}, {0x65, 7}, {0x66, 7},
+	{0x67, 7}, {0x68, 7}, {0x69, 7}, {0x6a, 7},
+	{0x6b, 7}, {0x6c, 7}, {0x6d, 7}, {0x6e, 7},
+	{0x6f, 7}, {0x70, 7}, {0x71, 7}, {0x72, 7},
+	{0xfc, 8}, {0x73, 7}, {0xfd, 8}, {0x1ffb, 13},
+	{0x7fff0, 19}, {0x1ffc, 13}, {0x3ffc, 14}, {0x22, 6},
+	{0x7ffd, 15}, {0x3, 5}, {0x23, 6}, {0x4, 5},
+	{0x24, 6}, {0x5, 5}, {0x25, 6}, {0x26, 6},
+	{0x27, 6}, {0x6, 5}, {0x74, 7}, {0x75, 7},
+	{0x28, 6}, {0x29, 6}, {0x2a, 6}, {0x7, 5},
+	{0x2b, 6}, {0x76, 7}, {0x2c, 6}, {0x8, 5},
+	{0x9, 5}, {0x2d, 6}, {0x77, 7}, {0x78, 7},
+	{0x79, 7}, {0x7a, 7}, {0x7b, 7}, {0x7ffe, 15},
+	{0x7fc, 11}, {0x3ffd, 14}, {0x1ffd, 13}, {0xffffffc, 28},
+	{0xfffe6, 20}, {0x3fffd2, 22}, {0xfffe7, 20}, {0xfffe8, 20},
+	{0x3fffd3, 22}, {0x3fffd4, 22}, {0x3fffd5, 22}, {0x7fffd9, 23},
+	{0x3fffd6, 22}, {0x7fffda, 23}, {0x7fffdb, 23}, {0x7fffdc, 23},
+	{0x7fffdd, 23}, {0x7fffde, 23}, {0xffffeb, 24}, {0x7fffdf, 23},
+	{0xffffec, 24}, {0xffffed, 24}, {0x3fffd7, 22}, {0x7fffe0, 23},
+	{0xffffee, 24}, {0x7fffe1, 23}, {0x7fffe2, 23}, {0x7fffe3, 23},
+	{0x7fffe4, 23}, {0x1fffdc, 21}, {0x3fffd8, 22}, {0x7fffe5, 23},
+	{0x3fffd9, 22}, {0x7fffe6, 23}, {0x7fffe7, 23}, {0xffffef, 24},
+	{0x3fffda, 22}, {0x1fffdd, 21}, {0xfffe9, 20}, {0x3fffdb, 22},
+	{0x3fffdc, 22}, {0x7fffe8, 23}, {0x7fffe9, 23}, {0x1fffde, 21},
+	{0x7fffea, 23}, {0x3fffdd, 22}, {0x3fffde, 22}, {0xfffff0, 24},
+	{0x1fffdf, 21}, {0x3fffdf, 22}, {0x7fffeb, 23}, {0x7fffec, 23},
+	{0x1fffe0, 21}, {0x1fffe1, 21}, {0x3fffe0, 22}, {0x1fffe2, 21},
+	{0x7fffed, 23}, {0x3fffe1, 22}, {0x7fffee, 23}, {0x7fffef, 23},
+	{0xfffea, 20}, {0x3fffe2, 22}, {0x3fffe3, 22}, {0x3fffe4, 22},
+	{0x7ffff0, 23}, {0x3fffe5, 22}, {0x3fffe6, 22}, {0x7ffff1, 23},
+	{0x3ffffe0, 26}, {0x3ffffe1, 26}, {0xfffeb, 20}, {0x7fff1, 19},
+	{0x3fffe7, 22}, {0x7ffff2, 23}, {0x3fffe8, 22}, {0x1ffffec, 25},
+	{0x3ffffe2, 26}, {0x3ffffe3, 26}, {0x3ffffe4, 26}, {0x7ffffde, 27},
+	{0x7ffffdf, 27}, {0x3ffffe5, 26}, {0xfffff1, 24}, {0x1ffffed, 25},
+	{0x7fff2, 19}, {0x1fffe3, 21}, {0x3ffffe6, 26}, {0x7ffffe0, 27},
+	{0x7ffffe1, 27}, {0x3ffffe7, 26}, {0x7ffffe2, 27}, {0xfffff2, 24},
+	{0x1fffe4, 21}, {0x1fffe5, 21}, {0x3ffffe8, 26}, {0x3ffffe9, 26},
+	{0xffffffd, 28}, {0x7ffffe3, 27}, {0x7ffffe4, 27}, {0x7ffffe5, 27},
+	{0xfffec, 20}, {0xfffff3, 24}, {0xfffed, 20}, {0x1fffe6, 21},
+	{0x3fffe9, 22}, {0x1fffe7, 21}, {0x1fffe8, 21}, {0x7ffff3, 23},
+	{0x3fffea, 22}, {0x3fffeb, 22}, {0x1ffffee, 25}, {0x1ffffef, 25},
+	{0xfffff4, 24}, {0xfffff5, 24}, {0x3ffffea, 26}, {0x7ffff4, 23},
+	{0x3ffffeb, 26}, {0x7ffffe6, 27}, {0x3ffffec, 26}, {0x3ffffed, 26},
+	{0x7ffffe7, 27}, {0x7ffffe8, 27}, {0x7ffffe9, 27}, {0x7ffffea, 27},
+	{0x7ffffeb, 27}, {0xffffffe, 28}, {0x7ffffec, 27}, {0x7ffffed, 27},
+	{0x7ffffee, 27}, {0x7ffffef, 27}, {0x7fffff0, 27}, {0x3ffffee, 26},
+}
+
+// endregion HPACK
@@ -0,0 +1,143 @@
+package simplehttp
+
+import (
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHpackDecoder(t *testing.T) {
+	// RFC 7541 Appendix C: the header blocks of a conn, decoded in order
+	cases := []struct {
+		name      string
+		tableSize int
+		blocks    []string
+		expected  [][]hpackField
+		size      int // of the dynamic table after
+	}{
+		{
+			"C.3 requests", hpackTableSize,
+			[]string{
+				"828684410f7777772e6578616d706c652e636f6d",
+				"828684be58086e6f2d6361636865",
+				"828785bf400a637573746f6d2d6b65790c637573746f6d2d76616c7565",
+			},
+			[][]hpackField{
+				{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"}},
+				{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"},
+					{"cache-control", "no-cache"}},
+				{{":method", "GET"}, {":scheme", "https"}, {":path", "/index.html"}, {":authority", "www.example.com"},
+					{"custom-key", "custom-value"}},
+			},
+			164,
+		},
+		{
+			"C.4 requests with Huffman", hpackTableSize,
+			[]string{
+				"828684418cf1e3c2e5f23a6ba0ab90f4ff",
+				"828684be5886a8eb10649cbf",
+				"828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf",
+			},
+			[][]hpackField{
+				{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"}},
+				{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"},
+					{"cache-control", "no-cache"}},
+				{{":method", "GET"}, {":scheme", "https"}, {":path", "/index.html"}, {":authority", "www.example.com"},
+					{"custom-key", "custom-value"}},
+			},
+			164,
+		},
+		{
+			"C.5 responses with eviction", 256,
+			[]string{
+				"4803333032580770726976617465611d4d6f6e2c203231204f637420323031332032303a31333a323120474d54" +
+					"6e1768747470733a2f2f7777772e6578616d706c652e636f6d",
+				"4803333037c1c0bf",
+			},
+			[][]hpackField{
+				{{":status", "302"}, {"cache-control", "private"}, {"date", "Mon, 21 Oct 2013 20:13:21 GMT"},
+					{"location", "https://www.example.com"}},
+				{{":status", "307"}, {"cache-control", "private"}, {"date", "Mon, 21 Oct 2013 20:13:21 GMT"},
+					{"location", "https://www.example.com"}},
+			},
+			222,
+		},
+	}
+	for _, tt := range cases {
+		d := newHpackDecoder(http2MaxHeaderListSize)
+		d.maxSize = tt.tableSize
+		for i, block := range tt.blocks {
+			b, _ := hex.DecodeString(block)
+			got, err := d.decode(b)
+			if err != nil || !reflect.DeepEqual(got, tt.expected[i]) {
+				t.Errorf("%s: expected %v of the block %d, got %v %v", tt.name, tt.expected[i], i, got, err)
+			}
+		}
+		if d.size != tt.size {
+			t.Errorf("%s: expected the dynamic table of %d, got %d", tt.name, tt.size, d.size)
+		}
+	}
+}
+
+func TestHpackDecoderErrors(t *testing.T) {
+	cases := []struct {
+		name     string
+		block    string
+		expected error
+	}{
+		{"index 0", "80", errHpackInvalid},
+		{"index out of the tables", "ff00", errHpackInvalid},
+		{"integer truncated", "ff", errHpackInvalid},
+		{"string truncated", "000161", errHpackInvalid},
+		{"Huffman padding not EOS", "0001618100", errHpackInvalid},
+		{"Huffman EOS", "00016184ffffffff", errHpackInvalid},
+		{"Huffman padding too long", "00016182ffff", errHpackInvalid},
+		{"size update after a field", "8420", errHpackInvalid},
+		{"size update over the max", "3fe21f", errHpackInvalid},
+		{"header list too large", "8286", errHpackTooLarge},
+	}
+	for _, tt := range cases {
+		b, _ := hex.DecodeString(tt.block)
+		if _, err := newHpackDecoder(40).decode(b); err != tt.expected {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, err)
+		}
+	}
+
+	// a size update at the beginning evicts the entries
+	d := newHpackDecoder(http2MaxHeaderListSize)
+	b, _ := hex.DecodeString("400a637573746f6d2d6b65790c637573746f6d2d76616c7565")
+	if _, err := d.decode(b); err != nil || d.size != 54 {
+		t.Fatalf("expected an entry of 54, got %d %v", d.size, err)
+	}
+	if got, err := d.decode([]byte{0x20, 0x82}); err != nil || d.size != 0 || len(got) != 1 {
+		t.Errorf("expected the table emptied by the size update, got %d %v", d.size, err)
+	}
+}
+
+func TestHpackEncode(t *testing.T) {
+	fields := []hpackField{
+		{":status", "200"},                        // static, indexed
+		{":status", "418"},                        // static name
+		{"content-type", "text/plain"},            // static name, Huffman
+		{"x-custom", "\x00\xff binary"},           // new name, raw as longer in Huffman
+		{"x-long", strings.Repeat("abcdef", 100)}, // multi-byte lengths
+		{"x-empty", ""},
+	}
+	var block []byte
+	for _, f := range fields {
+		block = hpackAppendField(block, f.name, f.value)
+	}
+	if block[0] != 0x88 {
+		t.Errorf("expected :status 200 indexed as 0x88, got %#x", block[0])
+	}
+	got, err := newHpackDecoder(http2MaxHeaderListSize).decode(block)
+	if err != nil || !reflect.DeepEqual(got, fields) {
+		t.Errorf("expected %v, got %v %v", fields, got, err)
+	}
+
+	// RFC 7541 C.4.1
+	if got := hex.EncodeToString(hpackAppendString(nil, "www.example.com")); got != "8cf1e3c2e5f23a6ba0ab90f4ff" {
+		t.Errorf("expected www.example.com Huffman-encoded, got %s", got)
+	}
+}
@@ -3,13 +3,17 @@ package simplehttp
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"io"
 	"net"
 	"net/http" // for http.StatusText only: 都是硬编码，重写一遍太蠢了
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -41,6 +45,13 @@ type Request struct {
 
 	Headers map[string]string
 	Body    io.Reader
+
+	// RemoteAddr is the network address ("ip:port") of the client,
+	// set by the server.
+	RemoteAddr string
+	// TLS is the state of the TLS connection the request received on,
+	// nil for plain HTTP. Set by the server.
+	TLS *tls.ConnectionState
 }
 
 func NewRequest() *Request {
@@ -49,13 +60,25 @@ func NewRequest() *Request {
 	}
 }
 
-// Parse HTTP Request from a tcp conn
+// Parse HTTP Request from a tcp conn.
+// If conn is a *bufio.Reader, the bytes after the request are left
+// in it, e.g. for the conn to be hijacked.
 func (r *Request) Parse(conn io.Reader) error {
-	scanner := bufio.NewScanner(conn)
-	scanner.Split(bufio.ScanBytes)
+	reader, ok := conn.(*bufio.Reader)
+	if !ok {
+		reader = bufio.NewReader(conn)
+	}
+
+	if err := r.parseHead(reader); err != nil {
+		return err
+	}
+	return r.readBody(reader)
+}
 
+// parseHead parses the request line and the headers.
+func (r *Request) parseHead(reader *bufio.Reader) error {
 	// parse the request line
-	line, err := scanBytesToLine(scanner, ReadRequestLineTimeout)
+	line, err := readLine(reader, ReadRequestLineTimeout)
 	if err != nil {
 		return err
 	}
@@ -66,7 +89,7 @@ func (r *Request) Parse(conn io.Reader) error {
 
 	// parse the headers
 	for {
-		line, err := scanBytesToLine(scanner, ReadRequestLineTimeout)
+		line, err := readLine(reader, ReadRequestLineTimeout)
 		if err != nil {
 			return err
 		}
@@ -81,9 +104,13 @@ func (r *Request) Parse(conn io.Reader) error {
 			r.Headers[key] = value
 		}
 	}
+	return nil
+}
 
+// readBody reads the body into a buffer.
+func (r *Request) readBody(reader *bufio.Reader) error {
 	// read the body
-	// TODO: lazy read: a wrapper of scanner => io.Reader
+	// TODO: lazy read: a wrapper of reader => io.Reader
 
 	buf := &bytes.Buffer{}
 	r.Body = buf
@@ -102,75 +129,169 @@ func (r *Request) Parse(conn io.Reader) error {
 		return err
 	}
 
-	return scanBytesToBuffer(scanner, buf, length, ReadRequestBodyTimeout)
+	return readToBuffer(reader, buf, length, ReadRequestBodyTimeout)
 }
 
-// scanBytesToLine scan a http line from the scanner (split by bufio.ScanBytes).
-// For Request.Parse use only.
-func scanBytesToLine(scanner *bufio.Scanner, timeout time.Duration) (string, error) {
-	chStr := make(chan string)
-	chErr := make(chan error)
+// ExpectContinue reports whether the client waits for a 100 Continue
+// before sending the body (Expect: 100-continue). The HttpServer sends
+// it when the handler reads the Body (of a Content-Length) first, unless
+// ContinueImmediately, so a handler may reject the request by the headers
+// without reading the body, e.g. with 413 if the Content-Length is too
+// large, or 417.
+func (r *Request) ExpectContinue() bool {
+	return r.Version != "HTTP/1.0" && strings.EqualFold(r.Headers["Expect"], "100-continue")
+}
 
-	go func() {
-		s := strings.Builder{}
-		for scanner.Scan() {
-			if scanner.Err() != nil {
-				chErr <- scanner.Err()
-				return
+// continueReader is the Body of a request expecting 100 Continue, read
+// lazily: before the first Read, the 100 Continue is sent by before.
+type continueReader struct {
+	reader io.Reader
+	before func() error
+	err    error // sticky
+}
+
+func (cr *continueReader) Read(p []byte) (int, error) {
+	if cr.before != nil {
+		before := cr.before
+		cr.before = nil
+		cr.err = before()
+	}
+	if cr.err != nil {
+		return 0, cr.err
+	}
+
+	n, err := cr.reader.Read(p)
+	if err != nil {
+		cr.err = err
+	}
+	return n, err
+}
+
+const (
+	// readAheadChunk is the size of the chunks of a readAheadBody.
+	readAheadChunk = 32 << 10
+	// readAheadLimit is about the max of a readAheadBody read ahead.
+	readAheadLimit = 256 << 10
+)
+
+var errBodyAbandoned = errors.New("body abandoned")
+
+// readAheadBody is the body of a request expecting 100 Continue, read
+// by watchDisconnect ahead of the handler, up to the readAheadLimit
+// unread, so the client disconnecting is seen while the handler doesn't
+// read the body, e.g. rejecting the request, or reading a part only.
+type readAheadBody struct {
+	length   int64
+	chunks   chan []byte   // closed at the end of the body, or on err
+	err      error         // of reading the body, set before chunks closed
+	done     chan struct{} // closed when the handler returns
+	pending  []byte        // of the last chunk
+	deadline time.Time     // of reading the body, set on the 100 Continue
+}
+
+func newReadAheadBody(length int) *readAheadBody {
+	return &readAheadBody{
+		length: int64(length),
+		chunks: make(chan []byte, readAheadLimit/readAheadChunk),
+		done:   make(chan struct{}),
+	}
+}
+
+func (b *readAheadBody) Read(p []byte) (int, error) {
+	if len(b.pending) == 0 {
+		timer := time.NewTimer(time.Until(b.deadline))
+		defer timer.Stop()
+		select {
+		case chunk, ok := <-b.chunks:
+			switch {
+			case ok:
+				b.pending = chunk
+			case b.err != nil:
+				return 0, b.err
+			default:
+				return 0, io.EOF
 			}
+		case <-timer.C:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	n := copy(p, b.pending)
+	b.pending = b.pending[n:]
+	return n, nil
+}
 
-			b := scanner.Bytes()
-			if b[0] == '\r' {
-				if scanner.Scan() && scanner.Bytes()[0] == '\n' { // CRLF
-					break
-				} else {
-					s.Write(b)
-					s.Write(scanner.Bytes())
-					continue
-				}
+// readFrom reads the body from r into the chunks, until the end of the
+// body, an error, or the handler returns (errBodyAbandoned).
+func (b *readAheadBody) readFrom(r io.Reader) error {
+	defer close(b.chunks)
+	for left := b.length; left > 0; {
+		size := int64(readAheadChunk)
+		if left < size {
+			size = left
+		}
+		chunk := make([]byte, size)
+		n, err := r.Read(chunk)
+		if n > 0 {
+			select {
+			case b.chunks <- chunk[:n]:
+			case <-b.done:
+				return errBodyAbandoned
 			}
-			s.Write(b)
+			left -= int64(n)
+		}
+		if err == io.EOF && left > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil && left > 0 {
+			b.err = err
+			return err
+		}
+	}
+	return nil
+}
+
+// readLine reads a http line (ending with CRLF, or a bare LF)
+// from the reader, without the line ending.
+// For Request.Parse use only.
+func readLine(reader *bufio.Reader, timeout time.Duration) (string, error) {
+	type result struct {
+		line string
+		err  error
+	}
+	ch := make(chan result, 1)
+
+	go func() {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			ch <- result{"", err}
+			return
 		}
-		chStr <- s.String()
+		ch <- result{strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil}
 	}()
 
 	select {
-	case line := <-chStr:
-		return line, nil
-	case err := <-chErr:
-		return "", err
+	case res := <-ch:
+		return res.line, res.err
 	case <-time.After(timeout):
-		return "", errors.New("scanBytesToLine: timeout")
+		return "", errors.New("readLine: timeout")
 	}
 }
 
-// scanBytesToBuffer copy bytes from scanner to buffer.
+// readToBuffer copy length bytes from reader to buffer.
 // For Request.Parse use only.
-func scanBytesToBuffer(scanner *bufio.Scanner, buf *bytes.Buffer, length int, timeout time.Duration) error {
-	chDone := make(chan struct{})
-	chErr := make(chan error)
+func readToBuffer(reader *bufio.Reader, buf *bytes.Buffer, length int, timeout time.Duration) error {
+	ch := make(chan error, 1)
 
 	go func() {
-		for buf.Len() < length && scanner.Scan() {
-			if scanner.Err() != nil {
-				chErr <- scanner.Err()
-				return
-			}
-			buf.Write(scanner.Bytes())
-			if scanner.Err() != nil {
-				break
-			}
-		}
-		chDone <- struct{}{}
+		_, err := io.CopyN(buf, reader, int64(length))
+		ch <- err
 	}()
 
 	select {
-	case <-chDone:
-		return nil
-	case err := <-chErr:
+	case err := <-ch:
 		return err
 	case <-time.After(timeout):
-		return errors.New("scanBytesToBuffer: timeout")
+		return errors.New("readToBuffer: timeout")
 	}
 }
 
@@ -209,8 +330,15 @@ type Response struct {
 	Status  int
 	Reason  string
 
+	// Headers are written as is, except the values of lines apart (see
+	// AddHeader), which are written as headers apart.
 	Headers map[string]string
 	Body    ResponseWriter
+
+	// bodyReader, if set by SetBodyReader, is streamed to the conn
+	// as the body, instead of the buffered Body.
+	bodyReader io.Reader
+	bodyLength int64 // < 0 for unknown: until EOF
 }
 
 func NewResponse() *Response {
@@ -220,26 +348,38 @@ func NewResponse() *Response {
 	}
 }
 
+// AddHeader adds the value to the header key, joined by ", " to the
+// values added before, except Set-Cookie, whose values may contain
+// commas (in Expires), which are kept on lines apart and written as
+// Set-Cookie headers apart.
+func (r *Response) AddHeader(key string, value string) {
+	v, ok := r.Headers[key]
+	switch {
+	case !ok:
+		r.Headers[key] = value
+	case strings.EqualFold(key, "Set-Cookie"):
+		r.Headers[key] = v + "\n" + value
+	default:
+		r.Headers[key] = v + ", " + value
+	}
+}
+
 // write response to conn
 // TODO: error handling
 func (r *Response) write(conn io.Writer) error {
-	// write status line
-	_, err := fmt.Fprintf(conn, "%s %d %s\r\n", r.Version, r.Status, r.Reason)
-
-	// let's calculate the real content length
-	r.Headers["Content-Length"] = fmt.Sprintf("%d", r.Body.Len())
+	r.setContentLength()
 
-	// write headers
-	for k, v := range r.Headers {
-		_, err = fmt.Fprintf(conn, "%s: %s\r\n", k, v)
-		if err != nil {
-			return err
-		}
+	err := r.writeHead(conn)
+	if err != nil {
+		return err
 	}
-	_, err = fmt.Fprintf(conn, "\r\n")
 
 	// write body
-	_, err = io.Copy(conn, r.Body)
+	if r.bodyReader != nil {
+		err = r.writeBodyReader(conn)
+	} else {
+		_, err = io.Copy(conn, r.Body)
+	}
 
 	return err
 
@@ -250,6 +390,129 @@ func (r *Response) write(conn io.Writer) error {
 	//_, _ = conn.write([]byte("OK"))
 }
 
+// setContentLength sets the Content-Length header to the real length
+// of the body.
+func (r *Response) setContentLength() {
+	// 1xx, 204 and 304 responses have no body, thus no Content-Length
+	if r.Status < 200 || r.Status == 204 || r.Status == 304 {
+		return
+	}
+	switch {
+	case r.bodyReader == nil:
+		r.Headers["Content-Length"] = fmt.Sprintf("%d", r.Body.Len())
+	case r.bodyLength >= 0:
+		r.Headers["Content-Length"] = fmt.Sprintf("%d", r.bodyLength)
+	default: // unknown length: delimited by closing the conn (or the stream)
+		delete(r.Headers, "Content-Length")
+	}
+}
+
+// writeHead writes the status line and headers of the response.
+func (r *Response) writeHead(conn io.Writer) error {
+	// write status line
+	_, err := fmt.Fprintf(conn, "%s %d %s\r\n", r.Version, r.Status, r.Reason)
+	if err != nil {
+		return err
+	}
+
+	// write headers
+	for k, v := range r.Headers {
+		for _, line := range strings.Split(v, "\n") {
+			_, err = fmt.Fprintf(conn, "%s: %s\r\n", k, line)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err = fmt.Fprintf(conn, "\r\n")
+	return err
+}
+
+// streamWriter is the Body of a streamed response, writing to the conn
+// directly instead of buffering, see serverConn.stream.
+type streamWriter struct {
+	conn io.Writer
+	n    int
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	n, err := w.conn.Write(p)
+	w.n += n
+	return n, err
+}
+
+func (w *streamWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Len returns the number of bytes written, as they are not buffered.
+func (w *streamWriter) Len() int {
+	return w.n
+}
+
+// Read reads nothing: the body is written to the conn already.
+func (w *streamWriter) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+// SetBodyReader makes the response body stream from reader when the
+// response is written: length bytes, or until EOF if length < 0 (with
+// no Content-Length sent). The buffered Body is ignored then. reader is
+// closed after written if it's an io.Closer.
+//
+// Use it for large contents, e.g. files: instead of being copied into the
+// Body, an *os.File is sent to the conn directly with sendfile (or splice)
+// on plain TCP connections, and through a reused buffer on TLS ones.
+func (r *Response) SetBodyReader(reader io.Reader, length int64) {
+	r.closeBodyReader()
+	r.bodyReader = reader
+	r.bodyLength = length
+}
+
+// copyBufferPool holds buffers for writeBodyReader,
+// when sendfile is not available, e.g. for TLS.
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 64*1024)
+		return &b
+	},
+}
+
+// writeBodyReader streams the bodyReader to conn, and closes it.
+func (r *Response) writeBodyReader(conn io.Writer) error {
+	defer r.closeBodyReader()
+
+	reader := r.bodyReader
+	if r.bodyLength >= 0 {
+		// *net.TCPConn takes *io.LimitedReader of *os.File for sendfile
+		reader = &io.LimitedReader{R: reader, N: r.bodyLength}
+	}
+
+	buf := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(buf)
+
+	// io.CopyBuffer uses conn.ReadFrom (sendfile) if possible
+	_, err := io.CopyBuffer(conn, reader, *buf)
+	return err
+}
+
+// closeBodyReader closes and drops the bodyReader, if any.
+func (r *Response) closeBodyReader() {
+	if closer, ok := r.bodyReader.(io.Closer); ok {
+		_ = closer.Close()
+	}
+	r.bodyReader = nil
+}
+
+// resetBody discards the body written, if the Body supports Reset,
+// e.g. the default bytes.Buffer, as well as the body reader.
+func (r *Response) resetBody() {
+	if b, ok := r.Body.(interface{ Reset() }); ok {
+		b.Reset()
+	}
+	r.closeBodyReader()
+}
+
 // SetStateLine set the state line of the response.
 // e.g. HTTP/1.1 200 OK
 // The status reason is inferred from the status code.
@@ -267,20 +530,27 @@ func (r *Response) SetStateLine(version string, status int) {
 //
 //	Context = Request + Response
 //
-// NOTE: simplehttp.Context is not context.Context.
+// NOTE: simplehttp.Context is not context.Context,
+// use Ctx() to get the context.Context of the request.
 type Context struct {
 	Request  *Request
 	Response *Response
 
+	ctx                 context.Context
+	serverCtx           context.Context // the base context.Context of the HttpServer, or nil
+	conn                responseConn    // nil if not served by HttpServer
 	values              sync.Map
 	handlers            []Handler
 	currentHandlerIndex int
+	aborted             bool
+	errors              []error
 }
 
 func NewContext(request *Request, response *Response) *Context {
 	return &Context{
 		Request:             request,
 		Response:            response,
+		ctx:                 context.Background(),
 		values:              sync.Map{},
 		handlers:            []Handler{},
 		currentHandlerIndex: -1,
@@ -302,6 +572,112 @@ func (c *Context) Delete(key string) {
 	c.values.Delete(key)
 }
 
+// Key is a typed key of values in a Context, for SetValue, GetValue
+// and MustGetValue. It saves the type assertions of Get, and avoids key
+// collisions between packages: every Key made by NewKey is unique,
+// even if there is another one with the same name and type.
+//
+//	var UserKey = simplehttp.NewKey[*User]("user")
+//
+//	simplehttp.SetValue(c, UserKey, user)
+//	user, ok := simplehttp.GetValue(c, UserKey)
+type Key[T any] struct {
+	name string // for debugging only, also makes Key not zero-sized, thus unique
+}
+
+// NewKey creates a new unique Key of values of type T.
+// The name is for debugging only.
+func NewKey[T any](name string) *Key[T] {
+	return &Key[T]{name: name}
+}
+
+// String returns the name of the key.
+func (k *Key[T]) String() string {
+	return k.name
+}
+
+// isKey makes Key[T] a typedKey.
+func (k *Key[T]) isKey() {}
+
+// typedKey is any *Key[T].
+type typedKey interface {
+	isKey()
+}
+
+// SetValue sets a typed value in the context.
+func SetValue[T any](c *Context, key *Key[T], value T) {
+	c.values.Store(key, value)
+}
+
+// GetValue gets a typed value from the context.
+func GetValue[T any](c *Context, key *Key[T]) (value T, ok bool) {
+	v, ok := c.values.Load(key)
+	if !ok {
+		return value, false
+	}
+	value, _ = v.(T) // nil of an interface type T is stored as nil
+	return value, true
+}
+
+// MustGetValue is like GetValue but panics if the value is not set.
+func MustGetValue[T any](c *Context, key *Key[T]) T {
+	v, ok := GetValue(c, key)
+	if !ok {
+		panic(fmt.Sprintf("MustGetValue: key %q not set", key.name))
+	}
+	return v
+}
+
+// DeleteValue deletes a typed value from the context.
+func DeleteValue[T any](c *Context, key *Key[T]) {
+	c.values.Delete(key)
+}
+
+// Ctx returns the context.Context of the request, which is cancelled
+// when the client disconnects, the server shuts down, or the
+// HttpServer.RequestTimeout expires. Pass it to database drivers
+// and outbound calls to stop them along with the request.
+//
+// Values set by Context.Set and SetValue are visible through
+// Ctx().Value(key).
+func (c *Context) Ctx() context.Context {
+	return contextBridge{Context: c.ctx, c: c}
+}
+
+// WithContext replaces the context.Context of the request with ctx,
+// typically derived from Ctx(), e.g. to set a shorter deadline:
+//
+//	ctx, cancel := context.WithTimeout(c.Ctx(), time.Second)
+//	defer cancel()
+//	c.WithContext(ctx)
+//
+// NOTE: unlike http.Request.WithContext, this modifies c in place.
+func (c *Context) WithContext(ctx context.Context) {
+	if ctx == nil {
+		panic("WithContext: nil context")
+	}
+	c.ctx = ctx
+}
+
+// contextBridge is the context.Context of a Context:
+// with the values in the Context visible via Value.
+type contextBridge struct {
+	context.Context
+	c *Context
+}
+
+// Value returns the value set by Context.Set (for a string key) or
+// SetValue (for a *Key[T]), or looks up the underlying context.Context.
+func (b contextBridge) Value(key interface{}) interface{} {
+	switch key.(type) {
+	case string, typedKey:
+		if v, ok := b.c.values.Load(key); ok {
+			return v
+		}
+	}
+	return b.Context.Value(key)
+}
+
 // ResponseText makes a response with status and plain text as body.
 func (c *Context) ResponseText(status int, text string) {
 	c.Response.SetStateLine(c.Request.Version, status)
@@ -324,6 +700,114 @@ func (c *Context) ResponseJSON(status int, v interface{}) {
 	_ = enc.Encode(v)
 }
 
+// Redirect makes a redirect response to target with status code, which
+// must be one of 301, 302, 303, 307 and 308, otherwise it panics.
+//
+// A relative target is resolved against the request URL:
+//
+//	GET /a/b/c?x=1   Redirect(302, "d")        =>  Location: /a/b/d
+//	GET /a/b/c?x=1   Redirect(302, "../d?y=2") =>  Location: /a/d?y=2
+//	GET /a/b/c?x=1   Redirect(302, "")         =>  Location: /a/b/c?x=1
+//
+// An absolute target (with a scheme or a host) is used as is,
+// while only http and https are allowed. Use LocalRedirect instead
+// if the target may come from user input, to avoid open redirects.
+func (c *Context) Redirect(code int, target string) {
+	if !isRedirectCode(code) {
+		panic(fmt.Sprintf("Redirect: invalid redirect status code %d", code))
+	}
+
+	location, err := c.resolveLocation(target, false)
+	if err != nil {
+		c.ResponseText(500, err.Error())
+		return
+	}
+	c.redirect(code, location)
+}
+
+// LocalRedirect is like Redirect, but the scheme and host of the target
+// are dropped, so that the redirect never leaves this site:
+//
+//	LocalRedirect(302, "https://evil.com/a")  =>  Location: /a
+//	LocalRedirect(302, "//evil.com/a")        =>  Location: /a
+//	LocalRedirect(302, "/\\evil.com/a")       =>  Location: /a
+func (c *Context) LocalRedirect(code int, target string) {
+	if !isRedirectCode(code) {
+		panic(fmt.Sprintf("LocalRedirect: invalid redirect status code %d", code))
+	}
+
+	location, err := c.resolveLocation(target, true)
+	if err != nil {
+		c.ResponseText(400, err.Error())
+		return
+	}
+	c.redirect(code, location)
+}
+
+// isRedirectCode reports whether code is a redirect status code
+// that comes with a Location.
+func isRedirectCode(code int) bool {
+	switch code {
+	case 301, 302, 303, 307, 308:
+		return true
+	}
+	return false
+}
+
+// resolveLocation resolves the redirect target against the request URL.
+// If local, the scheme and host of target are dropped.
+func (c *Context) resolveLocation(target string, local bool) (string, error) {
+	if local {
+		// browsers take '\' as '/': "/\\evil.com" is "//evil.com"
+		target = strings.ReplaceAll(target, "\\", "/")
+	}
+
+	ref, err := url.Parse(target)
+	if err != nil {
+		return "", fmt.Errorf("bad redirect target: %w", err)
+	}
+
+	if local {
+		if ref.IsAbs() || ref.Host != "" { // "https://evil.com" => "/"
+			ref.Path = "/" + ref.Path
+		}
+		ref.Scheme, ref.Opaque, ref.User, ref.Host = "", "", nil, ""
+	} else if ref.Scheme != "" && ref.Scheme != "http" && ref.Scheme != "https" {
+		return "", fmt.Errorf("bad redirect target: scheme %q not allowed", ref.Scheme)
+	}
+
+	if ref.IsAbs() || ref.Host != "" {
+		return ref.String(), nil
+	}
+
+	base, err := url.Parse(c.Request.Url)
+	if err != nil {
+		return "", fmt.Errorf("bad request url: %w", err)
+	}
+	resolved := base.ResolveReference(ref)
+	resolved.Scheme, resolved.User, resolved.Host = "", nil, "" // keep it relative
+	// "//evil.com" may hide in the path, e.g. "https://x///evil.com", or
+	// come of the dot segments removed, e.g. "/.//evil.com"
+	if local && strings.HasPrefix(resolved.Path, "//") {
+		resolved.Path = "/" + strings.TrimLeft(resolved.Path, "/")
+		resolved.RawPath = ""
+	}
+
+	return resolved.String(), nil
+}
+
+// redirect makes the redirect response with the resolved location.
+func (c *Context) redirect(code int, location string) {
+	c.Response.SetStateLine(c.Request.Version, code)
+	c.Response.Headers["Location"] = location
+
+	if c.Request.Method != "HEAD" {
+		c.Response.Headers["Content-Type"] = "text/html; charset=utf-8"
+		_, _ = fmt.Fprintf(c.Response.Body, "<a href=\"%s\">%s</a>.\n",
+			html.EscapeString(location), http.StatusText(code))
+	}
+}
+
 // Chain makes a handler chain, returns a handler,
 // call which will start the chain.
 //
@@ -353,15 +837,120 @@ func (c *Context) setChain(chain []Handler) {
 // Next call the next handler (middleware) in the chain.
 // A middleware should call Next() exactly once to continue the chain.
 // the last handler, i.e. the real handler, should not call Next().
+//
+// The chain stops once Abort() is called.
 func (c *Context) Next() {
 	c.currentHandlerIndex++
-	for c.currentHandlerIndex < len(c.handlers) {
+	for c.currentHandlerIndex < len(c.handlers) && !c.aborted {
 		// loop in case of a middleware not calling Next()
 		c.handlers[c.currentHandlerIndex].ServeHTTP(c)
 		c.currentHandlerIndex++
 	}
 }
 
+// Abort stops the chain: the pending handlers will not be called,
+// e.g. an auth middleware may Abort to skip the real handler.
+// It does not stop the current handler, nor the middlewares
+// that have called Next() and are waiting it to return.
+func (c *Context) Abort() {
+	c.aborted = true
+}
+
+// AbortWithStatus makes a response with status (and empty body),
+// and Abort.
+func (c *Context) AbortWithStatus(status int) {
+	c.Response.SetStateLine(c.Request.Version, status)
+	c.Abort()
+}
+
+// AbortWithJSON makes a response with status and JSON as body,
+// and Abort.
+func (c *Context) AbortWithJSON(status int, v interface{}) {
+	c.ResponseJSON(status, v)
+	c.Abort()
+}
+
+// IsAborted reports whether Abort has been called.
+func (c *Context) IsAborted() bool {
+	return c.aborted
+}
+
+// Error collects an error occurred while handling the request,
+// e.g. for a final error-handling middleware (see ErrorHandler)
+// to make the error response. A nil err is ignored.
+func (c *Context) Error(err error) {
+	if err != nil {
+		c.errors = append(c.errors, err)
+	}
+}
+
+// Errors returns the errors collected by Error.
+func (c *Context) Errors() []error {
+	return c.errors
+}
+
+// Hijack takes over the conn of the request from the HttpServer, e.g.
+// for WebSocket or the CONNECT tunnels of ForwardProxy: the Response
+// will not be written, and the conn will not be closed but by the
+// caller. The conn returned reads the data the client sent after the
+// request first.
+//
+// The context.Context of the request (Ctx) is still cancelled on
+// Shutdown or when the RequestTimeout expires, but no longer when the
+// client disconnects.
+func (c *Context) Hijack() (net.Conn, error) {
+	if c.conn == nil {
+		return nil, errors.New("hijack: not served by HttpServer")
+	}
+	return c.conn.hijack()
+}
+
+// WriteInformational sends an informational (1xx) response before the
+// final one, e.g. 103 Early Hints for the client to preload resources
+// while the response is being made:
+//
+//	_ = c.WriteInformational(103, map[string]string{
+//		"Link": "</style.css>; rel=preload; as=style",
+//	})
+//
+// It fails after the response is streamed, or for HTTP/1.0 clients, which
+// don't expect them. 100 Continue is sent by the HttpServer, see
+// Request.ExpectContinue, and 101 is for upgrades, see Hijack.
+func (c *Context) WriteInformational(status int, headers map[string]string) error {
+	switch {
+	case c.conn == nil:
+		return errors.New("informational: not served by HttpServer")
+	case status <= 101 || status > 199:
+		return fmt.Errorf("informational: bad status %d", status)
+	case c.Request.Version == "HTTP/1.0":
+		return errors.New("informational: not supported by HTTP/1.0")
+	}
+	return c.conn.informational(status, headers)
+}
+
+// serverContext returns the base context.Context of the HttpServer
+// serving c, which is cancelled on Shutdown but not by RequestTimeout,
+// e.g. for the conn after Hijack.
+func (c *Context) serverContext() context.Context {
+	if c.serverCtx == nil {
+		return context.Background()
+	}
+	return c.serverCtx
+}
+
+// responseConn is the conn a Context is served on: a serverConn, or
+// an http2Stream of HTTP/2.
+type responseConn interface {
+	// hijack takes over the conn, see Context.Hijack.
+	hijack() (net.Conn, error)
+	// stream writes the head of the response now, and makes its Body
+	// write to the conn directly, see Context.SSE.
+	stream(response *Response) error
+	// informational writes an informational (1xx) response, see
+	// Context.WriteInformational.
+	informational(status int, headers map[string]string) error
+}
+
 // endregion Context
 
 // region Handler
@@ -386,6 +975,9 @@ func (f HandlerFunc) ServeHTTP(c *Context) {
 
 // TODO: HTTP/1.1 keep-alive
 
+// ErrServerClosed is returned by ListenAndServe(TLS) after Shutdown.
+var ErrServerClosed = errors.New("simplehttp: Server closed")
+
 type Server interface {
 	SetHandler(handler Handler)
 	ListenAndServe(addr string) error
@@ -399,6 +991,31 @@ type Server interface {
 
 type HttpServer struct {
 	Handler Handler
+
+	// RequestTimeout is the deadline of the context.Context (Context.Ctx)
+	// of each request, counted from the request is parsed.
+	// Zero means no timeout.
+	RequestTimeout time.Duration
+
+	// DisableHTTP2 serves HTTP/1.x only. Otherwise, HTTP/2 is served to
+	// the clients negotiating "h2" by ALPN on TLS, and on cleartext to
+	// the ones sending the HTTP/2 preface with prior knowledge, or
+	// upgrading to "h2c". The handlers are the same for both versions:
+	// Request.Version is "HTTP/2.0" for HTTP/2, whose header names are
+	// canonicalized, e.g. "content-type" as "Content-Type".
+	DisableHTTP2 bool
+
+	// ContinueImmediately sends 100 Continue to the clients expecting it
+	// right after the request headers, instead of when the handler reads
+	// the body first, see Request.ExpectContinue.
+	ContinueImmediately bool
+
+	mu        sync.Mutex
+	ctx       context.Context // the base context.Context of requests
+	cancel    context.CancelFunc
+	listeners []net.Listener
+	conns     sync.WaitGroup
+	closed    bool
 }
 
 func (s *HttpServer) SetHandler(handler Handler) {
@@ -407,20 +1024,29 @@ func (s *HttpServer) SetHandler(handler Handler) {
 
 // handleConn parse a request, create the context,
 // handle it with s.Handler, write response back, and close conn.
+// An HTTP/2 conn is served by serveHTTP2 instead.
 // NOTE: handleConn is not a Handler.
 func (s *HttpServer) handleConn(conn net.Conn) {
 	// TODO: HTTP/1.1 keep-alive
-	defer conn.Close()
+	sc := newServerConn(conn)
+	if !s.DisableHTTP2 && sc.isHTTP2() {
+		s.serveHTTP2(conn, sc.reader, nil, nil)
+		return
+	}
+	defer sc.close()
 
 	// data flow: request -> context -> handler -> response
 
 	request := NewRequest()
 
 	response := NewResponse()
-	defer response.write(conn)
+	defer sc.writeResponse(response)
 
 	defer func() { // something wrong and not handled by the handler
 		if err := recover(); err != nil {
+			if sc.isHijacked() || sc.isStreaming() { // too late to respond
+				panic(err)
+			}
 			// let's try to response a 500, but it's not guaranteed
 			response.Version = "HTTP/1.0"
 			response.Status = 500
@@ -438,18 +1064,370 @@ func (s *HttpServer) handleConn(conn net.Conn) {
 	}()
 
 	ctx := NewContext(request, response)
-
-	// parse request
-	if err := request.Parse(conn); err != nil {
+	ctx.conn = sc
+	ctx.serverCtx = s.baseContext()
+
+	// parse request, with the body unless it's read lazily, expecting
+	// 100 Continue
+	lazyLength := 0
+	err := request.parseHead(sc.reader)
+	if err == nil && request.ExpectContinue() {
+		if s.ContinueImmediately {
+			err = sc.informational(100, nil)
+		} else if n, _ := strconv.Atoi(request.Headers["Content-Length"]); n > 0 {
+			lazyLength = n
+		}
+	}
+	if err == nil && lazyLength == 0 {
+		err = request.readBody(sc.reader)
+	}
+	if err != nil {
 		response.Version = "HTTP/1.0"
 		response.Status = 400
 		response.Reason = "Bad Request"
 	}
+	request.RemoteAddr = conn.RemoteAddr().String()
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		request.TLS = &state
+	}
+
+	// the request upgrading to h2c is served as the stream 1 of HTTP/2
+	if !s.DisableHTTP2 && response.Status == 0 && lazyLength == 0 {
+		if settings, ok := h2cUpgrade(request); ok {
+			sc.upgradeH2C()
+			_, err := io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+				"Connection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+			if err == nil {
+				s.serveHTTP2(conn, sc.reader, request, settings)
+			}
+			return
+		}
+	}
+
+	// the context.Context of the request: cancelled when the server
+	// shuts down, the RequestTimeout expires, or the client disconnects.
+	reqCtx, cancel := context.WithCancel(s.baseContext())
+	defer cancel()
+	if s.RequestTimeout > 0 {
+		reqCtx, cancel = context.WithTimeout(reqCtx, s.RequestTimeout)
+		defer cancel()
+	}
+	ctx.WithContext(reqCtx)
+	if lazyLength > 0 { // read by watchDisconnect
+		body := sc.continueBody(lazyLength)
+		defer close(body.done)
+		request.Body = &continueReader{
+			reader: body,
+			before: func() error {
+				body.deadline = time.Now().Add(ReadRequestBodyTimeout)
+				return sc.informational(100, nil)
+			},
+		}
+	}
+	sc.watch(cancel)
 
 	// handle request
 	s.Handler.ServeHTTP(ctx)
 
-	// deferred: write response and close conn
+	// deferred: write response and close conn, unless hijacked
+}
+
+// serverConn is a conn served by handleConn, which may be hijacked by
+// the handler to take it over, e.g. for CONNECT tunnels.
+type serverConn struct {
+	conn   net.Conn
+	reader *bufio.Reader // the request is parsed from
+
+	mu        sync.Mutex
+	hijacked  bool
+	streaming bool // the response is being written
+	watching  bool // by watchDisconnect
+	body      *readAheadBody
+	reading   bool          // the body, by watchDisconnect
+	peeked    []byte        // read by watchDisconnect
+	watchDone chan struct{} // closed when watchDisconnect returns
+}
+
+// newServerConn makes a serverConn of conn.
+func newServerConn(conn net.Conn) *serverConn {
+	return &serverConn{
+		conn:      conn,
+		reader:    bufio.NewReader(conn),
+		watchDone: make(chan struct{}),
+	}
+}
+
+// isHTTP2 reports whether the client speaks HTTP/2 on the conn: "h2"
+// negotiated by ALPN on TLS, or the HTTP/2 preface sent on cleartext.
+func (sc *serverConn) isHTTP2() bool {
+	_ = sc.conn.SetDeadline(time.Now().Add(ReadRequestLineTimeout))
+	defer func() { _ = sc.conn.SetDeadline(time.Time{}) }()
+
+	if tlsConn, ok := sc.conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			return false
+		}
+		return tlsConn.ConnectionState().NegotiatedProtocol == "h2"
+	}
+	// peek no more than sent, as HTTP/1 requests may be shorter
+	for n := 1; n <= len(http2Preface); n++ {
+		b, err := sc.reader.Peek(n)
+		if err != nil || !strings.HasPrefix(http2Preface, string(b)) {
+			return false
+		}
+	}
+	return true
+}
+
+// upgradeH2C takes over the conn from handleConn, to serve it as HTTP/2,
+// before watchDisconnect starts.
+func (sc *serverConn) upgradeH2C() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.hijacked = true
+}
+
+// watch starts watchDisconnect, unless hijacked.
+func (sc *serverConn) watch(cancel context.CancelFunc) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if !sc.hijacked && !sc.watching {
+		sc.watching = true
+		go sc.watchDisconnect(cancel)
+	}
+}
+
+// continueBody makes the body of length bytes of the request expecting
+// 100 Continue, to be read ahead by watchDisconnect, before watch.
+func (sc *serverConn) continueBody(length int) *readAheadBody {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.body = newReadAheadBody(length)
+	sc.reading = true
+	return sc.body
+}
+
+// informational writes an informational (1xx) response, before the
+// final one.
+func (sc *serverConn) informational(status int, headers map[string]string) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.hijacked || sc.streaming {
+		return errors.New("informational: response written already")
+	}
+	r := &Response{Version: "HTTP/1.1", Status: status, Reason: http.StatusText(status), Headers: headers}
+	return r.writeHead(sc.conn)
+}
+
+// watchDisconnect calls cancel when the client disconnects, that is,
+// the conn is closed while the request is being handled. It stops
+// watching if any data arrives (which is not expected for our
+// one-request-per-conn HTTP), keeping it for hijack, or the conn
+// is hijacked. It returns after conn is closed by handleConn as well.
+// The body of continueBody is read first, see readAheadBody.
+func (sc *serverConn) watchDisconnect(cancel context.CancelFunc) {
+	defer close(sc.watchDone)
+
+	if sc.body != nil {
+		err := sc.body.readFrom(sc.reader)
+		sc.mu.Lock()
+		sc.reading = false
+		if err != nil && err != errBodyAbandoned && !sc.hijacked {
+			cancel()
+		}
+		sc.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+
+	b := make([]byte, 1)
+	n, _ := sc.conn.Read(b)
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if n > 0 {
+		sc.peeked = b[:n]
+		return
+	}
+	if !sc.hijacked {
+		cancel()
+	}
+}
+
+// hijack takes over the conn from handleConn: the response will not be
+// written and the conn will not be closed. The conn returned reads the
+// data buffered after the request first.
+func (sc *serverConn) hijack() (net.Conn, error) {
+	sc.mu.Lock()
+	if sc.hijacked {
+		sc.mu.Unlock()
+		return nil, errors.New("hijack: conn already hijacked")
+	}
+	if sc.reading { // watchDisconnect may wait for the handler reading it
+		sc.mu.Unlock()
+		return nil, errors.New("hijack: request body unread")
+	}
+	sc.hijacked = true
+	watching := sc.watching
+	sc.mu.Unlock()
+
+	// stop watchDisconnect reading the conn
+	if watching {
+		_ = sc.conn.SetReadDeadline(time.Unix(1, 0))
+		<-sc.watchDone
+	}
+	if err := sc.conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	buffered, _ := sc.reader.Peek(sc.reader.Buffered()) // read before peeked
+	pending := append(append([]byte(nil), buffered...), sc.peeked...)
+	return &hijackedConn{Conn: sc.conn, reader: io.MultiReader(bytes.NewReader(pending), sc.conn)}, nil
+}
+
+// isHijacked reports whether the conn is hijacked.
+func (sc *serverConn) isHijacked() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.hijacked
+}
+
+// stream writes the status line and headers of the response now, and
+// makes its Body write to the conn directly, delimited by closing the
+// conn. The conn is still closed by handleConn after the handler.
+func (sc *serverConn) stream(response *Response) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.hijacked || sc.streaming {
+		return errors.New("stream: response written already")
+	}
+	sc.streaming = true
+
+	response.resetBody()
+	delete(response.Headers, "Content-Length")
+	if err := response.writeHead(sc.conn); err != nil {
+		return err
+	}
+	response.Body = &streamWriter{conn: sc.conn}
+	return nil
+}
+
+// isStreaming reports whether the response is streamed.
+func (sc *serverConn) isStreaming() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.streaming
+}
+
+// writeResponse writes the response to the conn, unless hijacked or
+// streamed.
+func (sc *serverConn) writeResponse(response *Response) {
+	if !sc.isHijacked() && !sc.isStreaming() {
+		_ = response.write(sc.conn)
+	}
+}
+
+// close closes the conn, unless hijacked.
+func (sc *serverConn) close() {
+	if !sc.isHijacked() {
+		_ = sc.conn.Close()
+	}
+}
+
+// hijackedConn is a hijacked conn, reading the data buffered before
+// hijacked first.
+type hijackedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+// Read reads the buffered data, then the conn.
+func (hc *hijackedConn) Read(p []byte) (int, error) {
+	return hc.reader.Read(p)
+}
+
+// CloseWrite shuts down the writing side of the conn, if supported,
+// e.g. by TCP and TLS conns.
+func (hc *hijackedConn) CloseWrite() error {
+	if cw, ok := hc.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("CloseWrite not supported")
+}
+
+// baseContext returns the base context.Context of requests,
+// which is cancelled on Shutdown.
+func (s *HttpServer) baseContext() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	return s.ctx
+}
+
+// serve accepts conns from listen, handle them with s.Handler,
+// until the server shuts down.
+func (s *HttpServer) serve(listen net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = listen.Close()
+		return ErrServerClosed
+	}
+	s.listeners = append(s.listeners, listen)
+	s.mu.Unlock()
+
+	for {
+		conn, err := listen.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			continue
+		}
+
+		s.conns.Add(1)
+		go func() {
+			defer s.conns.Done()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+// Shutdown stops the server: closes the listeners, cancels the
+// context.Context of the in-flight requests, and waits for their
+// handlers to return, or ctx to be done.
+func (s *HttpServer) Shutdown(ctx context.Context) error {
+	s.baseContext() // make sure s.cancel is set
+
+	s.mu.Lock()
+	s.closed = true
+	for _, l := range s.listeners {
+		_ = l.Close()
+	}
+	s.listeners = nil
+	s.cancel()
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.conns.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // ListenAndServe listen addr, and serve HTTP: handle conn with s.Handler
@@ -459,10 +1437,7 @@ func (s *HttpServer) ListenAndServe(addr string) error {
 		return err
 	}
 
-	for {
-		conn, _ := listen.Accept()
-		go s.handleConn(conn)
-	}
+	return s.serve(listen)
 }
 
 // ListenAndServeTLS listen addr, and serve HTTPS: handle conn with s.Handler
@@ -473,16 +1448,16 @@ func (s *HttpServer) ListenAndServeTLS(addr, certFile, keyFile string) error {
 	}
 
 	config := &tls.Config{Certificates: []tls.Certificate{cer}}
+	if !s.DisableHTTP2 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
 
 	listen, err := tls.Listen("tcp", addr, config)
 	if err != nil {
 		return err
 	}
 
-	for {
-		conn, _ := listen.Accept()
-		go s.handleConn(conn)
-	}
+	return s.serve(listen)
 }
 
 // endregion Server
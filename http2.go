@@ -0,0 +1,1299 @@
+package simplehttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// http2Preface is the client connection preface (RFC 9113 Section 3.4).
+	http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+	http2FrameHeaderLen = 9
+	// http2MaxFrameSize is SETTINGS_MAX_FRAME_SIZE of the server, the
+	// default: the max payload of frames received, and sent until the
+	// client allows larger ones.
+	http2MaxFrameSize = 16384
+	// http2DefaultWindow is the initial flow-control window by default.
+	http2DefaultWindow = 65535
+	// http2MaxWindow is the max size of flow-control windows.
+	http2MaxWindow = 1<<31 - 1
+	// http2ReceiveWindow is the flow-control window of each stream and
+	// the conn for the request bodies, replenished as the handlers read
+	// them.
+	http2ReceiveWindow = 1 << 20
+	// http2MaxBufferedBody is the max request body buffered until the
+	// end of the request, when the handler starts. The handler of a
+	// larger one starts early, reading the body as received.
+	http2MaxBufferedBody = 64 << 10
+	// http2MaxStreams is SETTINGS_MAX_CONCURRENT_STREAMS of the server.
+	http2MaxStreams = 250
+	// http2MaxHeaderListSize is SETTINGS_MAX_HEADER_LIST_SIZE of the
+	// server, as well as the max size of a header block received.
+	http2MaxHeaderListSize = 1 << 20
+	// http2IdleTimeout is how long a conn without streams is kept open.
+	http2IdleTimeout = 5 * time.Minute
+	// http2MaxResets is the max number of RST_STREAM received in an
+	// http2ResetInterval. More are taken as an attack (rapid reset),
+	// which closes the conn with ENHANCE_YOUR_CALM.
+	http2MaxResets     = 1000
+	http2ResetInterval = 10 * time.Second
+)
+
+// frame types (RFC 9113 Section 6)
+const (
+	http2FrameData         = 0x0
+	http2FrameHeaders      = 0x1
+	http2FramePriority     = 0x2
+	http2FrameRSTStream    = 0x3
+	http2FrameSettings     = 0x4
+	http2FramePushPromise  = 0x5
+	http2FramePing         = 0x6
+	http2FrameGoAway       = 0x7
+	http2FrameWindowUpdate = 0x8
+	http2FrameContinuation = 0x9
+)
+
+// frame flags
+const (
+	http2FlagEndStream  = 0x1
+	http2FlagAck        = 0x1
+	http2FlagEndHeaders = 0x4
+	http2FlagPadded     = 0x8
+	http2FlagPriority   = 0x20
+)
+
+// error codes (RFC 9113 Section 7)
+const (
+	http2NoError          = 0x0
+	http2ProtocolError    = 0x1
+	http2InternalError    = 0x2
+	http2FlowControlError = 0x3
+	http2StreamClosed     = 0x5
+	http2FrameSizeError   = 0x6
+	http2RefusedStream    = 0x7
+	http2Cancel           = 0x8
+	http2CompressionError = 0x9
+	http2EnhanceYourCalm  = 0xb
+)
+
+// settings (RFC 9113 Section 6.5.2)
+const (
+	http2SettingEnablePush           = 0x2
+	http2SettingMaxConcurrentStreams = 0x3
+	http2SettingInitialWindowSize    = 0x4
+	http2SettingMaxFrameSize         = 0x5
+	http2SettingMaxHeaderListSize    = 0x6
+)
+
+var (
+	errHTTP2Malformed     = errors.New("http2: malformed request")
+	errHTTP2StreamClosed  = errors.New("http2: stream closed")
+	errHTTP2NotHijackable = errors.New("hijack: not supported by HTTP/2")
+)
+
+// http2ConnectionHeaders are the connection-specific headers, not
+// allowed in HTTP/2 (RFC 9113 Section 8.2.2).
+var http2ConnectionHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+// http2HeaderKeys are the keys of the headers received whose usual
+// spelling is not the canonical one, as HTTP/2 header names are lowercase.
+var http2HeaderKeys = map[string]string{
+	"etag":             "ETag",
+	"last-event-id":    "Last-Event-ID",
+	"www-authenticate": "WWW-Authenticate",
+	"te":               "TE",
+}
+
+// region HTTP/2
+
+// http2Error is an error of the conn (stream 0) or a stream, with the
+// error code to send by GOAWAY or RST_STREAM.
+type http2Error struct {
+	stream uint32
+	code   uint32
+	reason string
+}
+
+func (e http2Error) Error() string {
+	return fmt.Sprintf("http2: %s (stream %d, code %d)", e.reason, e.stream, e.code)
+}
+
+// http2ConnError is a connection error, which closes the conn.
+func http2ConnError(code uint32, reason string) error {
+	return http2Error{code: code, reason: reason}
+}
+
+// http2StreamError is a stream error, which resets the stream only.
+func http2StreamError(stream uint32, code uint32, reason string) error {
+	return http2Error{stream: stream, code: code, reason: reason}
+}
+
+// http2Conn is a conn served as HTTP/2 by serveHTTP2. The frames are
+// read by serve, and the streams are handled concurrently, each by
+// s.Handler in a goroutine, once the request is received.
+type http2Conn struct {
+	server *HttpServer
+	conn   net.Conn
+	reader *bufio.Reader
+	tls    *tls.ConnectionState
+	// ctx is the base context.Context of the streams, cancelled after
+	// GOAWAY is sent on Shutdown, or when the conn is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// read by serve only
+	decoder     *hpackDecoder
+	headerBlock []byte // of the HEADERS being continued by CONTINUATION
+	headerID    uint32 // the stream of headerBlock, 0 for none
+	headerFlags byte
+	resets      int // the RST_STREAM received since resetsSince
+	resetsSince time.Time
+
+	writeMu sync.Mutex
+	writer  *bufio.Writer
+
+	mu                sync.Mutex
+	cond              *sync.Cond // broadcast when the send windows grow, or streams end
+	streams           map[uint32]*http2Stream
+	lastStreamID      uint32
+	recvWindow        int64 // taken by DATA until read, see refillLocked
+	refilled          int64 // of recvWindow, to send by sendRefilled
+	sendWindow        int64
+	initialSendWindow int64
+	maxSendFrame      int
+	running           int  // the handlers started and not returned yet
+	goingAway         bool // no more streams accepted
+	closed            bool
+	idle              *time.Timer
+
+	handlers sync.WaitGroup
+	done     chan struct{}
+}
+
+// serveHTTP2 serves the conn as HTTP/2 until it's closed, reading from
+// reader, the conn buffered. upgrade is the HTTP/1.1 request upgraded to
+// h2c, served as the stream 1, with the settings of its HTTP2-Settings,
+// or nil.
+func (s *HttpServer) serveHTTP2(conn net.Conn, reader *bufio.Reader, upgrade *Request, settings []byte) {
+	h2 := &http2Conn{
+		server:            s,
+		conn:              conn,
+		reader:            reader,
+		decoder:           newHpackDecoder(http2MaxHeaderListSize),
+		recvWindow:        http2ReceiveWindow,
+		writer:            bufio.NewWriterSize(conn, http2MaxFrameSize+http2FrameHeaderLen),
+		streams:           make(map[uint32]*http2Stream),
+		sendWindow:        http2DefaultWindow,
+		initialSendWindow: http2DefaultWindow,
+		maxSendFrame:      http2MaxFrameSize,
+		done:              make(chan struct{}),
+	}
+	h2.ctx, h2.cancel = context.WithCancel(context.Background())
+	h2.cond = sync.NewCond(&h2.mu)
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		h2.tls = &state
+	}
+	if upgrade != nil {
+		_ = h2.applySettings(settings)
+	}
+	h2.serve(upgrade)
+}
+
+// serve reads and processes the frames of the conn, until it's closed,
+// by the client, an error, or Shutdown.
+func (h2 *http2Conn) serve(upgrade *Request) {
+	defer func() {
+		h2.mu.Lock()
+		h2.closed = true
+		for _, st := range h2.streams {
+			st.cancel()
+		}
+		h2.cond.Broadcast()
+		h2.mu.Unlock()
+
+		close(h2.done)
+		h2.cancel()
+		h2.idle.Stop()
+		_ = h2.conn.Close()
+		h2.handlers.Wait()
+	}()
+
+	h2.mu.Lock()
+	h2.idle = time.AfterFunc(http2IdleTimeout, h2.closeIfIdle)
+	h2.mu.Unlock()
+
+	// the server preface
+	var settings []byte
+	settings = http2AppendSetting(settings, http2SettingMaxConcurrentStreams, http2MaxStreams)
+	settings = http2AppendSetting(settings, http2SettingInitialWindowSize, http2ReceiveWindow)
+	settings = http2AppendSetting(settings, http2SettingMaxHeaderListSize, http2MaxHeaderListSize)
+	if h2.writeFrame(http2FrameSettings, 0, 0, settings) != nil ||
+		h2.writeWindowUpdate(0, http2ReceiveWindow-http2DefaultWindow) != nil {
+		return
+	}
+
+	if upgrade != nil { // the request upgraded is the stream 1, half-closed
+		upgrade.Version = "HTTP/2.0"
+		body := upgrade.Body
+		h2.mu.Lock()
+		st := h2.newStream(1, upgrade)
+		_, _ = st.body.ReadFrom(body)
+		st.endStream = true
+		h2.lastStreamID = 1
+		h2.start(st)
+		h2.mu.Unlock()
+	}
+
+	go func() {
+		select {
+		case <-h2.server.baseContext().Done(): // Shutdown
+			h2.goAway()
+			h2.cancel()
+		case <-h2.done:
+		}
+	}()
+
+	// the client preface, then SETTINGS first
+	_ = h2.conn.SetReadDeadline(time.Now().Add(ReadRequestLineTimeout))
+	preface := make([]byte, len(http2Preface))
+	if _, err := io.ReadFull(h2.reader, preface); err != nil || string(preface) != http2Preface {
+		return
+	}
+	_ = h2.conn.SetReadDeadline(time.Time{})
+
+	for first := true; ; first = false {
+		typ, flags, id, payload, err := h2.readFrame()
+		if err == nil && first && typ != http2FrameSettings {
+			err = http2ConnError(http2ProtocolError, "SETTINGS expected first")
+		}
+		if err == nil {
+			err = h2.processFrame(typ, flags, id, payload)
+		}
+
+		var h2err http2Error
+		switch {
+		case err == nil:
+		case errors.As(err, &h2err) && h2err.stream != 0:
+			h2.resetStream(h2err.stream, h2err.code)
+		case errors.As(err, &h2err):
+			h2.mu.Lock()
+			last := h2.lastStreamID
+			h2.mu.Unlock()
+			_ = h2.writeGoAway(last, h2err.code)
+			return
+		default: // the conn is broken or closed
+			return
+		}
+		// the window of the conn refilled by the frame, e.g. of the DATA
+		// of a closed stream, or the body unread of a stream reset
+		_ = h2.sendRefilled()
+	}
+}
+
+// readFrame reads a frame.
+func (h2 *http2Conn) readFrame() (typ byte, flags byte, id uint32, payload []byte, err error) {
+	var header [http2FrameHeaderLen]byte
+	if _, err = io.ReadFull(h2.reader, header[:]); err != nil {
+		return
+	}
+	length := int(header[0])<<16 | int(header[1])<<8 | int(header[2])
+	typ, flags = header[3], header[4]
+	id = binary.BigEndian.Uint32(header[5:]) & 0x7fffffff
+	if length > http2MaxFrameSize {
+		err = http2ConnError(http2FrameSizeError, "frame too large")
+		return
+	}
+	payload = make([]byte, length)
+	_, err = io.ReadFull(h2.reader, payload)
+	return
+}
+
+// processFrame processes a frame received.
+func (h2 *http2Conn) processFrame(typ byte, flags byte, id uint32, payload []byte) error {
+	if h2.headerID != 0 && (typ != http2FrameContinuation || id != h2.headerID) {
+		return http2ConnError(http2ProtocolError, "CONTINUATION expected")
+	}
+
+	switch typ {
+	case http2FrameData:
+		return h2.processData(flags, id, payload)
+	case http2FrameHeaders:
+		return h2.processHeaders(flags, id, payload)
+	case http2FrameContinuation:
+		if h2.headerID == 0 {
+			return http2ConnError(http2ProtocolError, "unexpected CONTINUATION")
+		}
+		if len(h2.headerBlock)+len(payload) > http2MaxHeaderListSize {
+			return http2ConnError(http2EnhanceYourCalm, "header block too large")
+		}
+		h2.headerBlock = append(h2.headerBlock, payload...)
+		if flags&http2FlagEndHeaders == 0 {
+			return nil
+		}
+		return h2.processHeaderBlock()
+	case http2FramePriority:
+		if id == 0 {
+			return http2ConnError(http2ProtocolError, "PRIORITY of stream 0")
+		}
+		if len(payload) != 5 {
+			return http2StreamError(id, http2FrameSizeError, "bad PRIORITY")
+		}
+		return nil // no prioritization
+	case http2FrameRSTStream:
+		return h2.processRSTStream(id, payload)
+	case http2FrameSettings:
+		return h2.processSettings(flags, id, payload)
+	case http2FramePushPromise:
+		return http2ConnError(http2ProtocolError, "PUSH_PROMISE from the client")
+	case http2FramePing:
+		if id != 0 {
+			return http2ConnError(http2ProtocolError, "PING of a stream")
+		}
+		if len(payload) != 8 {
+			return http2ConnError(http2FrameSizeError, "bad PING")
+		}
+		if flags&http2FlagAck != 0 {
+			return nil
+		}
+		return h2.writeFrame(http2FramePing, http2FlagAck, 0, payload)
+	case http2FrameGoAway:
+		if id != 0 {
+			return http2ConnError(http2ProtocolError, "GOAWAY of a stream")
+		}
+		h2.mu.Lock()
+		h2.goingAway = true // the client opens no more streams
+		h2.closeIfDoneLocked()
+		h2.mu.Unlock()
+		return nil
+	case http2FrameWindowUpdate:
+		return h2.processWindowUpdate(id, payload)
+	default: // unknown frame types are ignored
+		return nil
+	}
+}
+
+// processHeaders processes a HEADERS frame: starts the header block of
+// a new stream, or the trailers of one.
+func (h2 *http2Conn) processHeaders(flags byte, id uint32, payload []byte) error {
+	if id == 0 || id%2 == 0 {
+		return http2ConnError(http2ProtocolError, "bad stream id")
+	}
+	payload, err := http2Unpad(flags, payload)
+	if err != nil {
+		return err
+	}
+	if flags&http2FlagPriority != 0 {
+		if len(payload) < 5 {
+			return http2ConnError(http2FrameSizeError, "bad HEADERS")
+		}
+		payload = payload[5:]
+	}
+
+	h2.headerBlock = append(h2.headerBlock[:0], payload...)
+	h2.headerID, h2.headerFlags = id, flags
+	if flags&http2FlagEndHeaders == 0 {
+		return nil
+	}
+	return h2.processHeaderBlock()
+}
+
+// processHeaderBlock processes the complete header block of a stream:
+// the request of a new stream, or trailers, which are discarded.
+func (h2 *http2Conn) processHeaderBlock() error {
+	id, endStream := h2.headerID, h2.headerFlags&http2FlagEndStream != 0
+	h2.headerID = 0
+	fields, err := h2.decoder.decode(h2.headerBlock)
+	if err != nil { // the dynamic table is broken
+		return http2ConnError(http2CompressionError, err.Error())
+	}
+
+	h2.mu.Lock()
+	defer h2.mu.Unlock()
+
+	if st, ok := h2.streams[id]; ok { // trailers
+		switch {
+		case st.endStream:
+			return http2StreamError(id, http2StreamClosed, "HEADERS after END_STREAM")
+		case !endStream:
+			return http2StreamError(id, http2ProtocolError, "trailers without END_STREAM")
+		}
+		return h2.endStream(st)
+	}
+	if id <= h2.lastStreamID {
+		return http2ConnError(http2StreamClosed, "HEADERS of a closed stream")
+	}
+	h2.lastStreamID = id
+	if h2.goingAway {
+		return nil
+	}
+	// the handlers of streams reset keep running until they return,
+	// so are counted as well
+	if len(h2.streams) >= http2MaxStreams || h2.running >= http2MaxStreams {
+		return http2StreamError(id, http2RefusedStream, "too many streams")
+	}
+
+	request, err := h2.newRequest(fields)
+	if err != nil {
+		return http2StreamError(id, http2ProtocolError, err.Error())
+	}
+	st := h2.newStream(id, request)
+	if n, _ := strconv.Atoi(request.Headers["Content-Length"]); !endStream && n > 0 && request.ExpectContinue() {
+		// handled while the body is received, see Request.ExpectContinue
+		request.Body = &continueReader{
+			reader: http2BodyReader{st},
+			before: func() error {
+				h2.mu.Lock()
+				h2.watchStall(st) // the client sends the body from now on
+				h2.mu.Unlock()
+				return st.informational(100, nil)
+			},
+		}
+		h2.start(st)
+	} else if !endStream {
+		h2.watchStall(st)
+	}
+	if !endStream {
+		return nil
+	}
+	return h2.endStream(st)
+}
+
+// processData processes a DATA frame: a part of the request body. The
+// windows taken by the body are refilled as the handler reads it, see
+// http2BodyReader, and by the padding right away.
+func (h2 *http2Conn) processData(flags byte, id uint32, payload []byte) error {
+	if id == 0 {
+		return http2ConnError(http2ProtocolError, "DATA of stream 0")
+	}
+	data, err := http2Unpad(flags, payload)
+	if err != nil {
+		return err
+	}
+	n, padding := int64(len(payload)), int64(len(payload)-len(data))
+
+	h2.mu.Lock()
+	if h2.recvWindow -= n; h2.recvWindow < 0 {
+		h2.mu.Unlock()
+		return http2ConnError(http2FlowControlError, "conn window exceeded")
+	}
+	st, ok := h2.streams[id]
+	switch {
+	case !ok && id > h2.lastStreamID:
+		h2.mu.Unlock()
+		return http2ConnError(http2ProtocolError, "DATA of an idle stream")
+	case !ok || st.endStream:
+		h2.refillLocked(n) // discarded
+		h2.mu.Unlock()
+		return http2StreamError(id, http2StreamClosed, "DATA of a closed stream")
+	}
+	if st.recvWindow -= n; st.recvWindow < 0 {
+		h2.refillLocked(n)
+		h2.mu.Unlock()
+		return http2StreamError(id, http2FlowControlError, "stream window exceeded")
+	}
+	st.body.Write(data)
+	st.received += int64(len(data))
+	st.unread += int64(len(data))
+	h2.refillLocked(padding)
+	st.recvWindow += padding
+
+	if flags&http2FlagEndStream != 0 {
+		err := h2.endStream(st)
+		h2.mu.Unlock()
+		return err
+	}
+	h2.watchStall(st)
+	if !st.started && (st.body.Len() > http2MaxBufferedBody || h2.recvWindow < http2MaxBufferedBody) {
+		// too large to buffer, or taking the window of the conn, so
+		// read by the handler as received
+		st.request.Body = http2BodyReader{st}
+		h2.start(st)
+	}
+	h2.cond.Broadcast()
+	h2.mu.Unlock()
+
+	if padding > 0 {
+		return h2.writeWindowUpdate(id, uint32(padding))
+	}
+	return nil
+}
+
+// processRSTStream processes a RST_STREAM frame: the stream is cancelled,
+// though its handler is counted as running until it returns.
+func (h2 *http2Conn) processRSTStream(id uint32, payload []byte) error {
+	if len(payload) != 4 {
+		return http2ConnError(http2FrameSizeError, "bad RST_STREAM")
+	}
+	if now := time.Now(); now.Sub(h2.resetsSince) > http2ResetInterval {
+		h2.resets, h2.resetsSince = 0, now
+	}
+	if h2.resets++; h2.resets > http2MaxResets {
+		return http2ConnError(http2EnhanceYourCalm, "too many RST_STREAM")
+	}
+	h2.mu.Lock()
+	defer h2.mu.Unlock()
+	if id == 0 || id > h2.lastStreamID {
+		return http2ConnError(http2ProtocolError, "RST_STREAM of an idle stream")
+	}
+	if st, ok := h2.streams[id]; ok {
+		h2.removeStreamLocked(st)
+	}
+	return nil
+}
+
+// processSettings processes a SETTINGS frame, and acknowledges it.
+func (h2 *http2Conn) processSettings(flags byte, id uint32, payload []byte) error {
+	switch {
+	case id != 0:
+		return http2ConnError(http2ProtocolError, "SETTINGS of a stream")
+	case flags&http2FlagAck != 0:
+		if len(payload) != 0 {
+			return http2ConnError(http2FrameSizeError, "bad SETTINGS ACK")
+		}
+		return nil
+	}
+	if err := h2.applySettings(payload); err != nil {
+		return err
+	}
+	return h2.writeFrame(http2FrameSettings, http2FlagAck, 0, nil)
+}
+
+// applySettings applies the settings of the client.
+func (h2 *http2Conn) applySettings(payload []byte) error {
+	if len(payload)%6 != 0 {
+		return http2ConnError(http2FrameSizeError, "bad SETTINGS")
+	}
+	h2.mu.Lock()
+	defer h2.mu.Unlock()
+	defer h2.cond.Broadcast()
+
+	for p := payload; len(p) > 0; p = p[6:] {
+		v := binary.BigEndian.Uint32(p[2:])
+		switch binary.BigEndian.Uint16(p) {
+		case http2SettingEnablePush:
+			if v > 1 {
+				return http2ConnError(http2ProtocolError, "bad SETTINGS_ENABLE_PUSH")
+			}
+		case http2SettingInitialWindowSize:
+			if v > http2MaxWindow {
+				return http2ConnError(http2FlowControlError, "bad SETTINGS_INITIAL_WINDOW_SIZE")
+			}
+			delta := int64(v) - h2.initialSendWindow
+			for _, st := range h2.streams {
+				if st.sendWindow += delta; st.sendWindow > http2MaxWindow {
+					return http2ConnError(http2FlowControlError, "stream window overflow")
+				}
+			}
+			h2.initialSendWindow = int64(v)
+		case http2SettingMaxFrameSize:
+			if v < http2MaxFrameSize || v > 1<<24-1 {
+				return http2ConnError(http2ProtocolError, "bad SETTINGS_MAX_FRAME_SIZE")
+			}
+			h2.maxSendFrame = int(v)
+		}
+		// the others are advisory, or for the encoder, which doesn't
+		// use the dynamic table, and unknown ones are ignored
+	}
+	return nil
+}
+
+// processWindowUpdate processes a WINDOW_UPDATE frame: the send window
+// of the conn or a stream grows.
+func (h2 *http2Conn) processWindowUpdate(id uint32, payload []byte) error {
+	if len(payload) != 4 {
+		return http2ConnError(http2FrameSizeError, "bad WINDOW_UPDATE")
+	}
+	increment := int64(binary.BigEndian.Uint32(payload) & 0x7fffffff)
+
+	h2.mu.Lock()
+	defer h2.mu.Unlock()
+	defer h2.cond.Broadcast()
+	if id == 0 {
+		if increment == 0 {
+			return http2ConnError(http2ProtocolError, "zero WINDOW_UPDATE")
+		}
+		if h2.sendWindow += increment; h2.sendWindow > http2MaxWindow {
+			return http2ConnError(http2FlowControlError, "conn window overflow")
+		}
+		return nil
+	}
+
+	st, ok := h2.streams[id]
+	switch {
+	case !ok && id > h2.lastStreamID:
+		return http2ConnError(http2ProtocolError, "WINDOW_UPDATE of an idle stream")
+	case increment == 0:
+		return http2StreamError(id, http2ProtocolError, "zero WINDOW_UPDATE")
+	case !ok: // closed already
+		return nil
+	}
+	if st.sendWindow += increment; st.sendWindow > http2MaxWindow {
+		return http2StreamError(id, http2FlowControlError, "stream window overflow")
+	}
+	return nil
+}
+
+// newRequest makes the Request of the header fields of a stream
+// (RFC 9113 Section 8.3.1), with the headers keyed canonically, as
+// HTTP/2 header names are lowercase. An error is returned if it's
+// malformed.
+func (h2 *http2Conn) newRequest(fields []hpackField) (*Request, error) {
+	r := NewRequest()
+	r.Version = "HTTP/2.0"
+	r.RemoteAddr = h2.conn.RemoteAddr().String()
+	r.TLS = h2.tls
+
+	pseudo := make(map[string]string)
+	var cookies []string
+	for _, f := range fields {
+		if strings.HasPrefix(f.name, ":") {
+			if len(r.Headers) > 0 || len(cookies) > 0 {
+				return nil, errHTTP2Malformed // pseudo-headers come first
+			}
+			switch f.name {
+			case ":method", ":scheme", ":authority", ":path":
+			default:
+				return nil, errHTTP2Malformed
+			}
+			if _, ok := pseudo[f.name]; ok {
+				return nil, errHTTP2Malformed
+			}
+			pseudo[f.name] = f.value
+			continue
+		}
+
+		if f.name == "" || f.name != strings.ToLower(f.name) || http2ConnectionHeaders[f.name] ||
+			(f.name == "te" && f.value != "trailers") {
+			return nil, errHTTP2Malformed
+		}
+		if f.name == "cookie" { // may be split (RFC 9113 Section 8.2.3)
+			cookies = append(cookies, f.value)
+			continue
+		}
+		key, ok := http2HeaderKeys[f.name]
+		if !ok {
+			key = textproto.CanonicalMIMEHeaderKey(f.name)
+		}
+		if v, ok := r.Headers[key]; ok {
+			r.Headers[key] = v + ", " + f.value
+		} else {
+			r.Headers[key] = f.value
+		}
+	}
+	if len(cookies) > 0 {
+		r.Headers["Cookie"] = strings.Join(cookies, "; ")
+	}
+
+	r.Method = pseudo[":method"]
+	authority, hasScheme, hasPath := pseudo[":authority"], pseudo[":scheme"] != "", pseudo[":path"] != ""
+	switch {
+	case r.Method == "":
+		return nil, errHTTP2Malformed
+	case r.Method == "CONNECT":
+		if authority == "" || hasScheme || hasPath {
+			return nil, errHTTP2Malformed
+		}
+		r.Url = authority
+	default:
+		if !hasScheme || !hasPath {
+			return nil, errHTTP2Malformed
+		}
+		r.Url = pseudo[":path"]
+	}
+	if authority != "" {
+		r.Headers["Host"] = authority
+	}
+	return r, nil
+}
+
+// newStream makes a stream of the request, and adds it. h2.mu is held.
+func (h2 *http2Conn) newStream(id uint32, request *Request) *http2Stream {
+	st := &http2Stream{
+		h2:         h2,
+		id:         id,
+		request:    request,
+		recvWindow: http2ReceiveWindow,
+		sendWindow: h2.initialSendWindow,
+	}
+	st.ctx, st.cancel = context.WithCancel(h2.ctx)
+	request.Body = &st.body
+	h2.streams[id] = st
+	return st
+}
+
+// endStream ends the request of the stream, and starts to handle it.
+// h2.mu is held.
+func (h2 *http2Conn) endStream(st *http2Stream) error {
+	// the body is buffered, as in HTTP/1, so is its length known, unless
+	// read by the handler started already
+	length := strconv.FormatInt(st.received, 10)
+	if l, ok := st.request.Headers["Content-Length"]; ok && l != length {
+		return http2StreamError(st.id, http2ProtocolError, "bad content-length")
+	} else if !ok && st.received > 0 && !st.started {
+		st.request.Headers["Content-Length"] = length
+	}
+	st.endStream = true
+	if st.stall != nil {
+		st.stall.Stop()
+	}
+
+	if st.started {
+		h2.cond.Broadcast()
+		return nil
+	}
+	// the body buffered is the handler's, no longer of the windows
+	h2.refillLocked(st.unread)
+	st.unread = 0
+	h2.start(st)
+	return nil
+}
+
+// start handles the stream in a goroutine. h2.mu is held.
+func (h2 *http2Conn) start(st *http2Stream) {
+	st.started = true
+	h2.running++
+	h2.handlers.Add(1)
+	go func() {
+		defer h2.handlers.Done()
+		defer func() {
+			h2.mu.Lock()
+			h2.running--
+			h2.mu.Unlock()
+		}()
+		st.serve()
+	}()
+	go func() { // wake up writeData waiting for windows
+		<-st.ctx.Done()
+		h2.mu.Lock()
+		h2.cond.Broadcast()
+		h2.mu.Unlock()
+	}()
+}
+
+// resetStream resets the stream by RST_STREAM with the error code.
+func (h2 *http2Conn) resetStream(id uint32, code uint32) {
+	_ = h2.writeRSTStream(id, code)
+	h2.mu.Lock()
+	if st, ok := h2.streams[id]; ok {
+		h2.removeStreamLocked(st)
+	}
+	h2.mu.Unlock()
+	_ = h2.sendRefilled()
+}
+
+// removeStreamLocked removes the stream, cancelling it, and refills the
+// window of the conn by the body unread, see sendRefilled. h2.mu is held.
+func (h2 *http2Conn) removeStreamLocked(st *http2Stream) {
+	st.cancel()
+	if h2.streams[st.id] != st {
+		return
+	}
+	if st.stall != nil {
+		st.stall.Stop()
+	}
+	h2.refillLocked(st.unread)
+	st.unread = 0
+	delete(h2.streams, st.id)
+	h2.cond.Broadcast()
+	if len(h2.streams) == 0 && !h2.closed {
+		h2.idle.Reset(http2IdleTimeout)
+	}
+	h2.closeIfDoneLocked()
+}
+
+// watchStall resets the stream if no DATA is received in the
+// ReadRequestBodyTimeout from now, while the windows allow the client
+// to send. h2.mu is held.
+func (h2 *http2Conn) watchStall(st *http2Stream) {
+	if st.stall != nil {
+		st.stall.Reset(ReadRequestBodyTimeout)
+		return
+	}
+	st.stall = time.AfterFunc(ReadRequestBodyTimeout, func() {
+		h2.mu.Lock()
+		switch {
+		case h2.streams[st.id] != st || st.endStream:
+			h2.mu.Unlock()
+			return
+		case st.recvWindow <= 0 || h2.recvWindow <= 0: // waiting for the body read
+			st.stall.Reset(ReadRequestBodyTimeout)
+			h2.mu.Unlock()
+			return
+		}
+		h2.mu.Unlock()
+		h2.resetStream(st.id, http2Cancel)
+	})
+}
+
+// refillLocked refills the window of the conn by n, of the body read or
+// discarded. h2.mu is held, and sendRefilled is called after.
+func (h2 *http2Conn) refillLocked(n int64) {
+	h2.recvWindow += n
+	h2.refilled += n
+}
+
+// sendRefilled sends the window of the conn refilled, if any, by
+// WINDOW_UPDATE.
+func (h2 *http2Conn) sendRefilled() error {
+	h2.mu.Lock()
+	n := h2.refilled
+	h2.refilled = 0
+	h2.mu.Unlock()
+	if n == 0 {
+		return nil
+	}
+	return h2.writeWindowUpdate(0, uint32(n))
+}
+
+// closeIfDoneLocked closes the conn if going away without streams left.
+// h2.mu is held.
+func (h2 *http2Conn) closeIfDoneLocked() {
+	if h2.goingAway && len(h2.streams) == 0 {
+		_ = h2.conn.Close()
+	}
+}
+
+// goAway stops accepting streams by GOAWAY, e.g. on Shutdown, closing
+// the conn once the streams in flight are done.
+func (h2 *http2Conn) goAway() {
+	h2.mu.Lock()
+	if h2.goingAway {
+		h2.mu.Unlock()
+		return
+	}
+	h2.goingAway = true
+	last := h2.lastStreamID
+	h2.mu.Unlock()
+
+	_ = h2.writeGoAway(last, http2NoError)
+
+	h2.mu.Lock()
+	h2.closeIfDoneLocked()
+	h2.mu.Unlock()
+}
+
+// closeIfIdle goes away if no streams, after the http2IdleTimeout.
+func (h2 *http2Conn) closeIfIdle() {
+	h2.mu.Lock()
+	idle := len(h2.streams) == 0
+	h2.mu.Unlock()
+	if idle {
+		h2.goAway()
+	}
+}
+
+// writeFrame writes a frame.
+func (h2 *http2Conn) writeFrame(typ byte, flags byte, id uint32, payload []byte) error {
+	h2.writeMu.Lock()
+	defer h2.writeMu.Unlock()
+	h2.bufferFrame(typ, flags, id, payload)
+	return h2.writer.Flush()
+}
+
+// bufferFrame writes a frame to the buffer. h2.writeMu is held.
+func (h2 *http2Conn) bufferFrame(typ byte, flags byte, id uint32, payload []byte) {
+	length := len(payload)
+	header := [http2FrameHeaderLen]byte{byte(length >> 16), byte(length >> 8), byte(length), typ, flags}
+	binary.BigEndian.PutUint32(header[5:], id)
+	_, _ = h2.writer.Write(header[:])
+	_, _ = h2.writer.Write(payload)
+}
+
+// writeHeaderBlock writes the header block of a stream, in a HEADERS
+// frame followed by CONTINUATION ones if larger than a frame.
+func (h2 *http2Conn) writeHeaderBlock(id uint32, block []byte, endStream bool) error {
+	h2.mu.Lock()
+	maxFrame := h2.maxSendFrame
+	h2.mu.Unlock()
+
+	h2.writeMu.Lock()
+	defer h2.writeMu.Unlock()
+	typ, flags := byte(http2FrameHeaders), byte(0)
+	if endStream {
+		flags = http2FlagEndStream
+	}
+	for {
+		chunk := block
+		if len(chunk) > maxFrame {
+			chunk = chunk[:maxFrame]
+		}
+		block = block[len(chunk):]
+		if len(block) == 0 {
+			h2.bufferFrame(typ, flags|http2FlagEndHeaders, id, chunk)
+			return h2.writer.Flush()
+		}
+		h2.bufferFrame(typ, flags, id, chunk)
+		typ, flags = http2FrameContinuation, 0
+	}
+}
+
+// writeWindowUpdate writes a WINDOW_UPDATE of the conn (id 0) or a stream.
+func (h2 *http2Conn) writeWindowUpdate(id uint32, increment uint32) error {
+	return h2.writeFrame(http2FrameWindowUpdate, 0, id, binary.BigEndian.AppendUint32(nil, increment))
+}
+
+// writeRSTStream writes a RST_STREAM.
+func (h2 *http2Conn) writeRSTStream(id uint32, code uint32) error {
+	return h2.writeFrame(http2FrameRSTStream, 0, id, binary.BigEndian.AppendUint32(nil, code))
+}
+
+// writeGoAway writes a GOAWAY.
+func (h2 *http2Conn) writeGoAway(lastStreamID uint32, code uint32) error {
+	payload := binary.BigEndian.AppendUint32(nil, lastStreamID)
+	return h2.writeFrame(http2FrameGoAway, 0, 0, binary.BigEndian.AppendUint32(payload, code))
+}
+
+// http2AppendSetting appends a setting to the payload of SETTINGS.
+func http2AppendSetting(payload []byte, id uint16, value uint32) []byte {
+	return binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint16(payload, id), value)
+}
+
+// http2Unpad returns the payload of a DATA or HEADERS frame without
+// the padding, if PADDED.
+func http2Unpad(flags byte, payload []byte) ([]byte, error) {
+	if flags&http2FlagPadded == 0 {
+		return payload, nil
+	}
+	if len(payload) == 0 || int(payload[0]) >= len(payload) {
+		return nil, http2ConnError(http2ProtocolError, "bad padding")
+	}
+	return payload[1 : len(payload)-int(payload[0])], nil
+}
+
+// http2Stream is a stream of an http2Conn, which is the conn of the
+// Context (see responseConn) for the handler.
+type http2Stream struct {
+	h2      *http2Conn
+	id      uint32
+	request *Request
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	// guarded by h2.mu
+	body       bytes.Buffer // the request body
+	received   int64        // the length of the body received
+	unread     int64        // of the body, taking the windows until read
+	stall      *time.Timer  // see watchStall
+	endStream  bool         // the request is received
+	started    bool         // the handler is started
+	recvWindow int64
+	sendWindow int64
+
+	mu        sync.Mutex
+	streaming bool
+	finished  bool // the response is written
+}
+
+// serve handles the request of the stream with s.Handler, and writes
+// the response.
+func (st *http2Stream) serve() {
+	h2 := st.h2
+	defer func() {
+		h2.mu.Lock()
+		unread := h2.streams[st.id] == st && !st.endStream
+		h2.removeStreamLocked(st)
+		h2.mu.Unlock()
+		_ = h2.sendRefilled()
+		if unread { // responded early, see Request.ExpectContinue
+			_ = h2.writeRSTStream(st.id, http2NoError)
+		}
+	}()
+
+	response := NewResponse()
+	defer st.finish(response)
+
+	defer func() { // something wrong and not handled by the handler
+		if err := recover(); err != nil {
+			if st.isStreaming() { // too late to respond
+				h2.resetStream(st.id, http2InternalError)
+				panic(err)
+			}
+			response := NewResponse()
+			response.SetStateLine(st.request.Version, 500)
+			if DebugPanicResponse {
+				_, _ = response.Body.Write([]byte(
+					fmt.Sprintf("panic: %v", err)))
+			}
+			st.finish(response)
+
+			// and throw the panic again
+			panic(err)
+		}
+	}()
+
+	ctx := NewContext(st.request, response)
+	ctx.conn = st
+	ctx.serverCtx = h2.server.baseContext()
+
+	reqCtx := st.ctx
+	if timeout := h2.server.RequestTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(reqCtx, timeout)
+		defer cancel()
+	}
+	ctx.WithContext(reqCtx)
+
+	if body, ok := st.request.Body.(*continueReader); ok && h2.server.ContinueImmediately {
+		_, _ = body.Read(nil) // sends 100 Continue
+	}
+	h2.server.Handler.ServeHTTP(ctx)
+}
+
+// hijack is not supported by HTTP/2.
+func (st *http2Stream) hijack() (net.Conn, error) {
+	return nil, errHTTP2NotHijackable
+}
+
+// stream writes the headers of the response now, and makes its Body
+// write DATA frames directly, until the handler returns.
+func (st *http2Stream) stream(response *Response) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.streaming || st.finished {
+		return errors.New("stream: response written already")
+	}
+	st.streaming = true
+
+	response.resetBody()
+	delete(response.Headers, "Content-Length")
+	if err := st.writeHeaders(response, false); err != nil {
+		return err
+	}
+	response.Body = &streamWriter{conn: http2DataWriter{st}}
+	return nil
+}
+
+// informational writes the headers of an informational (1xx) response.
+func (st *http2Stream) informational(status int, headers map[string]string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.streaming || st.finished {
+		return errors.New("informational: response written already")
+	}
+	return st.writeHeaders(&Response{Status: status, Headers: headers}, false)
+}
+
+// isStreaming reports whether the response is streamed.
+func (st *http2Stream) isStreaming() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.streaming
+}
+
+// finish writes the response, or ends the one streamed, once.
+func (st *http2Stream) finish(response *Response) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.finished {
+		return
+	}
+	st.finished = true
+	if st.streaming {
+		_, _ = st.writeData(nil, true)
+		return
+	}
+	_ = st.writeResponse(response)
+}
+
+// writeResponse writes the headers and the body of the response. The
+// body of a HEAD request, or a response with no body, is not sent.
+func (st *http2Stream) writeResponse(response *Response) error {
+	response.setContentLength()
+	hasBody := st.request.Method != "HEAD" && response.Status >= 200 &&
+		response.Status != 204 && response.Status != 304 &&
+		(response.bodyReader != nil || response.Body.Len() > 0)
+	if !hasBody {
+		response.closeBodyReader()
+		return st.writeHeaders(response, true)
+	}
+
+	if err := st.writeHeaders(response, false); err != nil {
+		return err
+	}
+	var err error
+	if response.bodyReader != nil {
+		err = response.writeBodyReader(http2DataWriter{st})
+	} else {
+		_, err = io.Copy(http2DataWriter{st}, response.Body)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = st.writeData(nil, true)
+	return err
+}
+
+// writeHeaders writes the status and headers of the response, in
+// lowercase, without the connection-specific ones.
+func (st *http2Stream) writeHeaders(response *Response, endStream bool) error {
+	h2 := st.h2
+	h2.mu.Lock()
+	closed := h2.closed || h2.streams[st.id] != st
+	h2.mu.Unlock()
+	if closed { // reset, by the client or an error
+		return errHTTP2StreamClosed
+	}
+
+	block := hpackAppendField(nil, ":status", strconv.Itoa(response.Status))
+	for k, v := range response.Headers {
+		name := strings.ToLower(k)
+		if http2ConnectionHeaders[name] {
+			continue
+		}
+		for _, line := range strings.Split(v, "\n") { // see Response.AddHeader
+			block = hpackAppendField(block, name, line)
+		}
+	}
+	return h2.writeHeaderBlock(st.id, block, endStream)
+}
+
+// writeData writes p in DATA frames, as the send windows of the conn
+// and the stream allow, then END_STREAM if end.
+func (st *http2Stream) writeData(p []byte, end bool) (int, error) {
+	h2 := st.h2
+	written := 0
+	for len(p) > 0 || end {
+		h2.mu.Lock()
+		for len(p) > 0 && !h2.closed && st.ctx.Err() == nil && (h2.sendWindow <= 0 || st.sendWindow <= 0) {
+			h2.cond.Wait()
+		}
+		if h2.closed || h2.streams[st.id] != st {
+			h2.mu.Unlock()
+			return written, errHTTP2StreamClosed
+		}
+		if len(p) > 0 && (h2.sendWindow <= 0 || st.sendWindow <= 0) { // cancelled waiting
+			h2.mu.Unlock()
+			return written, st.ctx.Err()
+		}
+		n := int64(len(p))
+		for _, limit := range []int64{int64(h2.maxSendFrame), h2.sendWindow, st.sendWindow} {
+			if n > limit {
+				n = limit
+			}
+		}
+		h2.sendWindow -= n
+		st.sendWindow -= n
+		h2.mu.Unlock()
+
+		var flags byte
+		if end && n == int64(len(p)) {
+			flags = http2FlagEndStream
+		}
+		if err := h2.writeFrame(http2FrameData, flags, st.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += int(n)
+		p = p[n:]
+		if flags != 0 {
+			break
+		}
+	}
+	return written, nil
+}
+
+// http2DataWriter writes DATA frames of a stream.
+type http2DataWriter struct {
+	st *http2Stream
+}
+
+func (w http2DataWriter) Write(p []byte) (int, error) {
+	return w.st.writeData(p, false)
+}
+
+// http2BodyReader reads the body of a stream as received, for the
+// handler started before its end, see Request.ExpectContinue, refilling
+// the windows by the body read.
+type http2BodyReader struct {
+	st *http2Stream
+}
+
+func (r http2BodyReader) Read(p []byte) (int, error) {
+	st, h2 := r.st, r.st.h2
+	h2.mu.Lock()
+	for len(p) > 0 && st.body.Len() == 0 && !st.endStream && !h2.closed &&
+		h2.streams[st.id] == st && st.ctx.Err() == nil {
+		h2.cond.Wait()
+	}
+	var n int
+	var err error
+	switch {
+	case st.body.Len() > 0 || len(p) == 0:
+		n, err = st.body.Read(p)
+	case st.endStream:
+		err = io.EOF
+	case h2.closed || h2.streams[st.id] != st:
+		err = errHTTP2StreamClosed
+	default:
+		err = st.ctx.Err()
+	}
+
+	read := int64(n)
+	if read > st.unread { // e.g. of the request upgraded
+		read = st.unread
+	}
+	st.unread -= read
+	h2.refillLocked(read)
+	receiving := read > 0 && !st.endStream && h2.streams[st.id] == st
+	if receiving {
+		st.recvWindow += read
+	}
+	h2.mu.Unlock()
+
+	_ = h2.sendRefilled()
+	if receiving {
+		_ = h2.writeWindowUpdate(st.id, uint32(read))
+	}
+	return n, err
+}
+
+// h2cUpgrade returns the settings of the HTTP2-Settings of the request,
+// if it's an upgrade to h2c (RFC 7540 Section 3.2) on a cleartext conn,
+// and removes the headers of the upgrade.
+func h2cUpgrade(r *Request) ([]byte, bool) {
+	if r.TLS != nil || !headerHasToken(r.Headers["Upgrade"], "h2c") ||
+		!headerHasToken(r.Headers["Connection"], "Upgrade") {
+		return nil, false
+	}
+	var encoded string
+	found := false
+	for k, v := range r.Headers {
+		if strings.EqualFold(k, "HTTP2-Settings") {
+			encoded, found = v, true
+		}
+	}
+	settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if !found || err != nil || len(settings)%6 != 0 {
+		return nil, false
+	}
+
+	for k := range r.Headers {
+		switch strings.ToLower(k) {
+		case "connection", "upgrade", "http2-settings":
+			delete(r.Headers, k)
+		}
+	}
+	return settings, true
+}
+
+// endregion HTTP/2
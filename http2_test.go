@@ -0,0 +1,663 @@
+package simplehttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testHTTP2PortBase = 24230
+
+// testH2Client is a client speaking HTTP/2 frames, for the cases the
+// net/http client can't make: prior knowledge, h2c upgrade and bad frames.
+type testH2Client struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	decoder *hpackDecoder
+}
+
+// dialHTTP2 dials the port, and sends the preface with prior knowledge.
+func dialHTTP2(t *testing.T, port int, settings ...uint32) *testH2Client {
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return newTestH2Client(t, conn, bufio.NewReader(conn), settings...)
+}
+
+// newTestH2Client sends the preface and the settings (id, value pairs)
+// on the conn read by reader.
+func newTestH2Client(t *testing.T, conn net.Conn, reader *bufio.Reader, settings ...uint32) *testH2Client {
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &testH2Client{conn: conn, reader: reader, decoder: newHpackDecoder(http2MaxHeaderListSize)}
+	if _, err := io.WriteString(conn, http2Preface); err != nil {
+		t.Fatal(err)
+	}
+	var payload []byte
+	for i := 0; i+1 < len(settings); i += 2 {
+		payload = http2AppendSetting(payload, uint16(settings[i]), settings[i+1])
+	}
+	c.writeFrame(t, http2FrameSettings, 0, 0, payload)
+	return c
+}
+
+func (c *testH2Client) writeFrame(t *testing.T, typ byte, flags byte, id uint32, payload []byte) {
+	header := []byte{byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), typ, flags}
+	if _, err := c.conn.Write(append(binary.BigEndian.AppendUint32(header, id), payload...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeHeaders writes the header fields, as name, value pairs.
+func (c *testH2Client) writeHeaders(t *testing.T, id uint32, endStream bool, fields ...string) {
+	var block []byte
+	for i := 0; i+1 < len(fields); i += 2 {
+		block = hpackAppendField(block, fields[i], fields[i+1])
+	}
+	flags := byte(http2FlagEndHeaders)
+	if endStream {
+		flags |= http2FlagEndStream
+	}
+	c.writeFrame(t, http2FrameHeaders, flags, id, block)
+}
+
+// readFrame reads a frame, skipping SETTINGS, PING and WINDOW_UPDATE.
+func (c *testH2Client) readFrame(t *testing.T) (typ byte, flags byte, id uint32, payload []byte) {
+	for {
+		typ, flags, id, payload = c.readAnyFrame(t)
+		switch typ {
+		case http2FrameSettings, http2FramePing, http2FrameWindowUpdate:
+			continue
+		}
+		return typ, flags, id, payload
+	}
+}
+
+// readAnyFrame reads a frame, of any type.
+func (c *testH2Client) readAnyFrame(t *testing.T) (typ byte, flags byte, id uint32, payload []byte) {
+	header := make([]byte, http2FrameHeaderLen)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		t.Fatal(err)
+	}
+	payload = make([]byte, int(header[0])<<16|int(header[1])<<8|int(header[2]))
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[3], header[4], binary.BigEndian.Uint32(header[5:]), payload
+}
+
+// sync sends a PING, and reads the frames sent before its ACK.
+func (c *testH2Client) sync(t *testing.T) {
+	c.writeFrame(t, http2FramePing, 0, 0, make([]byte, 8))
+	for {
+		if typ, flags, _, _ := c.readAnyFrame(t); typ == http2FramePing && flags&http2FlagAck != 0 {
+			return
+		}
+	}
+}
+
+// expectFrame reads a frame of the type, e.g. RST_STREAM or GOAWAY,
+// returning the error code of them.
+func (c *testH2Client) expectFrame(t *testing.T, expected byte) (id uint32, code uint32) {
+	typ, _, id, payload := c.readFrame(t)
+	if typ != expected {
+		t.Fatalf("expected frame type %d, got %d of stream %d: %q", expected, typ, id, payload)
+	}
+	if len(payload) >= 4 {
+		code = binary.BigEndian.Uint32(payload[len(payload)-4:])
+	}
+	return id, code
+}
+
+// readResponse reads the headers and the body of the response of the stream.
+func (c *testH2Client) readResponse(t *testing.T, id uint32) (map[string]string, string) {
+	headers := make(map[string]string)
+	var body bytes.Buffer
+	for {
+		typ, flags, got, payload := c.readFrame(t)
+		if got != id {
+			t.Fatalf("expected a frame of stream %d, got type %d of %d", id, typ, got)
+		}
+		switch typ {
+		case http2FrameHeaders:
+			fields, err := c.decoder.decode(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range fields {
+				headers[f.name] = f.value
+			}
+		case http2FrameData:
+			body.Write(payload)
+		default:
+			t.Fatalf("expected the response of stream %d, got type %d %q", id, typ, payload)
+		}
+		if flags&http2FlagEndStream != 0 {
+			return headers, body.String()
+		}
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	port := testHTTP2PortBase
+	tlsPort := testHTTP2PortBase + 1
+
+	cancelled := make(chan struct{}, 1)
+	large := bytes.Repeat([]byte("0123456789abcdef"), 1<<16) // 1 MB
+
+	// server
+	r := NewPrefixRouter("/")
+	r.HandleFunc(MethodAny, "/hello", func(c *Context) {
+		c.ResponseText(200, fmt.Sprintf("hello %s %s %s %s",
+			c.Request.Version, c.Request.Headers["Host"], c.Request.Headers["X-Custom"], c.Request.Headers["Cookie"]))
+	})
+	r.POST("/echo", func(c *Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		c.Response.SetStateLine(c.Request.Version, 200)
+		c.Response.Headers["X-Length"] = c.Request.Headers["Content-Length"]
+		_, _ = c.Response.Body.Write(body)
+	})
+	r.POST("/reject", func(c *Context) {
+		c.ResponseText(413, "too large")
+	})
+	r.GET("/large", func(c *Context) {
+		c.Response.SetStateLine(c.Request.Version, 200)
+		c.Response.SetBodyReader(bytes.NewReader(large), int64(len(large)))
+	})
+	r.GET("/events", func(c *Context) {
+		stream, err := c.SSE()
+		if err != nil {
+			panic(err)
+		}
+		_ = stream.Send("", "1", "first")
+		_ = stream.Send("", "2", "second")
+		<-stream.Done()
+		cancelled <- struct{}{}
+	})
+	go func() {
+		s := HttpServer{Handler: r}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			panic(err)
+		}
+	}()
+	go func() {
+		certFile, keyFile := testCertFiles(t)
+		s := HttpServer{Handler: r}
+		if err := s.ListenAndServeTLS(fmt.Sprintf(":%d", tlsPort), certFile, keyFile); err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	t.Run("tls", func(t *testing.T) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		}}
+		url := fmt.Sprintf("https://localhost:%d", tlsPort)
+
+		req, _ := http.NewRequest("GET", url+"/hello", nil)
+		req.Header.Set("X-Custom", "custom")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		expected := fmt.Sprintf("hello HTTP/2.0 localhost:%d custom ", tlsPort)
+		if resp.ProtoMajor != 2 || string(body) != expected || resp.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+			t.Errorf("expected %q over HTTP/2, got %q over %s %v", expected, body, resp.Proto, resp.Header)
+		}
+
+		// larger than the windows both ways
+		upload := bytes.Repeat([]byte("x"), 5<<20)
+		resp, err = client.Post(url+"/echo", "text/plain", bytes.NewReader(upload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ = io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if !bytes.Equal(body, upload) || resp.Header.Get("X-Length") != "5242880" {
+			t.Errorf("expected 5 MB echoed, got %d bytes %v", len(body), resp.Header)
+		}
+
+		// multiplexed on a conn
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, err := client.Get(url + "/large")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				body, _ := io.ReadAll(resp.Body)
+				_ = resp.Body.Close()
+				if resp.ProtoMajor != 2 || !bytes.Equal(body, large) {
+					t.Errorf("expected 1 MB over HTTP/2, got %d bytes over %s", len(body), resp.Proto)
+				}
+			}()
+		}
+		wg.Wait()
+
+		// HTTP/1.1 still, without h2 by ALPN
+		client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+		resp, err = client.Get(url + "/hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ = io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.ProtoMajor != 1 || !strings.HasPrefix(string(body), "hello HTTP/1.1") {
+			t.Errorf("expected HTTP/1.1, got %q over %s", body, resp.Proto)
+		}
+	})
+
+	t.Run("priorKnowledge", func(t *testing.T) {
+		c := dialHTTP2(t, port)
+		c.writeHeaders(t, 1, true, ":method", "GET", ":scheme", "http", ":path", "/hello",
+			":authority", "localhost", "x-custom", "raw", "cookie", "a=1", "cookie", "b=2")
+		headers, body := c.readResponse(t, 1)
+		expected := "hello HTTP/2.0 localhost raw a=1; b=2"
+		if headers[":status"] != "200" || body != expected || headers["content-length"] != fmt.Sprint(len(expected)) {
+			t.Errorf("expected %q, got %q %v", expected, body, headers)
+		}
+
+		c.writeHeaders(t, 3, true, ":method", "HEAD", ":scheme", "http", ":path", "/hello", ":authority", "localhost")
+		headers, body = c.readResponse(t, 3)
+		if headers[":status"] != "200" || body != "" || headers["content-length"] == "" {
+			t.Errorf("expected a HEAD response without body, got %q %v", body, headers)
+		}
+	})
+
+	t.Run("upgrade", func(t *testing.T) {
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, _ = io.WriteString(conn, "GET /hello HTTP/1.1\r\n"+
+			"Host: localhost\r\n"+
+			"Connection: Upgrade, HTTP2-Settings\r\n"+
+			"Upgrade: h2c\r\n"+
+			"HTTP2-Settings: AAMAAABkAAQAoAAAAAIAAAAA\r\n"+
+			"X-Custom: upgraded\r\n\r\n")
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil || resp.StatusCode != 101 || resp.Header.Get("Upgrade") != "h2c" {
+			t.Fatalf("expected 101 to h2c, got %v %v", resp, err)
+		}
+
+		c := newTestH2Client(t, conn, reader)
+		headers, body := c.readResponse(t, 1)
+		if expected := "hello HTTP/2.0 localhost upgraded "; headers[":status"] != "200" || body != expected {
+			t.Errorf("expected %q, got %q %v", expected, body, headers)
+		}
+	})
+
+	t.Run("flowControl", func(t *testing.T) {
+		c := dialHTTP2(t, port, http2SettingInitialWindowSize, 10)
+		c.writeHeaders(t, 1, true, ":method", "GET", ":scheme", "http", ":path", "/hello", ":authority", "localhost")
+
+		if typ, _, _, _ := c.readFrame(t); typ != http2FrameHeaders {
+			t.Fatalf("expected HEADERS, got %d", typ)
+		}
+		typ, flags, _, payload := c.readFrame(t)
+		if typ != http2FrameData || flags&http2FlagEndStream != 0 || string(payload) != "hello HTTP" {
+			t.Fatalf("expected 10 bytes of DATA by the window, got %d %q", typ, payload)
+		}
+		c.writeFrame(t, http2FrameWindowUpdate, 0, 1, binary.BigEndian.AppendUint32(nil, 100))
+		if _, body := c.readResponse(t, 1); body != "/2.0 localhost  " {
+			t.Errorf("expected the rest after WINDOW_UPDATE, got %q", body)
+		}
+	})
+
+	t.Run("sse", func(t *testing.T) {
+		c := dialHTTP2(t, port)
+		c.writeHeaders(t, 1, true, ":method", "GET", ":scheme", "http", ":path", "/events", ":authority", "localhost")
+
+		_, _, _, block := c.readFrame(t)
+		fields, _ := c.decoder.decode(block)
+		if fields[0].value != "200" {
+			t.Errorf("expected 200, got %v", fields)
+		}
+		var got []byte
+		expected := "id: 1\ndata: first\n\nid: 2\ndata: second\n\n"
+		for len(got) < len(expected) {
+			typ, flags, _, payload := c.readFrame(t)
+			if typ != http2FrameData || flags&http2FlagEndStream != 0 {
+				t.Fatalf("expected DATA streamed, got %d", typ)
+			}
+			got = append(got, payload...)
+		}
+		if string(got) != expected {
+			t.Errorf("expected %q, got %q", expected, got)
+		}
+
+		c.writeFrame(t, http2FrameRSTStream, 0, 1, binary.BigEndian.AppendUint32(nil, 0x8))
+		select {
+		case <-cancelled:
+		case <-time.After(2 * time.Second):
+			t.Errorf("expected the stream cancelled by RST_STREAM")
+		}
+	})
+
+	t.Run("expectContinue", func(t *testing.T) {
+		c := dialHTTP2(t, port)
+		request := []string{":method", "POST", ":scheme", "http", ":path", "/echo", ":authority", "localhost",
+			"expect", "100-continue", "content-length", "5"}
+		c.writeHeaders(t, 1, false, request...)
+		typ, flags, _, block := c.readFrame(t)
+		if fields, _ := c.decoder.decode(block); typ != http2FrameHeaders || flags&http2FlagEndStream != 0 ||
+			len(fields) != 1 || fields[0].value != "100" {
+			t.Fatalf("expected 100 Continue before the body, got %d %v", typ, fields)
+		}
+		c.writeFrame(t, http2FrameData, http2FlagEndStream, 1, []byte("hello"))
+		if headers, body := c.readResponse(t, 1); headers[":status"] != "200" || body != "hello" ||
+			headers["x-length"] != "5" {
+			t.Errorf("expected the body read, got %q %v", body, headers)
+		}
+
+		// rejected without the body, which isn't needed then
+		request[5] = "/reject"
+		c.writeHeaders(t, 3, false, request...)
+		if headers, body := c.readResponse(t, 3); headers[":status"] != "413" || body != "too large" {
+			t.Errorf("expected 413 without 100 Continue, got %q %v", body, headers)
+		}
+		if id, code := c.expectFrame(t, http2FrameRSTStream); id != 3 || code != http2NoError {
+			t.Errorf("expected RST_STREAM(NO_ERROR) of stream 3, got %d of %d", code, id)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		request := []string{":method", "GET", ":scheme", "http", ":path", "/hello", ":authority", "localhost"}
+		cases := []struct {
+			name     string
+			send     func(t *testing.T, c *testH2Client)
+			frame    byte
+			expected uint32
+		}{
+			{"DATA of an idle stream", func(t *testing.T, c *testH2Client) {
+				c.writeFrame(t, http2FrameData, 0, 1, []byte("x"))
+			}, http2FrameGoAway, http2ProtocolError},
+			{"zero WINDOW_UPDATE", func(t *testing.T, c *testH2Client) {
+				c.writeFrame(t, http2FrameWindowUpdate, 0, 0, make([]byte, 4))
+			}, http2FrameGoAway, http2ProtocolError},
+			{"bad header block", func(t *testing.T, c *testH2Client) {
+				c.writeFrame(t, http2FrameHeaders, http2FlagEndHeaders|http2FlagEndStream, 1, []byte{0x80})
+			}, http2FrameGoAway, http2CompressionError},
+			{"CONTINUATION expected", func(t *testing.T, c *testH2Client) {
+				c.writeFrame(t, http2FrameHeaders, 0, 1, []byte{0x82})
+				c.writeFrame(t, http2FramePing, 0, 0, make([]byte, 8))
+			}, http2FrameGoAway, http2ProtocolError},
+			{"uppercase header", func(t *testing.T, c *testH2Client) {
+				c.writeHeaders(t, 1, true, append(request, "X-Upper", "1")...)
+			}, http2FrameRSTStream, http2ProtocolError},
+			{"connection header", func(t *testing.T, c *testH2Client) {
+				c.writeHeaders(t, 1, true, append(request, "connection", "close")...)
+			}, http2FrameRSTStream, http2ProtocolError},
+			{"no :path", func(t *testing.T, c *testH2Client) {
+				c.writeHeaders(t, 1, true, request[:4]...)
+			}, http2FrameRSTStream, http2ProtocolError},
+			{"bad content-length", func(t *testing.T, c *testH2Client) {
+				c.writeHeaders(t, 1, false, append(request, "content-length", "5")...)
+				c.writeFrame(t, http2FrameData, http2FlagEndStream, 1, []byte("x"))
+			}, http2FrameRSTStream, http2ProtocolError},
+		}
+		for _, tt := range cases {
+			c := dialHTTP2(t, port)
+			tt.send(t, c)
+			if _, code := c.expectFrame(t, tt.frame); code != tt.expected {
+				t.Errorf("%s: expected the error code %d, got %d", tt.name, tt.expected, code)
+			}
+			if tt.frame == http2FrameRSTStream { // the conn goes on
+				c.writeHeaders(t, 3, true, request...)
+				if headers, _ := c.readResponse(t, 3); headers[":status"] != "200" {
+					t.Errorf("%s: expected the conn usable after RST_STREAM, got %v", tt.name, headers)
+				}
+			}
+		}
+	})
+}
+
+func TestHTTP2Shutdown(t *testing.T) {
+	port := testHTTP2PortBase + 2
+
+	started := make(chan struct{})
+	s := HttpServer{Handler: HandlerFunc(func(c *Context) {
+		close(started)
+		<-c.Ctx().Done()
+		c.ResponseText(503, "shutting down")
+	})}
+	go func() {
+		_ = s.ListenAndServe(fmt.Sprintf(":%d", port))
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	c := dialHTTP2(t, port)
+	c.writeHeaders(t, 1, true, ":method", "GET", ":scheme", "http", ":path", "/", ":authority", "localhost")
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+
+	typ, _, _, payload := c.readFrame(t)
+	if typ != http2FrameGoAway || binary.BigEndian.Uint32(payload) != 1 || binary.BigEndian.Uint32(payload[4:]) != http2NoError {
+		t.Fatalf("expected GOAWAY after the stream 1, got %d %x", typ, payload)
+	}
+	if headers, body := c.readResponse(t, 1); headers[":status"] != "503" || body != "shutting down" {
+		t.Errorf("expected the stream in flight responded, got %q %v", body, headers)
+	}
+	if _, err := c.reader.ReadByte(); err != io.EOF {
+		t.Errorf("expected the conn closed, got %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHTTP2RapidReset(t *testing.T) {
+	port := testHTTP2PortBase + 3
+
+	started := make(chan struct{}, http2MaxStreams)
+	release := make(chan struct{})
+	r := NewPrefixRouter("/")
+	r.GET("/block", func(c *Context) { // not cancelled by the reset
+		started <- struct{}{}
+		<-release
+		c.ResponseText(200, "released")
+	})
+	r.GET("/hello", func(c *Context) {
+		c.ResponseText(200, "hello")
+	})
+	go func() {
+		s := HttpServer{Handler: r}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	request := func(path string) []string {
+		return []string{":method", "GET", ":scheme", "http", ":path", path, ":authority", "localhost"}
+	}
+	cancel := binary.BigEndian.AppendUint32(nil, 0x8)
+
+	t.Run("running", func(t *testing.T) {
+		c := dialHTTP2(t, port)
+		id := uint32(1)
+		for i := 0; i < http2MaxStreams; i, id = i+1, id+2 {
+			c.writeHeaders(t, id, true, request("/block")...)
+			<-started
+			c.writeFrame(t, http2FrameRSTStream, 0, id, cancel)
+		}
+		c.writeHeaders(t, id, true, request("/hello")...)
+		if got, code := c.expectFrame(t, http2FrameRSTStream); got != id || code != http2RefusedStream {
+			t.Errorf("expected REFUSED_STREAM of stream %d, with the handlers reset running, got %d of %d", id, code, got)
+		}
+
+		close(release)
+		time.Sleep(200 * time.Millisecond)
+		id += 2
+		c.writeHeaders(t, id, true, request("/hello")...)
+		if headers, body := c.readResponse(t, id); headers[":status"] != "200" || body != "hello" {
+			t.Errorf("expected the stream accepted once the handlers returned, got %q %v", body, headers)
+		}
+	})
+
+	t.Run("resetRate", func(t *testing.T) {
+		c := dialHTTP2(t, port)
+		id := uint32(1)
+		for i := 0; i <= http2MaxResets; i, id = i+1, id+2 {
+			c.writeHeaders(t, id, true, request("/hello")...)
+			c.writeFrame(t, http2FrameRSTStream, 0, id, cancel)
+		}
+		for {
+			typ, _, _, payload := c.readFrame(t)
+			if typ != http2FrameGoAway {
+				continue // the responses of the streams not reset in time
+			}
+			if code := binary.BigEndian.Uint32(payload[4:]); code != http2EnhanceYourCalm {
+				t.Errorf("expected GOAWAY(ENHANCE_YOUR_CALM), got %d", code)
+			}
+			break
+		}
+	})
+}
+
+func TestHTTP2RequestBody(t *testing.T) {
+	port := testHTTP2PortBase + 4
+
+	read := make(chan struct{})
+	r := NewPrefixRouter("/")
+	r.POST("/wait", func(c *Context) {
+		<-read
+		body, _ := io.ReadAll(c.Request.Body)
+		c.ResponseText(200, fmt.Sprint(len(body)))
+	})
+	r.POST("/reject", func(c *Context) {
+		c.ResponseText(413, "too large")
+	})
+	r.GET("/hello", func(c *Context) {
+		c.ResponseText(200, "hello")
+	})
+	go func() {
+		s := HttpServer{Handler: r}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	request := func(method string, path string) []string {
+		return []string{":method", method, ":scheme", "http", ":path", path, ":authority", "localhost"}
+	}
+	chunk := bytes.Repeat([]byte("x"), http2MaxFrameSize)
+	const chunks = http2MaxBufferedBody/http2MaxFrameSize + 1 // larger than buffered
+
+	t.Run("refillOnRead", func(t *testing.T) {
+		c := dialHTTP2(t, port)
+		c.sync(t)
+		c.writeHeaders(t, 1, false, request("POST", "/wait")...)
+		for i := 0; i < chunks; i++ {
+			c.writeFrame(t, http2FrameData, 0, 1, chunk)
+		}
+
+		_ = c.conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		header := make([]byte, http2FrameHeaderLen)
+		if _, err := io.ReadFull(c.reader, header); err == nil {
+			t.Fatalf("expected no WINDOW_UPDATE until the body is read, got type %d of stream %d",
+				header[3], binary.BigEndian.Uint32(header[5:]))
+		}
+		_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		// refilled as read, the conn and the stream
+		close(read)
+		conn, stream, n := 0, 0, chunks*len(chunk)
+		for conn < n || stream < n {
+			typ, _, id, payload := c.readAnyFrame(t)
+			switch {
+			case typ != http2FrameWindowUpdate:
+			case id == 0:
+				conn += int(binary.BigEndian.Uint32(payload))
+			case id == 1:
+				stream += int(binary.BigEndian.Uint32(payload))
+			}
+		}
+		if conn != n || stream != n {
+			t.Errorf("expected the windows refilled by %d, got %d of the conn, %d of the stream", n, conn, stream)
+		}
+		c.writeFrame(t, http2FrameData, http2FlagEndStream, 1, []byte("x"))
+		if headers, body := c.readResponse(t, 1); headers[":status"] != "200" || body != fmt.Sprint(chunks*len(chunk)+1) {
+			t.Errorf("expected the body read as received, got %q %v", body, headers)
+		}
+	})
+
+	t.Run("unreadRefilled", func(t *testing.T) {
+		c := dialHTTP2(t, port)
+		c.sync(t)
+		c.writeHeaders(t, 1, false, request("POST", "/reject")...)
+		for i := 0; i < chunks; i++ {
+			c.writeFrame(t, http2FrameData, 0, 1, chunk)
+		}
+
+		// the response, and the window of the conn refilled by the body
+		// unread, before RST_STREAM(NO_ERROR)
+		var status []hpackField
+		refilled := 0
+		for {
+			typ, _, id, payload := c.readAnyFrame(t)
+			if typ == http2FrameHeaders {
+				status, _ = c.decoder.decode(payload)
+			}
+			if typ == http2FrameWindowUpdate && id == 0 {
+				refilled += int(binary.BigEndian.Uint32(payload))
+			}
+			if typ == http2FrameRSTStream {
+				if code := binary.BigEndian.Uint32(payload); id != 1 || code != http2NoError {
+					t.Errorf("expected RST_STREAM(NO_ERROR) of stream 1, got %d of %d", code, id)
+				}
+				break
+			}
+		}
+		if len(status) == 0 || status[0].value != "413" || refilled != chunks*len(chunk) {
+			t.Errorf("expected 413, and the window refilled by %d, got %v, %d", chunks*len(chunk), status, refilled)
+		}
+	})
+
+	t.Run("stall", func(t *testing.T) {
+		c := dialHTTP2(t, port)
+		start := time.Now()
+		c.writeHeaders(t, 1, false, request("POST", "/reject")...) // and no DATA
+		if id, code := c.expectFrame(t, http2FrameRSTStream); id != 1 || code != http2Cancel {
+			t.Errorf("expected RST_STREAM(CANCEL) of stream 1, got %d of %d", code, id)
+		}
+		if elapsed := time.Since(start); elapsed < ReadRequestBodyTimeout {
+			t.Errorf("expected the stream reset after %v without DATA, got %v", ReadRequestBodyTimeout, elapsed)
+		}
+
+		c.writeHeaders(t, 3, true, request("GET", "/hello")...)
+		if headers, body := c.readResponse(t, 3); headers[":status"] != "200" || body != "hello" {
+			t.Errorf("expected the conn usable after the stall, got %q %v", body, headers)
+		}
+	})
+}
@@ -1,9 +1,22 @@
 package simplehttp
 
 import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -57,8 +70,7 @@ func TestHttp(t *testing.T) {
 	})
 
 	t.Run("handlerPanic", func(t *testing.T) {
-		return
-		// xxx: not working, failed to recover from panic
+		t.Skip("xxx: not working, failed to recover from panic")
 
 		// server
 		go func() {
@@ -172,3 +184,544 @@ func TestChain(t *testing.T) {
 		port++
 	})
 }
+
+func TestRedirect(t *testing.T) {
+	port := testHttpPortBase + 20
+
+	// server
+	go func() {
+		r := NewPrefixRouter("/")
+		r.Use(Logger, Recovery)
+
+		r.GET("/a/b/", func(c *Context) {
+			c.Redirect(302, c.Request.Headers["X-Target"])
+		})
+		r.GET("/local/", func(c *Context) {
+			c.LocalRedirect(301, c.Request.Headers["X-Target"])
+		})
+		r.GET("/bad", func(c *Context) {
+			c.Redirect(200, "/")
+		})
+
+		s := HttpServer{Handler: r}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			panic(err)
+		}
+	}()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	cases := []struct {
+		path             string
+		target           string
+		expectedStatus   int
+		expectedLocation string
+	}{
+		{"/a/b/c?x=1", "d", 302, "/a/b/d"},
+		{"/a/b/c?x=1", "../d?y=2", 302, "/a/d?y=2"},
+		{"/a/b/c?x=1", "", 302, "/a/b/c?x=1"},
+		{"/a/b/c", "/e#f", 302, "/e#f"},
+		{"/a/b/c", "https://example.com/x", 302, "https://example.com/x"},
+		{"/a/b/c", "javascript:alert(1)", 500, ""},
+
+		{"/local/c", "https://evil.com/x?y=1", 301, "/x?y=1"},
+		{"/local/c", "//evil.com/x", 301, "/x"},
+		{"/local/c", "https://evil.com", 301, "/"},
+		{"/local/c", "/\\evil.com/x", 301, "/x"},
+		{"/local/c", "d", 301, "/local/d"},
+		{"/local/c", "/.//evil.com", 301, "/evil.com"},
+		{"/local/c", "/a/..//evil.com", 301, "/evil.com"},
+
+		{"/bad", "", 500, ""},
+	}
+
+	time.Sleep(1 * time.Second)
+
+	for _, tt := range cases {
+		t.Run(tt.path+" "+tt.target, func(t *testing.T) {
+			req, err := http.NewRequest("GET",
+				fmt.Sprintf("http://localhost:%d%s", port, tt.path), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Target", tt.target)
+
+			got, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.StatusCode != tt.expectedStatus {
+				t.Errorf("expected status code %d, got %d",
+					tt.expectedStatus, got.StatusCode)
+			}
+			if location := got.Header.Get("Location"); location != tt.expectedLocation {
+				t.Errorf("expected Location %q, got %q", tt.expectedLocation, location)
+			}
+		})
+	}
+}
+
+func TestAttachment(t *testing.T) {
+	port := testHttpPortBase + 30
+
+	dir := t.TempDir()
+	writeTestFile(t, dir+"/report.txt", "report")
+
+	// server
+	go func() {
+		r := NewPrefixRouter("/")
+		r.GET("/file", func(c *Context) {
+			c.File(dir + "/report.txt")
+		})
+		r.GET("/ascii", func(c *Context) {
+			c.Attachment(dir+"/report.txt", "")
+		})
+		r.GET("/utf8", func(c *Context) {
+			c.Attachment(dir+"/report.txt", "报告 \"2022\".txt")
+		})
+		r.GET("/missing", func(c *Context) {
+			c.Attachment(dir+"/missing.txt", "")
+		})
+
+		s := HttpServer{Handler: r}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			panic(err)
+		}
+	}()
+
+	cases := []struct {
+		path                string
+		expectedStatus      int
+		expectedDisposition string
+	}{
+		{"/file", 200, ""},
+		{"/ascii", 200, `attachment; filename="report.txt"`},
+		{"/utf8", 200, `attachment; filename="__ _2022_.txt"; filename*=UTF-8''%E6%8A%A5%E5%91%8A%20%222022%22.txt`},
+		{"/missing", 404, ""},
+	}
+
+	time.Sleep(1 * time.Second)
+
+	for _, tt := range cases {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := http.Get(fmt.Sprintf("http://localhost:%d%s", port, tt.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.StatusCode != tt.expectedStatus {
+				t.Errorf("expected status code %d, got %d",
+					tt.expectedStatus, got.StatusCode)
+			}
+			if d := got.Header.Get("Content-Disposition"); d != tt.expectedDisposition {
+				t.Errorf("expected Content-Disposition %q, got %q", tt.expectedDisposition, d)
+			}
+		})
+	}
+}
+
+func TestAbort(t *testing.T) {
+	port := testHttpPortBase + 40
+
+	// server
+	go func() {
+		auth := func(c *Context) {
+			if c.Request.Headers["Authorization"] == "" {
+				c.AbortWithJSON(401, map[string]string{"error": "unauthorized"})
+				return
+			}
+			c.Next()
+		}
+		never := func(c *Context) {
+			panic("handler after Abort called")
+		}
+
+		r := NewPrefixRouter("/")
+		r.Use(Logger, Recovery, ErrorHandler)
+
+		r.GET("/auth", auth, func(c *Context) {
+			c.ResponseText(200, "secret")
+		})
+		r.GET("/abort", func(c *Context) {
+			c.AbortWithStatus(403)
+			if !c.IsAborted() {
+				panic("expected IsAborted")
+			}
+		}, never)
+		r.GET("/errors", func(c *Context) {
+			c.Error(errors.New("first"))
+			c.Error(nil)
+			c.Next()
+		}, func(c *Context) {
+			c.Error(errors.New("second"))
+			c.ResponseText(200, "partial")
+		})
+		r.GET("/errors-status", func(c *Context) {
+			c.Error(errors.New("teapot"))
+			c.AbortWithStatus(418)
+		}, never)
+
+		s := HttpServer{Handler: r}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			panic(err)
+		}
+	}()
+
+	cases := []struct {
+		path           string
+		auth           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"/auth", "", 401, `{"error":"unauthorized"}` + "\n"},
+		{"/auth", "Basic xxx", 200, "secret"},
+		{"/abort", "", 403, ""},
+		{"/errors", "", 500, `{"errors":["first","second"]}` + "\n"},
+		{"/errors-status", "", 418, `{"errors":["teapot"]}` + "\n"},
+	}
+
+	time.Sleep(1 * time.Second)
+
+	for _, tt := range cases {
+		t.Run(tt.path+" "+tt.auth, func(t *testing.T) {
+			req, err := http.NewRequest("GET",
+				fmt.Sprintf("http://localhost:%d%s", port, tt.path), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+
+			got, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.StatusCode != tt.expectedStatus {
+				t.Errorf("expected status code %d, got %d",
+					tt.expectedStatus, got.StatusCode)
+			}
+			b, err := io.ReadAll(got.Body)
+			if err != nil {
+				t.Error(err)
+			}
+			if string(b) != tt.expectedBody {
+				t.Errorf("expected %s, got %s", tt.expectedBody, string(b))
+			}
+		})
+	}
+}
+
+func TestContextCtx(t *testing.T) {
+	port := testHttpPortBase + 50
+
+	canceled := make(chan error, 1)
+	s := &HttpServer{RequestTimeout: 500 * time.Millisecond}
+	served := make(chan error, 1)
+
+	// server
+	go func() {
+		r := NewPrefixRouter("/")
+		r.GET("/value", func(c *Context) {
+			c.Set("user", "alice")
+			c.ResponseText(200, fmt.Sprint(c.Ctx().Value("user")))
+		})
+		r.GET("/timeout", func(c *Context) {
+			<-c.Ctx().Done()
+			c.ResponseText(200, c.Ctx().Err().Error())
+		})
+		r.GET("/shorter", func(c *Context) {
+			ctx, cancel := context.WithTimeout(c.Ctx(), 10*time.Millisecond)
+			defer cancel()
+			c.WithContext(ctx)
+
+			st := time.Now()
+			<-c.Ctx().Done()
+			c.ResponseText(200, fmt.Sprint(time.Since(st) < 250*time.Millisecond))
+		})
+		r.GET("/wait", func(c *Context) {
+			<-c.Ctx().Done()
+			canceled <- c.Ctx().Err()
+		})
+
+		s.Handler = r
+		served <- s.ListenAndServe(fmt.Sprintf(":%d", port))
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	t.Run("value", func(t *testing.T) {
+		testRouter(t, port, "GET", "/value", 200, "alice")
+	})
+	t.Run("timeout", func(t *testing.T) {
+		testRouter(t, port, "GET", "/timeout", 200, context.DeadlineExceeded.Error())
+	})
+	t.Run("withContext", func(t *testing.T) {
+		testRouter(t, port, "GET", "/shorter", 200, "true")
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = fmt.Fprintf(conn, "GET /wait HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		time.Sleep(100 * time.Millisecond)
+		_ = conn.Close()
+
+		select {
+		case err := <-canceled:
+			if err != context.Canceled {
+				t.Errorf("expected %v, got %v", context.Canceled, err)
+			}
+		case <-time.After(400 * time.Millisecond): // before RequestTimeout
+			t.Error("expected context cancelled on client disconnect")
+		}
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		go func() {
+			_, _ = http.Get(fmt.Sprintf("http://localhost:%d/wait", port))
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		if err := s.Shutdown(context.Background()); err != nil {
+			t.Error(err)
+		}
+		select {
+		case err := <-canceled:
+			if err != context.Canceled {
+				t.Errorf("expected %v, got %v", context.Canceled, err)
+			}
+		default:
+			t.Error("expected context cancelled on shutdown")
+		}
+		if err := <-served; err != ErrServerClosed {
+			t.Errorf("expected %v, got %v", ErrServerClosed, err)
+		}
+	})
+}
+
+func TestExpectContinue(t *testing.T) {
+	port := testHttpPortBase + 60
+	immediatePort := testHttpPortBase + 61
+
+	// server
+	r := NewPrefixRouter("/")
+	r.POST("/upload", func(c *Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		c.ResponseText(200, fmt.Sprintf("%s %v", body, err))
+	})
+	r.POST("/reject", func(c *Context) {
+		c.ResponseText(413, "too large")
+	})
+	r.GET("/hints", func(c *Context) {
+		err := c.WriteInformational(103, map[string]string{"Link": "</style.css>; rel=preload"})
+		c.ResponseText(200, fmt.Sprint(err))
+	})
+	cancelled := make(chan struct{}, 1)
+	r.POST("/abandon", func(c *Context) {
+		if strings.HasSuffix(c.Request.Url, "?read=1") {
+			_, _ = io.ReadFull(c.Request.Body, make([]byte, 1))
+		}
+		select { // the rest of the body unread
+		case <-c.Ctx().Done():
+			cancelled <- struct{}{}
+		case <-time.After(3 * time.Second):
+		}
+		c.ResponseText(200, "done")
+	})
+	go func() {
+		s := HttpServer{Handler: r}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			panic(err)
+		}
+	}()
+	go func() {
+		s := HttpServer{Handler: r, ContinueImmediately: true}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", immediatePort)); err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	// dial sends the request head, and returns the reader of the responses
+	dial := func(t *testing.T, port int, head string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.WriteString(conn, head); err != nil {
+			t.Fatal(err)
+		}
+		return conn, bufio.NewReader(conn)
+	}
+	readResponse := func(t *testing.T, reader *bufio.Reader) (*http.Response, string) {
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+	upload := "POST /upload HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n"
+
+	t.Run("continue", func(t *testing.T) {
+		conn, reader := dial(t, port, upload)
+		defer conn.Close()
+		if resp, _ := readResponse(t, reader); resp.StatusCode != 100 {
+			t.Fatalf("expected 100 Continue before the body, got %s", resp.Status)
+		}
+		_, _ = io.WriteString(conn, "hello")
+		if resp, body := readResponse(t, reader); resp.StatusCode != 200 || body != "hello <nil>" {
+			t.Errorf("expected the body read, got %s %q", resp.Status, body)
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		conn, reader := dial(t, port, strings.Replace(upload, "/upload", "/reject", 1))
+		defer conn.Close()
+		if resp, body := readResponse(t, reader); resp.StatusCode != 413 || body != "too large" {
+			t.Errorf("expected 413 without 100 Continue, got %s %q", resp.Status, body)
+		}
+	})
+
+	t.Run("immediately", func(t *testing.T) {
+		conn, reader := dial(t, immediatePort, strings.Replace(upload, "/upload", "/reject", 1))
+		defer conn.Close()
+		if resp, _ := readResponse(t, reader); resp.StatusCode != 100 {
+			t.Fatalf("expected 100 Continue right away, got %s", resp.Status)
+		}
+		_, _ = io.WriteString(conn, "hello")
+		if resp, _ := readResponse(t, reader); resp.StatusCode != 413 {
+			t.Errorf("expected 413 after the body, got %s", resp.Status)
+		}
+	})
+
+	t.Run("abandoned", func(t *testing.T) {
+		for _, url := range []string{"/abandon", "/abandon?read=1"} {
+			conn, reader := dial(t, port, strings.Replace(upload, "/upload", url, 1))
+			if strings.HasSuffix(url, "?read=1") {
+				if resp, _ := readResponse(t, reader); resp.StatusCode != 100 {
+					t.Fatalf("%s: expected 100 Continue before the body, got %s", url, resp.Status)
+				}
+				_, _ = io.WriteString(conn, "hello")
+			}
+			time.Sleep(100 * time.Millisecond)
+			_ = conn.Close()
+
+			select {
+			case <-cancelled:
+			case <-time.After(2 * time.Second):
+				t.Errorf("%s: expected the request cancelled on disconnect, with the body unread", url)
+			}
+		}
+	})
+
+	t.Run("earlyHints", func(t *testing.T) {
+		conn, reader := dial(t, port, "GET /hints HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		defer conn.Close()
+		resp, _ := readResponse(t, reader)
+		if resp.StatusCode != 103 || resp.Header.Get("Link") != "</style.css>; rel=preload" {
+			t.Fatalf("expected 103 Early Hints, got %s %v", resp.Status, resp.Header)
+		}
+		if resp, body := readResponse(t, reader); resp.StatusCode != 200 || body != "<nil>" {
+			t.Errorf("expected 200 after 103, got %s %q", resp.Status, body)
+		}
+
+		// not to HTTP/1.0 clients
+		conn, reader = dial(t, port, "GET /hints HTTP/1.0\r\n\r\n")
+		defer conn.Close()
+		if resp, body := readResponse(t, reader); resp.StatusCode != 200 || body == "<nil>" {
+			t.Errorf("expected no 103 to HTTP/1.0, got %s %q", resp.Status, body)
+		}
+	})
+}
+
+func TestTypedValues(t *testing.T) {
+	type user struct{ name string }
+
+	userKey := NewKey[*user]("user")
+	otherUserKey := NewKey[*user]("user") // same name, different key
+	countKey := NewKey[int]("count")
+
+	c := NewContext(NewRequest(), NewResponse())
+
+	alice := &user{name: "alice"}
+	SetValue(c, userKey, alice)
+	SetValue(c, countKey, 42)
+	c.Set("user", "string key")
+
+	if got, ok := GetValue(c, userKey); !ok || got != alice {
+		t.Errorf("expected %v, got %v (ok=%v)", alice, got, ok)
+	}
+	if got, ok := GetValue(c, otherUserKey); ok || got != nil {
+		t.Errorf("expected no value for a different key, got %v (ok=%v)", got, ok)
+	}
+	if got := MustGetValue(c, countKey); got != 42 {
+		t.Errorf("expected 42, got %v", got)
+	}
+	if got, _ := c.Get("user"); got != "string key" {
+		t.Errorf("expected string key value, got %v", got)
+	}
+	if got := c.Ctx().Value(userKey); got != alice {
+		t.Errorf("expected %v from Ctx().Value, got %v", alice, got)
+	}
+
+	DeleteValue(c, countKey)
+	if _, ok := GetValue(c, countKey); ok {
+		t.Error("expected value deleted")
+	}
+
+	// nil stored under an interface type
+	errKey := NewKey[error]("err")
+	SetValue(c, errKey, nil)
+	if got, ok := GetValue(c, errKey); !ok || got != nil {
+		t.Errorf("expected a nil error stored, got %v %v", got, ok)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected MustGetValue to panic for a missing key")
+		}
+	}()
+	MustGetValue(c, countKey)
+}
+
+// testCertFiles generates a self-signed certificate for localhost,
+// returns the paths of the cert and key PEM files.
+func testCertFiles(t testing.TB) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestFile(t, certFile, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	writeTestFile(t, keyFile, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})))
+	return certFile, keyFile
+}
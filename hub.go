@@ -0,0 +1,342 @@
+package simplehttp
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// HubQueueSize is the default max number of messages queued per
+	// subscriber of a Hub, see WithHubQueueSize.
+	HubQueueSize = 64
+)
+
+// HubDropPolicy is what a Hub does with the messages published to a
+// subscriber whose queue is full, i.e. a slow consumer.
+type HubDropPolicy int
+
+const (
+	// HubDropOldest discards the oldest message queued for the new one.
+	HubDropOldest HubDropPolicy = iota
+	// HubDropNewest discards the new message.
+	HubDropNewest
+	// HubDropSubscriber unsubscribes the subscriber, e.g. to disconnect
+	// the client, which may reconnect and catch up with the replay.
+	HubDropSubscriber
+)
+
+// HubMessage is a message published to a Hub.
+type HubMessage struct {
+	ID    string `json:"id"` // increasing in the Hub
+	Topic string `json:"topic"`
+	Event string `json:"event,omitempty"`
+	Data  string `json:"data"`
+
+	seq uint64
+}
+
+// region Hub
+
+// Hub is a topic-based pub/sub hub, broadcasting the messages published
+// to the subscribers of the topics, e.g. SSE and WebSocket clients
+// (see ServeSSE and ServeWebSocket). It's safe for concurrent use, and
+// Publish never blocks on the subscribers, so it can be called from
+// anywhere in the process:
+//
+//	hub := NewHub(WithHubReplay(100))
+//	r.GET("/events", func(c *Context) {
+//		hub.ServeSSE(c, "news")
+//	})
+//	r.GET("/ws", WebSocket(func(c *Context, ws *WebSocketConn) {
+//		hub.ServeWebSocket(c, ws, "news")
+//	}))
+//
+//	// somewhere else
+//	hub.Publish("news", "headline", "Hello, world!")
+type Hub struct {
+	queueSize  int
+	dropPolicy HubDropPolicy
+	replaySize int
+
+	mu     sync.Mutex
+	seq    uint64
+	topics map[string]*hubTopic
+}
+
+// hubTopic is a topic of a Hub.
+type hubTopic struct {
+	subscribers map[*HubSubscriber]struct{}
+	replay      []HubMessage // ring buffer of the last messages
+	next        int          // index in replay of the next message
+}
+
+// HubOption configures a Hub.
+type HubOption func(h *Hub)
+
+// NewHub makes a Hub.
+func NewHub(options ...HubOption) *Hub {
+	h := &Hub{
+		queueSize:  HubQueueSize,
+		dropPolicy: HubDropOldest,
+		topics:     make(map[string]*hubTopic),
+	}
+	for _, option := range options {
+		option(h)
+	}
+	if h.queueSize < 1 {
+		h.queueSize = 1
+	}
+	return h
+}
+
+// WithHubQueueSize sets the max number of messages queued per
+// subscriber, HubQueueSize by default.
+func WithHubQueueSize(size int) HubOption {
+	return func(h *Hub) {
+		h.queueSize = size
+	}
+}
+
+// WithHubDropPolicy sets what to do with the messages to a subscriber
+// whose queue is full, HubDropOldest by default.
+func WithHubDropPolicy(policy HubDropPolicy) HubOption {
+	return func(h *Hub) {
+		h.dropPolicy = policy
+	}
+}
+
+// WithHubReplay keeps the last size messages of each topic, to replay
+// to the new subscribers, see Subscribe. No replay by default.
+func WithHubReplay(size int) HubOption {
+	return func(h *Hub) {
+		h.replaySize = size
+	}
+}
+
+// Publish publishes a message of the event type ("" for none) and the
+// data to the topic, and returns it.
+func (h *Hub) Publish(topic string, event string, data string) HubMessage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seq++
+	m := HubMessage{ID: strconv.FormatUint(h.seq, 10), Topic: topic, Event: event, Data: data, seq: h.seq}
+	t := h.topic(topic)
+	if h.replaySize > 0 {
+		if len(t.replay) < h.replaySize {
+			t.replay = append(t.replay, m)
+		} else {
+			t.replay[t.next] = m
+		}
+		t.next = (t.next + 1) % h.replaySize
+	}
+
+	for s := range t.subscribers {
+		h.deliver(s, m)
+	}
+	h.dropTopicIfUnused(topic, t)
+	return m
+}
+
+// deliver queues the message m to the subscriber s, by the drop policy
+// if the queue is full. h.mu is held.
+func (h *Hub) deliver(s *HubSubscriber, m HubMessage) {
+	for {
+		select {
+		case s.queue <- m:
+			return
+		default:
+		}
+
+		switch h.dropPolicy {
+		case HubDropNewest:
+			atomic.AddUint64(&s.dropped, 1)
+			return
+		case HubDropSubscriber:
+			atomic.AddUint64(&s.dropped, 1)
+			h.unsubscribe(s)
+			return
+		default: // HubDropOldest
+			select {
+			case <-s.queue:
+				atomic.AddUint64(&s.dropped, 1)
+			default: // consumed meanwhile
+			}
+		}
+	}
+}
+
+// Subscribe subscribes to the topics. The messages kept for replay
+// (see WithHubReplay) after the message of lastID, or all of them if
+// lastID is "", are queued first (up to the queue size), then the ones
+// published.
+func (h *Hub) Subscribe(lastID string, topics ...string) *HubSubscriber {
+	s := &HubSubscriber{
+		hub:    h,
+		topics: topics,
+		queue:  make(chan HubMessage, h.queueSize),
+	}
+	after, _ := strconv.ParseUint(lastID, 10, 64)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var replay []HubMessage
+	for _, topic := range topics {
+		t := h.topic(topic)
+		t.subscribers[s] = struct{}{}
+		for _, m := range t.replay {
+			if m.seq > after {
+				replay = append(replay, m)
+			}
+		}
+	}
+	sort.Slice(replay, func(i, j int) bool { return replay[i].seq < replay[j].seq })
+	if len(replay) > h.queueSize {
+		replay = replay[len(replay)-h.queueSize:]
+	}
+	for _, m := range replay {
+		s.queue <- m
+	}
+	return s
+}
+
+// Subscribers returns the number of subscribers of the topic.
+func (h *Hub) Subscribers(topic string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if t, ok := h.topics[topic]; ok {
+		return len(t.subscribers)
+	}
+	return 0
+}
+
+// topic returns the topic, made if not exists. h.mu is held.
+func (h *Hub) topic(topic string) *hubTopic {
+	t, ok := h.topics[topic]
+	if !ok {
+		t = &hubTopic{subscribers: make(map[*HubSubscriber]struct{})}
+		h.topics[topic] = t
+	}
+	return t
+}
+
+// dropTopicIfUnused drops the topic if it has no subscribers nor
+// messages to replay. h.mu is held.
+func (h *Hub) dropTopicIfUnused(topic string, t *hubTopic) {
+	if len(t.subscribers) == 0 && len(t.replay) == 0 {
+		delete(h.topics, topic)
+	}
+}
+
+// unsubscribe removes the subscriber s from its topics and closes its
+// queue. h.mu is held.
+func (h *Hub) unsubscribe(s *HubSubscriber) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	for _, topic := range s.topics {
+		if t, ok := h.topics[topic]; ok {
+			delete(t.subscribers, s)
+			h.dropTopicIfUnused(topic, t)
+		}
+	}
+	close(s.queue)
+}
+
+// ServeSSE streams the messages of the topics to the client of c as
+// Server-Sent Events (see Context.SSE), with the event types and ids of
+// the messages, until the client disconnects, or it's unsubscribed as
+// a slow consumer (HubDropSubscriber). A reconnecting client gets the
+// messages missed (Last-Event-ID) from the replay.
+func (h *Hub) ServeSSE(c *Context, topics ...string) {
+	stream, err := c.SSE()
+	if err != nil {
+		c.ResponseText(500, "Internal Server Error")
+		return
+	}
+	s := h.Subscribe(stream.LastEventID(), topics...)
+	defer s.Close()
+
+	for {
+		select {
+		case <-stream.Done():
+			return
+		case m, ok := <-s.Messages():
+			if !ok {
+				return
+			}
+			if err := stream.Send(m.Event, m.ID, m.Data); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// ServeWebSocket sends the messages of the topics to the client of ws,
+// as text messages of the HubMessage in JSON, until the client closes
+// the conn, or it's unsubscribed as a slow consumer (HubDropSubscriber),
+// closing with WebSocketClosePolicyViolation. The messages from the
+// client are discarded. The messages kept for replay are sent first.
+func (h *Hub) ServeWebSocket(c *Context, ws *WebSocketConn, topics ...string) {
+	s := h.Subscribe("", topics...)
+	defer s.Close()
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case m, ok := <-s.Messages():
+			if !ok {
+				_ = ws.Close(WebSocketClosePolicyViolation, "too slow")
+				return
+			}
+			data, _ := json.Marshal(m)
+			if err := ws.WriteMessage(WebSocketText, data); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// HubSubscriber is a subscriber of topics of a Hub, see Hub.Subscribe.
+type HubSubscriber struct {
+	hub     *Hub
+	topics  []string
+	queue   chan HubMessage
+	closed  bool   // guarded by hub.mu
+	dropped uint64 // atomic
+}
+
+// Messages returns the queue of the messages, which is closed when
+// unsubscribed.
+func (s *HubSubscriber) Messages() <-chan HubMessage {
+	return s.queue
+}
+
+// Dropped returns the number of messages dropped as the queue was full.
+func (s *HubSubscriber) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close unsubscribes. It's fine to Close twice.
+func (s *HubSubscriber) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.unsubscribe(s)
+}
+
+// endregion Hub
@@ -0,0 +1,205 @@
+package simplehttp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testHubPortBase = 24130
+
+// queuedIDs returns the ids of the messages queued to s, until closed or
+// none left.
+func queuedIDs(s *HubSubscriber) string {
+	var ids []string
+	for {
+		select {
+		case m, ok := <-s.Messages():
+			if !ok {
+				return strings.Join(append(ids, "closed"), " ")
+			}
+			ids = append(ids, m.ID)
+		default:
+			return strings.Join(ids, " ")
+		}
+	}
+}
+
+// waitSubscribers waits until the topic of the hub has n subscribers.
+func waitSubscribers(t *testing.T, hub *Hub, topic string, n int) {
+	for i := 0; i < 100 && hub.Subscribers(topic) != n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := hub.Subscribers(topic); got != n {
+		t.Fatalf("expected %d subscribers of %s, got %d", n, topic, got)
+	}
+}
+
+func TestHub(t *testing.T) {
+	t.Run("fanOut", func(t *testing.T) {
+		hub := NewHub()
+		a := hub.Subscribe("", "news")
+		b := hub.Subscribe("", "news", "sports")
+		c := hub.Subscribe("", "sports")
+
+		hub.Publish("news", "", "1")
+		hub.Publish("sports", "", "2")
+		hub.Publish("weather", "", "3")
+		hub.Publish("news", "", "4")
+		if got := queuedIDs(a); got != "1 4" {
+			t.Errorf("expected 1 4 to a, got %s", got)
+		}
+		if got := queuedIDs(b); got != "1 2 4" {
+			t.Errorf("expected 1 2 4 to b, got %s", got)
+		}
+		if got := queuedIDs(c); got != "2" {
+			t.Errorf("expected 2 to c, got %s", got)
+		}
+
+		b.Close()
+		b.Close()
+		if got := queuedIDs(b); got != "closed" {
+			t.Errorf("expected b closed, got %s", got)
+		}
+		if hub.Subscribers("news") != 1 || hub.Subscribers("sports") != 1 {
+			t.Errorf("expected b unsubscribed, got %d %d", hub.Subscribers("news"), hub.Subscribers("sports"))
+		}
+	})
+
+	t.Run("dropPolicies", func(t *testing.T) {
+		cases := []struct {
+			policy          HubDropPolicy
+			expectedIDs     string
+			expectedDropped uint64
+		}{
+			{HubDropOldest, "4 5", 3},
+			{HubDropNewest, "1 2", 3},
+			{HubDropSubscriber, "1 2 closed", 1},
+		}
+		for _, tt := range cases {
+			hub := NewHub(WithHubQueueSize(2), WithHubDropPolicy(tt.policy))
+			s := hub.Subscribe("", "news")
+			for i := 0; i < 5; i++ {
+				hub.Publish("news", "", "slow")
+			}
+			if got := queuedIDs(s); got != tt.expectedIDs || s.Dropped() != tt.expectedDropped {
+				t.Errorf("expected %s with %d dropped by the policy %d, got %s with %d",
+					tt.expectedIDs, tt.expectedDropped, tt.policy, got, s.Dropped())
+			}
+		}
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		hub := NewHub(WithHubReplay(3), WithHubQueueSize(4))
+		for i := 0; i < 5; i++ {
+			hub.Publish("news", "", "old")
+			hub.Publish("sports", "", "old")
+		}
+		cases := []struct {
+			lastID   string
+			topics   []string
+			expected string
+		}{
+			{"", []string{"news"}, "5 7 9"},
+			{"6", []string{"news"}, "7 9"},
+			{"9", []string{"news"}, ""},
+			{"", []string{"news", "sports"}, "7 8 9 10"}, // up to the queue size
+			{"7", []string{"sports", "news"}, "8 9 10"},
+		}
+		for _, tt := range cases {
+			s := hub.Subscribe(tt.lastID, tt.topics...)
+			if got := queuedIDs(s); got != tt.expected {
+				t.Errorf("expected %s replayed after %q of %v, got %s", tt.expected, tt.lastID, tt.topics, got)
+			}
+			s.Close()
+		}
+	})
+}
+
+func TestHubServe(t *testing.T) {
+	port := testHubPortBase
+
+	hub := NewHub(WithHubReplay(10))
+
+	// server
+	go func() {
+		r := NewPrefixRouter("/")
+		r.GET("/events", func(c *Context) {
+			hub.ServeSSE(c, "news")
+		})
+		r.GET("/ws", WebSocket(func(c *Context, ws *WebSocketConn) {
+			hub.ServeWebSocket(c, ws, "news")
+		}))
+
+		s := HttpServer{Handler: r}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	hub.Publish("news", "headline", "missed")
+	hub.Publish("news", "headline", "replayed")
+
+	t.Run("sse", func(t *testing.T) {
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, _ = io.WriteString(conn, "GET /events HTTP/1.1\r\nHost: localhost\r\nLast-Event-ID: 1\r\n\r\n")
+		got, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		waitSubscribers(t, hub, "news", 1)
+		m := hub.Publish("news", "", "live")
+		expected := "event: headline\nid: 2\ndata: replayed\n\n" +
+			"id: " + m.ID + "\ndata: live\n\n"
+		b := make([]byte, len(expected))
+		if _, err := io.ReadFull(got.Body, b); err != nil || string(b) != expected {
+			t.Errorf("expected\n%q\ngot\n%q %v", expected, b, err)
+		}
+
+		_ = conn.Close()
+		waitSubscribers(t, hub, "news", 0)
+	})
+
+	t.Run("webSocket", func(t *testing.T) {
+		c, resp := dialWebSocket(t, port, "/ws", nil)
+		if resp.StatusCode != 101 {
+			t.Fatalf("expected 101, got %d", resp.StatusCode)
+		}
+		waitSubscribers(t, hub, "news", 1)
+		hub.Publish("news", "", "to ws")
+
+		var messages []HubMessage
+		for len(messages) < 4 { // the 3 replayed and the new one
+			_, payload, err := c.readFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var m HubMessage
+			if err := json.Unmarshal(payload, &m); err != nil {
+				t.Fatal(err)
+			}
+			messages = append(messages, m)
+		}
+		if last := messages[3]; last.Topic != "news" || last.Data != "to ws" {
+			t.Errorf("expected the new message last, got %+v", messages)
+		}
+
+		c.writeFrame(t, 0x88, closePayload(WebSocketCloseNormal, ""))
+		c.expectClose(t, WebSocketCloseNormal)
+		waitSubscribers(t, hub, "news", 0)
+	})
+}
@@ -0,0 +1,296 @@
+package simplehttp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	pathLib "path"
+	"strings"
+	"sync"
+)
+
+// sniffLen is the number of bytes to sniff the MIME type of contents.
+const sniffLen = 512
+
+// region MIME types
+
+var (
+	mimeTypesMu sync.RWMutex
+	// mimeTypes maps extensions (lower case, with the dot) to MIME types.
+	mimeTypes = map[string]string{
+		// text
+		".html":        "text/html; charset=utf-8",
+		".htm":         "text/html; charset=utf-8",
+		".css":         "text/css; charset=utf-8",
+		".js":          "text/javascript; charset=utf-8",
+		".mjs":         "text/javascript; charset=utf-8",
+		".txt":         "text/plain; charset=utf-8",
+		".text":        "text/plain; charset=utf-8",
+		".log":         "text/plain; charset=utf-8",
+		".md":          "text/markdown; charset=utf-8",
+		".markdown":    "text/markdown; charset=utf-8",
+		".csv":         "text/csv; charset=utf-8",
+		".tsv":         "text/tab-separated-values; charset=utf-8",
+		".xml":         "text/xml; charset=utf-8",
+		".ics":         "text/calendar; charset=utf-8",
+		".vtt":         "text/vtt; charset=utf-8",
+		".yaml":        "text/yaml; charset=utf-8",
+		".yml":         "text/yaml; charset=utf-8",
+		".json":        "application/json",
+		".map":         "application/json",
+		".jsonld":      "application/ld+json",
+		".webmanifest": "application/manifest+json",
+		".xhtml":       "application/xhtml+xml",
+		".rss":         "application/rss+xml",
+		".atom":        "application/atom+xml",
+		".wasm":        "application/wasm",
+
+		// images
+		".png":  "image/png",
+		".apng": "image/apng",
+		".jpg":  "image/jpeg",
+		".jpeg": "image/jpeg",
+		".gif":  "image/gif",
+		".webp": "image/webp",
+		".avif": "image/avif",
+		".svg":  "image/svg+xml",
+		".ico":  "image/vnd.microsoft.icon",
+		".bmp":  "image/bmp",
+		".tif":  "image/tiff",
+		".tiff": "image/tiff",
+
+		// fonts
+		".woff":  "font/woff",
+		".woff2": "font/woff2",
+		".ttf":   "font/ttf",
+		".otf":   "font/otf",
+		".eot":   "application/vnd.ms-fontobject",
+
+		// audio & video
+		".mp3":  "audio/mpeg",
+		".wav":  "audio/wav",
+		".oga":  "audio/ogg",
+		".ogg":  "audio/ogg",
+		".opus": "audio/opus",
+		".flac": "audio/flac",
+		".aac":  "audio/aac",
+		".m4a":  "audio/mp4",
+		".mp4":  "video/mp4",
+		".m4v":  "video/mp4",
+		".webm": "video/webm",
+		".ogv":  "video/ogg",
+		".mov":  "video/quicktime",
+		".avi":  "video/x-msvideo",
+		".mkv":  "video/x-matroska",
+		".m3u8": "application/vnd.apple.mpegurl",
+		".ts":   "video/mp2t",
+
+		// documents & archives
+		".pdf":  "application/pdf",
+		".rtf":  "application/rtf",
+		".doc":  "application/msword",
+		".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		".xls":  "application/vnd.ms-excel",
+		".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		".ppt":  "application/vnd.ms-powerpoint",
+		".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+		".odt":  "application/vnd.oasis.opendocument.text",
+		".epub": "application/epub+zip",
+		".zip":  "application/zip",
+		".gz":   "application/gzip",
+		".tgz":  "application/gzip",
+		".bz2":  "application/x-bzip2",
+		".xz":   "application/x-xz",
+		".zst":  "application/zstd",
+		".tar":  "application/x-tar",
+		".7z":   "application/x-7z-compressed",
+		".rar":  "application/vnd.rar",
+		".jar":  "application/java-archive",
+
+		// binaries
+		".bin": "application/octet-stream",
+		".exe": "application/octet-stream",
+		".dll": "application/octet-stream",
+		".so":  "application/octet-stream",
+		".iso": "application/octet-stream",
+		".dmg": "application/octet-stream",
+		".deb": "application/vnd.debian.binary-package",
+		".apk": "application/vnd.android.package-archive",
+	}
+)
+
+// RegisterMimeType associates the extension ext (e.g. ".wasm" or "wasm")
+// with the MIME type typ, replacing the existing one, for the FileServer.
+// The charset=utf-8 parameter is added to text/* types without a charset.
+func RegisterMimeType(ext string, typ string) {
+	ext = strings.ToLower(ext)
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	if strings.HasPrefix(typ, "text/") && !strings.Contains(typ, "charset=") {
+		typ += "; charset=utf-8"
+	}
+
+	mimeTypesMu.Lock()
+	defer mimeTypesMu.Unlock()
+	mimeTypes[ext] = typ
+}
+
+// SystemMimeTypesFiles are the well-known paths of the system mime.types
+// files, loaded by LoadMimeTypes if no file is given.
+var SystemMimeTypesFiles = []string{
+	"/etc/mime.types",
+	"/etc/apache2/mime.types",
+	"/etc/apache/mime.types",
+	"/etc/httpd/conf/mime.types",
+}
+
+// LoadMimeTypes registers the MIME types of the mime.types files,
+// or the SystemMimeTypesFiles (those not exist are skipped) if no file
+// is given. The format of each line is:
+//
+//	# comment
+//	type/subtype	ext1 ext2 ...
+func LoadMimeTypes(files ...string) error {
+	system := len(files) == 0
+	if system {
+		files = SystemMimeTypesFiles
+	}
+
+	for _, file := range files {
+		f, err := os.Open(file)
+		if system && errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = parseMimeTypes(f)
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseMimeTypes registers the MIME types read from r in the mime.types format.
+func parseMimeTypes(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.Contains(fields[0], "/") {
+			continue
+		}
+		for _, ext := range fields[1:] {
+			RegisterMimeType(ext, fields[0])
+		}
+	}
+	return scanner.Err()
+}
+
+// mimeType returns the MIME type registered for the extension of the path,
+// or "" if unknown.
+func mimeType(path string) string {
+	mimeTypesMu.RLock()
+	defer mimeTypesMu.RUnlock()
+	return mimeTypes[strings.ToLower(pathLib.Ext(path))]
+}
+
+// sniffSignature is a magic number at the beginning of contents of a type.
+type sniffSignature struct {
+	offset int
+	magic  string
+	typ    string
+}
+
+// sniffSignatures are the signatures of binary types, checked in order.
+var sniffSignatures = []sniffSignature{
+	{0, "%PDF-", "application/pdf"},
+	{0, "\x89PNG\r\n\x1a\n", "image/png"},
+	{0, "\xff\xd8\xff", "image/jpeg"},
+	{0, "GIF87a", "image/gif"},
+	{0, "GIF89a", "image/gif"},
+	{8, "WEBP", "image/webp"}, // RIFF....WEBP
+	{8, "WAVE", "audio/wav"},  // RIFF....WAVE
+	{8, "AVI ", "video/x-msvideo"},
+	{0, "BM", "image/bmp"},
+	{0, "\x00\x00\x01\x00", "image/vnd.microsoft.icon"},
+	{4, "ftypavif", "image/avif"},
+	{4, "ftyp", "video/mp4"},
+	{0, "\x1a\x45\xdf\xa3", "video/webm"},
+	{0, "OggS\x00", "application/ogg"},
+	{0, "ID3", "audio/mpeg"},
+	{0, "fLaC", "audio/flac"},
+	{0, "wOFF", "font/woff"},
+	{0, "wOF2", "font/woff2"},
+	{0, "\x00\x01\x00\x00", "font/ttf"},
+	{0, "OTTO", "font/otf"},
+	{0, "\x00asm", "application/wasm"},
+	{0, "PK\x03\x04", "application/zip"},
+	{0, "\x1f\x8b\x08", "application/gzip"},
+	{0, "BZh", "application/x-bzip2"},
+	{0, "\xfd7zXZ\x00", "application/x-xz"},
+	{0, "7z\xbc\xaf\x27\x1c", "application/x-7z-compressed"},
+	{0, "Rar!\x1a\x07", "application/vnd.rar"},
+}
+
+// sniffHTMLTags are the leading tags of HTML documents (lower case).
+var sniffHTMLTags = []string{
+	"<!doctype html", "<html", "<head", "<body", "<script", "<iframe",
+	"<style", "<title", "<table", "<div", "<p", "<a", "<h1", "<br",
+	"<font", "<b", "<!--",
+}
+
+// sniffMimeType determines the MIME type of the data (its first sniffLen
+// bytes are considered), roughly after the WHATWG MIME Sniffing Standard:
+// known binary signatures, HTML, XML, then text/plain if there are no
+// binary bytes, or application/octet-stream.
+func sniffMimeType(data []byte) string {
+	if len(data) > sniffLen {
+		data = data[:sniffLen]
+	}
+
+	for _, sig := range sniffSignatures {
+		if len(data) >= sig.offset+len(sig.magic) &&
+			string(data[sig.offset:sig.offset+len(sig.magic)]) == sig.magic {
+			return sig.typ
+		}
+	}
+
+	// UTF BOMs
+	switch {
+	case bytes.HasPrefix(data, []byte("\xef\xbb\xbf")):
+		return "text/plain; charset=utf-8"
+	case bytes.HasPrefix(data, []byte("\xfe\xff")):
+		return "text/plain; charset=utf-16be"
+	case bytes.HasPrefix(data, []byte("\xff\xfe")):
+		return "text/plain; charset=utf-16le"
+	}
+
+	text := bytes.ToLower(bytes.TrimLeft(data, "\t\n\x0c\r "))
+	for _, tag := range sniffHTMLTags {
+		// the tag is terminated by a space or ">"
+		if bytes.HasPrefix(text, []byte(tag)) && len(text) > len(tag) &&
+			(text[len(tag)] == ' ' || text[len(tag)] == '>' || tag == "<!--") {
+			return "text/html; charset=utf-8"
+		}
+	}
+	if bytes.HasPrefix(text, []byte("<?xml")) {
+		return "text/xml; charset=utf-8"
+	}
+
+	for _, b := range data {
+		// binary data bytes of the standard
+		if b <= 0x08 || b == 0x0b || 0x0e <= b && b <= 0x1a || 0x1c <= b && b <= 0x1f {
+			return "application/octet-stream"
+		}
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// endregion MIME types
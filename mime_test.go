@@ -0,0 +1,180 @@
+package simplehttp
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+const testMimePortBase = 23130
+
+func TestMimeType(t *testing.T) {
+	cases := []struct {
+		path     string
+		expected string
+	}{
+		{"index.html", "text/html; charset=utf-8"},
+		{"app.mjs", "text/javascript; charset=utf-8"},
+		{"app.js.map", "application/json"},
+		{"main.wasm", "application/wasm"},
+		{"font.woff2", "font/woff2"},
+		{"photo.WEBP", "image/webp"},
+		{"doc.pdf", "application/pdf"},
+		{"dir.d/noext", ""},
+		{"file.unknown", ""},
+	}
+	for _, tt := range cases {
+		if got := mimeType(tt.path); got != tt.expected {
+			t.Errorf("mimeType(%q): expected %q, got %q", tt.path, tt.expected, got)
+		}
+	}
+}
+
+func TestRegisterMimeType(t *testing.T) {
+	RegisterMimeType("SHTTP1", "application/x-simplehttp")
+	RegisterMimeType(".shttp2", "text/x-simplehttp")
+	RegisterMimeType(".shttp3", "text/x-simplehttp; charset=iso-8859-1")
+
+	cases := []struct {
+		path     string
+		expected string
+	}{
+		{"a.shttp1", "application/x-simplehttp"},
+		{"a.shttp2", "text/x-simplehttp; charset=utf-8"},
+		{"a.shttp3", "text/x-simplehttp; charset=iso-8859-1"},
+	}
+	for _, tt := range cases {
+		if got := mimeType(tt.path); got != tt.expected {
+			t.Errorf("mimeType(%q): expected %q, got %q", tt.path, tt.expected, got)
+		}
+	}
+}
+
+func TestLoadMimeTypes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mime.types")
+	writeTestFile(t, path, `# comment
+application/x-shttp-a	shttpa shttpb
+text/x-shttp-c		shttpc # trailing comment
+application/x-no-extension
+`)
+
+	if err := LoadMimeTypes(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadMimeTypes(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected error for missing file, got nil")
+	}
+
+	cases := []struct {
+		path     string
+		expected string
+	}{
+		{"a.shttpa", "application/x-shttp-a"},
+		{"a.shttpb", "application/x-shttp-a"},
+		{"a.shttpc", "text/x-shttp-c; charset=utf-8"},
+	}
+	for _, tt := range cases {
+		if got := mimeType(tt.path); got != tt.expected {
+			t.Errorf("mimeType(%q): expected %q, got %q", tt.path, tt.expected, got)
+		}
+	}
+}
+
+func TestSniffMimeType(t *testing.T) {
+	cases := []struct {
+		name     string
+		data     string
+		expected string
+	}{
+		{"empty", "", "text/plain; charset=utf-8"},
+		{"text", "hello, world\n", "text/plain; charset=utf-8"},
+		{"utf8", "你好\n", "text/plain; charset=utf-8"},
+		{"html", "\n  <!DOCTYPE HTML><html></html>", "text/html; charset=utf-8"},
+		{"htmlTag", "<p>hello</p>", "text/html; charset=utf-8"},
+		{"notHtml", "<pre", "text/plain; charset=utf-8"},
+		{"xml", "<?xml version=\"1.0\"?><a/>", "text/xml; charset=utf-8"},
+		{"pdf", "%PDF-1.7\n", "application/pdf"},
+		{"png", "\x89PNG\r\n\x1a\n\x00\x00", "image/png"},
+		{"webp", "RIFF\x00\x00\x00\x00WEBPVP8 ", "image/webp"},
+		{"wasm", "\x00asm\x01\x00\x00\x00", "application/wasm"},
+		{"woff2", "wOF2\x00\x01", "font/woff2"},
+		{"mp4", "\x00\x00\x00\x18ftypmp42", "video/mp4"},
+		{"gzip", "\x1f\x8b\x08\x00", "application/gzip"},
+		{"binary", "\x01\x02\x03", "application/octet-stream"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sniffMimeType([]byte(tt.data)); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestFileServerSniffing(t *testing.T) {
+	port := testMimePortBase
+
+	html := "<!DOCTYPE html><title>sniffed</title>"
+	fsys := fstest.MapFS{
+		"page":       {Data: []byte(html)},
+		"image.blob": {Data: []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")},
+		"main.wasm":  {Data: []byte("\x00asm\x01\x00\x00\x00")},
+	}
+
+	zipBuf := &bytes.Buffer{}
+	zw := zip.NewWriter(zipBuf)
+	w, _ := zw.Create("page")
+	_, _ = w.Write([]byte(html))
+	_ = zw.Close()
+	zipFS, err := zip.NewReader(bytes.NewReader(zipBuf.Bytes()), int64(zipBuf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// server
+	go func() {
+		r := NewPrefixRouter("/")
+		r.GET("/map/", FileServerFS(fsys, "/map"))
+		r.GET("/zip/", FileServerFS(zipFS, "/zip"))
+
+		s := HttpServer{Handler: r}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	cases := []struct {
+		path                string
+		expectedContentType string
+		expectedBody        string
+	}{
+		{"/map/page", "text/html; charset=utf-8", html},
+		{"/map/image.blob", "image/png", "\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"},
+		{"/map/main.wasm", "application/wasm", "\x00asm\x01\x00\x00\x00"},
+		{"/zip/page", "text/html; charset=utf-8", html}, // can not seek: reopened
+	}
+	for _, tt := range cases {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := http.Get(fmt.Sprintf("http://localhost:%d%s", port, tt.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(got.Body)
+			_ = got.Body.Close()
+			if ct := got.Header.Get("Content-Type"); ct != tt.expectedContentType {
+				t.Errorf("expected Content-Type %q, got %q", tt.expectedContentType, ct)
+			}
+			if string(b) != tt.expectedBody {
+				t.Errorf("expected %q, got %q", tt.expectedBody, b)
+			}
+		})
+	}
+}
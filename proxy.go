@@ -0,0 +1,815 @@
+package simplehttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ProxyTimeout is the default time limit of a ReverseProxy to get
+	// the response headers from the upstream.
+	ProxyTimeout = 30 * time.Second
+
+	// ProxyRetries is the default number of retries of a ReverseProxy
+	// for idempotent requests.
+	ProxyRetries = 2
+
+	// proxyMaxIdleConns is the max number of idle conns kept per upstream.
+	proxyMaxIdleConns = 16
+)
+
+// errStaleConn is the error of a reused idle conn closed by the upstream
+// before responding: the request may have been processed or not, so it's
+// only resent if idempotent.
+var errStaleConn = errors.New("upstream closed the idle conn")
+
+// hopHeaders are the hop-by-hop headers, not forwarded by proxies
+// (RFC 9110 Section 7.6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// region Handler: ReverseProxy
+
+// ReverseProxy is a Handler that forwards requests to the target, an
+// "http" or "https" URL, and streams the responses back:
+//
+//	r.GET("/api/", ReverseProxy("http://10.0.0.2:8080"))
+//
+//	GET /api/users?page=2  =>  GET http://10.0.0.2:8080/api/users?page=2
+//
+// The path and query of the target, if any, are prepended to the ones of
+// the request. The Host header is rewritten to the target host, the
+// hop-by-hop headers (Connection and the ones it lists, Keep-Alive, TE,
+// Upgrade, ...) are removed both ways, and the X-Forwarded-For,
+// X-Forwarded-Proto, X-Forwarded-Host and Forwarded (RFC 7239) headers
+// are added.
+//
+// Idempotent requests are retried (ProxyRetries times by default) if the
+// upstream fails before responding. Failures are answered with 502 Bad
+// Gateway, or 504 Gateway Timeout if no response headers are received in
+// time (ProxyTimeout by default). The conns to the upstream are kept
+// alive and reused.
+//
+// It panics if the target is not a valid http(s) URL.
+func ReverseProxy(target string, options ...ProxyOption) HandlerFunc {
+	p := &reverseProxy{
+		timeout: ProxyTimeout,
+		retries: ProxyRetries,
+	}
+	for _, option := range options {
+		option(p)
+	}
+	up, err := newUpstream(target, p.tlsConfig)
+	if err != nil {
+		panic(fmt.Sprintf("ReverseProxy: %v", err))
+	}
+	p.pool = &UpstreamPool{upstreams: []*upstream{up}, balancer: &roundRobin{}}
+	return p.serve
+}
+
+// reverseProxy is the ReverseProxy.
+type reverseProxy struct {
+	pool *UpstreamPool
+
+	timeout        time.Duration
+	retries        int
+	tlsConfig      *tls.Config
+	modifyRequest  func(c *Context, req *Request)
+	modifyResponse func(c *Context, resp *Response) error
+}
+
+// ProxyOption configures a ReverseProxy.
+type ProxyOption func(p *reverseProxy)
+
+// WithProxyTimeout sets the time limit to get the response headers from
+// the upstream, including connecting and sending the request, zero for
+// no limit.
+func WithProxyTimeout(timeout time.Duration) ProxyOption {
+	return func(p *reverseProxy) {
+		p.timeout = timeout
+	}
+}
+
+// WithProxyRetries sets the number of retries of idempotent requests
+// (GET, HEAD, OPTIONS, TRACE, PUT and DELETE) failed before responding,
+// zero for no retries.
+func WithProxyRetries(retries int) ProxyOption {
+	return func(p *reverseProxy) {
+		p.retries = retries
+	}
+}
+
+// WithProxyTLSConfig sets the TLS config to connect to https upstreams,
+// e.g. with the RootCAs of a private CA. See WithUpstreamTLSConfig for
+// the LoadBalancer.
+func WithProxyTLSConfig(config *tls.Config) ProxyOption {
+	return func(p *reverseProxy) {
+		p.tlsConfig = config
+	}
+}
+
+// WithProxyRequest sets a hook to modify the request to the upstream,
+// after its Headers are rewritten, e.g. to strip a path prefix or add an
+// auth header. The path of the upstream URL is prepended to the Url
+// after, and the Host header is the upstream host unless set:
+//
+//	WithProxyRequest(func(c *Context, req *Request) {
+//		req.Url = strings.TrimPrefix(req.Url, "/api")
+//		req.Headers["Authorization"] = "Bearer " + token
+//	})
+func WithProxyRequest(modify func(c *Context, req *Request)) ProxyOption {
+	return func(p *reverseProxy) {
+		p.modifyRequest = modify
+	}
+}
+
+// WithProxyResponse sets a hook to modify the response from the upstream,
+// i.e. c.Response with the status and headers set and the body to be
+// streamed. The response is replaced with a 502 Bad Gateway if it returns
+// an error.
+func WithProxyResponse(modify func(c *Context, resp *Response) error) ProxyOption {
+	return func(p *reverseProxy) {
+		p.modifyResponse = modify
+	}
+}
+
+// serve is the HandlerFunc of the ReverseProxy.
+func (p *reverseProxy) serve(c *Context) {
+	ctx := c.Ctx() // cancelled when the client disconnects
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	req := p.outboundRequest(c)
+	if p.modifyRequest != nil {
+		p.modifyRequest(c, req)
+	}
+
+	// the body parsed is in memory, so it can be resent for retries
+	var replay *bytes.Reader
+	if buf, ok := req.Body.(*bytes.Buffer); ok {
+		replay = bytes.NewReader(buf.Bytes())
+		req.Body = replay
+	}
+
+	// retry on another upstream if any
+	var up *upstream
+	var tried []*upstream
+	var resp *upstreamResponse
+	var err error
+	for attempt := 0; ; attempt++ {
+		if up = p.pool.pick(c, tried); up == nil {
+			up = p.pool.pick(c, nil) // all tried, try again
+		}
+		if up == nil {
+			err = errNoUpstream
+			break
+		}
+		tried = append(tried, up)
+
+		if replay != nil {
+			_, _ = replay.Seek(0, io.SeekStart)
+		}
+		resp, err = up.roundTrip(ctx, req, up.done)
+		if !errors.Is(err, errStaleConn) { // not the fault of the upstream
+			p.pool.report(up, ctx, err)
+		}
+		if err == nil || ctx.Err() != nil || replay == nil {
+			break
+		}
+		if attempt >= p.retries || !isIdempotent(req.Method) {
+			break
+		}
+	}
+	if err != nil {
+		p.fail(c, ctx, up, err)
+		return
+	}
+
+	setUpstreamResponse(c, resp)
+	if p.modifyResponse != nil {
+		if err := p.modifyResponse(c, c.Response); err != nil {
+			c.Response.resetBody()
+			c.Response.Headers = make(map[string]string)
+			p.fail(c, ctx, up, err)
+		}
+	}
+}
+
+// fail makes the error response of the err of proxying a request to
+// the up (nil if none available).
+func (p *reverseProxy) fail(c *Context, ctx context.Context, up *upstream, err error) {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		c.ResponseText(504, "Gateway Timeout")
+	case ctx.Err() != nil: // client disconnected, nobody cares
+		c.ResponseText(503, "Service Unavailable")
+	default:
+		if up != nil {
+			err = fmt.Errorf("%s: %w", up.url, err)
+		}
+		_, _ = fmt.Fprintf(os.Stderr, "ReverseProxy %v\n", err)
+		c.ResponseText(502, "Bad Gateway")
+	}
+}
+
+// setUpstreamResponse makes the response to the c of the upstream resp,
+// without the hop-by-hop headers, streaming the body.
+func setUpstreamResponse(c *Context, resp *upstreamResponse) {
+	c.Response.SetStateLine(c.Request.Version, resp.status)
+	if resp.reason != "" {
+		c.Response.Reason = resp.reason
+	}
+	for k, values := range resp.headers {
+		if k != "Content-Length" {
+			delete(c.Response.Headers, k)
+			for _, v := range values {
+				c.Response.AddHeader(k, v)
+			}
+		}
+	}
+	removeHopHeaders(c.Response.Headers)
+	c.Response.SetBodyReader(resp.body, resp.contentLength)
+}
+
+// outboundRequest makes the request to the upstreams of the request to
+// the c, with the headers rewritten.
+func (p *reverseProxy) outboundRequest(c *Context) *Request {
+	req := NewRequest()
+	req.Method = c.Request.Method
+	req.Url = c.Request.Url
+	req.Version = "HTTP/1.1"
+	req.Body = c.Request.Body
+	req.RemoteAddr = c.Request.RemoteAddr
+	req.TLS = c.Request.TLS
+
+	for k, v := range c.Request.Headers {
+		req.Headers[k] = v
+	}
+	removeHopHeaders(req.Headers)
+	delete(req.Headers, "Expect") // answered here, as the body is read
+
+	host := c.Request.Headers["Host"]
+	delete(req.Headers, "Host") // the upstream host by default
+	setForwardedHeaders(req.Headers, c.Request, host)
+	return req
+}
+
+// setForwardedHeaders adds the client of the req, received for the host,
+// to the X-Forwarded-* and Forwarded headers.
+func setForwardedHeaders(headers map[string]string, req *Request, host string) {
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		clientIP = req.RemoteAddr
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	if xff := headers["X-Forwarded-For"]; xff != "" {
+		headers["X-Forwarded-For"] = xff + ", " + clientIP
+	} else {
+		headers["X-Forwarded-For"] = clientIP
+	}
+	headers["X-Forwarded-Proto"] = proto
+	if host != "" {
+		headers["X-Forwarded-Host"] = host
+	}
+
+	// RFC 7239: IPv6 addresses are bracketed and quoted
+	node := clientIP
+	if strings.Contains(node, ":") {
+		node = `"[` + node + `]"`
+	}
+	forwarded := "for=" + node
+	if host != "" {
+		forwarded += ";host=" + strconv.Quote(host)
+	}
+	forwarded += ";proto=" + proto
+	if f := headers["Forwarded"]; f != "" {
+		forwarded = f + ", " + forwarded
+	}
+	headers["Forwarded"] = forwarded
+}
+
+// removeHopHeaders removes the hop-by-hop headers, including the ones
+// listed in the Connection header, from headers.
+func removeHopHeaders(headers map[string]string) {
+	hops := make(map[string]bool, len(hopHeaders))
+	for _, h := range hopHeaders {
+		hops[h] = true
+	}
+	for k, v := range headers {
+		if textproto.CanonicalMIMEHeaderKey(k) == "Connection" {
+			for _, name := range strings.Split(v, ",") {
+				hops[textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))] = true
+			}
+		}
+	}
+	for k := range headers {
+		if hops[textproto.CanonicalMIMEHeaderKey(k)] {
+			delete(headers, k)
+		}
+	}
+}
+
+// isIdempotent reports whether requests of the method can be safely
+// resent (RFC 9110 Section 9.2.2).
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// upstream is a server that a proxy forwards requests to,
+// keeping the idle conns to it and its state for load balancing.
+type upstream struct {
+	url       *url.URL
+	addr      string      // host:port to dial
+	tlsConfig *tls.Config // nil for http
+	weight    int
+	dial      func(ctx context.Context, network string, address string) (net.Conn, error)
+
+	mu           sync.Mutex
+	idle         []*upstreamConn
+	closed       bool // no more idle conns kept
+	active       int  // requests in flight
+	unhealthy    bool // by the active health checks
+	fails        int  // consecutive failures
+	ejectedUntil time.Time
+	requests     int64
+	failures     int64
+	lastError    string
+}
+
+// newUpstream makes an upstream of the target URL.
+func newUpstream(target string, tlsConfig *tls.Config) (*upstream, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("bad upstream %q: not an http(s) URL", target)
+	}
+
+	up := &upstream{url: u, addr: u.Host, weight: 1, dial: (&net.Dialer{}).DialContext}
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		up.addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	if u.Scheme == "https" {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		up.tlsConfig = tlsConfig.Clone()
+		if up.tlsConfig.ServerName == "" {
+			up.tlsConfig.ServerName = u.Hostname()
+		}
+	}
+	return up, nil
+}
+
+// requestTarget returns the request target to the upstream of the
+// request target reqURL: the path and query of the upstream URL joined
+// with the ones of reqURL.
+func (up *upstream) requestTarget(reqURL string) string {
+	path, query, _ := strings.Cut(reqURL, "?")
+	path, _, _ = strings.Cut(path, "#")
+	query, _, _ = strings.Cut(query, "#")
+
+	if base := strings.TrimSuffix(up.url.EscapedPath(), "/"); base != "" {
+		path = base + "/" + strings.TrimPrefix(path, "/")
+	}
+	if path == "" {
+		path = "/"
+	}
+	switch {
+	case up.url.RawQuery == "":
+	case query == "":
+		query = up.url.RawQuery
+	default:
+		query = up.url.RawQuery + "&" + query
+	}
+	if query != "" {
+		return path + "?" + query
+	}
+	return path
+}
+
+// upstreamConn is a conn to an upstream.
+type upstreamConn struct {
+	net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	reused bool // taken from the idle conns
+}
+
+// getConn takes an idle conn to the upstream, or dials a new one if none
+// or fresh.
+func (up *upstream) getConn(ctx context.Context, fresh bool) (*upstreamConn, error) {
+	up.mu.Lock()
+	if n := len(up.idle); n > 0 && !fresh {
+		uc := up.idle[n-1]
+		up.idle = up.idle[:n-1]
+		up.mu.Unlock()
+		uc.reused = true
+		return uc, nil
+	}
+	up.mu.Unlock()
+
+	conn, err := up.dial(ctx, "tcp", up.addr)
+	if err != nil {
+		return nil, err
+	}
+	if up.tlsConfig != nil {
+		tlsConn := tls.Client(conn, up.tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	return &upstreamConn{Conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}, nil
+}
+
+// putConn gives a conn back to the idle conns, or closes it if too many.
+func (up *upstream) putConn(uc *upstreamConn) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if up.closed || len(up.idle) >= proxyMaxIdleConns {
+		_ = uc.Close()
+		return
+	}
+	up.idle = append(up.idle, uc)
+}
+
+// dropIdle closes the idle conns to the upstream.
+func (up *upstream) dropIdle() {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	for _, uc := range up.idle {
+		_ = uc.Close()
+	}
+	up.idle = nil
+}
+
+// close closes the idle conns to the upstream, and the conns given back
+// after.
+func (up *upstream) close() {
+	up.dropIdle()
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	up.closed = true
+}
+
+// upstreamResponse is a response from an upstream.
+type upstreamResponse struct {
+	status        int
+	reason        string
+	headers       textproto.MIMEHeader
+	body          io.ReadCloser
+	contentLength int64 // -1 if unknown
+}
+
+// roundTrip sends the req to the upstream, and reads the response
+// headers. The conn is given back after the body is read to the end, or
+// closed if the body is closed before. ctx limits until the response
+// headers are read. done, if not nil, is called when the exchange ends:
+// on error, or after the body is released.
+//
+// If a reused idle conn turns out closed by the upstream (errStaleConn),
+// the req is resent once on a new conn, only if idempotent, as it may
+// have been processed. A body which can not be resent (not a
+// *bytes.Reader, e.g. read lazily, see Request.ExpectContinue) is sent on
+// a new conn at once.
+func (up *upstream) roundTrip(ctx context.Context, req *Request, done func()) (*upstreamResponse, error) {
+	if done == nil {
+		done = func() {}
+	}
+	replay, ok := req.Body.(*bytes.Reader)
+	fresh := req.Body != nil && !ok
+
+	resp, uc, err := up.exchange(ctx, req, fresh)
+	if errors.Is(err, errStaleConn) && isIdempotent(req.Method) {
+		if replay != nil {
+			_, _ = replay.Seek(0, io.SeekStart)
+		}
+		resp, uc, err = up.exchange(ctx, req, true)
+	}
+	if err != nil {
+		done()
+		return nil, err
+	}
+
+	body := resp.body.(*upstreamBody)
+	body.release = func(reusable bool) {
+		if reusable {
+			up.putConn(uc)
+		} else {
+			_ = uc.Close()
+		}
+		done()
+	}
+	if body.remaining == 0 {
+		body.finish(true)
+	}
+	return resp, nil
+}
+
+// exchange sends the req on a conn, an idle one unless fresh, and reads
+// the response headers, closing the conn on error.
+func (up *upstream) exchange(ctx context.Context, req *Request, fresh bool) (*upstreamResponse, *upstreamConn, error) {
+	uc, err := up.getConn(ctx, fresh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// abort the conn I/O when ctx is done
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			_ = uc.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	resp, err := uc.roundTrip(req, up.requestTarget(req.Url), up.url.Host)
+	close(stop)
+	<-stopped
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = uc.Close()
+		if uc.reused && errors.Is(err, io.EOF) {
+			err = fmt.Errorf("%w: %v", errStaleConn, err)
+			up.dropIdle() // likely closed too, e.g. by an idle timeout
+		}
+		return nil, nil, err
+	}
+	_ = uc.SetDeadline(time.Time{})
+	return resp, uc, nil
+}
+
+// roundTrip writes the req to the conn, with the request target and
+// the default Host, and reads the response headers.
+func (uc *upstreamConn) roundTrip(req *Request, target string, host string) (*upstreamResponse, error) {
+	headers := req.Headers
+	if _, ok := headers["Content-Length"]; !ok {
+		if l, ok := req.Body.(Lener); ok && l.Len() > 0 {
+			headers["Content-Length"] = strconv.Itoa(l.Len())
+		}
+	}
+
+	_, _ = fmt.Fprintf(uc.w, "%s %s HTTP/1.1\r\n", req.Method, target)
+	if _, ok := headers["Host"]; !ok {
+		_, _ = fmt.Fprintf(uc.w, "Host: %s\r\n", host)
+	}
+	for k, v := range headers {
+		_, _ = fmt.Fprintf(uc.w, "%s: %s\r\n", k, v)
+	}
+	_, _ = uc.w.WriteString("\r\n")
+	if req.Body != nil {
+		if _, err := io.Copy(uc.w, req.Body); err != nil {
+			return nil, err
+		}
+	}
+	if err := uc.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := readUpstreamResponse(uc.r, req.Method)
+		if err != nil {
+			return nil, err
+		}
+		if resp.status >= 200 || resp.status == 101 {
+			return resp, nil
+		}
+		// 1xx interim responses are not forwarded
+	}
+}
+
+// readUpstreamResponse reads the status line and headers of a response
+// to a request of the method from r, leaving the body to be read.
+func readUpstreamResponse(r *bufio.Reader, method string) (*upstreamResponse, error) {
+	tp := textproto.NewReader(r)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	version, status, _ := strings.Cut(line, " ")
+	code, reason, _ := strings.Cut(status, " ")
+	if !strings.HasPrefix(version, "HTTP/1.") {
+		return nil, fmt.Errorf("malformed upstream status line %q", line)
+	}
+	resp := &upstreamResponse{reason: reason}
+	if resp.status, err = strconv.Atoi(code); err != nil || resp.status < 100 || resp.status > 999 {
+		return nil, fmt.Errorf("malformed upstream status line %q", line)
+	}
+
+	if resp.headers, err = tp.ReadMIMEHeader(); err != nil {
+		return nil, fmt.Errorf("malformed upstream response headers: %w", err)
+	}
+
+	// the body length (RFC 9112 Section 6.3)
+	keepAlive := version != "HTTP/1.0" && !headerHasToken(resp.headers.Get("Connection"), "close")
+	body := &upstreamBody{r: r, remaining: -1, reusable: keepAlive}
+	resp.body, resp.contentLength = body, -1
+	switch {
+	case method == "HEAD" || resp.status < 200 || resp.status == 204 || resp.status == 304:
+		body.remaining = 0
+		if method == "HEAD" { // keep the Content-Length for the client
+			resp.contentLength, _ = strconv.ParseInt(resp.headers.Get("Content-Length"), 10, 64)
+			body.r = strings.NewReader("")
+		}
+	case headerHasToken(resp.headers.Get("Transfer-Encoding"), "chunked"):
+		body.r = &chunkedReader{r: r}
+	case resp.headers.Get("Content-Length") != "":
+		n, err := strconv.ParseInt(resp.headers.Get("Content-Length"), 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("malformed upstream Content-Length %q", resp.headers.Get("Content-Length"))
+		}
+		body.remaining, resp.contentLength = n, n
+	default: // until the upstream closes the conn
+		body.reusable = false
+	}
+	return resp, nil
+}
+
+// headerHasToken reports whether the comma-separated header value
+// contains the token, case-insensitively.
+func headerHasToken(value string, token string) bool {
+	for _, t := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamBody is the body of an upstream response, which releases the
+// conn when read to the end or closed.
+type upstreamBody struct {
+	r         io.Reader
+	remaining int64 // bytes left, -1 if delimited by r
+	reusable  bool  // the conn can be reused after the body is read
+
+	mu       sync.Mutex
+	release  func(reusable bool)
+	released bool
+}
+
+// Read reads the body.
+func (b *upstreamBody) Read(p []byte) (int, error) {
+	if b.remaining == 0 {
+		b.finish(true)
+		return 0, io.EOF
+	}
+	if b.remaining > 0 && int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.r.Read(p)
+	if b.remaining > 0 {
+		b.remaining -= int64(n)
+		if b.remaining == 0 { // release the conn early, before the EOF is read
+			b.finish(true)
+		} else if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	if err != nil {
+		b.finish(err == io.EOF)
+	}
+	return n, err
+}
+
+// Close releases the conn, which can not be reused if the body is not
+// read to the end.
+func (b *upstreamBody) Close() error {
+	b.finish(false)
+	return nil
+}
+
+// finish releases the conn once, reusable if the body is read to the end.
+func (b *upstreamBody) finish(complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.released || b.release == nil {
+		return
+	}
+	b.released = true
+	b.release(complete && b.reusable)
+}
+
+// chunkedReader decodes a chunked body (RFC 9112 Section 7.1), dropping
+// the chunk extensions and trailers.
+type chunkedReader struct {
+	r   *bufio.Reader
+	n   int64 // bytes left in the current chunk
+	err error
+}
+
+// Read reads the decoded body.
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	if cr.n == 0 {
+		if cr.n, cr.err = cr.readChunkSize(); cr.err != nil {
+			return 0, cr.err
+		}
+	}
+
+	if int64(len(p)) > cr.n {
+		p = p[:cr.n]
+	}
+	n, err := cr.r.Read(p)
+	cr.n -= int64(n)
+	if cr.n == 0 && err == nil {
+		err = cr.readCRLF()
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	cr.err = err
+	return n, err
+}
+
+// readChunkSize reads a chunk size line, and the trailers after the last
+// chunk, returning io.EOF then.
+func (cr *chunkedReader) readChunkSize() (int64, error) {
+	line, err := cr.readLine()
+	if err != nil {
+		return 0, err
+	}
+	size, _, _ := strings.Cut(line, ";")
+	n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("malformed chunk size %q", line)
+	}
+	if n > 0 {
+		return n, nil
+	}
+	for { // the trailers, till the empty line
+		if line, err = cr.readLine(); err != nil {
+			return 0, err
+		}
+		if line == "" {
+			return 0, io.EOF
+		}
+	}
+}
+
+// readCRLF reads the CRLF after a chunk.
+func (cr *chunkedReader) readCRLF() error {
+	if line, err := cr.readLine(); err != nil {
+		return err
+	} else if line != "" {
+		return errors.New("malformed chunk: missing CRLF")
+	}
+	return nil
+}
+
+// readLine reads a line, without the line ending.
+func (cr *chunkedReader) readLine() (string, error) {
+	line, err := cr.r.ReadString('\n')
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// endregion Handler: ReverseProxy
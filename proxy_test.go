@@ -0,0 +1,391 @@
+package simplehttp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testProxyPortBase = 23630
+
+// testUpstream starts an upstream server of the handler, counting the
+// conns accepted.
+func testUpstream(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *countingListener) {
+	srv := httptest.NewUnstartedServer(handler)
+	listener := &countingListener{Listener: srv.Listener}
+	srv.Listener = listener
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv, listener
+}
+
+func TestReverseProxy(t *testing.T) {
+	port := testProxyPortBase
+
+	echo, echoListener := testUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/base/big": // chunked
+			_, _ = io.WriteString(w, strings.Repeat("0123456789", 100000))
+			return
+		case "/base/slow":
+			time.Sleep(500 * time.Millisecond)
+		case "/base/missing":
+			w.Header().Set("X-Upstream", "echo")
+			http.Error(w, "no such thing", 404)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Upstream", "echo")
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = fmt.Fprintf(w, "%s %s %s\n", r.Method, r.Host, r.URL.RequestURI())
+		for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded",
+			"X-Secret", "Keep-Alive", "X-Custom", "X-Modified"} {
+			_, _ = fmt.Fprintf(w, "%s=%s\n", name, r.Header.Get(name))
+		}
+		_, _ = fmt.Fprintf(w, "body=%d\n", len(body))
+	})
+
+	var flakyAttempts int32
+	flaky, _ := testUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&flakyAttempts, 1)%3 != 0 { // fails twice, then succeeds
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			_ = conn.Close()
+			return
+		}
+		_, _ = io.WriteString(w, "finally")
+	})
+
+	tlsUpstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "over tls")
+	}))
+	t.Cleanup(tlsUpstream.Close)
+
+	// server
+	go func() {
+		r := NewPrefixRouter("/")
+		r.HandleFunc(MethodAny, "/proxy/", ReverseProxy(echo.URL+"/base?from=proxy",
+			WithProxyRequest(func(c *Context, req *Request) {
+				req.Url = strings.Replace(req.Url, "/proxy/", "/", 1)
+				req.Headers["X-Modified"] = "request"
+			}),
+			WithProxyResponse(func(c *Context, resp *Response) error {
+				resp.Headers["X-Modified"] = "response"
+				return nil
+			}),
+		))
+		r.GET("/rejected", ReverseProxy(echo.URL, WithProxyResponse(func(c *Context, resp *Response) error {
+			return errors.New("rejected")
+		})))
+		r.HandleFunc(MethodAny, "/flaky", ReverseProxy(flaky.URL))
+		r.GET("/noretry", ReverseProxy(flaky.URL, WithProxyRetries(0)))
+		r.GET("/slow", ReverseProxy(echo.URL+"/base", WithProxyTimeout(100*time.Millisecond)))
+		r.GET("/tls", ReverseProxy(tlsUpstream.URL, WithProxyTLSConfig(&tls.Config{RootCAs: certPool(tlsUpstream)})))
+		r.GET("/down", ReverseProxy("http://127.0.0.1:1"))
+
+		s := HttpServer{Handler: r}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	do := func(t *testing.T, method string, path string, body string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, fmt.Sprintf("http://localhost:%d%s", port, path), strings.NewReader(body))
+		got, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(got.Body)
+		_ = got.Body.Close()
+		return got, string(b)
+	}
+
+	t.Run("forward", func(t *testing.T) {
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_, _ = io.WriteString(conn, "GET /proxy/a/b?x=1 HTTP/1.1\r\n"+
+			"Host: example.com\r\n"+
+			"X-Forwarded-For: 10.0.0.1\r\n"+
+			"Connection: X-Secret\r\n"+
+			"X-Secret: hop\r\n"+
+			"Keep-Alive: timeout=5\r\n"+
+			"X-Custom: end-to-end\r\n\r\n")
+		got, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(got.Body)
+
+		if got.StatusCode != 200 || got.Header.Get("X-Upstream") != "echo" || got.Header.Get("X-Modified") != "response" {
+			t.Errorf("expected 200 from the upstream, modified, got %d %v", got.StatusCode, got.Header)
+		}
+		expected := "GET " + strings.TrimPrefix(echo.URL, "http://") + " /base/a/b?from=proxy&x=1\n" +
+			"X-Forwarded-For=10.0.0.1, 127.0.0.1\n" +
+			"X-Forwarded-Proto=http\n" +
+			"X-Forwarded-Host=example.com\n" +
+			`Forwarded=for=127.0.0.1;host="example.com";proto=http` + "\n" +
+			"X-Secret=\n" +
+			"Keep-Alive=\n" +
+			"X-Custom=end-to-end\n" +
+			"X-Modified=request\n" +
+			"body=0\n"
+		if string(b) != expected {
+			t.Errorf("expected\n%s\ngot\n%s", expected, b)
+		}
+	})
+
+	t.Run("body", func(t *testing.T) {
+		_, body := do(t, "POST", "/proxy/upload", strings.Repeat("x", 1<<20))
+		if !strings.HasSuffix(body, "body=1048576\n") {
+			t.Errorf("expected the body forwarded, got\n%s", body)
+		}
+
+		got, body := do(t, "GET", "/proxy/big", "")
+		if got.StatusCode != 200 || body != strings.Repeat("0123456789", 100000) {
+			t.Errorf("expected 200 with the chunked body, got %d with %d bytes", got.StatusCode, len(body))
+		}
+	})
+
+	t.Run("status", func(t *testing.T) {
+		got, body := do(t, "GET", "/proxy/missing", "")
+		if got.StatusCode != 404 || body != "no such thing\n" || got.Header.Get("X-Upstream") != "echo" {
+			t.Errorf("expected 404 from the upstream, got %d %q %v", got.StatusCode, body, got.Header)
+		}
+
+		got, body = do(t, "HEAD", "/proxy/head", "")
+		if got.StatusCode != 200 || got.ContentLength <= 0 || body != "" {
+			t.Errorf("expected 200 with Content-Length and no body, got %d %d %q", got.StatusCode, got.ContentLength, body)
+		}
+	})
+
+	t.Run("keepAlive", func(t *testing.T) {
+		before := atomic.LoadInt32(&echoListener.accepted)
+		for i := 0; i < 5; i++ {
+			do(t, "GET", "/proxy/keep", "")
+		}
+		if accepted := atomic.LoadInt32(&echoListener.accepted) - before; accepted > 1 {
+			t.Errorf("expected the upstream conn reused, got %d new conns", accepted)
+		}
+	})
+
+	cases := []struct {
+		name           string
+		method         string
+		path           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"retry", "GET", "/flaky", 200, "finally"},
+		{"noRetryPOST", "POST", "/flaky", 502, "Bad Gateway"},
+		{"noRetry", "GET", "/noretry", 502, "Bad Gateway"},
+		{"modifyResponseError", "GET", "/rejected", 502, "Bad Gateway"},
+		{"timeout", "GET", "/slow", 504, "Gateway Timeout"},
+		{"down", "GET", "/down", 502, "Bad Gateway"},
+		{"tls", "GET", "/tls", 200, "over tls"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&flakyAttempts, 0)
+			got, body := do(t, tt.method, tt.path, "")
+			if got.StatusCode != tt.expectedStatus || body != tt.expectedBody {
+				t.Errorf("expected %d %q, got %d %q", tt.expectedStatus, tt.expectedBody, got.StatusCode, body)
+			}
+		})
+	}
+}
+
+func TestReverseProxyStaleConn(t *testing.T) {
+	port := testProxyPortBase + 10
+
+	var processed int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cookies":
+			w.Header().Add("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT")
+			w.Header().Add("Set-Cookie", "b=2; Expires=Thu, 22 Oct 2015 07:28:00 GMT")
+		case "/slow":
+			time.Sleep(50 * time.Millisecond)
+		case "/processed": // then closes the conn without a response
+			atomic.AddInt32(&processed, 1)
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			_ = conn.Close()
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		_, _ = fmt.Fprintf(w, "body=%d", len(body))
+	}))
+	srv.Config.IdleTimeout = 100 * time.Millisecond // closes the idle conns
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	pool := NewUpstreamPool([]string{srv.URL}, WithPassiveEjection(1, 30*time.Second))
+
+	// server
+	go func() {
+		s := HttpServer{Handler: ReverseProxy(srv.URL)}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			panic(err)
+		}
+	}()
+	go func() {
+		s := HttpServer{Handler: LoadBalancer(pool)}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port+1)); err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	doPort := func(t *testing.T, port int, method string, path string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, fmt.Sprintf("http://localhost:%d%s", port, path), nil)
+		got, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(got.Body)
+		_ = got.Body.Close()
+		return got, string(b)
+	}
+	do := func(t *testing.T, method string, path string) (*http.Response, string) {
+		return doPort(t, port, method, path)
+	}
+
+	t.Run("setCookie", func(t *testing.T) {
+		got, _ := do(t, "GET", "/cookies")
+		cookies := got.Header.Values("Set-Cookie")
+		if len(cookies) != 2 || cookies[0] != "a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT" ||
+			cookies[1] != "b=2; Expires=Thu, 22 Oct 2015 07:28:00 GMT" {
+			t.Errorf("expected 2 Set-Cookie headers, got %q", cookies)
+		}
+	})
+
+	t.Run("idempotentOnly", func(t *testing.T) {
+		cases := []struct {
+			method string
+			resent bool
+		}{
+			{"POST", false},
+			{"GET", true}, // on new conns, closed too
+		}
+		for _, tt := range cases {
+			do(t, "GET", "/idle") // an idle conn to reuse
+			atomic.StoreInt32(&processed, 0)
+			if got, _ := do(t, tt.method, "/processed"); got.StatusCode != 502 {
+				t.Errorf("%s: expected 502, got %d", tt.method, got.StatusCode)
+			}
+			if got := atomic.LoadInt32(&processed); (got > 1) != tt.resent {
+				t.Errorf("%s: expected resent %v, got processed %d times", tt.method, tt.resent, got)
+			}
+		}
+	})
+
+	t.Run("noEjection", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ { // idle conns
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if got, err := http.Get(fmt.Sprintf("http://localhost:%d/slow", port+1)); err == nil {
+					_, _ = io.Copy(io.Discard, got.Body)
+					_ = got.Body.Close()
+				}
+			}()
+		}
+		wg.Wait()
+		time.Sleep(200 * time.Millisecond) // closed by the upstream
+
+		for i := 0; i < 2; i++ {
+			if got, body := doPort(t, port+1, "GET", "/after"); got.StatusCode != 200 {
+				t.Fatalf("expected 200 after the idle timeout, got %d %q", got.StatusCode, body)
+			}
+		}
+		status := pool.Status()[0]
+		if status.Ejected || status.Failures != 0 {
+			t.Errorf("expected no failures of stale conns, got %+v", status)
+		}
+		up := pool.upstreams[0]
+		up.mu.Lock()
+		idle := len(up.idle)
+		up.mu.Unlock()
+		if idle != 1 {
+			t.Errorf("expected the stale conns dropped at once, got %d idle conns", idle)
+		}
+	})
+
+	t.Run("lazyBody", func(t *testing.T) {
+		do(t, "GET", "/idle")
+		time.Sleep(200 * time.Millisecond) // closed by the upstream
+
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_, _ = io.WriteString(conn, "PUT /upload HTTP/1.1\r\nHost: localhost\r\n"+
+			"Expect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+		reader := bufio.NewReader(conn)
+		if got, err := http.ReadResponse(reader, nil); err != nil || got.StatusCode != 100 {
+			t.Fatalf("expected 100 Continue, got %v %v", got, err)
+		}
+		_, _ = io.WriteString(conn, "hello")
+		got, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := io.ReadAll(got.Body); got.StatusCode != 200 || string(b) != "body=5" {
+			t.Errorf("expected the body sent on a new conn, got %d %q", got.StatusCode, b)
+		}
+	})
+}
+
+// certPool returns a cert pool of the cert of the TLS test server.
+func certPool(srv *httptest.Server) *x509.CertPool {
+	return srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+}
+
+func TestChunkedReader(t *testing.T) {
+	cases := []struct {
+		name         string
+		input        string
+		expectedBody string
+		expectedErr  bool
+	}{
+		{"chunks", "5\r\nhello\r\n7;ext=1\r\n, world\r\n0\r\n\r\n", "hello, world", false},
+		{"trailers", "3\r\nabc\r\n0\r\nX-Trailer: 1\r\n\r\n", "abc", false},
+		{"truncated", "5\r\nhel", "hel", true},
+		{"badSize", "zz\r\nhello\r\n", "", true},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			input := tt.input
+			if !tt.expectedErr {
+				input += "next" // the next response on the conn
+			}
+			r := bufio.NewReader(strings.NewReader(input))
+			got, err := io.ReadAll(&chunkedReader{r: r})
+			if string(got) != tt.expectedBody || (err != nil) != tt.expectedErr {
+				t.Errorf("expected %q (err: %v), got %q %v", tt.expectedBody, tt.expectedErr, got, err)
+			}
+			if !tt.expectedErr {
+				if rest, _ := io.ReadAll(r); string(rest) != "next" {
+					t.Errorf("expected the reader left after the body, got %q", rest)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package simplehttp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MaxRanges is the max number of ranges in a Range header to serve.
+	// Requests with more ranges get the full content instead,
+	// as a guard against range-amplification abuse.
+	MaxRanges = 32
+
+	// rangeCoalesceGap is the max gap between two ranges to be coalesced
+	// into one, about the overhead of a part in multipart/byteranges.
+	rangeCoalesceGap = 80
+)
+
+var (
+	errInvalidRange  = errors.New("invalid range")
+	errNoOverlap     = errors.New("invalid range: failed to overlap")
+	errTooManyRanges = errors.New("invalid range: too many ranges")
+)
+
+// region FileServer: Range
+
+// httpRange is a satisfiable byte range of a representation.
+type httpRange struct {
+	start, length int64
+}
+
+// contentRange returns the Content-Range header value of the range.
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRanges parses a Range header ([RFC 9110 Section 14.2]) against
+// a representation of size bytes:
+//
+//	bytes=0-499         the first 500 bytes
+//	bytes=9500-         from the byte 9500 to the end
+//	bytes=-500          the final 500 bytes
+//	bytes=0-0,-1        the first and the last bytes
+//
+// The unsatisfiable ranges are dropped, returns errNoOverlap if none is
+// left. Overlapping (or nearly adjacent) ranges are coalesced, so the
+// result is sorted.
+//
+// errInvalidRange and errTooManyRanges tell the caller to ignore the
+// Range header: for a syntax error, more than MaxRanges ranges, or
+// ranges adding up to more than the size (range amplification).
+//
+// [RFC 9110 Section 14.2]: https://www.rfc-editor.org/rfc/rfc9110#name-range
+func parseRanges(header string, size int64) ([]httpRange, error) {
+	unit, set, ok := strings.Cut(header, "=")
+	if !ok || strings.TrimSpace(unit) != "bytes" {
+		return nil, errInvalidRange
+	}
+
+	specs := strings.Split(set, ",")
+	if len(specs) > MaxRanges {
+		return nil, errTooManyRanges
+	}
+
+	var ranges []httpRange
+	var total int64
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" { // tolerate "bytes=0-1,,2-3"
+			continue
+		}
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, errInvalidRange
+		}
+
+		var r httpRange
+		if first == "" { // suffix-range: -500
+			n, err := parseRangeInt(last)
+			if err != nil {
+				return nil, err
+			}
+			if n == 0 {
+				continue // unsatisfiable
+			}
+			if n > size {
+				n = size
+			}
+			r = httpRange{start: size - n, length: n}
+		} else { // int-range: 0-499 or 9500-
+			start, err := parseRangeInt(first)
+			if err != nil {
+				return nil, err
+			}
+			end := size - 1
+			if last != "" {
+				if end, err = parseRangeInt(last); err != nil {
+					return nil, err
+				}
+				if end < start {
+					return nil, errInvalidRange
+				}
+			}
+			if start >= size {
+				continue // unsatisfiable
+			}
+			if end >= size {
+				end = size - 1
+			}
+			r = httpRange{start: start, length: end - start + 1}
+		}
+
+		ranges = append(ranges, r)
+		total += r.length
+	}
+
+	if len(ranges) == 0 {
+		return nil, errNoOverlap
+	}
+
+	if len(ranges) > 1 && total > size {
+		return nil, errTooManyRanges
+	}
+	return coalesceRanges(ranges), nil
+}
+
+// parseRangeInt parses a non-negative decimal in a range spec.
+func parseRangeInt(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s[0] < '0' || s[0] > '9' { // no sign allowed
+		return 0, errInvalidRange
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, errInvalidRange
+	}
+	return n, nil
+}
+
+// coalesceRanges sorts the ranges, and merges the overlapping ones,
+// as well as those with gaps less than rangeCoalesceGap in between.
+func coalesceRanges(ranges []httpRange) []httpRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start < ranges[j].start
+	})
+
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		lastEnd := last.start + last.length
+		if r.start <= lastEnd+rangeCoalesceGap {
+			if end := r.start + r.length; end > lastEnd {
+				last.length = end - last.start
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// seekTo moves the read offset of f from offset to start: by Seek if f
+// is an io.Seeker, or by reading and discarding otherwise (e.g. a file
+// in a zip).
+func seekTo(f fs.File, offset int64, start int64) error {
+	if seeker, ok := f.(io.Seeker); ok {
+		_, err := seeker.Seek(start, io.SeekStart)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, f, start-offset)
+	return err
+}
+
+// multipartHeader returns the boundary and headers of the i-th part
+// in a multipart/byteranges body.
+func multipartHeader(i int, boundary string, contentType string, contentRange string) string {
+	header := fmt.Sprintf("--%s\r\nContent-Type: %s\r\nContent-Range: %s\r\n\r\n",
+		boundary, contentType, contentRange)
+	if i > 0 {
+		header = "\r\n" + header
+	}
+	return header
+}
+
+// multipartTrailer returns the closing boundary of a multipart/byteranges body.
+func multipartTrailer(boundary string) string {
+	return "\r\n--" + boundary + "--\r\n"
+}
+
+// multipartRangesReader returns a reader of the multipart/byteranges body
+// (RFC 9110 Section 14.6) of the ranges of f, which reads f on demand,
+// and the length of the body.
+func multipartRangesReader(f io.ReaderAt, boundary string, contentType string, size int64, ranges []httpRange) (io.Reader, int64) {
+	var readers []io.Reader
+	var length int64
+	for i, r := range ranges {
+		header := multipartHeader(i, boundary, contentType, r.contentRange(size))
+		readers = append(readers,
+			strings.NewReader(header),
+			io.NewSectionReader(f, r.start, r.length))
+		length += int64(len(header)) + r.length
+	}
+	trailer := multipartTrailer(boundary)
+	readers = append(readers, strings.NewReader(trailer))
+	length += int64(len(trailer))
+
+	return io.MultiReader(readers...), length
+}
+
+// writeMultipartRanges writes the multipart/byteranges body of the sorted
+// ranges of f to w, for files can not io.ReaderAt.
+func writeMultipartRanges(w io.Writer, f fs.File, boundary string, contentType string, size int64, ranges []httpRange) error {
+	var offset int64
+	for i, r := range ranges {
+		header := multipartHeader(i, boundary, contentType, r.contentRange(size))
+		if _, err := io.WriteString(w, header); err != nil {
+			return err
+		}
+		if err := seekTo(f, offset, r.start); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, f, r.length); err != nil {
+			return err
+		}
+		offset = r.start + r.length
+	}
+	_, err := io.WriteString(w, multipartTrailer(boundary))
+	return err
+}
+
+// readCloser is an io.Reader with an io.Closer, e.g. a reader of a file,
+// closing the file.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// endregion FileServer: Range
@@ -0,0 +1,210 @@
+package simplehttp
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+const testRangePortBase = 22930
+
+func TestParseRanges(t *testing.T) {
+	const size = 10000
+
+	cases := []struct {
+		header      string
+		expected    []httpRange
+		expectedErr error
+	}{
+		{"bytes=0-499", []httpRange{{0, 500}}, nil},
+		{"bytes=500-999", []httpRange{{500, 500}}, nil},
+		{"bytes=9500-", []httpRange{{9500, 500}}, nil},
+		{"bytes=-500", []httpRange{{9500, 500}}, nil},
+		{"bytes=-20000", []httpRange{{0, 10000}}, nil},
+		{"bytes=9000-20000", []httpRange{{9000, 1000}}, nil},
+		{"bytes=0-0, -1", []httpRange{{0, 1}, {9999, 1}}, nil},
+		{"bytes= 0-1 , 5000-5001", []httpRange{{0, 2}, {5000, 2}}, nil},
+
+		// coalescing
+		{"bytes=500-700,600-999", []httpRange{{500, 500}}, nil},
+		{"bytes=0-99,100-199", []httpRange{{0, 200}}, nil},
+		{"bytes=150-249,0-99", []httpRange{{0, 250}}, nil}, // gap < rangeCoalesceGap
+		{"bytes=5000-5099,0-99", []httpRange{{0, 100}, {5000, 100}}, nil},
+
+		// unsatisfiable
+		{"bytes=10000-", nil, errNoOverlap},
+		{"bytes=-0", nil, errNoOverlap},
+		{"bytes=20000-30000,-0", nil, errNoOverlap},
+		{"bytes=20000-30000,0-0", []httpRange{{0, 1}}, nil},
+
+		// invalid: to be ignored
+		{"bytes=1-0", nil, errInvalidRange},
+		{"bytes=a-b", nil, errInvalidRange},
+		{"bytes=+1-2", nil, errInvalidRange},
+		{"bytes=0", nil, errInvalidRange},
+		{"items=0-1", nil, errInvalidRange},
+		{"bytes 0-1", nil, errInvalidRange},
+
+		// abusive: to be ignored
+		{"bytes=" + strings.Repeat("0-,", MaxRanges) + "0-", nil, errTooManyRanges},
+		{"bytes=0-,0-", nil, errTooManyRanges},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.header, func(t *testing.T) {
+			got, err := parseRanges(tt.header, size)
+			if err != tt.expectedErr {
+				t.Errorf("expected error %v, got %v", tt.expectedErr, err)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestFileServerRanges(t *testing.T) {
+	port := testRangePortBase
+
+	root := t.TempDir()
+	writeTestFile(t, filepath.Join(root, "digits.txt"), "0123456789")
+	writeTestFile(t, filepath.Join(root, "empty.txt"), "")
+	content := strings.Repeat("abcdefghij", 100) // 1000 bytes
+	writeTestFile(t, filepath.Join(root, "letters.txt"), content)
+
+	// server
+	go func() {
+		s := HttpServer{Handler: FileServer(root, "/")}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	get := func(t *testing.T, path string, rangeHeader string) (*http.Response, []byte) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d%s", port, path), nil)
+		req.Header.Set("Range", rangeHeader)
+		got, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(got.Body)
+		return got, b
+	}
+
+	cases := []struct {
+		name                 string
+		path                 string
+		rangeHeader          string
+		expectedStatus       int
+		expectedBody         string
+		expectedContentRange string
+	}{
+		{"single", "/digits.txt", "bytes=2-4", 206, "234", "bytes 2-4/10"},
+		{"suffix", "/digits.txt", "bytes=-3", 206, "789", "bytes 7-9/10"},
+		{"open", "/digits.txt", "bytes=8-", 206, "89", "bytes 8-9/10"},
+		{"coalesced", "/digits.txt", "bytes=0-2,1-3", 206, "0123", "bytes 0-3/10"},
+		{"unsatisfiable", "/digits.txt", "bytes=10-", 416, "Range Not Satisfiable", "bytes */10"},
+		{"invalid", "/digits.txt", "bytes=x-y", 200, "0123456789", ""},
+		{"amplification", "/digits.txt", "bytes=0-,0-,0-", 200, "0123456789", ""},
+		{"empty", "/empty.txt", "bytes=0-1", 200, "", ""},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, body := get(t, tt.path, tt.rangeHeader)
+			if got.StatusCode != tt.expectedStatus {
+				t.Errorf("expected status code %d, got %d", tt.expectedStatus, got.StatusCode)
+			}
+			if string(body) != tt.expectedBody {
+				t.Errorf("expected %q, got %q", tt.expectedBody, body)
+			}
+			if cr := got.Header.Get("Content-Range"); cr != tt.expectedContentRange {
+				t.Errorf("expected Content-Range %q, got %q", tt.expectedContentRange, cr)
+			}
+		})
+	}
+
+	t.Run("multipart", func(t *testing.T) {
+		got, body := get(t, "/letters.txt", "bytes=990-,0-4,500-509")
+		if got.StatusCode != 206 {
+			t.Fatalf("expected status code 206, got %d", got.StatusCode)
+		}
+		mediaType, params, err := mime.ParseMediaType(got.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/byteranges" {
+			t.Fatalf("expected multipart/byteranges, got %s (%v)", got.Header.Get("Content-Type"), err)
+		}
+
+		expected := []struct{ contentRange, body string }{
+			{"bytes 0-4/1000", content[0:5]},
+			{"bytes 500-509/1000", content[500:510]},
+			{"bytes 990-999/1000", content[990:]},
+		}
+		mr := multipart.NewReader(strings.NewReader(string(body)), params["boundary"])
+		for i, e := range expected {
+			part, err := mr.NextPart()
+			if err != nil {
+				t.Fatalf("part %d: %v", i, err)
+			}
+			if cr := part.Header.Get("Content-Range"); cr != e.contentRange {
+				t.Errorf("part %d: expected Content-Range %q, got %q", i, e.contentRange, cr)
+			}
+			if ct := part.Header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+				t.Errorf("part %d: expected Content-Type text/plain; charset=utf-8, got %q", i, ct)
+			}
+			b, _ := io.ReadAll(part)
+			if string(b) != e.body {
+				t.Errorf("part %d: expected %q, got %q", i, e.body, b)
+			}
+		}
+		if _, err := mr.NextPart(); err != io.EOF {
+			t.Errorf("expected 3 parts only, got more (%v)", err)
+		}
+	})
+}
+
+func TestMultipartRangesReader(t *testing.T) {
+	content := "0123456789abcdefghij"
+	ranges := []httpRange{{0, 2}, {10, 5}, {19, 1}}
+	boundary := "BOUNDARY"
+
+	body, length := multipartRangesReader(strings.NewReader(content), boundary, "text/plain", int64(len(content)), ranges)
+	streamed, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(streamed)) != length {
+		t.Errorf("expected length %d, got %d", length, len(streamed))
+	}
+
+	// the buffered one for files can not io.ReaderAt
+	buffered := &strings.Builder{}
+	f := fstest.MapFS{"f": {Data: []byte(content)}}
+	file, _ := f.Open("f")
+	if err := writeMultipartRanges(buffered, file, boundary, "text/plain", int64(len(content)), ranges); err != nil {
+		t.Fatal(err)
+	}
+	if buffered.String() != string(streamed) {
+		t.Errorf("expected the same body, got\n%q\nand\n%q", streamed, buffered.String())
+	}
+
+	mr := multipart.NewReader(strings.NewReader(string(streamed)), boundary)
+	for i, r := range ranges {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		b, _ := io.ReadAll(part)
+		if expected := content[r.start : r.start+r.length]; string(b) != expected {
+			t.Errorf("part %d: expected %q, got %q", i, expected, b)
+		}
+	}
+}
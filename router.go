@@ -2,6 +2,7 @@ package simplehttp
 
 import (
 	"fmt"
+	"net/url"
 	"regexp"
 	"sort"
 	"strings"
@@ -52,6 +53,23 @@ type Router interface {
 	Use(middlewares ...Handler)
 }
 
+// NamedRouter is a Router with named routes, supporting reverse routing,
+// e.g. by TemplateEngine.Router.
+type NamedRouter interface {
+	Router
+
+	// Name gives the route path a name, so that URL can build it back.
+	Name(name string, path string)
+
+	// URL returns the full URL path of the named route (i.e. reverse routing),
+	// with the optional subpaths escaped and appended:
+	//
+	//	r := NewPrefixRouter("/api")
+	//	r.Name("user", "/user/")
+	//	r.URL("user", "alice") == "/api/user/alice"
+	URL(name string, subpaths ...string) (string, error)
+}
+
 type routerItem struct {
 	method   string
 	path     string
@@ -110,6 +128,7 @@ type prefixRouter struct {
 	baseURL     string
 	routes      []routerItem
 	middlewares []Handler
+	names       map[string]string // name => path, for reverse routing
 }
 
 // NewPrefixRouter creates a new prefix router, that is, a router
@@ -117,11 +136,12 @@ type prefixRouter struct {
 //
 //	"/abc"  will match "/abc" or "/abc?x=1";
 //	"/abc/" will match "/abc/", "/abc/?x=1", "/abc/def" or "/abc/def/..."
-func NewPrefixRouter(baseURL string) Router {
+func NewPrefixRouter(baseURL string) NamedRouter {
 	return &prefixRouter{
 		baseURL:     baseURL,
 		routes:      []routerItem{},
 		middlewares: []Handler{},
+		names:       map[string]string{},
 	}
 }
 
@@ -268,3 +288,26 @@ func (p *prefixRouter) DELETE(path string, handlers ...HandlerFunc) {
 func (p *prefixRouter) Use(middlewares ...Handler) {
 	p.middlewares = append(p.middlewares, middlewares...)
 }
+
+// Name gives the route path a name, so that URL can build it back.
+func (p *prefixRouter) Name(name string, path string) {
+	if _, ok := p.names[name]; ok {
+		panic("duplicate route name")
+	}
+	p.names[name] = path
+}
+
+// URL returns the full URL path of the named route, i.e. baseURL + path,
+// with the optional subpaths escaped and appended.
+func (p *prefixRouter) URL(name string, subpaths ...string) (string, error) {
+	path, ok := p.names[name]
+	if !ok {
+		return "", fmt.Errorf("URL: no route named %q", name)
+	}
+
+	u := strings.TrimSuffix(p.baseURL, "/") + "/" + strings.TrimPrefix(path, "/")
+	for _, s := range subpaths {
+		u = strings.TrimSuffix(u, "/") + "/" + url.PathEscape(s)
+	}
+	return u, nil
+}
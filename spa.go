@@ -0,0 +1,129 @@
+package simplehttp
+
+import (
+	"errors"
+	"io/fs"
+	pathLib "path"
+	"strings"
+)
+
+const (
+	// spaFallbackCacheControl makes clients revalidate the fallback file,
+	// so that a new deployment is picked up at once.
+	spaFallbackCacheControl = "no-cache"
+	// hashedAssetCacheControl caches files with hashed names for a year:
+	// a new version gets a new name.
+	hashedAssetCacheControl = "public, max-age=31536000, immutable"
+)
+
+// region FileServer: SPA
+
+// WithSPAFallback makes the FileServer serve a single-page application:
+// navigations to paths not exist, e.g. a deep link to /settings/profile,
+// are served with the fallback file (e.g. "index.html", relative to the
+// root) with Cache-Control: no-cache, so that the client side router
+// takes over. A request is a navigation if it Accept text/html and the
+// path has no file extension; missing assets (e.g. /app.js) are still 404.
+//
+// Files with hashed names made by bundlers (e.g. main.3f9a1c2b.js or
+// index-BxK3s9aZ.js) are served with long-lived cache headers.
+func WithSPAFallback(file string) FileServerOption {
+	return func(srv *fileServer) {
+		srv.spaFallback = fsName(file)
+	}
+}
+
+// spa returns the name of the file to serve for the request of the file
+// named name in the SPA mode: the fallback file for navigations to paths
+// not exist, or the name itself, setting the Cache-Control header.
+func (srv *fileServer) spa(c *Context, name string) string {
+	stat, err := fs.Stat(srv.fsys, name)
+	if errors.Is(err, fs.ErrNotExist) && isNavigation(c, name) {
+		c.Response.Headers["Cache-Control"] = spaFallbackCacheControl
+		return srv.spaFallback
+	}
+	if err == nil && !stat.IsDir() && isHashedAsset(name) {
+		c.Response.Headers["Cache-Control"] = hashedAssetCacheControl
+	}
+	return name
+}
+
+// isNavigation reports whether the request of the file named name looks
+// like a navigation of browsers: GET (or HEAD) an HTML page, and the path
+// has no file extension.
+func isNavigation(c *Context, name string) bool {
+	if c.Request.Method != "GET" && c.Request.Method != "HEAD" {
+		return false
+	}
+	return strings.Contains(c.Request.Headers["Accept"], "text/html") &&
+		pathLib.Ext(name) == ""
+}
+
+// isHashedAsset reports whether the file name contains a content hash
+// made by bundlers, separated by dots or dashes from the other parts:
+//
+//	main.3f9a1c2b.js        (hex, webpack)
+//	index-BxK3s9aZ.js       (8 chars base64url, Vite/Rollup)
+//	chunk.3f9a1c2b.min.css
+//
+// The base64url form is only taken right before the extension, as it's
+// more likely to be a part of the name, e.g. app-release1.js.
+func isHashedAsset(name string) bool {
+	base := pathLib.Base(name)
+	base = strings.TrimSuffix(base, pathLib.Ext(base))
+	parts := strings.FieldsFunc(base, func(r rune) bool {
+		return r == '.' || r == '-'
+	})
+	for i, part := range parts {
+		if i > 0 && (isHexHash(part) || i == len(parts)-1 && isBase64Hash(part)) { // not the name itself
+			return true
+		}
+	}
+	return false
+}
+
+// isHexHash reports whether s is a lower case hex hash of 8+ digits,
+// with at least one letter (not to be taken for a date or version).
+func isHexHash(s string) bool {
+	if len(s) < 8 {
+		return false
+	}
+	letter := false
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+		case r >= 'a' && r <= 'f':
+			letter = true
+		default:
+			return false
+		}
+	}
+	return letter
+}
+
+// isBase64Hash reports whether s is an 8 chars base64url hash, with at
+// least one digit, and mixed case letters or an underscore (not to be
+// taken for a word with a number, e.g. latin123).
+func isBase64Hash(s string) bool {
+	if len(s) != 8 {
+		return false
+	}
+	digit, lower, upper, underscore := false, false, false, false
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			digit = true
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r == '_':
+			underscore = true
+		default:
+			return false
+		}
+	}
+	return digit && (lower && upper || underscore)
+}
+
+// endregion FileServer: SPA
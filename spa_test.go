@@ -0,0 +1,113 @@
+package simplehttp
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+const testSPAPortBase = 23230
+
+func TestIsHashedAsset(t *testing.T) {
+	cases := []struct {
+		name     string
+		expected bool
+	}{
+		{"static/js/main.3f9a1c2b.js", true},
+		{"static/css/main.3f9a1c2b.chunk.css", true},
+		{"assets/index-BxK3s9aZ.js", true},
+		{"assets/vendor-a1b2c3d4e5f6a7b8c9d0.js", true},
+		{"app.js", false},
+		{"3f9a1c2b.js", false},
+		{"main.settings.js", false},
+		{"report-20221001.pdf", false},
+		{"jquery-3.6.0.min.js", false},
+		{"main.Settings.js", false},
+		{"assets/index-b_3s9azq.js", true},
+		{"app-release1.js", false},
+		{"font-latin123.woff", false},
+		{"icons-Set2Blue.min.svg", false},
+		{"lib-V1Beta2x-core.js", false},
+	}
+	for _, tt := range cases {
+		if got := isHashedAsset(tt.name); got != tt.expected {
+			t.Errorf("isHashedAsset(%q): expected %v, got %v", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestFileServerSPA(t *testing.T) {
+	port := testSPAPortBase
+
+	fsys := fstest.MapFS{
+		"index.html":                 {Data: []byte("app")},
+		"favicon.ico":                {Data: []byte("icon")},
+		"assets/index-BxK3s9aZ.js":   {Data: []byte("hashed")},
+		"docs/index.html":            {Data: []byte("docs")},
+		"static/js/main.3f9a1c2b.js": {Data: []byte("webpack")},
+	}
+
+	// server
+	go func() {
+		r := NewPrefixRouter("/")
+		r.GET("/app/", FileServerFS(fsys, "/app", WithSPAFallback("/index.html")))
+		r.GET("/plain/", FileServerFS(fsys, "/plain"))
+
+		s := HttpServer{Handler: r}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	const htmlAccept = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+
+	cases := []struct {
+		name                 string
+		path                 string
+		accept               string
+		expectedStatus       int
+		expectedBody         string
+		expectedCacheControl string
+	}{
+		{"deepLink", "/app/settings/profile", htmlAccept, 200, "app", "no-cache"},
+		{"deepLinkSlash", "/app/settings/", htmlAccept, 200, "app", "no-cache"},
+		{"deepLinkQuery", "/app/search?q=go", htmlAccept, 200, "app", "no-cache"},
+		{"root", "/app/", htmlAccept, 200, "app", ""},
+		{"existingDir", "/app/docs/", htmlAccept, 200, "docs", ""},
+		{"existingFile", "/app/favicon.ico", "*/*", 200, "icon", ""},
+		{"missingAsset", "/app/missing.js", "*/*", 404, "Not Found", ""},
+		{"missingAssetHTML", "/app/missing.png", htmlAccept, 404, "Not Found", ""},
+		{"notNavigation", "/app/api/users", "application/json", 404, "Not Found", ""},
+		{"hashedVite", "/app/assets/index-BxK3s9aZ.js", "*/*", 200, "hashed", "public, max-age=31536000, immutable"},
+		{"hashedWebpack", "/app/static/js/main.3f9a1c2b.js", "*/*", 200, "webpack", "public, max-age=31536000, immutable"},
+		{"missingHashed", "/app/assets/index-Zz9Zz9Zz.js", "*/*", 404, "Not Found", ""},
+		{"noSPA", "/plain/settings/profile", htmlAccept, 404, "Not Found", ""},
+		{"noSPAHashed", "/plain/assets/index-BxK3s9aZ.js", "*/*", 200, "hashed", ""},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d%s", port, tt.path), nil)
+			req.Header.Set("Accept", tt.accept)
+			got, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(got.Body)
+			_ = got.Body.Close()
+			if got.StatusCode != tt.expectedStatus {
+				t.Errorf("expected status code %d, got %d", tt.expectedStatus, got.StatusCode)
+			}
+			if string(b) != tt.expectedBody {
+				t.Errorf("expected %q, got %q", tt.expectedBody, b)
+			}
+			if cc := got.Header.Get("Cache-Control"); cc != tt.expectedCacheControl {
+				t.Errorf("expected Cache-Control %q, got %q", tt.expectedCacheControl, cc)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package simplehttp
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// region SSE
+
+// EventStream is a stream of Server-Sent Events, see Context.SSE.
+// It's safe for concurrent use.
+type EventStream struct {
+	c           *Context
+	lastEventID string
+
+	mu sync.Mutex
+}
+
+// SSE starts a stream of Server-Sent Events as the response of the c:
+// the response (200, text/event-stream) is sent right away, and the
+// events are written to the conn as they are sent, e.g.
+//
+//	r.GET("/events", func(c *Context) {
+//		stream, err := c.SSE()
+//		if err != nil {
+//			return
+//		}
+//		stream.Heartbeat(15 * time.Second)
+//		for _, e := range missedEvents(stream.LastEventID()) {
+//			_ = stream.Send("update", e.ID, e.Data)
+//		}
+//		for {
+//			select {
+//			case <-stream.Done(): // client gone
+//				return
+//			case e := <-updates:
+//				if err := stream.Send("update", e.ID, e.Data); err != nil {
+//					return
+//				}
+//			}
+//		}
+//	})
+//
+// The stream ends when the handler returns, closing the conn. The
+// headers set to the Response before are sent too.
+func (c *Context) SSE() (*EventStream, error) {
+	if c.conn == nil {
+		return nil, errors.New("SSE: not served by HttpServer")
+	}
+
+	c.Response.SetStateLine(c.Request.Version, 200)
+	c.Response.Headers["Content-Type"] = "text/event-stream"
+	c.Response.Headers["Cache-Control"] = "no-cache"
+	c.Response.Headers["X-Accel-Buffering"] = "no" // for nginx in front
+	if err := c.conn.stream(c.Response); err != nil {
+		return nil, err
+	}
+	return &EventStream{c: c, lastEventID: c.Request.Headers["Last-Event-ID"]}, nil
+}
+
+// LastEventID returns the id of the last event received by the client
+// before reconnecting (the Last-Event-ID header), "" if none, to send
+// the events missed.
+func (s *EventStream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done returns a channel closed when the client disconnects, or the
+// context.Context of the request is done otherwise.
+func (s *EventStream) Done() <-chan struct{} {
+	return s.c.Ctx().Done()
+}
+
+// Send sends an event of the type event ("" for the default "message")
+// and the id ("" for none), with the data, which may be multiline.
+func (s *EventStream) Send(event string, id string, data string) error {
+	var b strings.Builder
+	if event != "" {
+		b.WriteString("event: " + sseField(event) + "\n")
+	}
+	if id != "" {
+		b.WriteString("id: " + strings.ReplaceAll(sseField(id), "\x00", "") + "\n")
+	}
+	for _, line := range sseLines(data) {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// Retry tells the client to wait for the delay before reconnecting,
+// if the conn is lost.
+func (s *EventStream) Retry(delay time.Duration) error {
+	return s.write("retry: " + strconv.FormatInt(delay.Milliseconds(), 10) + "\n\n")
+}
+
+// Comment sends a comment, which is ignored by the client, e.g. to keep
+// the conn alive through proxies, see Heartbeat.
+func (s *EventStream) Comment(text string) error {
+	var b strings.Builder
+	for _, line := range sseLines(text) {
+		b.WriteString(": " + line + "\n")
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// Heartbeat sends an empty comment every interval in the background,
+// until the stream is done.
+func (s *EventStream) Heartbeat(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.Done():
+				return
+			case <-ticker.C:
+				if err := s.Comment(""); err != nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// write writes the text of an event to the conn, unless the stream is
+// done.
+func (s *EventStream) write(text string) error {
+	if err := s.c.Ctx().Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.c.Response.Body.WriteString(text)
+	return err
+}
+
+// sseLines splits the text into lines, at any of CRLF, LF and CR.
+func sseLines(text string) []string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.Split(strings.ReplaceAll(text, "\r", "\n"), "\n")
+}
+
+// sseField returns the value of a single-line field, without line breaks.
+func sseField(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
+
+// endregion SSE
@@ -0,0 +1,92 @@
+package simplehttp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const testSSEPortBase = 24030
+
+func TestSSE(t *testing.T) {
+	port := testSSEPortBase
+
+	disconnected := make(chan struct{})
+
+	// server
+	go func() {
+		r := NewPrefixRouter("/")
+		r.GET("/events", func(c *Context) {
+			c.Response.Headers["X-Custom"] = "kept"
+			stream, err := c.SSE()
+			if err != nil {
+				panic(err)
+			}
+			_ = stream.Retry(3 * time.Second)
+			_ = stream.Send("", "", "resume after "+stream.LastEventID())
+			_ = stream.Send("update", "4\n2", "line 1\r\nline 2\rline 3")
+			_ = stream.Comment("still here")
+			stream.Heartbeat(50 * time.Millisecond)
+
+			<-stream.Done()
+			if err := stream.Send("update", "43", "too late"); err == nil {
+				t.Errorf("expected Send failing after the client disconnects")
+			}
+			close(disconnected)
+		})
+
+		s := HttpServer{Handler: r}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = io.WriteString(conn, "GET /events HTTP/1.1\r\n"+
+		"Host: localhost\r\n"+
+		"Accept: text/event-stream\r\n"+
+		"Last-Event-ID: 41\r\n\r\n")
+
+	r := bufio.NewReader(conn)
+	got, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.StatusCode != 200 || got.Header.Get("Content-Type") != "text/event-stream" ||
+		got.Header.Get("Cache-Control") != "no-cache" || got.Header.Get("X-Custom") != "kept" || got.ContentLength != -1 {
+		t.Errorf("expected 200 event stream without Content-Length, got %d %v", got.StatusCode, got.Header)
+	}
+
+	// the events are streamed, before the handler returns
+	expected := "retry: 3000\n\n" +
+		"data: resume after 41\n\n" +
+		"event: update\n" +
+		"id: 42\n" +
+		"data: line 1\n" +
+		"data: line 2\n" +
+		"data: line 3\n\n" +
+		": still here\n\n" +
+		": \n\n" // heartbeat
+	b := make([]byte, len(expected))
+	if _, err := io.ReadFull(got.Body, b); err != nil || string(b) != expected {
+		t.Errorf("expected\n%q\ngot\n%q %v", expected, b, err)
+	}
+
+	_ = conn.Close()
+	select {
+	case <-disconnected:
+	case <-time.After(2 * time.Second):
+		t.Errorf("expected the stream done after the client disconnects")
+	}
+}
@@ -0,0 +1,255 @@
+package simplehttp
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"os"
+	pathLib "path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TemplateExt is the extension of template files.
+	TemplateExt = ".html"
+	// TemplateLayoutsDir holds the layouts, shared by every page.
+	TemplateLayoutsDir = "layouts"
+	// TemplatePartialsDir holds the partials, shared by every page.
+	TemplatePartialsDir = "partials"
+
+	// templateEngineKey is the Context key of the TemplateEngine,
+	// set by TemplateEngine.ServeHTTP, used by Context.Render.
+	templateEngineKey = "simplehttp.TemplateEngine"
+)
+
+// region TemplateEngine
+
+// TemplateEngine renders html/template templates, for Context.Render.
+//
+// Templates are loaded from a directory (or a fs.FS) by convention:
+//
+//	layouts/*.html   shared by every page: {{define "base"}}...{{block "content" .}}{{end}}...{{end}}
+//	partials/*.html  shared by every page: {{define "nav"}}...{{end}}
+//	**/*.html        pages, named by the path: "page.html", "admin/users.html"
+//
+// Each page is parsed together with all the layouts and partials into
+// its own template set, so pages can fill in the blocks of a layout
+// without conflicting with each other:
+//
+//	{{template "base" .}}
+//	{{define "content"}}<h1>{{.Title}}</h1>{{end}}
+//
+// TemplateEngine is a middleware, use it to make it available to
+// Context.Render:
+//
+//	engine := NewTemplateEngine("templates").Router(r)
+//	r.Use(engine)
+//	r.GET("/", func(c *Context) { c.Render(200, "index.html", data) })
+type TemplateEngine struct {
+	// Dev (development mode) makes the engine check the template files
+	// on each Render, and re-parse them if any changed.
+	Dev bool
+
+	fsys  fs.FS
+	funcs template.FuncMap
+
+	mu       sync.RWMutex
+	pages    map[string]*template.Template // name => page (with layouts & partials)
+	modTimes map[string]time.Time          // file => mod time, for Dev
+}
+
+// NewTemplateEngine creates a TemplateEngine loading templates from dir.
+func NewTemplateEngine(dir string) *TemplateEngine {
+	return NewTemplateEngineFS(os.DirFS(dir))
+}
+
+// NewTemplateEngineFS creates a TemplateEngine loading templates from fsys,
+// e.g. an embed.FS.
+func NewTemplateEngineFS(fsys fs.FS) *TemplateEngine {
+	return &TemplateEngine{
+		fsys:  fsys,
+		funcs: template.FuncMap{},
+	}
+}
+
+// Funcs adds the functions to the templates' function map.
+// It must be called before the first Load or Render.
+func (e *TemplateEngine) Funcs(funcs template.FuncMap) *TemplateEngine {
+	for name, f := range funcs {
+		e.funcs[name] = f
+	}
+	return e
+}
+
+// Router adds the reverse routing function "url" of the router to the
+// templates' function map:
+//
+//	<a href="{{url "user" .Name}}">  =>  <a href="/api/user/alice">
+//
+// See NamedRouter.URL. The router must be a NamedRouter, or "url" fails.
+func (e *TemplateEngine) Router(r Router) *TemplateEngine {
+	url := func(name string, subpaths ...string) (string, error) {
+		return "", fmt.Errorf("url %q: router without named routes", name)
+	}
+	if named, ok := r.(NamedRouter); ok {
+		url = named.URL
+	}
+	return e.Funcs(template.FuncMap{
+		"url": url,
+	})
+}
+
+// ServeHTTP makes the engine available to Context.Render of the
+// following handlers.
+func (e *TemplateEngine) ServeHTTP(c *Context) {
+	c.Set(templateEngineKey, e)
+	c.Next()
+}
+
+// Load (re-)parses all the templates.
+func (e *TemplateEngine) Load() error {
+	modTimes, err := e.scan()
+	if err != nil {
+		return err
+	}
+
+	var shared, pages []string
+	for file := range modTimes {
+		if strings.HasPrefix(file, TemplateLayoutsDir+"/") ||
+			strings.HasPrefix(file, TemplatePartialsDir+"/") {
+			shared = append(shared, file)
+		} else {
+			pages = append(pages, file)
+		}
+	}
+	sort.Strings(shared) // parse in a stable order
+
+	parsed := make(map[string]*template.Template, len(pages))
+	for _, page := range pages {
+		t := template.New(page).Funcs(e.funcs)
+		for _, file := range shared {
+			if err := e.parseFile(t.New(file), file); err != nil {
+				return err
+			}
+		}
+		if err := e.parseFile(t, page); err != nil {
+			return err
+		}
+		parsed[page] = t
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pages = parsed
+	e.modTimes = modTimes
+
+	return nil
+}
+
+// parseFile reads file from the fsys and parses it into t.
+func (e *TemplateEngine) parseFile(t *template.Template, file string) error {
+	content, err := fs.ReadFile(e.fsys, file)
+	if err != nil {
+		return err
+	}
+	_, err = t.Parse(string(content))
+	return err
+}
+
+// scan walks the fsys, returns the mod times of all template files.
+func (e *TemplateEngine) scan() (map[string]time.Time, error) {
+	modTimes := map[string]time.Time{}
+	err := fs.WalkDir(e.fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || pathLib.Ext(path) != TemplateExt {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		modTimes[path] = info.ModTime()
+		return nil
+	})
+	return modTimes, err
+}
+
+// changed reports whether any template file is added, removed or modified
+// since the last Load.
+func (e *TemplateEngine) changed() bool {
+	modTimes, err := e.scan()
+	if err != nil {
+		return true // let Load report the error
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if len(modTimes) != len(e.modTimes) {
+		return true
+	}
+	for file, t := range modTimes {
+		if old, ok := e.modTimes[file]; !ok || !old.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Execute renders the page named name with data into w.
+// Templates are loaded lazily on the first call, and reloaded
+// if changed in Dev mode.
+func (e *TemplateEngine) Execute(w io.Writer, name string, data interface{}) error {
+	e.mu.RLock()
+	loaded := e.pages != nil
+	e.mu.RUnlock()
+
+	if !loaded || (e.Dev && e.changed()) {
+		if err := e.Load(); err != nil {
+			return err
+		}
+	}
+
+	e.mu.RLock()
+	t, ok := e.pages[name]
+	e.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("template: no page named %q", name)
+	}
+
+	return t.ExecuteTemplate(w, name, data)
+}
+
+// Render makes a response with status and the page named name rendered
+// with data as body. The TemplateEngine must be used as a middleware
+// before this handler.
+//
+// An error rendering the page results in a 500 response.
+func (c *Context) Render(status int, name string, data interface{}) {
+	v, ok := c.Get(templateEngineKey)
+	if !ok {
+		panic("Render: no TemplateEngine in the context, forgot to Use it?")
+	}
+	engine := v.(*TemplateEngine)
+
+	buf := &bytes.Buffer{}
+	if err := engine.Execute(buf, name, data); err != nil {
+		if DebugPanicResponse {
+			c.ResponseText(500, err.Error())
+		} else {
+			c.ResponseText(500, "Internal Server Error")
+		}
+		return
+	}
+
+	c.ResponseHTML(status, buf.String())
+}
+
+// endregion TemplateEngine
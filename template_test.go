@@ -0,0 +1,126 @@
+package simplehttp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testTemplatePortBase = 22630
+
+func TestTemplateEngine(t *testing.T) {
+	port := testTemplatePortBase
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"layouts/base.html":   `{{define "base"}}<title>{{block "title" .}}simplehttp{{end}}</title>{{template "nav" .}}{{block "content" .}}{{end}}{{end}}`,
+		"partials/nav.html":   `{{define "nav"}}<a href="{{url "user" "alice"}}">alice</a>{{end}}`,
+		"index.html":          `{{template "base" .}}{{define "content"}}<h1>{{.}}</h1>{{end}}`,
+		"admin/users.html":    `{{template "base" .}}{{define "title"}}users{{end}}{{define "content"}}{{upper .}}{{end}}`,
+		"hot.html":            `v1`,
+		"partials/extra.html": `{{define "extra"}}{{end}}`,
+	}
+	for name, content := range files {
+		writeTestFile(t, filepath.Join(dir, name), content)
+	}
+
+	// server
+	go func() {
+		r := NewPrefixRouter("/")
+		r.Use(Logger, Recovery)
+
+		engine := NewTemplateEngine(dir).Router(r).Funcs(map[string]interface{}{
+			"upper": func(s string) string { return s + "!" },
+		})
+		engine.Dev = true
+		r.Use(engine)
+
+		r.Name("user", "/user/")
+		r.GET("/index", func(c *Context) {
+			c.Render(200, "index.html", "hello")
+		})
+		r.GET("/users", func(c *Context) {
+			c.Render(200, "admin/users.html", "bob")
+		})
+		r.GET("/hot", func(c *Context) {
+			c.Render(200, "hot.html", nil)
+		})
+		r.GET("/missing", func(c *Context) {
+			c.Render(200, "missing.html", nil)
+		})
+
+		s := HttpServer{Handler: r}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	t.Run("layout", func(t *testing.T) {
+		testRouter(t, port, "GET", "/index", 200,
+			`<title>simplehttp</title><a href="/user/alice">alice</a><h1>hello</h1>`)
+	})
+	t.Run("override", func(t *testing.T) {
+		testRouter(t, port, "GET", "/users", 200,
+			`<title>users</title><a href="/user/alice">alice</a>bob!`)
+	})
+	t.Run("missing", func(t *testing.T) {
+		testRouter(t, port, "GET", "/missing", 500,
+			`template: no page named "missing.html"`)
+	})
+	t.Run("hotReload", func(t *testing.T) {
+		testRouter(t, port, "GET", "/hot", 200, "v1")
+
+		path := filepath.Join(dir, "hot.html")
+		writeTestFile(t, path, "v2")
+		future := time.Now().Add(time.Minute) // make sure mod time changes
+		if err := os.Chtimes(path, future, future); err != nil {
+			t.Fatal(err)
+		}
+
+		testRouter(t, port, "GET", "/hot", 200, "v2")
+	})
+}
+
+func TestPrefixRouterURL(t *testing.T) {
+	r := NewPrefixRouter("/api")
+	r.Name("user", "/user/")
+	r.Name("about", "about")
+
+	cases := []struct {
+		name     string
+		subpaths []string
+		expected string
+	}{
+		{"user", nil, "/api/user/"},
+		{"user", []string{"alice"}, "/api/user/alice"},
+		{"user", []string{"a b", "c/d"}, "/api/user/a%20b/c%2Fd"},
+		{"about", nil, "/api/about"},
+	}
+	for _, tt := range cases {
+		got, err := r.URL(tt.name, tt.subpaths...)
+		if err != nil {
+			t.Error(err)
+		}
+		if got != tt.expected {
+			t.Errorf("expected %s, got %s", tt.expected, got)
+		}
+	}
+
+	if _, err := r.URL("nobody"); err == nil {
+		t.Error("expected error for unknown route name, got nil")
+	}
+}
+
+// writeTestFile writes content to path, creating the parent dirs.
+func writeTestFile(t testing.TB, path string, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,791 @@
+package simplehttp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// WebSocketReadLimit is the default max size of the messages read
+	// from a WebSocketConn, see WithWebSocketReadLimit.
+	WebSocketReadLimit = 16 << 20
+	// websocketGUID is the magic of Sec-WebSocket-Accept (RFC 6455 Section 1.3).
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// websocketFragmentSize is the max payload size of the frames
+	// of a message written.
+	websocketFragmentSize = 32 << 10
+	// websocketCloseTimeout is how long the closing handshake waits for
+	// the close frame of the peer.
+	websocketCloseTimeout = 5 * time.Second
+	// websocketLingerTimeout is how long the data from the client is
+	// discarded after the close frame, see WebSocketConn.linger.
+	websocketLingerTimeout = 1 * time.Second
+	// websocketDeflateTail is the tail of the sync flush stripped from
+	// compressed messages (RFC 7692 Section 7.2.1).
+	websocketDeflateTail = "\x00\x00\xff\xff"
+)
+
+// the opcodes of frames (RFC 6455 Section 5.2).
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// WebSocketMessageType is the type of a WebSocket message.
+type WebSocketMessageType int
+
+const (
+	WebSocketText   WebSocketMessageType = wsText // UTF-8 text
+	WebSocketBinary WebSocketMessageType = wsBinary
+)
+
+// the close codes (RFC 6455 Section 7.4.1).
+const (
+	WebSocketCloseNormal          = 1000
+	WebSocketCloseGoingAway       = 1001
+	WebSocketCloseProtocolError   = 1002
+	WebSocketCloseUnsupportedData = 1003
+	WebSocketCloseNoStatus        = 1005 // never sent
+	WebSocketCloseAbnormal        = 1006 // never sent
+	WebSocketCloseInvalidPayload  = 1007
+	WebSocketClosePolicyViolation = 1008
+	WebSocketCloseTooBig          = 1009
+	WebSocketCloseInternalError   = 1011
+)
+
+// ErrWebSocketClosed is returned by writing to a WebSocketConn after its
+// close frame is sent.
+var ErrWebSocketClosed = errors.New("websocket: close sent")
+
+// WebSocketCloseError is the error of reading from a closed
+// WebSocketConn: the code and reason of the close frame of the peer,
+// or sent on a protocol error of the peer, or WebSocketCloseAbnormal
+// if the conn is closed without a close frame.
+type WebSocketCloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *WebSocketCloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("websocket: closed: %d", e.Code)
+	}
+	return fmt.Sprintf("websocket: closed: %d %s", e.Code, e.Reason)
+}
+
+// region Handler: WebSocket
+
+// WebSocket is a Handler upgrading the request to a WebSocket
+// (RFC 6455), then calling handler with the conn, e.g. echoing:
+//
+//	r.GET("/ws", WebSocket(func(c *Context, ws *WebSocketConn) {
+//		for {
+//			messageType, data, err := ws.ReadMessage()
+//			if err != nil {
+//				return
+//			}
+//			if err := ws.WriteMessage(messageType, data); err != nil {
+//				return
+//			}
+//		}
+//	}, WithWebSocketCompression()))
+//
+// The conn is closed (WebSocketCloseNormal) when the handler returns,
+// or with WebSocketCloseGoingAway when the context.Context of the
+// request is done, e.g. on Shutdown.
+//
+// Requests which are not a valid WebSocket handshake are answered with
+// an error status: 426 Upgrade Required if not an upgrade to WebSocket
+// version 13, 403 Forbidden if the Origin is not allowed (see
+// WithWebSocketOrigin), and 400 Bad Request otherwise.
+func WebSocket(handler func(c *Context, ws *WebSocketConn), options ...WebSocketOption) HandlerFunc {
+	u := &websocketUpgrader{
+		readLimit:   WebSocketReadLimit,
+		checkOrigin: sameOrigin,
+	}
+	for _, option := range options {
+		option(u)
+	}
+
+	return func(c *Context) {
+		ws := u.upgrade(c)
+		if ws == nil { // the error response made
+			return
+		}
+
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-c.Ctx().Done():
+				ws.closeWith(WebSocketCloseGoingAway, "")
+			case <-done:
+			}
+		}()
+
+		handler(c, ws)
+		_ = ws.Close(WebSocketCloseNormal, "")
+	}
+}
+
+// websocketUpgrader is the upgrader of WebSocket.
+type websocketUpgrader struct {
+	protocols   []string
+	readLimit   int64
+	compression bool
+	checkOrigin func(c *Context, origin string) bool
+}
+
+// WebSocketOption configures a WebSocket.
+type WebSocketOption func(u *websocketUpgrader)
+
+// WithWebSocketProtocols sets the subprotocols supported, in the order
+// of preference: the first one also requested by the client
+// (Sec-WebSocket-Protocol) is selected, see WebSocketConn.Protocol.
+func WithWebSocketProtocols(protocols ...string) WebSocketOption {
+	return func(u *websocketUpgrader) {
+		u.protocols = protocols
+	}
+}
+
+// WithWebSocketReadLimit sets the max size of the messages read,
+// decompressed. The conn is closed with WebSocketCloseTooBig if a
+// message exceeds it. WebSocketReadLimit by default.
+func WithWebSocketReadLimit(limit int64) WebSocketOption {
+	return func(u *websocketUpgrader) {
+		u.readLimit = limit
+	}
+}
+
+// WithWebSocketCompression enables the permessage-deflate extension
+// (RFC 7692) if requested by the client: messages are compressed,
+// without context takeover, i.e. each one on its own.
+func WithWebSocketCompression() WebSocketOption {
+	return func(u *websocketUpgrader) {
+		u.compression = true
+	}
+}
+
+// WithWebSocketOrigin sets the check of the Origin header of the
+// handshake, against cross-site WebSocket hijacking. By default, the
+// host of the Origin must be the Host of the request, if present.
+func WithWebSocketOrigin(check func(origin string) bool) WebSocketOption {
+	return func(u *websocketUpgrader) {
+		u.checkOrigin = func(c *Context, origin string) bool {
+			return check(origin)
+		}
+	}
+}
+
+// sameOrigin reports whether the origin is of the host of the request.
+func sameOrigin(c *Context, origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, c.Request.Headers["Host"])
+}
+
+// upgrade validates the handshake of the request (RFC 6455 Section
+// 4.2.1), hijacks the conn and answers 101 Switching Protocols. It
+// returns nil with the error response made if failed.
+func (u *websocketUpgrader) upgrade(c *Context) *WebSocketConn {
+	headers := c.Request.Headers
+	if !headerHasToken(headers["Connection"], "Upgrade") || !headerHasToken(headers["Upgrade"], "websocket") {
+		c.ResponseText(426, "Upgrade Required")
+		c.Response.Headers["Upgrade"] = "websocket"
+		c.Response.Headers["Connection"] = "Upgrade"
+		return nil
+	}
+	if strings.TrimSpace(headers["Sec-WebSocket-Version"]) != "13" {
+		c.ResponseText(426, "Upgrade Required")
+		c.Response.Headers["Sec-WebSocket-Version"] = "13"
+		return nil
+	}
+	key := strings.TrimSpace(headers["Sec-WebSocket-Key"])
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 ||
+		c.Request.Method != "GET" || c.Request.Version != "HTTP/1.1" {
+		c.ResponseText(400, "Bad Request")
+		return nil
+	}
+	if origin := headers["Origin"]; origin != "" && !u.checkOrigin(c, origin) {
+		c.ResponseText(403, "Forbidden")
+		return nil
+	}
+
+	protocol := u.selectProtocol(headers["Sec-WebSocket-Protocol"])
+	compress := u.compression && acceptDeflate(headers["Sec-WebSocket-Extensions"])
+
+	conn, err := c.Hijack()
+	if err != nil {
+		c.ResponseText(500, "Internal Server Error")
+		return nil
+	}
+
+	accept := sha1.Sum([]byte(key + websocketGUID))
+	var b strings.Builder
+	b.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	b.WriteString("Upgrade: websocket\r\n")
+	b.WriteString("Connection: Upgrade\r\n")
+	b.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n")
+	if protocol != "" {
+		b.WriteString("Sec-WebSocket-Protocol: " + protocol + "\r\n")
+	}
+	if compress {
+		b.WriteString("Sec-WebSocket-Extensions: permessage-deflate; server_no_context_takeover; client_no_context_takeover\r\n")
+	}
+	b.WriteString("\r\n")
+	if _, err := io.WriteString(conn, b.String()); err != nil {
+		_ = conn.Close()
+		return nil
+	}
+
+	return &WebSocketConn{
+		conn:      conn,
+		r:         bufio.NewReader(conn),
+		w:         bufio.NewWriter(conn),
+		protocol:  protocol,
+		compress:  compress,
+		readLimit: u.readLimit,
+		done:      make(chan struct{}),
+	}
+}
+
+// selectProtocol returns the first subprotocol supported of the ones
+// requested, "" for none.
+func (u *websocketUpgrader) selectProtocol(requested string) string {
+	for _, protocol := range u.protocols {
+		if headerHasToken(requested, protocol) {
+			return protocol
+		}
+	}
+	return ""
+}
+
+// acceptDeflate reports whether any of the offers of extensions
+// (Sec-WebSocket-Extensions) is a permessage-deflate we support:
+// the window of the server can't be reduced with compress/flate.
+func acceptDeflate(extensions string) bool {
+	for _, offer := range strings.Split(extensions, ",") {
+		params := strings.Split(offer, ";")
+		if strings.TrimSpace(params[0]) != "permessage-deflate" {
+			continue
+		}
+		supported := true
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			switch strings.TrimSpace(name) {
+			case "server_no_context_takeover", "client_no_context_takeover", "client_max_window_bits":
+			case "server_max_window_bits":
+				supported = supported && strings.Trim(strings.TrimSpace(value), `"`) == "15"
+			default:
+				supported = false
+			}
+		}
+		if supported {
+			return true
+		}
+	}
+	return false
+}
+
+// endregion Handler: WebSocket
+
+// region WebSocketConn
+
+// WebSocketConn is a WebSocket conn, see WebSocket. Messages may be
+// read by one goroutine and written by others concurrently.
+type WebSocketConn struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	protocol  string
+	compress  bool // permessage-deflate
+	readLimit int64
+
+	readMu        sync.Mutex // held reading a message
+	readErr       error      // the conn is closed
+	closeReceived bool
+
+	messageMu sync.Mutex // held by the writer of the message being written
+	writeMu   sync.Mutex // held writing a frame
+	w         *bufio.Writer
+	closeSent bool
+	deflater  *flate.Writer
+
+	closeOnce sync.Once
+	done      chan struct{} // closed when the conn is closed
+}
+
+// Protocol returns the subprotocol selected, see WithWebSocketProtocols.
+func (ws *WebSocketConn) Protocol() string {
+	return ws.protocol
+}
+
+// RemoteAddr returns the address of the client.
+func (ws *WebSocketConn) RemoteAddr() net.Addr {
+	return ws.conn.RemoteAddr()
+}
+
+// SetReadDeadline sets the deadline of reading messages, after which
+// the conn is closed. A zero t means no deadline.
+func (ws *WebSocketConn) SetReadDeadline(t time.Time) error {
+	return ws.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline of writing messages.
+// A zero t means no deadline.
+func (ws *WebSocketConn) SetWriteDeadline(t time.Time) error {
+	return ws.conn.SetWriteDeadline(t)
+}
+
+// ReadMessage reads the next message, answering pings meanwhile.
+// It returns a *WebSocketCloseError once the conn is closed, see the
+// type, or another error if failed to read, closing the conn.
+func (ws *WebSocketConn) ReadMessage() (WebSocketMessageType, []byte, error) {
+	ws.readMu.Lock()
+	defer ws.readMu.Unlock()
+	return ws.readMessage()
+}
+
+// readMessage is ReadMessage with readMu held.
+func (ws *WebSocketConn) readMessage() (WebSocketMessageType, []byte, error) {
+	if ws.readErr != nil {
+		return 0, nil, ws.readErr
+	}
+	messageType, data, err := ws.nextMessage()
+	if err == nil {
+		return messageType, data, nil
+	}
+
+	var closeErr *WebSocketCloseError
+	switch {
+	case errors.As(err, &closeErr): // the close frame of the peer echoed, or a protocol error
+		_ = ws.writeClose(closeErr.Code, closeErr.Reason)
+		if !ws.closeReceived { // the client may be sending
+			ws.linger()
+		}
+		ws.closeConn()
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		ws.closeConn()
+		err = &WebSocketCloseError{Code: WebSocketCloseAbnormal}
+	default:
+		ws.closeConn()
+	}
+	ws.readErr = err
+	return 0, nil, err
+}
+
+// nextMessage reads the frames of the next message. The errors of the
+// peer violating the protocol are *WebSocketCloseError of the code to
+// close with.
+func (ws *WebSocketConn) nextMessage() (WebSocketMessageType, []byte, error) {
+	var (
+		opcode     byte // of the message, wsContinuation before the first frame
+		compressed bool
+		payload    []byte
+	)
+	for {
+		limit := ws.readLimit - int64(len(payload))
+		f, err := ws.readFrame(limit)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch f.opcode {
+		case wsPing:
+			_ = ws.writeFrame(wsPong, true, false, f.payload)
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			ws.closeReceived = true
+			code, reason, err := parseClosePayload(f.payload)
+			if err != nil {
+				return 0, nil, err
+			}
+			return 0, nil, &WebSocketCloseError{Code: code, Reason: reason}
+		case wsContinuation:
+			if opcode == wsContinuation {
+				return 0, nil, &WebSocketCloseError{WebSocketCloseProtocolError, "continuation without a message"}
+			}
+		default:
+			if opcode != wsContinuation {
+				return 0, nil, &WebSocketCloseError{WebSocketCloseProtocolError, "message interrupted"}
+			}
+			opcode, compressed = f.opcode, f.rsv1
+		}
+
+		payload = append(payload, f.payload...)
+		if f.fin {
+			break
+		}
+	}
+
+	if compressed {
+		var err error
+		if payload, err = ws.inflate(payload); err != nil {
+			return 0, nil, err
+		}
+	}
+	if opcode == wsText && !utf8.Valid(payload) {
+		return 0, nil, &WebSocketCloseError{WebSocketCloseInvalidPayload, "invalid UTF-8"}
+	}
+	return WebSocketMessageType(opcode), payload, nil
+}
+
+// websocketFrame is a frame read.
+type websocketFrame struct {
+	fin     bool
+	rsv1    bool // compressed
+	opcode  byte
+	payload []byte
+}
+
+// readFrame reads a frame of the client (RFC 6455 Section 5.2),
+// with the payload up to limit bytes.
+func (ws *WebSocketConn) readFrame(limit int64) (websocketFrame, error) {
+	var f websocketFrame
+	var head [8]byte
+	if _, err := io.ReadFull(ws.r, head[:2]); err != nil {
+		return f, err
+	}
+	f.fin = head[0]&0x80 != 0
+	f.rsv1 = head[0]&0x40 != 0
+	f.opcode = head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+
+	switch {
+	case head[0]&0x30 != 0:
+		return f, &WebSocketCloseError{WebSocketCloseProtocolError, "reserved bits set"}
+	case f.rsv1 && (!ws.compress || f.opcode == wsContinuation || f.opcode >= wsClose):
+		return f, &WebSocketCloseError{WebSocketCloseProtocolError, "unexpected compression"}
+	case f.opcode > wsBinary && f.opcode < wsClose, f.opcode > wsPong:
+		return f, &WebSocketCloseError{WebSocketCloseProtocolError, "unknown opcode"}
+	case f.opcode >= wsClose && (!f.fin || length > 125):
+		return f, &WebSocketCloseError{WebSocketCloseProtocolError, "invalid control frame"}
+	case !masked:
+		return f, &WebSocketCloseError{WebSocketCloseProtocolError, "unmasked frame"}
+	}
+
+	switch length {
+	case 126:
+		if _, err := io.ReadFull(ws.r, head[:2]); err != nil {
+			return f, err
+		}
+		length = uint64(binary.BigEndian.Uint16(head[:2]))
+	case 127:
+		if _, err := io.ReadFull(ws.r, head[:8]); err != nil {
+			return f, err
+		}
+		length = binary.BigEndian.Uint64(head[:8])
+		if length>>63 != 0 {
+			return f, &WebSocketCloseError{WebSocketCloseProtocolError, "invalid length"}
+		}
+	}
+	if f.opcode < wsClose && length > uint64(limit) {
+		return f, &WebSocketCloseError{WebSocketCloseTooBig, "message too big"}
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.r, mask[:]); err != nil {
+		return f, err
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(ws.r, f.payload); err != nil {
+		return f, err
+	}
+	for i := range f.payload {
+		f.payload[i] ^= mask[i%4]
+	}
+	return f, nil
+}
+
+// parseClosePayload parses the code and reason of the payload of
+// a close frame.
+func parseClosePayload(payload []byte) (int, string, error) {
+	switch {
+	case len(payload) == 0:
+		return WebSocketCloseNoStatus, "", nil
+	case len(payload) == 1:
+		return 0, "", &WebSocketCloseError{WebSocketCloseProtocolError, "invalid close frame"}
+	}
+	code := int(binary.BigEndian.Uint16(payload))
+	if !(code >= 1000 && code <= 1003 || code >= 1007 && code <= 1014 || code >= 3000 && code <= 4999) {
+		return 0, "", &WebSocketCloseError{WebSocketCloseProtocolError, "invalid close code"}
+	}
+	if !utf8.Valid(payload[2:]) {
+		return 0, "", &WebSocketCloseError{WebSocketCloseInvalidPayload, "invalid UTF-8"}
+	}
+	return code, string(payload[2:]), nil
+}
+
+// inflate decompresses the payload of a compressed message,
+// up to the read limit.
+func (ws *WebSocketConn) inflate(payload []byte) ([]byte, error) {
+	// the tail stripped, and an empty final block to end the stream
+	r := flate.NewReader(io.MultiReader(bytes.NewReader(payload), strings.NewReader(websocketDeflateTail+"\x01\x00\x00\xff\xff")))
+	defer r.Close()
+	data, err := io.ReadAll(io.LimitReader(r, ws.readLimit+1))
+	switch {
+	case err != nil:
+		return nil, &WebSocketCloseError{WebSocketCloseInvalidPayload, "invalid compressed data"}
+	case int64(len(data)) > ws.readLimit:
+		return nil, &WebSocketCloseError{WebSocketCloseTooBig, "message too big"}
+	}
+	return data, nil
+}
+
+// WriteMessage writes a message of the messageType and data.
+func (ws *WebSocketConn) WriteMessage(messageType WebSocketMessageType, data []byte) error {
+	w, err := ws.NextWriter(messageType)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// WriteText writes a text message.
+func (ws *WebSocketConn) WriteText(text string) error {
+	return ws.WriteMessage(WebSocketText, []byte(text))
+}
+
+// WriteBinary writes a binary message.
+func (ws *WebSocketConn) WriteBinary(data []byte) error {
+	return ws.WriteMessage(WebSocketBinary, data)
+}
+
+// NextWriter returns the writer of a message of the messageType, which
+// is sent in frames as written, ending when the writer is closed.
+// Other messages wait until then, but pings and pongs may be sent
+// in between.
+func (ws *WebSocketConn) NextWriter(messageType WebSocketMessageType) (io.WriteCloser, error) {
+	if messageType != WebSocketText && messageType != WebSocketBinary {
+		return nil, fmt.Errorf("websocket: bad message type %d", messageType)
+	}
+	ws.messageMu.Lock()
+	w := &websocketWriter{ws: ws, opcode: byte(messageType)}
+	if ws.compress {
+		w.rsv1 = true
+		if ws.deflater == nil {
+			ws.deflater, _ = flate.NewWriter(&w.buf, flate.DefaultCompression)
+		} else {
+			ws.deflater.Reset(&w.buf)
+		}
+		w.deflater = ws.deflater
+	}
+	return w, nil
+}
+
+// websocketWriter is the writer of a message, see NextWriter.
+type websocketWriter struct {
+	ws       *WebSocketConn
+	opcode   byte // of the next frame
+	rsv1     bool // compressed, set on the first frame only
+	buf      bytes.Buffer
+	deflater *flate.Writer // nil if not compressed
+	err      error
+	closed   bool
+}
+
+func (w *websocketWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrWebSocketClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.deflater != nil {
+		if _, err := w.deflater.Write(p); err != nil {
+			w.err = err
+			return 0, err
+		}
+	} else {
+		w.buf.Write(p)
+	}
+	if err := w.flushFragments(false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flushFragments writes the full fragments buffered, but the possible
+// deflate tail unless final.
+func (w *websocketWriter) flushFragments(final bool) error {
+	keep := 0
+	if w.deflater != nil && !final {
+		keep = len(websocketDeflateTail)
+	}
+	for w.buf.Len()-keep > websocketFragmentSize {
+		w.err = w.ws.writeFrame(w.opcode, false, w.rsv1, w.buf.Next(websocketFragmentSize))
+		w.opcode, w.rsv1 = wsContinuation, false
+		if w.err != nil {
+			return w.err
+		}
+	}
+	return nil
+}
+
+// Close writes the last frame of the message.
+func (w *websocketWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.ws.messageMu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+
+	if w.deflater != nil {
+		if err := w.deflater.Flush(); err != nil {
+			return err
+		}
+		w.buf.Truncate(w.buf.Len() - len(websocketDeflateTail))
+	}
+	if err := w.flushFragments(true); err != nil {
+		return err
+	}
+	return w.ws.writeFrame(w.opcode, true, w.rsv1, w.buf.Bytes())
+}
+
+// Ping writes a ping with the data, up to 125 bytes. The pong answered
+// by the client is ignored by ReadMessage.
+func (ws *WebSocketConn) Ping(data []byte) error {
+	if len(data) > 125 {
+		return errors.New("websocket: ping data too long")
+	}
+	return ws.writeFrame(wsPing, true, false, data)
+}
+
+// writeFrame writes a frame of the server (unmasked).
+func (ws *WebSocketConn) writeFrame(opcode byte, fin bool, rsv1 bool, payload []byte) error {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+	if ws.closeSent {
+		return ErrWebSocketClosed
+	}
+	if opcode == wsClose {
+		ws.closeSent = true
+	}
+
+	var head [10]byte
+	head[0] = opcode
+	if fin {
+		head[0] |= 0x80
+	}
+	if rsv1 {
+		head[0] |= 0x40
+	}
+	n := 2
+	switch length := len(payload); {
+	case length <= 125:
+		head[1] = byte(length)
+	case length <= 0xffff:
+		head[1] = 126
+		binary.BigEndian.PutUint16(head[2:], uint16(length))
+		n += 2
+	default:
+		head[1] = 127
+		binary.BigEndian.PutUint64(head[2:], uint64(length))
+		n += 8
+	}
+	_, _ = ws.w.Write(head[:n])
+	_, _ = ws.w.Write(payload)
+	return ws.w.Flush()
+}
+
+// Close starts the closing handshake with the code and reason: sends
+// the close frame, waits for the one of the client (for a while, the
+// messages received meanwhile are discarded), then closes the conn.
+// It's fine to Close a closed conn.
+func (ws *WebSocketConn) Close(code int, reason string) error {
+	if err := ws.writeClose(code, reason); err != nil && !errors.Is(err, ErrWebSocketClosed) {
+		ws.closeConn()
+		return err
+	}
+
+	if ws.readMu.TryLock() { // nobody reading, read the close frame here
+		_ = ws.conn.SetReadDeadline(time.Now().Add(websocketCloseTimeout))
+		for {
+			if _, _, err := ws.readMessage(); err != nil {
+				break
+			}
+		}
+		ws.readMu.Unlock()
+	} else { // ReadMessage will get it, and close the conn
+		timer := time.NewTimer(websocketCloseTimeout)
+		defer timer.Stop()
+		select {
+		case <-ws.done:
+		case <-timer.C:
+		}
+	}
+	ws.closeConn()
+	return nil
+}
+
+// writeClose writes the close frame of the code and reason (truncated
+// to fit in a control frame).
+func (ws *WebSocketConn) writeClose(code int, reason string) error {
+	var payload []byte
+	if code != WebSocketCloseNoStatus {
+		if len(reason) > 123 {
+			n := 123
+			for n > 0 && !utf8.RuneStart(reason[n]) {
+				n--
+			}
+			reason = reason[:n]
+		}
+		payload = make([]byte, 2, 2+len(reason))
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		payload = append(payload, reason...)
+	}
+	return ws.writeFrame(wsClose, true, false, payload)
+}
+
+// closeWith sends the close frame of the code and reason, unless sent,
+// and closes the conn without waiting for the client.
+func (ws *WebSocketConn) closeWith(code int, reason string) {
+	_ = ws.writeClose(code, reason)
+	ws.closeConn()
+}
+
+// linger shuts down the writing side of the conn after the close frame,
+// and discards the data from the client until it closes the conn too
+// (for a while), not to reset the conn losing the close frame.
+func (ws *WebSocketConn) linger() {
+	if cw, ok := ws.conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+	_ = ws.conn.SetReadDeadline(time.Now().Add(websocketLingerTimeout))
+	_, _ = io.Copy(io.Discard, ws.r)
+}
+
+// closeConn closes the conn.
+func (ws *WebSocketConn) closeConn() {
+	ws.closeOnce.Do(func() {
+		_ = ws.conn.Close()
+		close(ws.done)
+	})
+}
+
+// endregion WebSocketConn
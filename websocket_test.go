@@ -0,0 +1,452 @@
+package simplehttp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testWebSocketPortBase = 23930
+
+// testWSClient is a raw WebSocket client, writing and reading frames.
+type testWSClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialWebSocket connects to the path, with the headers of the handshake
+// over the defaults, and returns the client with the response.
+func dialWebSocket(t *testing.T, port int, path string, headers map[string]string) (*testWSClient, *http.Response) {
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	h := map[string]string{
+		"Host":                  fmt.Sprintf("localhost:%d", port),
+		"Upgrade":               "websocket",
+		"Connection":            "Upgrade",
+		"Sec-WebSocket-Key":     "dGhlIHNhbXBsZSBub25jZQ==",
+		"Sec-WebSocket-Version": "13",
+	}
+	for k, v := range headers {
+		h[k] = v
+	}
+	req := "GET " + path + " HTTP/1.1\r\n"
+	for k, v := range h {
+		if v != "" {
+			req += k + ": " + v + "\r\n"
+		}
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &testWSClient{conn: conn, r: bufio.NewReader(conn)}
+	resp, err := http.ReadResponse(c.r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, resp
+}
+
+// writeFrame writes a masked frame of the first byte b0 (FIN, RSV and
+// opcode) and the payload.
+func (c *testWSClient) writeFrame(t *testing.T, b0 byte, payload []byte) {
+	head := []byte{b0, 0x80}
+	switch {
+	case len(payload) <= 125:
+		head[1] |= byte(len(payload))
+	case len(payload) <= 0xffff:
+		head[1] |= 126
+		head = binary.BigEndian.AppendUint16(head, uint16(len(payload)))
+	default:
+		head[1] |= 127
+		head = binary.BigEndian.AppendUint64(head, uint64(len(payload)))
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	masked := make([]byte, len(payload))
+	for i := range payload {
+		masked[i] = payload[i] ^ mask[i%4]
+	}
+	if _, err := c.conn.Write(append(append(head, mask...), masked...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readFrame reads a frame of the server.
+func (c *testWSClient) readFrame() (byte, []byte, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(c.r, head); err != nil {
+		return 0, nil, err
+	}
+	if head[1]&0x80 != 0 {
+		return 0, nil, fmt.Errorf("masked frame from the server")
+	}
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.r, ext); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.r, ext); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+	payload := make([]byte, length)
+	_, err := io.ReadFull(c.r, payload)
+	return head[0], payload, err
+}
+
+// readMessage reads a control frame, or the frames of a data message
+// joined, with the FIN of the last one.
+func (c *testWSClient) readMessage() (byte, []byte, error) {
+	b0, payload, err := c.readFrame()
+	for err == nil && b0&0x80 == 0 && b0&0x0f < wsClose {
+		var next []byte
+		var b byte
+		b, next, err = c.readFrame()
+		b0 |= b & 0x80
+		payload = append(payload, next...)
+	}
+	return b0, payload, err
+}
+
+// expectClose reads frames until a close frame, which must be of the code.
+func (c *testWSClient) expectClose(t *testing.T, code int) {
+	t.Helper()
+	for {
+		b0, payload, err := c.readFrame()
+		if err != nil {
+			t.Fatalf("expected close %d, got %v", code, err)
+		}
+		if b0&0x0f != wsClose {
+			continue
+		}
+		got := WebSocketCloseNoStatus
+		if len(payload) >= 2 {
+			got = int(binary.BigEndian.Uint16(payload))
+		}
+		if got != code {
+			t.Errorf("expected close %d, got %d %q", code, got, payload[min1(len(payload), 2):])
+		}
+		return
+	}
+}
+
+// closePayload returns the payload of a close frame.
+func closePayload(code int, reason string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+}
+
+// deflate compresses p as a message of permessage-deflate.
+func deflate(p []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	_, _ = w.Write(p)
+	_ = w.Flush()
+	return bytes.TrimSuffix(buf.Bytes(), []byte(websocketDeflateTail))
+}
+
+// inflate decompresses the payload of a compressed message.
+func inflate(t *testing.T, p []byte) []byte {
+	r := flate.NewReader(io.MultiReader(bytes.NewReader(p), strings.NewReader(websocketDeflateTail+"\x01\x00\x00\xff\xff")))
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestWebSocket(t *testing.T) {
+	port := testWebSocketPortBase
+
+	echo := func(c *Context, ws *WebSocketConn) {
+		for {
+			messageType, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := ws.WriteMessage(messageType, data); err != nil {
+				return
+			}
+		}
+	}
+	closed := make(chan error, 1)
+
+	// servers
+	go func() {
+		r := NewPrefixRouter("/")
+		r.GET("/echo", WebSocket(echo, WithWebSocketReadLimit(1<<20),
+			WithWebSocketProtocols("chat.v2", "chat")))
+		r.GET("/deflate", WebSocket(echo, WithWebSocketCompression()))
+		r.GET("/any", WebSocket(echo, WithWebSocketOrigin(func(origin string) bool {
+			return strings.HasSuffix(origin, ".example.com")
+		})))
+		r.GET("/fragments", WebSocket(func(c *Context, ws *WebSocketConn) {
+			w, _ := ws.NextWriter(WebSocketBinary)
+			_, _ = w.Write(make([]byte, 2*websocketFragmentSize+100))
+			_ = w.Close()
+			_, _, _ = ws.ReadMessage()
+		}))
+		r.GET("/bye", WebSocket(func(c *Context, ws *WebSocketConn) {
+			closed <- ws.Close(WebSocketClosePolicyViolation, "bye")
+		}))
+
+		s := HttpServer{Handler: r}
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	t.Run("handshake", func(t *testing.T) {
+		cases := []struct {
+			name           string
+			path           string
+			headers        map[string]string
+			expectedStatus int
+			expectedHeader [2]string
+		}{
+			{"ok", "/echo", nil, 101, [2]string{"Sec-WebSocket-Accept", "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="}},
+			{"protocol", "/echo", map[string]string{"Sec-WebSocket-Protocol": "chat, chat.v2"}, 101,
+				[2]string{"Sec-WebSocket-Protocol", "chat.v2"}},
+			{"noProtocol", "/echo", map[string]string{"Sec-WebSocket-Protocol": "other"}, 101,
+				[2]string{"Sec-WebSocket-Protocol", ""}},
+			{"deflate", "/deflate", map[string]string{"Sec-WebSocket-Extensions": "permessage-deflate; client_max_window_bits"}, 101,
+				[2]string{"Sec-WebSocket-Extensions", "permessage-deflate; server_no_context_takeover; client_no_context_takeover"}},
+			{"deflateSmallWindow", "/deflate", map[string]string{"Sec-WebSocket-Extensions": "permessage-deflate; server_max_window_bits=10"}, 101,
+				[2]string{"Sec-WebSocket-Extensions", ""}},
+			{"deflateDisabled", "/echo", map[string]string{"Sec-WebSocket-Extensions": "permessage-deflate"}, 101,
+				[2]string{"Sec-WebSocket-Extensions", ""}},
+			{"sameOrigin", "/echo", map[string]string{"Origin": fmt.Sprintf("http://localhost:%d", port)}, 101, [2]string{}},
+			{"crossOrigin", "/echo", map[string]string{"Origin": "http://evil.com"}, 403, [2]string{}},
+			{"allowedOrigin", "/any", map[string]string{"Origin": "https://app.example.com"}, 101, [2]string{}},
+			{"notUpgrade", "/echo", map[string]string{"Upgrade": ""}, 426, [2]string{"Upgrade", "websocket"}},
+			{"badVersion", "/echo", map[string]string{"Sec-WebSocket-Version": "8"}, 426, [2]string{"Sec-WebSocket-Version", "13"}},
+			{"badKey", "/echo", map[string]string{"Sec-WebSocket-Key": "short"}, 400, [2]string{}},
+		}
+		for _, tt := range cases {
+			t.Run(tt.name, func(t *testing.T) {
+				_, resp := dialWebSocket(t, port, tt.path, tt.headers)
+				if resp.StatusCode != tt.expectedStatus {
+					t.Errorf("expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+				}
+				if name := tt.expectedHeader[0]; name != "" && resp.Header.Get(name) != tt.expectedHeader[1] {
+					t.Errorf("expected %s: %q, got %q", name, tt.expectedHeader[1], resp.Header.Get(name))
+				}
+			})
+		}
+	})
+
+	// autobahn-style: frames sent, frames expected back, then the close
+	// code expected; 0 for a normal closing handshake by the client.
+	type frame struct {
+		b0      byte
+		payload string
+	}
+	cases := []struct {
+		name      string
+		sent      []frame
+		expected  []frame
+		closeCode int
+	}{
+		// 1: framing
+		{"1.1.1 emptyText", []frame{{0x81, ""}}, []frame{{0x81, ""}}, 0},
+		{"1.1.2 text125", []frame{{0x81, strings.Repeat("*", 125)}}, []frame{{0x81, strings.Repeat("*", 125)}}, 0},
+		{"1.1.3 text126", []frame{{0x81, strings.Repeat("*", 126)}}, []frame{{0x81, strings.Repeat("*", 126)}}, 0},
+		{"1.1.4 text65535", []frame{{0x81, strings.Repeat("*", 65535)}}, nil, 0},
+		{"1.2.1 binary", []frame{{0x82, "\x00\xff\xfe"}}, []frame{{0x82, "\x00\xff\xfe"}}, 0},
+		{"1.2.2 binary65536", []frame{{0x82, strings.Repeat("\xfe", 65536)}}, nil, 0},
+
+		// 2: pings and pongs
+		{"2.1 ping", []frame{{0x89, ""}}, []frame{{0x8a, ""}}, 0},
+		{"2.3 pingBinary", []frame{{0x89, "\x00\xff\xfe\xfd"}}, []frame{{0x8a, "\x00\xff\xfe\xfd"}}, 0},
+		{"2.4 ping125", []frame{{0x89, strings.Repeat("*", 125)}}, []frame{{0x8a, strings.Repeat("*", 125)}}, 0},
+		{"2.5 ping126", []frame{{0x89, strings.Repeat("*", 126)}}, nil, WebSocketCloseProtocolError},
+		{"2.7 unsolicitedPong", []frame{{0x8a, "pong"}, {0x81, "after"}}, []frame{{0x81, "after"}}, 0},
+
+		// 3: reserved bits
+		{"3.1 rsv1", []frame{{0xc1, "hello"}}, nil, WebSocketCloseProtocolError},
+		{"3.2 rsv2", []frame{{0xa1, "hello"}}, nil, WebSocketCloseProtocolError},
+		{"3.7 rsv3Close", []frame{{0x98, ""}}, nil, WebSocketCloseProtocolError},
+
+		// 4: opcodes
+		{"4.1.1 opcode3", []frame{{0x83, ""}}, nil, WebSocketCloseProtocolError},
+		{"4.2.1 opcode11", []frame{{0x8b, ""}}, nil, WebSocketCloseProtocolError},
+		{"4.1.3 afterEcho", []frame{{0x81, "hello"}, {0x85, ""}}, []frame{{0x81, "hello"}}, WebSocketCloseProtocolError},
+
+		// 5: fragmentation
+		{"5.1 fragmentedPing", []frame{{0x09, "ping"}, {0x80, "ping"}}, nil, WebSocketCloseProtocolError},
+		{"5.3 fragmentedText", []frame{{0x01, "frag"}, {0x00, "men"}, {0x80, "ted"}}, []frame{{0x81, "fragmented"}}, 0},
+		{"5.6 pingInFragments", []frame{{0x01, "frag"}, {0x89, "ping"}, {0x80, "mented"}},
+			[]frame{{0x8a, "ping"}, {0x81, "fragmented"}}, 0},
+		{"5.9 continuationFirst", []frame{{0x80, "nothing"}}, nil, WebSocketCloseProtocolError},
+		{"5.18 interrupted", []frame{{0x01, "frag"}, {0x81, "new"}}, nil, WebSocketCloseProtocolError},
+
+		// 6: UTF-8
+		{"6.2 validUTF8", []frame{{0x81, "κόσμε"}}, []frame{{0x81, "κόσμε"}}, 0},
+		{"6.4 splitUTF8", []frame{{0x01, "\xce"}, {0x80, "\xba"}}, []frame{{0x81, "κ"}}, 0},
+		{"6.3 invalidUTF8", []frame{{0x81, "\xce\xba\xe1\xbd"}}, nil, WebSocketCloseInvalidPayload},
+		{"6.20 surrogate", []frame{{0x81, "\xed\xa0\x80"}}, nil, WebSocketCloseInvalidPayload},
+
+		// 7: closing
+		{"7.3.1 emptyClose", []frame{{0x88, ""}}, nil, WebSocketCloseNoStatus},
+		{"7.3.2 closeOneByte", []frame{{0x88, "\x03"}}, nil, WebSocketCloseProtocolError},
+		{"7.3.4 closeReason", []frame{{0x88, string(closePayload(1000, "done"))}}, nil, WebSocketCloseNormal},
+		{"7.5.1 closeInvalidUTF8", []frame{{0x88, string(closePayload(1000, "\xce\xba\xe1\xbd"))}}, nil, WebSocketCloseInvalidPayload},
+		{"7.7.1 closeAppCode", []frame{{0x88, string(closePayload(4000, ""))}}, nil, 4000},
+		{"7.9.1 close0", []frame{{0x88, string(closePayload(0, ""))}}, nil, WebSocketCloseProtocolError},
+		{"7.9.3 close1004", []frame{{0x88, string(closePayload(1004, ""))}}, nil, WebSocketCloseProtocolError},
+		{"7.9.4 close1005", []frame{{0x88, string(closePayload(1005, ""))}}, nil, WebSocketCloseProtocolError},
+		{"7.9.9 close2999", []frame{{0x88, string(closePayload(2999, ""))}}, nil, WebSocketCloseProtocolError},
+		{"7.1.3 afterClose", []frame{{0x88, string(closePayload(1000, ""))}, {0x81, "ignored"}}, nil, WebSocketCloseNormal},
+
+		// 9: limits
+		{"9.1 tooBig", []frame{{0x82, strings.Repeat("*", 1<<20+1)}}, nil, WebSocketCloseTooBig},
+		{"9.2 tooBigFragmented", []frame{{0x02, strings.Repeat("*", 1<<19)}, {0x80, strings.Repeat("*", 1<<19+1)}},
+			nil, WebSocketCloseTooBig},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			c, resp := dialWebSocket(t, port, "/echo", nil)
+			if resp.StatusCode != 101 {
+				t.Fatalf("expected 101, got %d", resp.StatusCode)
+			}
+			for _, f := range tt.sent {
+				c.writeFrame(t, f.b0, []byte(f.payload))
+			}
+			expected := tt.expected
+			if expected == nil && tt.closeCode == 0 { // the echo of the message
+				expected = []frame{{tt.sent[0].b0, tt.sent[0].payload}}
+			}
+			for _, f := range expected {
+				b0, payload, err := c.readMessage()
+				if err != nil || b0 != f.b0 || string(payload) != f.payload {
+					t.Fatalf("expected frame %#x of %d bytes, got %#x of %d bytes %v", f.b0, len(f.payload), b0, len(payload), err)
+				}
+			}
+
+			code := tt.closeCode
+			if code == 0 {
+				c.writeFrame(t, 0x88, closePayload(WebSocketCloseNormal, ""))
+				code = WebSocketCloseNormal
+			}
+			c.expectClose(t, code)
+			if _, _, err := c.readFrame(); err != io.EOF {
+				t.Errorf("expected the conn closed after the close frame, got %v", err)
+			}
+		})
+	}
+
+	t.Run("12 deflate", func(t *testing.T) {
+		c, resp := dialWebSocket(t, port, "/deflate", map[string]string{"Sec-WebSocket-Extensions": "permessage-deflate"})
+		if resp.StatusCode != 101 {
+			t.Fatalf("expected 101, got %d", resp.StatusCode)
+		}
+		for _, message := range []string{"", "hello", strings.Repeat("compressible ", 20000)} {
+			c.writeFrame(t, 0xc1, deflate([]byte(message)))
+			b0, data, err := c.readMessage()
+			if err != nil || b0 != 0xc1 {
+				t.Fatalf("expected a compressed message, got %#x %v", b0, err)
+			}
+			if got := inflate(t, data); string(got) != message {
+				t.Errorf("expected %d bytes echoed compressed, got %d", len(message), len(got))
+			}
+		}
+
+		// fragmented compressed message, uncompressed one
+		compressed := deflate([]byte("fragmented and compressed"))
+		c.writeFrame(t, 0x41, compressed[:5])
+		c.writeFrame(t, 0x80, compressed[5:])
+		if _, payload, _ := c.readFrame(); string(inflate(t, payload)) != "fragmented and compressed" {
+			t.Errorf("expected the fragmented message echoed, got %q", payload)
+		}
+		c.writeFrame(t, 0x81, []byte("plain"))
+		if _, payload, _ := c.readFrame(); string(inflate(t, payload)) != "plain" {
+			t.Errorf("expected the plain message echoed, got %q", payload)
+		}
+
+		c.writeFrame(t, 0xc1, []byte("\xff\xff\xff"))
+		c.expectClose(t, WebSocketCloseInvalidPayload)
+	})
+
+	t.Run("fragmentsWritten", func(t *testing.T) {
+		c, _ := dialWebSocket(t, port, "/fragments", nil)
+		expected := []struct {
+			b0     byte
+			length int
+		}{{0x02, websocketFragmentSize}, {0x00, websocketFragmentSize}, {0x80, 100}}
+		for _, f := range expected {
+			b0, payload, err := c.readFrame()
+			if err != nil || b0 != f.b0 || len(payload) != f.length {
+				t.Fatalf("expected frame %#x of %d bytes, got %#x of %d bytes %v", f.b0, f.length, b0, len(payload), err)
+			}
+		}
+		c.writeFrame(t, 0x88, nil)
+		c.expectClose(t, WebSocketCloseNoStatus)
+	})
+
+	t.Run("serverClose", func(t *testing.T) {
+		c, _ := dialWebSocket(t, port, "/bye", nil)
+		b0, payload, err := c.readFrame()
+		if err != nil || b0 != 0x88 || string(payload) != string(closePayload(WebSocketClosePolicyViolation, "bye")) {
+			t.Fatalf("expected close 1008 bye, got %#x %q %v", b0, payload, err)
+		}
+		c.writeFrame(t, 0x88, payload)
+		select {
+		case err := <-closed:
+			if err != nil {
+				t.Errorf("expected the closing handshake done, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("expected the closing handshake done after the close frame of the client")
+		}
+		if _, _, err := c.readFrame(); err != io.EOF {
+			t.Errorf("expected the conn closed, got %v", err)
+		}
+	})
+}
+
+func TestWebSocketShutdown(t *testing.T) {
+	port := testWebSocketPortBase + 1
+
+	reading := make(chan struct{})
+	s := &HttpServer{Handler: WebSocket(func(c *Context, ws *WebSocketConn) {
+		close(reading)
+		_, _, _ = ws.ReadMessage()
+	})}
+	go func() {
+		if err := s.ListenAndServe(fmt.Sprintf(":%d", port)); err != nil && err != ErrServerClosed {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(1 * time.Second)
+
+	c, _ := dialWebSocket(t, port, "/", nil)
+	<-reading
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("expected shut down, got %v", err)
+	}
+	c.expectClose(t, WebSocketCloseGoingAway)
+}